@@ -0,0 +1,264 @@
+// Package client is a Go client for a key-value store cluster. It talks to
+// the HTTP API of the nodes: it learns every node of the cluster from a few
+// seed URLs, spreads requests over the nodes that are up and moves a request
+// to another node when one cannot be reached.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options configures a Client. Zero values select the defaults.
+// HTTPClient sends the requests; it should not have a timeout shorter than
+// the longest Watch, since deadlines are taken from the contexts instead.
+// A node that could not be reached is skipped for DownTime (5s by
+// default), and the list of nodes is fetched again every SyncInterval
+// (30s by default, negative disables it).
+type Options struct {
+	HTTPClient   *http.Client
+	DownTime     time.Duration
+	SyncInterval time.Duration
+}
+
+// Client reads and writes keys of a cluster. Requests go to the nodes in
+// turn; any node serves any key. Reads, listings and watches are retried on
+// the next node when a node cannot be reached or answers that it is
+// unavailable. Writes are only retried when the request could not be sent,
+// so a write is never made twice.
+// It is safe for concurrent use.
+type Client struct {
+	http         *http.Client
+	downTime     time.Duration
+	syncInterval time.Duration
+
+	mu       sync.Mutex
+	seeds    []string
+	nodes    []string
+	down     map[string]time.Time
+	next     int
+	lastSync time.Time
+}
+
+// New returns a client for the cluster the nodes at endpoints belong to,
+// like "http://localhost:8001". The other nodes are discovered from them.
+func New(endpoints []string, opts Options) (*Client, error) {
+	var seeds []string
+	for _, endpoint := range endpoints {
+		if endpoint = strings.TrimSuffix(strings.TrimSpace(endpoint), "/"); endpoint != "" {
+			seeds = append(seeds, endpoint)
+		}
+	}
+	if len(seeds) == 0 {
+		return nil, errors.New("at least one endpoint is required")
+	}
+
+	c := &Client{
+		http:         opts.HTTPClient,
+		downTime:     opts.DownTime,
+		syncInterval: opts.SyncInterval,
+		seeds:        seeds,
+		nodes:        seeds,
+		down:         make(map[string]time.Time),
+	}
+	if c.http == nil {
+		c.http = &http.Client{}
+	}
+	if c.downTime == 0 {
+		c.downTime = 5 * time.Second
+	}
+	if c.syncInterval == 0 {
+		c.syncInterval = 30 * time.Second
+	}
+	return c, nil
+}
+
+// Nodes returns the nodes the client sends requests to.
+func (c *Client) Nodes() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.nodes...)
+}
+
+// Sync fetches the list of nodes from the cluster (GET /ring). The seed
+// endpoints are kept in the list, so the client can always start over from
+// them.
+func (c *Client) Sync(ctx context.Context) error {
+	var ring struct {
+		Nodes []string `json:"nodes"`
+	}
+	if err := c.do(ctx, request{method: http.MethodGet, path: "/ring", idempotent: true, noSync: true}, &ring); err != nil {
+		return err
+	}
+
+	nodes := append([]string(nil), c.seeds...)
+	for _, node := range ring.Nodes {
+		node = strings.TrimSuffix(node, "/")
+		if !slices.Contains(nodes, node) {
+			nodes = append(nodes, node)
+		}
+	}
+
+	c.mu.Lock()
+	c.nodes = nodes
+	c.lastSync = time.Now()
+	c.mu.Unlock()
+	return nil
+}
+
+// pick returns the nodes to try for a request, the next node in turn
+// first and the nodes that are down last. The prefer node, if any, comes
+// first when it is up.
+func (c *Client) pick(prefer string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.next = (c.next + 1) % len(c.nodes)
+	var up, down []string
+	for i := range c.nodes {
+		node := c.nodes[(c.next+i)%len(c.nodes)]
+		if until, ok := c.down[node]; ok && time.Now().Before(until) {
+			down = append(down, node)
+		} else {
+			up = append(up, node)
+		}
+	}
+	if i := slices.Index(up, prefer); i > 0 {
+		up[0], up[i] = up[i], up[0]
+	}
+	return append(up, down...)
+}
+
+// markDown skips node until it has had time to come back.
+func (c *Client) markDown(node string) {
+	c.mu.Lock()
+	c.down[node] = time.Now().Add(c.downTime)
+	c.mu.Unlock()
+}
+
+// markUp forgets that node was down.
+func (c *Client) markUp(node string) {
+	c.mu.Lock()
+	delete(c.down, node)
+	c.mu.Unlock()
+}
+
+// syncDue reports whether the list of nodes should be fetched again.
+func (c *Client) syncDue() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.syncInterval > 0 && time.Since(c.lastSync) > c.syncInterval
+}
+
+// request is an HTTP request to any node of the cluster.
+type request struct {
+	method     string
+	path       string
+	header     http.Header
+	body       []byte
+	idempotent bool
+
+	// prefer is the node to send the request to if it is up
+	prefer string
+
+	// noSync keeps the request from fetching the list of nodes first
+	noSync bool
+}
+
+// do sends req to the nodes in turn until one answers, and decodes a JSON
+// response into response unless it is nil. Error responses are returned
+// as errors.
+func (c *Client) do(ctx context.Context, req request, response any) error {
+	resp, err := c.send(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if response == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return fmt.Errorf("invalid response from %s: %w", resp.Request.URL.Host, err)
+	}
+	return nil
+}
+
+// send sends req to the nodes in turn and returns the first successful
+// response; the caller closes its body. A request that is not idempotent
+// only moves to another node when it could not be sent.
+func (c *Client) send(ctx context.Context, req request) (*http.Response, error) {
+	if !req.noSync && c.syncDue() {
+		// a failed sync leaves the known nodes in place
+		c.Sync(ctx)
+	}
+
+	var lastErr error
+	for _, node := range c.pick(req.prefer) {
+		resp, err := c.sendTo(ctx, node, req)
+		if err == nil {
+			c.markUp(node)
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		lastErr = err
+
+		var apiErr *Error
+		switch {
+		case errors.As(err, &apiErr) && apiErr.retryable() && req.idempotent:
+		case errors.As(err, &apiErr):
+			return nil, err
+		case isDialError(err):
+			c.markDown(node)
+		case req.idempotent:
+			c.markDown(node)
+		default:
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("no node could serve the request: %w", lastErr)
+}
+
+// sendTo sends req to node. Responses other than 2xx and 300 are returned
+// as errors.
+func (c *Client) sendTo(ctx context.Context, node string, req request) (*http.Response, error) {
+	var body io.Reader
+	if req.body != nil {
+		body = bytes.NewReader(req.body)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, node+req.path, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range req.header {
+		httpReq.Header[name] = values
+	}
+
+	resp, err := c.http.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 || resp.StatusCode == http.StatusMultipleChoices {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	return nil, responseError(node, resp)
+}
+
+// isDialError reports whether err means a request never reached the node.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
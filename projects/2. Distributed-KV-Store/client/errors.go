@@ -0,0 +1,91 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ErrNotFound is matched by the error returned for a key that does not
+// exist, was deleted or has expired:
+//
+//	if errors.Is(err, client.ErrNotFound) { ... }
+var ErrNotFound = errors.New("key not found")
+
+// Error is an error response of a node.
+type Error struct {
+	Node       string
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s responded with %d %s: %s", e.Node, e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Is makes a 404 Not Found match ErrNotFound.
+func (e *Error) Is(target error) bool {
+	return target == ErrNotFound && e.StatusCode == http.StatusNotFound
+}
+
+// retryable reports whether another node may serve the request: the node
+// could not reach the replicas of the key, or the leader in raft mode.
+func (e *Error) retryable() bool {
+	switch e.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// ConflictError is returned when the condition of a write does not hold.
+// Version is the current version of the key, 0 if it does not exist.
+type ConflictError struct {
+	Key     string
+	Version uint64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("version conflict on key %s: current version is %d", e.Key, e.Version)
+}
+
+// CompactedError is returned by a watch that starts at a revision the node
+// no longer keeps. Watching from CompactRevision+1 succeeds.
+type CompactedError struct {
+	Revision        uint64
+	CompactRevision uint64
+}
+
+func (e *CompactedError) Error() string {
+	return fmt.Sprintf("revision %d has been compacted, the oldest available revision is %d", e.Revision, e.CompactRevision+1)
+}
+
+// responseError turns an error response of node into an error.
+func responseError(node string, resp *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	var body struct {
+		Error           string `json:"error"`
+		Key             string `json:"key"`
+		Version         uint64 `json:"version"`
+		Revision        uint64 `json:"revision"`
+		CompactRevision uint64 `json:"compact_revision"`
+	}
+	isJSON := json.Unmarshal(data, &body) == nil
+
+	switch {
+	case resp.StatusCode == http.StatusConflict && isJSON && body.Error == "version conflict":
+		return &ConflictError{Key: body.Key, Version: body.Version}
+	case resp.StatusCode == http.StatusGone && isJSON:
+		return &CompactedError{Revision: body.Revision, CompactRevision: body.CompactRevision}
+	}
+
+	message := strings.TrimSpace(string(data))
+	if isJSON && body.Error != "" {
+		message = body.Error
+	}
+	return &Error{Node: node, StatusCode: resp.StatusCode, Message: message}
+}
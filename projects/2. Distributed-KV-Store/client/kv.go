@@ -0,0 +1,343 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KeyValue is a key read with Get. Value is in the encoding of ContentType,
+// as it was written. Context is sent back with a write to replace every
+// version that was read. When the key has concurrent versions, in eventual
+// mode, Siblings holds all of them, newest first, and Value is the first.
+type KeyValue struct {
+	Key         string
+	Value       []byte
+	ContentType string
+	Version     uint64
+	Context     string
+	ExpiresAt   time.Time
+	Siblings    []Sibling
+}
+
+// Sibling is one of the concurrent versions of a key.
+type Sibling struct {
+	Value       []byte
+	ContentType string
+}
+
+// GetOptions tunes a read. ReadQuorum is R (0 uses the node's default),
+// ReadRepair overrides the node's read repair setting when set, and Stale
+// skips the read-index round trip in raft mode.
+type GetOptions struct {
+	ReadQuorum int
+	ReadRepair *bool
+	Stale      bool
+}
+
+// PutOptions tunes a write. ContentType is stored with the value
+// (application/octet-stream by default) and returned by reads. The key
+// expires after TTL, rounded up to whole seconds, or at ExpiresAt.
+// With IfAbsent the write only succeeds if the key does not exist, and with
+// IfVersion only if the key is at that version; otherwise it fails with a
+// ConflictError. Context is the context of an earlier read, and
+// WriteQuorum is W (0 uses the node's default).
+type PutOptions struct {
+	ContentType string
+	TTL         time.Duration
+	ExpiresAt   time.Time
+	IfAbsent    bool
+	IfVersion   *uint64
+	Context     string
+	WriteQuorum int
+}
+
+// DeleteOptions tunes a delete, like PutOptions.
+type DeleteOptions struct {
+	IfVersion   *uint64
+	Context     string
+	WriteQuorum int
+}
+
+// PutResult is the outcome of a write. Acks is the number of replicas that
+// acknowledged it; it is 0 in raft mode.
+type PutResult struct {
+	Version uint64 `json:"version"`
+	Acks    int    `json:"acks"`
+}
+
+// Get reads key. It fails with an error matching ErrNotFound if the key
+// does not exist.
+func (c *Client) Get(ctx context.Context, key string, opts *GetOptions) (*KeyValue, error) {
+	query := url.Values{}
+	if opts != nil {
+		if opts.ReadQuorum > 0 {
+			query.Set("r", strconv.Itoa(opts.ReadQuorum))
+		}
+		if opts.ReadRepair != nil {
+			query.Set("repair", strconv.FormatBool(*opts.ReadRepair))
+		}
+		if opts.Stale {
+			query.Set("stale", "true")
+		}
+	}
+
+	resp, err := c.send(ctx, request{method: http.MethodGet, path: keyPath(key, query), idempotent: true})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	kv := &KeyValue{Key: key, Context: resp.Header.Get("X-Context")}
+	if kv.Version, err = strconv.ParseUint(strings.Trim(resp.Header.Get("ETag"), `"`), 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid version in response: %s", resp.Header.Get("ETag"))
+	}
+	if expiresAt := resp.Header.Get("X-Expires-At"); expiresAt != "" {
+		if kv.ExpiresAt, err = time.Parse(time.RFC3339Nano, expiresAt); err != nil {
+			return nil, fmt.Errorf("invalid expiry in response: %s", expiresAt)
+		}
+	}
+
+	if resp.StatusCode == http.StatusMultipleChoices {
+		var body struct {
+			Siblings []struct {
+				Value       json.RawMessage `json:"value"`
+				ContentType string          `json:"content_type"`
+			} `json:"siblings"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || len(body.Siblings) == 0 {
+			return nil, fmt.Errorf("invalid siblings in response: %v", err)
+		}
+		for _, sibling := range body.Siblings {
+			value, err := decodeValue(sibling.Value, sibling.ContentType)
+			if err != nil {
+				return nil, err
+			}
+			kv.Siblings = append(kv.Siblings, Sibling{Value: value, ContentType: sibling.ContentType})
+		}
+		kv.Value, kv.ContentType = kv.Siblings[0].Value, kv.Siblings[0].ContentType
+		return kv, nil
+	}
+
+	kv.ContentType = resp.Header.Get("Content-Type")
+	if kv.Value, err = io.ReadAll(resp.Body); err != nil {
+		return nil, err
+	}
+	return kv, nil
+}
+
+// Put writes value under key and returns the new version.
+func (c *Client) Put(ctx context.Context, key string, value []byte, opts *PutOptions) (PutResult, error) {
+	if opts == nil {
+		opts = &PutOptions{}
+	}
+	query := url.Values{}
+	if opts.TTL > 0 {
+		query.Set("ttl", strconv.FormatInt(int64((opts.TTL+time.Second-1)/time.Second), 10))
+	}
+	if !opts.ExpiresAt.IsZero() {
+		query.Set("expires_at", opts.ExpiresAt.Format(time.RFC3339Nano))
+	}
+	if opts.WriteQuorum > 0 {
+		query.Set("w", strconv.Itoa(opts.WriteQuorum))
+	}
+
+	contentType := opts.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	header := writeHeader(opts.IfVersion, opts.Context)
+	header.Set("Content-Type", contentType)
+	if opts.IfAbsent {
+		header.Set("If-None-Match", "*")
+	}
+	if value == nil {
+		value = []byte{}
+	}
+
+	var result PutResult
+	err := c.do(ctx, request{method: http.MethodPut, path: keyPath(key, query), header: header, body: value}, &result)
+	return result, err
+}
+
+// PutJSON writes v, encoded as JSON, under key.
+func (c *Client) PutJSON(ctx context.Context, key string, v any, opts *PutOptions) (PutResult, error) {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return PutResult{}, err
+	}
+	withType := PutOptions{}
+	if opts != nil {
+		withType = *opts
+	}
+	withType.ContentType = "application/json"
+	return c.Put(ctx, key, value, &withType)
+}
+
+// Delete deletes key and returns the number of replicas that acknowledged
+// the delete.
+func (c *Client) Delete(ctx context.Context, key string, opts *DeleteOptions) (int, error) {
+	if opts == nil {
+		opts = &DeleteOptions{}
+	}
+	query := url.Values{}
+	if opts.WriteQuorum > 0 {
+		query.Set("w", strconv.Itoa(opts.WriteQuorum))
+	}
+
+	var result PutResult
+	err := c.do(ctx, request{method: http.MethodDelete, path: keyPath(key, query), header: writeHeader(opts.IfVersion, opts.Context)}, &result)
+	return result.Acks, err
+}
+
+// Entry is a key returned by List or Scan. Value and ContentType are only
+// set when the values were asked for.
+type Entry struct {
+	Key         string
+	Value       []byte
+	ContentType string
+	Version     uint64
+}
+
+// ListOptions selects the keys to list: the keys that start with Prefix,
+// from Start on. Limit is the page size (100 by default, at most 1000),
+// Values returns the values with the keys, and Continue is the token of the
+// previous page. Stale skips the read-index round trip in raft mode.
+type ListOptions struct {
+	Prefix   string
+	Start    string
+	Limit    int
+	Values   bool
+	Continue string
+	Stale    bool
+}
+
+// ListPage is a page of keys in lexical order. Next is set when more keys
+// may follow; passing it as Continue returns the next page.
+type ListPage struct {
+	Entries []Entry
+	Next    string
+}
+
+// List returns a page of the live keys of the cluster.
+func (c *Client) List(ctx context.Context, opts *ListOptions) (*ListPage, error) {
+	if opts == nil {
+		opts = &ListOptions{}
+	}
+	query := url.Values{}
+	for name, value := range map[string]string{"prefix": opts.Prefix, "start": opts.Start, "continue": opts.Continue} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Values {
+		query.Set("values", "true")
+	}
+	if opts.Stale {
+		query.Set("stale", "true")
+	}
+
+	var body struct {
+		Keys []struct {
+			Key         string          `json:"key"`
+			Value       json.RawMessage `json:"value"`
+			ContentType string          `json:"content_type"`
+			Version     uint64          `json:"version"`
+		} `json:"keys"`
+		Next string `json:"next"`
+	}
+	if err := c.do(ctx, request{method: http.MethodGet, path: "/keys?" + query.Encode(), idempotent: true}, &body); err != nil {
+		return nil, err
+	}
+
+	page := &ListPage{Entries: make([]Entry, 0, len(body.Keys)), Next: body.Next}
+	for _, key := range body.Keys {
+		entry := Entry{Key: key.Key, ContentType: key.ContentType, Version: key.Version}
+		if key.Value != nil {
+			value, err := decodeValue(key.Value, key.ContentType)
+			if err != nil {
+				return nil, err
+			}
+			entry.Value = value
+		}
+		page.Entries = append(page.Entries, entry)
+	}
+	return page, nil
+}
+
+// Scan calls fn with every live key selected by opts, in lexical order,
+// fetching the pages one after the other. It stops at the first error fn
+// returns and returns it.
+func (c *Client) Scan(ctx context.Context, opts *ListOptions, fn func(Entry) error) error {
+	pageOpts := ListOptions{}
+	if opts != nil {
+		pageOpts = *opts
+	}
+	for {
+		page, err := c.List(ctx, &pageOpts)
+		if err != nil {
+			return err
+		}
+		for _, entry := range page.Entries {
+			if err := fn(entry); err != nil {
+				return err
+			}
+		}
+		if page.Next == "" {
+			return nil
+		}
+		pageOpts.Continue = page.Next
+	}
+}
+
+// keyPath returns the /v1/kv path of key with query.
+func keyPath(key string, query url.Values) string {
+	path := "/v1/kv/" + url.PathEscape(key)
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	return path
+}
+
+// writeHeader returns the headers of a write made if the key is at
+// ifVersion, when set, with writeContext.
+func writeHeader(ifVersion *uint64, writeContext string) http.Header {
+	header := http.Header{}
+	if ifVersion != nil {
+		header.Set("If-Match", strconv.Quote(strconv.FormatUint(*ifVersion, 10)))
+	}
+	if writeContext != "" {
+		header.Set("X-Context", writeContext)
+	}
+	return header
+}
+
+// decodeValue returns the bytes of a value the node sent as JSON, in a
+// listing, a watch event or a list of siblings: JSON values as they are,
+// text as a string and anything else base64 encoded.
+func decodeValue(raw json.RawMessage, contentType string) ([]byte, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if contentType == "" || mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+		return raw, nil
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, fmt.Errorf("invalid %s value: %w", contentType, err)
+	}
+	if strings.HasPrefix(mediaType, "text/") {
+		return []byte(s), nil
+	}
+	return base64.StdEncoding.DecodeString(s)
+}
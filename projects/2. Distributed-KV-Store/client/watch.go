@@ -0,0 +1,236 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limits of a watch stream: the longest line, holding one event, and the
+// longest wait between two attempts to reconnect.
+const (
+	maxEventSize    = 64 * 1024 * 1024
+	maxWatchBackoff = 5 * time.Second
+)
+
+// Event is a change to a key seen by a watch. Type is "put" or "delete";
+// the value of a put is in the encoding of ContentType, as for Get.
+type Event struct {
+	Type        string
+	Key         string
+	Value       []byte
+	ContentType string
+	Version     uint64
+	Revision    uint64
+}
+
+// WatchOptions tunes a watch. With Prefix the key is a prefix and every key
+// that starts with it is watched. With Revision the watch starts with the
+// changes since that revision instead of the ones to come.
+type WatchOptions struct {
+	Prefix   bool
+	Revision uint64
+}
+
+// Watcher receives the changes to the keys it watches. When the stream
+// breaks it reconnects, to the same node if it is up, and resumes after the
+// last revision it received. In eventual mode revisions are local to a
+// node, so resuming on another node may repeat or skip changes, or fail
+// with a CompactedError; in raft mode resuming is exact on every node.
+type Watcher struct {
+	client *Client
+	query  url.Values
+	events chan Event
+	cancel context.CancelFunc
+
+	// node is the node the stream is read from
+	node string
+
+	mu  sync.Mutex
+	err error
+}
+
+// Watch starts watching key, or every key with the prefix key when
+// opts.Prefix is set. The watch runs until ctx is done or Close is called.
+func (c *Client) Watch(ctx context.Context, key string, opts *WatchOptions) (*Watcher, error) {
+	if opts == nil {
+		opts = &WatchOptions{}
+	}
+	query := url.Values{}
+	if opts.Prefix {
+		query.Set("prefix", key)
+	} else {
+		query.Set("key", key)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	w := &Watcher{
+		client: c,
+		query:  query,
+		events: make(chan Event, 64),
+		cancel: cancel,
+	}
+	resp, err := w.connect(ctx, opts.Revision)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	go w.run(ctx, resp, opts.Revision)
+	return w, nil
+}
+
+// Events returns the channel the changes are delivered on. It is closed
+// when the watch ends; Err then tells why.
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+// Err returns the error that ended the watch, once Events is closed.
+func (w *Watcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Close stops the watch.
+func (w *Watcher) Close() {
+	w.cancel()
+}
+
+// connect opens a stream starting at revision (0 for the changes to come).
+func (w *Watcher) connect(ctx context.Context, revision uint64) (*http.Response, error) {
+	query := url.Values{}
+	for name, values := range w.query {
+		query[name] = values
+	}
+	if revision > 0 {
+		query.Set("revision", strconv.FormatUint(revision, 10))
+	}
+
+	resp, err := w.client.send(ctx, request{
+		method:     http.MethodGet,
+		path:       "/watch?" + query.Encode(),
+		header:     http.Header{"Accept": {"application/x-ndjson"}},
+		idempotent: true,
+		prefer:     w.node,
+	})
+	if err != nil {
+		return nil, err
+	}
+	w.node = resp.Request.URL.Scheme + "://" + resp.Request.URL.Host
+	return resp, nil
+}
+
+// run delivers the events of the stream resp, which started at start, and
+// reconnects whenever the stream breaks.
+func (w *Watcher) run(ctx context.Context, resp *http.Response, start uint64) {
+	defer close(w.events)
+
+	next := start
+	backoff := 100 * time.Millisecond
+	for {
+		received, err := w.read(ctx, resp, &next)
+		resp.Body.Close()
+		if ctx.Err() != nil {
+			w.stop(ctx.Err())
+			return
+		}
+		if err != nil {
+			w.stop(err)
+			return
+		}
+		if received {
+			backoff = 100 * time.Millisecond
+		}
+
+		// reconnect until a node accepts the watch or the error is final
+		for {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				w.stop(ctx.Err())
+				return
+			}
+			backoff = min(2*backoff, maxWatchBackoff)
+
+			resp, err = w.connect(ctx, next)
+			if err == nil {
+				break
+			}
+			var apiErr *Error
+			var compacted *CompactedError
+			if ctx.Err() != nil || errors.As(err, &compacted) || (errors.As(err, &apiErr) && !apiErr.retryable()) {
+				w.stop(err)
+				return
+			}
+		}
+	}
+}
+
+// read delivers the events of a stream until it ends and keeps next at
+// the revision after the last event. It reports whether any event was
+// received; the error is set when the watch cannot go on.
+func (w *Watcher) read(ctx context.Context, resp *http.Response, next *uint64) (bool, error) {
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxEventSize)
+
+	received := false
+	for scanner.Scan() {
+		var message struct {
+			Type        string          `json:"type"`
+			Key         string          `json:"key"`
+			Value       json.RawMessage `json:"value"`
+			ContentType string          `json:"content_type"`
+			Version     uint64          `json:"version"`
+			Revision    uint64          `json:"revision"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			return received, err
+		}
+
+		switch message.Type {
+		case "put", "delete":
+			event := Event{
+				Type:        message.Type,
+				Key:         message.Key,
+				ContentType: message.ContentType,
+				Version:     message.Version,
+				Revision:    message.Revision,
+			}
+			if message.Value != nil {
+				value, err := decodeValue(message.Value, message.ContentType)
+				if err != nil {
+					return received, err
+				}
+				event.Value = value
+			}
+			select {
+			case w.events <- event:
+			case <-ctx.Done():
+				return received, nil
+			}
+			*next = message.Revision + 1
+			received = true
+		case "error":
+			// the node dropped the watcher, which fell behind; resume
+			return received, nil
+		}
+	}
+	if errors.Is(scanner.Err(), bufio.ErrTooLong) {
+		return received, scanner.Err()
+	}
+	return received, nil
+}
+
+// stop records the error that ended the watch.
+func (w *Watcher) stop(err error) {
+	w.mu.Lock()
+	w.err = err
+	w.mu.Unlock()
+}
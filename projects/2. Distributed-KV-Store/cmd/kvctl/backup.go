@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/client"
+)
+
+// maxRecordSize is the longest line of a backup, holding one key.
+const maxRecordSize = 64 * 1024 * 1024
+
+// A backup holds one record per line, in key order. TTLs are not kept:
+// the listing does not return them, and a restored key does not expire.
+
+func (c *cli) backup(args []string) error {
+	set := flags("backup", "<file|->")
+	prefix := set.String("prefix", "", "Only back up the keys that start with this prefix")
+	file := parse(set, args, 1, 1)[0]
+
+	out := io.Writer(c.stdout)
+	if file != "-" {
+		f, err := os.Create(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	buffered := bufio.NewWriter(out)
+	encoder := json.NewEncoder(buffered)
+
+	// a backup may take longer than the timeout of one request, so it runs
+	// without a deadline
+	count := 0
+	err := c.client.Scan(context.Background(), &client.ListOptions{Prefix: *prefix, Values: true, Limit: 1000}, func(entry client.Entry) error {
+		count++
+		return encoder.Encode(record{
+			Key:         entry.Key,
+			Value:       encodeValue(entry.Value, entry.ContentType),
+			ContentType: entry.ContentType,
+			Version:     entry.Version,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+	if file != "-" {
+		fmt.Fprintf(os.Stderr, "Backed up %d keys to %s\n", count, file)
+	}
+	return nil
+}
+
+func (c *cli) restore(args []string) error {
+	set := flags("restore", "<file|->")
+	ifAbsent := set.Bool("if-absent", false, "Skip the keys that already exist")
+	file := parse(set, args, 1, 1)[0]
+
+	in := io.Reader(os.Stdin)
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+
+	restored, skipped := 0, 0
+	for line := 1; scanner.Scan(); line++ {
+		var r record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return fmt.Errorf("invalid record on line %d: %v", line, err)
+		}
+		value, err := r.decodeValue()
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		// values written with POST /store have no content type and are JSON
+		contentType := r.ContentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+
+		ctx, cancel := c.requestContext()
+		_, err = c.client.Put(ctx, r.Key, value, &client.PutOptions{ContentType: contentType, IfAbsent: *ifAbsent})
+		cancel()
+		var conflict *client.ConflictError
+		switch {
+		case *ifAbsent && errors.As(err, &conflict):
+			skipped++
+		case err != nil:
+			return fmt.Errorf("failed to restore key %s: %v", r.Key, err)
+		default:
+			restored++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if c.output == "json" {
+		return c.printJSON(map[string]int{"restored": restored, "skipped": skipped})
+	}
+	fmt.Fprintf(c.stdout, "Restored %d keys, skipped %d\n", restored, skipped)
+	return nil
+}
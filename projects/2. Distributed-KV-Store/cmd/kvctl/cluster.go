@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/node"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/store"
+)
+
+// nodeStatus is what status reports about one node. Error is set when the
+// node could not be reached.
+type nodeStatus struct {
+	Node      string               `json:"node"`
+	Up        bool                 `json:"up"`
+	Error     string               `json:"error,omitempty"`
+	Hash      string               `json:"hash,omitempty"`
+	Ownership float64              `json:"ownership"`
+	Status    *node.StatusResponse `json:"status,omitempty"`
+}
+
+func (c *cli) status(args []string) error {
+	set := flags("status", "")
+	parse(set, args, 0, 0)
+
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	if err := c.client.Sync(ctx); err != nil {
+		return err
+	}
+	var ring node.RingResponse
+	if err := c.getJSON(ctx, c.client.Nodes()[0]+"/ring", &ring); err != nil {
+		return err
+	}
+
+	// ask every node at once; the ones that are down only cost the timeout
+	nodes := c.client.Nodes()
+	statuses := make([]nodeStatus, len(nodes))
+	var wg sync.WaitGroup
+	for i, address := range nodes {
+		wg.Add(1)
+		go func(i int, address string) {
+			defer wg.Done()
+			statuses[i] = c.nodeStatus(ctx, address)
+			statuses[i].Ownership = ring.Ownership[address]
+		}(i, address)
+	}
+	wg.Wait()
+
+	if c.output == "json" {
+		return c.printJSON(statuses)
+	}
+	var rows [][]string
+	for _, status := range statuses {
+		ownership := fmt.Sprintf("%.1f%%", 100*status.Ownership)
+		if status.Status == nil {
+			rows = append(rows, []string{status.Node, "no", "-", "-", "-", "-", ownership, status.Error})
+			continue
+		}
+		mode := status.Status.Consistency
+		if status.Status.Raft != nil {
+			mode += "/" + status.Status.Raft.State
+		}
+		up := 0
+		for _, state := range status.Status.PeerStates {
+			if state {
+				up++
+			}
+		}
+		rows = append(rows, []string{
+			status.Node, "yes", mode, status.Status.Engine, strconv.Itoa(status.Status.Keys), status.Hash, ownership,
+			fmt.Sprintf("%d/%d", up, len(status.Status.PeerStates)),
+		})
+	}
+	return c.printTable([]string{"NODE", "UP", "MODE", "ENGINE", "KEYS", "HASH", "OWNERSHIP", "PEERS UP"}, rows)
+}
+
+// nodeStatus fetches the status and the store hash of address.
+func (c *cli) nodeStatus(ctx context.Context, address string) nodeStatus {
+	status := nodeStatus{Node: address}
+	var response node.StatusResponse
+	if err := c.getJSON(ctx, address+"/status", &response); err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Up = true
+	status.Status = &response
+
+	var hash struct {
+		Hash string `json:"hash"`
+	}
+	if err := c.getJSON(ctx, address+"/store/hash", &hash); err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Hash = hash.Hash
+	return status
+}
+
+func (c *cli) ring(args []string) error {
+	set := flags("ring", "[key]")
+	positional := parse(set, args, 0, 1)
+
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	address := c.client.Nodes()[0] + "/ring"
+	if len(positional) == 1 {
+		address += "?key=" + url.QueryEscape(positional[0])
+	}
+	var ring node.RingResponse
+	if err := c.getJSON(ctx, address, &ring); err != nil {
+		return err
+	}
+
+	if c.output == "json" {
+		return c.printJSON(ring)
+	}
+	if ring.Key != "" {
+		var rows [][]string
+		for i, owner := range ring.Owners {
+			role := "replica"
+			if i == 0 {
+				role = "primary"
+			}
+			rows = append(rows, []string{owner, role})
+		}
+		return c.printTable([]string{"NODE", "ROLE"}, rows)
+	}
+	var rows [][]string
+	for _, address := range sortedKeys(ring.Ownership) {
+		rows = append(rows, []string{address, fmt.Sprintf("%.1f%%", 100*ring.Ownership[address])})
+	}
+	fmt.Fprintf(c.stdout, "replicas=%d vnodes=%d\n", ring.Replicas, ring.VNodes)
+	return c.printTable([]string{"NODE", "OWNERSHIP"}, rows)
+}
+
+func (c *cli) snapshot(args []string) error {
+	set := flags("snapshot", "")
+	only := set.String("node", "", "Only take a snapshot on this node")
+	parse(set, args, 0, 0)
+
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	nodes := []string{*only}
+	if *only == "" {
+		if err := c.client.Sync(ctx); err != nil {
+			return err
+		}
+		nodes = c.client.Nodes()
+	}
+
+	type result struct {
+		Node     string                `json:"node"`
+		Error    string                `json:"error,omitempty"`
+		Snapshot *store.SnapshotStatus `json:"snapshot,omitempty"`
+	}
+	results := make([]result, 0, len(nodes))
+	failed := 0
+	for _, address := range nodes {
+		var status store.SnapshotStatus
+		if err := c.requestJSON(ctx, http.MethodPost, address+"/snapshot", &status); err != nil {
+			results = append(results, result{Node: address, Error: err.Error()})
+			failed++
+			continue
+		}
+		results = append(results, result{Node: address, Snapshot: &status})
+	}
+
+	if c.output == "json" {
+		if err := c.printJSON(results); err != nil {
+			return err
+		}
+	} else {
+		var rows [][]string
+		for _, result := range results {
+			if result.Snapshot == nil {
+				rows = append(rows, []string{result.Node, "-", "-", result.Error})
+				continue
+			}
+			rows = append(rows, []string{result.Node, strconv.FormatUint(result.Snapshot.LastSnapshotSeq, 10), result.Snapshot.LastSnapshotPath, ""})
+		}
+		if err := c.printTable([]string{"NODE", "SEQ", "PATH", "ERROR"}, rows); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("snapshot failed on %d of %d nodes", failed, len(nodes))
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/client"
+)
+
+// maxDisplayValue is the longest value shown in a table; longer ones are cut.
+const maxDisplayValue = 60
+
+// record is a key as kvctl prints it in JSON and stores it in backups.
+// JSON values are kept as they are, text as a string and anything else
+// base64 encoded, like the HTTP API lists them.
+type record struct {
+	Key         string          `json:"key"`
+	Value       json.RawMessage `json:"value,omitempty"`
+	ContentType string          `json:"content_type,omitempty"`
+	Version     uint64          `json:"version,omitempty"`
+	ExpiresAt   *time.Time      `json:"expires_at,omitempty"`
+	Type        string          `json:"type,omitempty"`
+	Revision    uint64          `json:"revision,omitempty"`
+}
+
+// mediaType returns the media type of contentType without its parameters.
+func mediaType(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType
+}
+
+// isJSON reports whether values of contentType are JSON. Values written
+// with POST /store have no content type and are JSON.
+func isJSON(contentType string) bool {
+	mediaType := mediaType(contentType)
+	return contentType == "" || mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// encodeValue returns value as a JSON value for a record.
+func encodeValue(value []byte, contentType string) json.RawMessage {
+	switch {
+	case value == nil:
+		return nil
+	case isJSON(contentType) && json.Valid(value):
+		return value
+	case strings.HasPrefix(mediaType(contentType), "text/"):
+		encoded, _ := json.Marshal(string(value))
+		return encoded
+	default:
+		encoded, _ := json.Marshal(base64.StdEncoding.EncodeToString(value))
+		return encoded
+	}
+}
+
+// decodeValue returns the bytes of the value of r, the reverse of encodeValue.
+func (r record) decodeValue() ([]byte, error) {
+	if isJSON(r.ContentType) {
+		return r.Value, nil
+	}
+	var s string
+	if err := json.Unmarshal(r.Value, &s); err != nil {
+		return nil, fmt.Errorf("invalid value of key %s: %v", r.Key, err)
+	}
+	if strings.HasPrefix(mediaType(r.ContentType), "text/") {
+		return []byte(s), nil
+	}
+	return base64.StdEncoding.DecodeString(s)
+}
+
+// displayValue returns value as it is shown in a table.
+func displayValue(value []byte, contentType string) string {
+	if !isJSON(contentType) && !strings.HasPrefix(mediaType(contentType), "text/") || !utf8.Valid(value) {
+		return fmt.Sprintf("<%d bytes>", len(value))
+	}
+	s := strings.Join(strings.Fields(string(value)), " ")
+	if len(s) > maxDisplayValue {
+		s = s[:maxDisplayValue-3] + "..."
+	}
+	return s
+}
+
+// expiry returns the expiry time of a record, nil if it does not expire.
+func expiry(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (c *cli) get(args []string) error {
+	set := flags("get", "<key>")
+	stale := set.Bool("stale", false, "Skip the read-index round trip in raft mode")
+	readQuorum := set.Int("r", 0, "Read quorum R (0 uses the node's default)")
+	raw := set.Bool("raw", false, "Print only the value, as it is stored")
+	key := parse(set, args, 1, 1)[0]
+
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	kv, err := c.client.Get(ctx, key, &client.GetOptions{ReadQuorum: *readQuorum, Stale: *stale})
+	if err != nil {
+		return err
+	}
+
+	if *raw {
+		_, err := c.stdout.Write(kv.Value)
+		return err
+	}
+	siblings := kv.Siblings
+	if len(siblings) == 0 {
+		siblings = []client.Sibling{{Value: kv.Value, ContentType: kv.ContentType}}
+	}
+	if c.output == "json" {
+		records := make([]record, 0, len(siblings))
+		for _, sibling := range siblings {
+			records = append(records, record{
+				Key:         key,
+				Value:       encodeValue(sibling.Value, sibling.ContentType),
+				ContentType: sibling.ContentType,
+				Version:     kv.Version,
+				ExpiresAt:   expiry(kv.ExpiresAt),
+			})
+		}
+		if len(records) == 1 {
+			return c.printJSON(records[0])
+		}
+		return c.printJSON(records)
+	}
+
+	expires := "-"
+	if !kv.ExpiresAt.IsZero() {
+		expires = kv.ExpiresAt.Local().Format(time.RFC3339)
+	}
+	var rows [][]string
+	for _, sibling := range siblings {
+		rows = append(rows, []string{key, strconv.FormatUint(kv.Version, 10), sibling.ContentType, expires, displayValue(sibling.Value, sibling.ContentType)})
+	}
+	return c.printTable([]string{"KEY", "VERSION", "CONTENT-TYPE", "EXPIRES", "VALUE"}, rows)
+}
+
+func (c *cli) put(args []string) error {
+	set := flags("put", "<key> <value|->")
+	contentType := set.String("content-type", "text/plain; charset=utf-8", "Content type of the value")
+	ttl := set.Duration("ttl", 0, "Time after which the key expires (0 means never)")
+	ifVersion := set.Int64("if-version", -1, "Only write if the key is at this version (0 means absent)")
+	ifAbsent := set.Bool("if-absent", false, "Only write if the key does not exist")
+	writeQuorum := set.Int("w", 0, "Write quorum W (0 uses the node's default)")
+	positional := parse(set, args, 2, 2)
+
+	value := []byte(positional[1])
+	if positional[1] == "-" {
+		var err error
+		if value, err = io.ReadAll(os.Stdin); err != nil {
+			return err
+		}
+	}
+	opts := &client.PutOptions{ContentType: *contentType, TTL: *ttl, IfAbsent: *ifAbsent, WriteQuorum: *writeQuorum}
+	if *ifVersion >= 0 {
+		version := uint64(*ifVersion)
+		opts.IfVersion = &version
+	}
+
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	result, err := c.client.Put(ctx, positional[0], value, opts)
+	if err != nil {
+		return err
+	}
+	if c.output == "json" {
+		return c.printJSON(result)
+	}
+	fmt.Fprintf(c.stdout, "OK version=%d acks=%d\n", result.Version, result.Acks)
+	return nil
+}
+
+func (c *cli) delete(args []string) error {
+	set := flags("delete", "<key>")
+	ifVersion := set.Int64("if-version", -1, "Only delete if the key is at this version")
+	writeQuorum := set.Int("w", 0, "Write quorum W (0 uses the node's default)")
+	key := parse(set, args, 1, 1)[0]
+
+	opts := &client.DeleteOptions{WriteQuorum: *writeQuorum}
+	if *ifVersion >= 0 {
+		version := uint64(*ifVersion)
+		opts.IfVersion = &version
+	}
+
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	acks, err := c.client.Delete(ctx, key, opts)
+	if err != nil {
+		return err
+	}
+	if c.output == "json" {
+		return c.printJSON(map[string]int{"acks": acks})
+	}
+	fmt.Fprintf(c.stdout, "OK acks=%d\n", acks)
+	return nil
+}
+
+func (c *cli) list(args []string) error {
+	set := flags("list", "")
+	prefix := set.String("prefix", "", "Only list the keys that start with this prefix")
+	start := set.String("start", "", "First key to list")
+	limit := set.Int("limit", 0, "Largest number of keys to list (0 lists them all)")
+	values := set.Bool("values", false, "List the values too")
+	stale := set.Bool("stale", false, "Skip the read-index round trip in raft mode")
+	parse(set, args, 0, 0)
+
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	var entries []client.Entry
+	errLimit := errors.New("limit reached")
+	opts := &client.ListOptions{Prefix: *prefix, Start: *start, Values: *values, Stale: *stale}
+	err := c.client.Scan(ctx, opts, func(entry client.Entry) error {
+		entries = append(entries, entry)
+		if *limit > 0 && len(entries) == *limit {
+			return errLimit
+		}
+		return nil
+	})
+	if err != nil && err != errLimit {
+		return err
+	}
+
+	if c.output == "json" {
+		records := make([]record, 0, len(entries))
+		for _, entry := range entries {
+			records = append(records, record{
+				Key:         entry.Key,
+				Value:       encodeValue(entry.Value, entry.ContentType),
+				ContentType: entry.ContentType,
+				Version:     entry.Version,
+			})
+		}
+		return c.printJSON(records)
+	}
+
+	header := []string{"KEY", "VERSION"}
+	if *values {
+		header = append(header, "CONTENT-TYPE", "VALUE")
+	}
+	var rows [][]string
+	for _, entry := range entries {
+		row := []string{entry.Key, strconv.FormatUint(entry.Version, 10)}
+		if *values {
+			row = append(row, entry.ContentType, displayValue(entry.Value, entry.ContentType))
+		}
+		rows = append(rows, row)
+	}
+	return c.printTable(header, rows)
+}
+
+func (c *cli) watch(args []string) error {
+	set := flags("watch", "<key>")
+	prefix := set.Bool("prefix", false, "Watch every key that starts with the key")
+	revision := set.Uint64("revision", 0, "Start with the changes since this revision")
+	key := parse(set, args, 1, 1)[0]
+
+	// the watch runs until it is interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	watcher, err := c.client.Watch(ctx, key, &client.WatchOptions{Prefix: *prefix, Revision: *revision})
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	encoder := json.NewEncoder(c.stdout)
+	for event := range watcher.Events() {
+		if c.output == "json" {
+			encoder.Encode(record{
+				Type:        event.Type,
+				Key:         event.Key,
+				Value:       encodeValue(event.Value, event.ContentType),
+				ContentType: event.ContentType,
+				Version:     event.Version,
+				Revision:    event.Revision,
+			})
+			continue
+		}
+		value := ""
+		if event.Type == "put" {
+			value = displayValue(event.Value, event.ContentType)
+		}
+		fmt.Fprintf(c.stdout, "%d\t%s\t%s\t%d\t%s\n", event.Revision, event.Type, event.Key, event.Version, value)
+	}
+	if err := watcher.Err(); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
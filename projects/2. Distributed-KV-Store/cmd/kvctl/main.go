@@ -0,0 +1,191 @@
+// Command kvctl operates a key-value store cluster from the command line:
+// it reads and writes keys, watches them, reports the state of the cluster
+// and backs it up. It talks to the HTTP API of the nodes given with
+// --endpoints and discovers the rest of the cluster from them.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/client"
+)
+
+const usage = `Usage: kvctl [flags] <command> [arguments]
+
+Keys:
+  get <key>                   Read a key
+  put <key> <value|->         Write a key ("-" reads the value from stdin)
+  delete <key>                Delete a key
+  list                        List keys
+  watch <key>                 Stream the changes to a key or a prefix
+
+Cluster:
+  status                      Peer states, store hashes and ring ownership of every node
+  ring [key]                  Ring ownership, or the replicas of a key
+  snapshot                    Take a snapshot on every node
+  backup <file|->             Write every key and value to a file
+  restore <file|->            Write the keys of a backup back to the cluster
+
+Run "kvctl <command> -h" for the flags of a command.
+
+Flags:
+`
+
+// command runs a subcommand with its arguments.
+type command func(c *cli, args []string) error
+
+var commands = map[string]command{
+	"get":      (*cli).get,
+	"put":      (*cli).put,
+	"delete":   (*cli).delete,
+	"list":     (*cli).list,
+	"watch":    (*cli).watch,
+	"status":   (*cli).status,
+	"ring":     (*cli).ring,
+	"snapshot": (*cli).snapshot,
+	"backup":   (*cli).backup,
+	"restore":  (*cli).restore,
+}
+
+// cli holds what every command needs: the client of the cluster, an HTTP
+// client for the endpoints the client package does not cover, the output
+// format and the timeout of each request.
+type cli struct {
+	client  *client.Client
+	http    *http.Client
+	output  string
+	timeout time.Duration
+	stdout  io.Writer
+}
+
+func main() {
+	endpoints := flag.String("endpoints", "http://localhost:8001", "Comma-separated list of node URLs")
+	output := flag.String("output", "table", "Output format: table or json")
+	timeout := flag.Duration("timeout", 10*time.Second, "Timeout of each request")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *output != "table" && *output != "json" {
+		fail(fmt.Errorf("unknown output format: %s", *output))
+	}
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	run, ok := commands[flag.Arg(0)]
+	if !ok {
+		fail(fmt.Errorf("unknown command: %s", flag.Arg(0)))
+	}
+
+	kv, err := client.New(strings.Split(*endpoints, ","), client.Options{})
+	if err != nil {
+		fail(err)
+	}
+	c := &cli{
+		client:  kv,
+		http:    &http.Client{Timeout: *timeout},
+		output:  *output,
+		timeout: *timeout,
+		stdout:  os.Stdout,
+	}
+	if err := run(c, flag.Args()[1:]); err != nil {
+		fail(err)
+	}
+}
+
+// fail prints err and exits.
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "kvctl:", err)
+	os.Exit(1)
+}
+
+// flags returns the flag set of a command. Parsing errors exit the program.
+func flags(name, arguments string) *flag.FlagSet {
+	set := flag.NewFlagSet(name, flag.ExitOnError)
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "Usage: kvctl %s %s\n", name, arguments)
+		set.PrintDefaults()
+	}
+	return set
+}
+
+// parse parses the arguments of a command, which must leave n positional
+// arguments, or between n and most when most is larger.
+func parse(set *flag.FlagSet, args []string, n, most int) []string {
+	set.Parse(args)
+	if set.NArg() < n || set.NArg() > max(n, most) {
+		set.Usage()
+		os.Exit(2)
+	}
+	return set.Args()
+}
+
+// requestContext returns the context of one request.
+func (c *cli) requestContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), c.timeout)
+}
+
+// printJSON writes v as indented JSON.
+func (c *cli) printJSON(v any) error {
+	encoder := json.NewEncoder(c.stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// printTable writes rows as columns aligned under header.
+func (c *cli) printTable(header []string, rows [][]string) error {
+	w := tabwriter.NewWriter(c.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+// getJSON fetches url and decodes the JSON response into v.
+func (c *cli) getJSON(ctx context.Context, url string, v any) error {
+	return c.requestJSON(ctx, http.MethodGet, url, v)
+}
+
+// requestJSON sends a request without a body to url and decodes the JSON
+// response into v.
+func (c *cli) requestJSON(ctx context.Context, method, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s responded with %d: %s", url, resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -15,7 +15,7 @@ func main() {
 	fmt.Println("Node initialized with the following configuration:")
 	fmt.Printf("Port: %s\n", node.Port)
 	fmt.Printf("Peers: %v\n", node.Peers)
-	fmt.Printf("Store: %v\n", node.DB)
+	fmt.Printf("Keys: %d\n", node.DB.Len())
 	fmt.Println("Ping Frequency:", node.PingFrequency)
 	fmt.Println("Timeout:", node.Timeout)
 
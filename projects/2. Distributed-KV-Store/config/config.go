@@ -15,6 +15,87 @@ type Config struct {
 	Peers         []string
 	PingFrequency int
 	Timeout       int
+
+	// DataDir is the directory holding the write-ahead log and snapshots;
+	// when it is empty the node keeps its data in memory only.
+	DataDir string
+
+	// A snapshot is taken every SnapshotInterval seconds, or as soon as
+	// SnapshotThreshold mutations have been logged since the last one.
+	// 0 disables either trigger.
+	SnapshotInterval  int
+	SnapshotThreshold int
+
+	// Engine selects the storage engine: "memory" (the default) or "lsm",
+	// which keeps data in SSTables under DataDir and needs a data directory.
+	Engine string
+
+	// Self is the URL other nodes use to reach this node.
+	Self string
+
+	// Consistency selects how writes are replicated: "eventual" (the
+	// default) or "raft".
+	Consistency string
+
+	// RaftJoin starts a node that waits to be added to an existing Raft
+	// cluster.
+	RaftJoin bool
+
+	// ElectionTimeout is the Raft election timeout in milliseconds.
+	ElectionTimeout int
+
+	// Replicas is the replication factor N; 0 means every node.
+	Replicas int
+
+	// WriteQuorum and ReadQuorum are the default number of replicas (W and
+	// R) that must answer a write or a read in eventual mode.
+	WriteQuorum int
+	ReadQuorum  int
+
+	// VNodes is the number of virtual nodes each node gets on the
+	// consistent-hash ring.
+	VNodes int
+
+	// AntiEntropyInterval is the number of seconds between Merkle tree
+	// comparisons with each peer; 0 disables them.
+	AntiEntropyInterval int
+
+	// Writes a peer misses are kept as hints for at most HintTTL seconds,
+	// and at most MaxHints of them per peer.
+	HintTTL  int
+	MaxHints int
+
+	// ReadRepair turns on read repair for reads that do not ask for it.
+	ReadRepair bool
+
+	// TombstoneGrace is the number of seconds a tombstone is kept after a
+	// delete before it may be purged; 0 keeps tombstones forever.
+	TombstoneGrace int
+
+	// ReapInterval is the number of seconds between two reaps of expired
+	// keys; 0 disables the reaper.
+	ReapInterval int
+
+	// WatchHistory is the number of recent changes kept for watchers that
+	// resume from an earlier revision.
+	WatchHistory int
+
+	// Transport selects how writes are sent to the replicas of a key:
+	// "http" (the default) or "grpc".
+	Transport string
+
+	// RespPort is the port Redis clients connect to; when it is empty RESP
+	// is not served.
+	RespPort string
+
+	// Writes wait for their replicas in a queue per peer holding at most
+	// ReplicationQueue writes, which are sent ReplicationBatch at a time.
+	ReplicationQueue int
+	ReplicationBatch int
+
+	// ReplicationPolicy tells what a write does when a queue is full:
+	// "block" (the default), "drop" or "fail".
+	ReplicationPolicy string
 }
 
 func Load() *Config {
@@ -22,6 +103,30 @@ func Load() *Config {
 	peers := flag.String("peers", "", "Comma-separated list of peer nodes (example: http://localhost:8001,http://localhost:8002")
 	pingFreq := flag.String("pingfreq", "15", "Frequency of pinging peers in seconds")
 	timeout := flag.String("timeout", "20", "Timeout for operations in seconds")
+	dataDir := flag.String("data-dir", "", "Directory for the write-ahead log and snapshots (empty keeps data in memory only)")
+	snapshotInterval := flag.String("snapshot-interval", "300", "Interval between snapshots in seconds (0 disables periodic snapshots)")
+	snapshotThreshold := flag.String("snapshot-threshold", "10000", "Number of logged writes that triggers a snapshot (0 disables)")
+	engine := flag.String("engine", "memory", "Storage engine: memory or lsm (lsm requires --data-dir)")
+	self := flag.String("self", "", "URL under which peers reach this node (default http://localhost:<port>)")
+	consistency := flag.String("consistency", "eventual", "Replication mode: eventual or raft")
+	raftJoin := flag.Bool("raft-join", false, "Start without members and wait to be added to an existing Raft cluster")
+	electionTimeout := flag.String("election-timeout", "1000", "Raft election timeout in milliseconds")
+	replicas := flag.String("replicas", "0", "Replication factor N: number of nodes holding each key (0 means every node)")
+	writeQuorum := flag.String("write-quorum", "1", "Default write quorum W: replicas that must acknowledge a write")
+	readQuorum := flag.String("read-quorum", "1", "Default read quorum R: replicas that must answer a read")
+	vnodes := flag.String("vnodes", "128", "Number of virtual nodes per node on the consistent-hash ring")
+	antiEntropyInterval := flag.String("anti-entropy-interval", "30", "Seconds between Merkle tree comparisons with each peer (0 disables)")
+	hintTTL := flag.String("hint-ttl", "10800", "Seconds a hint for an unreachable peer is kept before it is dropped (0 keeps hints forever)")
+	maxHints := flag.String("max-hints", "10000", "Maximum number of pending hints per peer (0 means no limit)")
+	readRepair := flag.Bool("read-repair", true, "Repair stale replicas found by reads (can be overridden per request)")
+	tombstoneGrace := flag.String("tombstone-grace", "86400", "Seconds a tombstone is kept after a delete before it may be purged (0 keeps tombstones forever)")
+	reapInterval := flag.String("reap-interval", "5", "Seconds between two reaps of expired keys (0 disables)")
+	watchHistory := flag.String("watch-history", "10000", "Number of recent changes kept for watchers resuming from an earlier revision")
+	transport := flag.String("transport", "http", "Transport used to send writes to replicas: http or grpc")
+	respPort := flag.String("resp-port", "", "Port for Redis (RESP) clients (empty disables the RESP listener)")
+	replicationQueue := flag.String("replication-queue", "1000", "Maximum number of writes queued for each peer")
+	replicationBatch := flag.String("replication-batch", "100", "Maximum number of queued writes sent to a peer in one request")
+	replicationPolicy := flag.String("replication-policy", "block", "What a write does when a peer's queue is full: block, drop (leave it to anti-entropy) or fail")
 	flag.Parse()
 
 	if *port == "" {
@@ -42,10 +147,141 @@ func Load() *Config {
 		log.Fatalf("Invalid timeout value: %v", err)
 	}
 
+	interval, err := strconv.Atoi(*snapshotInterval)
+	if err != nil || interval < 0 {
+		log.Fatalf("Invalid snapshot interval: %s", *snapshotInterval)
+	}
+
+	threshold, err := strconv.Atoi(*snapshotThreshold)
+	if err != nil || threshold < 0 {
+		log.Fatalf("Invalid snapshot threshold: %s", *snapshotThreshold)
+	}
+
+	switch *engine {
+	case "memory":
+	case "lsm":
+		if *dataDir == "" {
+			log.Fatal("The lsm engine requires --data-dir")
+		}
+	default:
+		log.Fatalf("Unknown storage engine: %s", *engine)
+	}
+
+	if *self == "" {
+		*self = "http://localhost:" + *port
+	}
+
+	if *consistency != "eventual" && *consistency != "raft" {
+		log.Fatalf("Unknown consistency mode: %s", *consistency)
+	}
+
+	election, err := strconv.Atoi(*electionTimeout)
+	if err != nil || election <= 0 {
+		log.Fatalf("Invalid election timeout: %s", *electionTimeout)
+	}
+
+	n, err := strconv.Atoi(*replicas)
+	if err != nil || n < 0 {
+		log.Fatalf("Invalid replication factor: %s", *replicas)
+	}
+
+	w, err := strconv.Atoi(*writeQuorum)
+	if err != nil || w < 1 || (n > 0 && w > n) {
+		log.Fatalf("Invalid write quorum: %s", *writeQuorum)
+	}
+
+	r, err := strconv.Atoi(*readQuorum)
+	if err != nil || r < 1 || (n > 0 && r > n) {
+		log.Fatalf("Invalid read quorum: %s", *readQuorum)
+	}
+
+	v, err := strconv.Atoi(*vnodes)
+	if err != nil || v < 1 {
+		log.Fatalf("Invalid number of virtual nodes: %s", *vnodes)
+	}
+
+	antiEntropy, err := strconv.Atoi(*antiEntropyInterval)
+	if err != nil || antiEntropy < 0 {
+		log.Fatalf("Invalid anti-entropy interval: %s", *antiEntropyInterval)
+	}
+
+	ttl, err := strconv.Atoi(*hintTTL)
+	if err != nil || ttl < 0 {
+		log.Fatalf("Invalid hint TTL: %s", *hintTTL)
+	}
+
+	maxPerPeer, err := strconv.Atoi(*maxHints)
+	if err != nil || maxPerPeer < 0 {
+		log.Fatalf("Invalid maximum number of hints: %s", *maxHints)
+	}
+
+	grace, err := strconv.Atoi(*tombstoneGrace)
+	if err != nil || grace < 0 {
+		log.Fatalf("Invalid tombstone grace period: %s", *tombstoneGrace)
+	}
+
+	reap, err := strconv.Atoi(*reapInterval)
+	if err != nil || reap < 0 {
+		log.Fatalf("Invalid reap interval: %s", *reapInterval)
+	}
+
+	history, err := strconv.Atoi(*watchHistory)
+	if err != nil || history < 1 {
+		log.Fatalf("Invalid watch history: %s", *watchHistory)
+	}
+
+	if *transport != "http" && *transport != "grpc" {
+		log.Fatalf("Unknown transport: %s", *transport)
+	}
+
+	if *respPort != "" {
+		if p, err := strconv.Atoi(*respPort); err != nil || p < 1 || p > 65535 || *respPort == *port {
+			log.Fatalf("Invalid RESP port: %s", *respPort)
+		}
+	}
+
+	queue, err := strconv.Atoi(*replicationQueue)
+	if err != nil || queue < 1 {
+		log.Fatalf("Invalid replication queue size: %s", *replicationQueue)
+	}
+
+	batch, err := strconv.Atoi(*replicationBatch)
+	if err != nil || batch < 1 {
+		log.Fatalf("Invalid replication batch size: %s", *replicationBatch)
+	}
+
+	if *replicationPolicy != "block" && *replicationPolicy != "drop" && *replicationPolicy != "fail" {
+		log.Fatalf("Unknown replication policy: %s", *replicationPolicy)
+	}
+
 	return &Config{
-		Port:          *port,
-		Peers:         strings.Split(*peers, ","),
-		PingFrequency: ping,
-		Timeout:       time,
+		Port:                *port,
+		Peers:               strings.Split(*peers, ","),
+		PingFrequency:       ping,
+		Timeout:             time,
+		DataDir:             *dataDir,
+		SnapshotInterval:    interval,
+		SnapshotThreshold:   threshold,
+		Engine:              *engine,
+		Self:                *self,
+		Consistency:         *consistency,
+		RaftJoin:            *raftJoin,
+		ElectionTimeout:     election,
+		Replicas:            n,
+		WriteQuorum:         w,
+		ReadQuorum:          r,
+		VNodes:              v,
+		AntiEntropyInterval: antiEntropy,
+		HintTTL:             ttl,
+		MaxHints:            maxPerPeer,
+		ReadRepair:          *readRepair,
+		TombstoneGrace:      grace,
+		ReapInterval:        reap,
+		WatchHistory:        history,
+		Transport:           *transport,
+		RespPort:            *respPort,
+		ReplicationQueue:    queue,
+		ReplicationBatch:    batch,
+		ReplicationPolicy:   *replicationPolicy,
 	}
 }
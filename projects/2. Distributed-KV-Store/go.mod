@@ -1,3 +1,15 @@
 module github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store
 
 go 1.22.1
+
+require (
+	golang.org/x/net v0.34.0
+	google.golang.org/grpc v1.70.0
+	google.golang.org/protobuf v1.36.5
+)
+
+require (
+	golang.org/x/sys v0.29.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20241202173237-19429a94021a // indirect
+)
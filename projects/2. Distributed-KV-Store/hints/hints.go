@@ -0,0 +1,303 @@
+package hints
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/store"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/wal"
+)
+
+// ErrFull is returned by Add when a peer already has the maximum number
+// of pending hints.
+var ErrFull = errors.New("too many pending hints for peer")
+
+// Hint is a write that could not be delivered to a peer, kept until the
+// peer is reachable again.
+type Hint struct {
+	Item    store.Store `json:"item"`
+	Created int64       `json:"created"`
+}
+
+// Options configures where hints are kept and for how long.
+// With an empty Dir hints are kept in memory only. A hint older than TTL
+// is dropped instead of being delivered, and a peer never has more than
+// MaxPerPeer pending hints (0 means no limit).
+type Options struct {
+	Dir        string
+	TTL        time.Duration
+	MaxPerPeer int
+}
+
+// Stats describes the hints kept for one peer.
+type Stats struct {
+	Pending  int    `json:"pending"`
+	Stored   uint64 `json:"stored"`
+	Replayed uint64 `json:"replayed"`
+	Expired  uint64 `json:"expired"`
+	Dropped  uint64 `json:"dropped"`
+}
+
+// peerHints holds the pending hints of one peer, oldest first.
+// The hints are mirrored in a write-ahead log when a directory is configured.
+type peerHints struct {
+	hints     []Hint
+	log       *wal.Log
+	stats     Stats
+	replaying bool
+}
+
+// Hints keeps the writes each peer missed while it was unreachable.
+// It is safe for concurrent use.
+type Hints struct {
+	mu    sync.Mutex
+	opts  Options
+	peers map[string]*peerHints
+}
+
+// Open loads the hints left in opts.Dir by a previous run.
+func Open(opts Options) (*Hints, error) {
+	h := &Hints{
+		opts:  opts,
+		peers: make(map[string]*peerHints),
+	}
+	if opts.Dir == "" {
+		return h, nil
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(opts.Dir, "hints-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "hints-"), ".log")
+		peer, err := base64.RawURLEncoding.DecodeString(name)
+		if err != nil {
+			log.Printf("Ignoring hint file %s: %v", path, err)
+			continue
+		}
+
+		p, err := h.openPeer(string(peer))
+		if err != nil {
+			h.Close()
+			return nil, err
+		}
+		err = p.log.Replay(func(data []byte) error {
+			var hint Hint
+			if err := json.Unmarshal(data, &hint); err != nil {
+				return err
+			}
+			p.hints = append(p.hints, hint)
+			return nil
+		})
+		if err != nil {
+			h.Close()
+			return nil, fmt.Errorf("failed to load hints from %s: %w", path, err)
+		}
+		p.stats.Pending = len(p.hints)
+		if len(p.hints) > 0 {
+			log.Printf("Loaded %d hints for peer %s", len(p.hints), peer)
+		}
+	}
+	return h, nil
+}
+
+// path returns the file holding the hints of peer.
+func (h *Hints) path(peer string) string {
+	return filepath.Join(h.opts.Dir, "hints-"+base64.RawURLEncoding.EncodeToString([]byte(peer))+".log")
+}
+
+// openPeer returns the hints of peer, creating them if needed.
+// Called with mu held or before h is shared.
+func (h *Hints) openPeer(peer string) (*peerHints, error) {
+	if p, ok := h.peers[peer]; ok {
+		return p, nil
+	}
+
+	p := &peerHints{}
+	if h.opts.Dir != "" {
+		l, err := wal.Open(h.path(peer))
+		if err != nil {
+			return nil, err
+		}
+		p.log = l
+	}
+	h.peers[peer] = p
+	return p, nil
+}
+
+// Add stores a hint for a write peer missed.
+func (h *Hints) Add(peer string, item store.Store) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	p, err := h.openPeer(peer)
+	if err != nil {
+		return err
+	}
+
+	if h.opts.MaxPerPeer > 0 && len(p.hints) >= h.opts.MaxPerPeer && !p.replaying {
+		// make room by dropping hints that would not be delivered anyway
+		if err := h.rewrite(peer, p, h.unexpired(p, p.hints)); err != nil {
+			return err
+		}
+	}
+	if h.opts.MaxPerPeer > 0 && len(p.hints) >= h.opts.MaxPerPeer {
+		p.stats.Dropped++
+		return ErrFull
+	}
+
+	hint := Hint{Item: item, Created: time.Now().UnixNano()}
+	if p.log != nil {
+		data, err := json.Marshal(hint)
+		if err != nil {
+			return err
+		}
+		if err := p.log.Append(data); err != nil {
+			return err
+		}
+	}
+	p.hints = append(p.hints, hint)
+	p.stats.Stored++
+	p.stats.Pending = len(p.hints)
+	return nil
+}
+
+// Replay delivers the pending hints of peer with send, oldest first.
+// It stops at the first hint send fails to deliver and keeps that hint and
+// the ones after it for the next replay. Expired hints are dropped.
+// It returns the number of hints delivered.
+func (h *Hints) Replay(peer string, send func(store.Store) error) (int, error) {
+	h.mu.Lock()
+	p, ok := h.peers[peer]
+	if !ok || p.replaying || len(p.hints) == 0 {
+		h.mu.Unlock()
+		return 0, nil
+	}
+	p.replaying = true
+	pending := append([]Hint(nil), p.hints...)
+	h.mu.Unlock()
+
+	done := 0
+	delivered := 0
+	var sendErr error
+	for _, hint := range pending {
+		if !h.expired(hint) {
+			if sendErr = send(hint.Item); sendErr != nil {
+				break
+			}
+			delivered++
+		}
+		done++
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p.replaying = false
+
+	// hints added while replaying were appended after the pending ones
+	remaining := h.unexpired(p, p.hints[done:])
+	p.stats.Replayed += uint64(delivered)
+	p.stats.Expired += uint64(done - delivered)
+	if err := h.rewrite(peer, p, remaining); err != nil {
+		return delivered, err
+	}
+	return delivered, sendErr
+}
+
+// expired reports whether hint is older than the TTL.
+func (h *Hints) expired(hint Hint) bool {
+	return h.opts.TTL > 0 && time.Since(time.Unix(0, hint.Created)) > h.opts.TTL
+}
+
+// unexpired returns the hints that have not expired and counts the others.
+func (h *Hints) unexpired(p *peerHints, hints []Hint) []Hint {
+	kept := make([]Hint, 0, len(hints))
+	for _, hint := range hints {
+		if h.expired(hint) {
+			p.stats.Expired++
+			continue
+		}
+		kept = append(kept, hint)
+	}
+	return kept
+}
+
+// rewrite replaces the hints of peer with hints. The new log is written next
+// to the old one and renamed into place, so a crash keeps one of the two.
+// Called with mu held.
+func (h *Hints) rewrite(peer string, p *peerHints, hints []Hint) error {
+	p.hints = hints
+	p.stats.Pending = len(hints)
+	if p.log == nil {
+		return nil
+	}
+
+	path := h.path(peer)
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+
+	tmpLog, err := wal.Open(tmp)
+	if err != nil {
+		return err
+	}
+	for _, hint := range hints {
+		data, err := json.Marshal(hint)
+		if err != nil {
+			tmpLog.Close()
+			return err
+		}
+		if err := tmpLog.Append(data); err != nil {
+			tmpLog.Close()
+			return err
+		}
+	}
+	tmpLog.Close()
+
+	p.log.Close()
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	p.log, err = wal.Open(path)
+	return err
+}
+
+// Stats returns the hint statistics of every peer that has had hints.
+func (h *Hints) Stats() map[string]Stats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stats := make(map[string]Stats, len(h.peers))
+	for peer, p := range h.peers {
+		stats[peer] = p.stats
+	}
+	return stats
+}
+
+// Close closes the hint logs.
+func (h *Hints) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var firstErr error
+	for _, p := range h.peers {
+		if p.log == nil {
+			continue
+		}
+		if err := p.log.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
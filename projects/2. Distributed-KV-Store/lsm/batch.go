@@ -0,0 +1,124 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/store"
+)
+
+// Flags of the first byte of a batch record in the write-ahead log.
+// A record without flagBatch holds a single entry.
+const (
+	flagBatch   = 2
+	flagApplied = 4
+)
+
+// Batch is a group of writes that Write stores atomically: after a crash
+// either every write of the batch is in the tree or none is.
+type Batch struct {
+	entries    []entry
+	applied    uint64
+	setApplied bool
+}
+
+// Put adds a write of item to the batch.
+func (b *Batch) Put(item store.Store) error {
+	value, err := json.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("failed to encode value: %w", err)
+	}
+	b.entries = append(b.entries, entry{key: item.Key, value: value})
+	return nil
+}
+
+// Delete adds a tombstone for key to the batch.
+func (b *Batch) Delete(key string) {
+	b.entries = append(b.entries, entry{key: key, deleted: true})
+}
+
+// SetApplied records index with the batch, to be returned by Applied once
+// the batch is written. It is how far the caller's own log has been applied
+// to the tree; 0 says the tree does not match any position of it.
+func (b *Batch) SetApplied(index uint64) {
+	b.applied = index
+	b.setApplied = true
+}
+
+// encode encodes b as one record: [flags][applied][entries...].
+func (b *Batch) encode() []byte {
+	flags := byte(flagBatch)
+	if b.setApplied {
+		flags |= flagApplied
+	}
+	data := []byte{flags}
+	if b.setApplied {
+		data = binary.AppendUvarint(data, b.applied)
+	}
+	for _, e := range b.entries {
+		data = appendEntry(data, e)
+	}
+	return data
+}
+
+// decodeRecord calls fn for every entry of a record of the write-ahead log,
+// and returns the applied index the record carries, if any.
+func decodeRecord(data []byte, fn func(entry)) (applied uint64, ok bool, err error) {
+	if len(data) == 0 || data[0]&flagBatch == 0 {
+		e, _, err := decodeEntry(data)
+		if err != nil {
+			return 0, false, err
+		}
+		fn(e)
+		return 0, false, nil
+	}
+
+	pos := 1
+	if data[0]&flagApplied != 0 {
+		var n int
+		applied, n = binary.Uvarint(data[pos:])
+		if n <= 0 {
+			return 0, false, errCorruptEntry
+		}
+		pos += n
+		ok = true
+	}
+	for pos < len(data) {
+		e, n, err := decodeEntry(data[pos:])
+		if err != nil {
+			return 0, false, err
+		}
+		fn(e)
+		pos += n
+	}
+	return applied, ok, nil
+}
+
+// Write stores every write of b atomically, together with its applied index.
+func (db *DB) Write(b *Batch) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.makeRoomForWrite(); err != nil {
+		return err
+	}
+	if err := db.log.Append(b.encode()); err != nil {
+		return err
+	}
+	for _, e := range b.entries {
+		db.mem.put(e)
+	}
+	if b.setApplied {
+		db.mem.applied = b.applied
+	}
+	return nil
+}
+
+// Applied returns the index recorded by the latest batch written with
+// SetApplied, in this run or an earlier one, or 0 if there is none.
+func (db *DB) Applied() uint64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.mem.applied
+}
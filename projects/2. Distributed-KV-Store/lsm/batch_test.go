@@ -0,0 +1,63 @@
+package lsm
+
+import (
+	"testing"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/store"
+)
+
+func TestBatchRecordsAppliedIndex(t *testing.T) {
+	dir := t.TempDir()
+	db := openDB(t, dir)
+	put(t, db, "gone", "soon")
+
+	var b Batch
+	if err := b.Put(store.Store{Key: "a", Value: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(store.Store{Key: "b", Value: "2"}); err != nil {
+		t.Fatal(err)
+	}
+	b.Delete("gone")
+	b.SetApplied(7)
+	if err := db.Write(&b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	want := map[string]string{"a": "1", "b": "2"}
+	checkContents(t, db, want)
+	if got := db.Applied(); got != 7 {
+		t.Fatalf("Applied is %d, want 7", got)
+	}
+
+	// from the write-ahead log
+	db.Close()
+	db = openDB(t, dir)
+	checkContents(t, db, want)
+	if got := db.Applied(); got != 7 {
+		t.Fatalf("Applied is %d after reopening, want 7", got)
+	}
+
+	// from the manifest, once the batch is flushed and more writes follow
+	for key, value := range fill(t, db, "c", 100) {
+		want[key] = value
+	}
+	waitIdle(t, db)
+	db.Close()
+	db = openDB(t, dir)
+	checkContents(t, db, want)
+	if got := db.Applied(); got != 7 {
+		t.Fatalf("Applied is %d after a flush, want 7", got)
+	}
+
+	// an applied index of 0 clears it
+	var reset Batch
+	reset.SetApplied(0)
+	if err := db.Write(&reset); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	db = openDB(t, dir)
+	if got := db.Applied(); got != 0 {
+		t.Fatalf("Applied is %d after it was cleared, want 0", got)
+	}
+}
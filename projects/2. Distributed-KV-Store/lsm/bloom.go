@@ -0,0 +1,72 @@
+package lsm
+
+import "hash/fnv"
+
+// bitsPerKey gives a false positive rate of roughly 1%.
+const bitsPerKey = 10
+
+// bloom is a bloom filter over the keys of one SSTable.
+// It lets Get skip tables that certainly do not contain a key
+// without reading any of their data blocks.
+type bloom struct {
+	bits []byte
+	k    uint8
+}
+
+// newBloom builds a filter holding the given key hashes.
+func newBloom(hashes []uint64) *bloom {
+	nbits := len(hashes) * bitsPerKey
+	if nbits < 64 {
+		nbits = 64
+	}
+	b := &bloom{
+		bits: make([]byte, (nbits+7)/8),
+		k:    7, // about bitsPerKey * ln(2)
+	}
+
+	m := uint64(len(b.bits) * 8)
+	for _, h := range hashes {
+		h1, h2 := h, h>>33|h<<31
+		for i := uint64(0); i < uint64(b.k); i++ {
+			pos := (h1 + i*h2) % m
+			b.bits[pos/8] |= 1 << (pos % 8)
+		}
+	}
+	return b
+}
+
+// mayContain reports whether the key with hash h may be in the table.
+// A false result is definite; a true result may be a false positive.
+func (b *bloom) mayContain(h uint64) bool {
+	m := uint64(len(b.bits) * 8)
+	if m == 0 {
+		return true
+	}
+
+	h1, h2 := h, h>>33|h<<31
+	for i := uint64(0); i < uint64(b.k); i++ {
+		pos := (h1 + i*h2) % m
+		if b.bits[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// encode returns the filter as [k][bits...].
+func (b *bloom) encode() []byte {
+	return append([]byte{b.k}, b.bits...)
+}
+
+func decodeBloom(data []byte) *bloom {
+	if len(data) == 0 {
+		return &bloom{}
+	}
+	return &bloom{k: data[0], bits: data[1:]}
+}
+
+func bloomHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
@@ -0,0 +1,275 @@
+package lsm
+
+import (
+	"log"
+	"os"
+)
+
+// schedule wakes up the background goroutine without blocking.
+func (db *DB) schedule() {
+	select {
+	case db.work <- struct{}{}:
+	default:
+	}
+}
+
+// backgroundWork flushes immutable memtables and runs compactions
+// until the database is closed.
+func (db *DB) backgroundWork() {
+	defer db.wg.Done()
+
+	for {
+		select {
+		case <-db.done:
+			return
+		case <-db.work:
+		}
+
+		err := db.flushImmutable()
+		for err == nil {
+			c := db.pickCompaction()
+			if c == nil {
+				break
+			}
+			err = db.runCompaction(c)
+		}
+
+		db.mu.Lock()
+		if err != nil {
+			log.Printf("LSM background work failed: %v", err)
+			db.bgErr = err
+		}
+		db.cond.Broadcast()
+		db.mu.Unlock()
+	}
+}
+
+// flushImmutable writes the immutable memtable to a new L0 table
+// and removes the write-ahead log that backed it.
+func (db *DB) flushImmutable() error {
+	db.mu.RLock()
+	imm, logNum := db.imm, db.immLogNum
+	db.mu.RUnlock()
+	if imm == nil {
+		return nil
+	}
+
+	t, err := db.writeTable(newSliceIterator(imm.sorted()))
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	old := db.current
+	db.current = newVersion(old.edit(nil, 0, []*table{t}))
+	if err := writeManifest(db.dir, db.current, db.nextFile, imm.applied); err != nil {
+		db.discardVersion(old)
+		db.mu.Unlock()
+		return err
+	}
+	db.applied = imm.applied
+	db.imm = nil
+	db.cond.Broadcast()
+	db.mu.Unlock()
+	old.unref()
+
+	return os.Remove(walPath(db.dir, logNum))
+}
+
+// compaction merges inputs from level into level+1.
+type compaction struct {
+	level  int
+	inputs []*table // tables from level, newest first for L0
+	lower  []*table // overlapping tables from level+1
+	v      *version
+}
+
+// pickCompaction chooses the next compaction, or returns nil if the
+// tree is in shape. L0 is compacted once it has too many tables; any
+// other level once it grows beyond its size budget. For those levels a
+// single table is picked, rotating through the key space.
+func (db *DB) pickCompaction() *compaction {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	v := db.current
+	c := &compaction{level: -1}
+
+	if len(v.levels[0]) >= db.opts.L0CompactionTrigger {
+		c.level = 0
+		for i := len(v.levels[0]) - 1; i >= 0; i-- {
+			c.inputs = append(c.inputs, v.levels[0][i])
+		}
+	} else {
+		maxBytes := db.opts.L1MaxBytes
+		for level := 1; level < numLevels-1; level++ {
+			if v.levelSize(level) > maxBytes {
+				c.level = level
+				c.inputs = []*table{db.nextTableToCompact(v, level)}
+				break
+			}
+			maxBytes *= db.opts.LevelMultiplier
+		}
+	}
+	if c.level < 0 {
+		return nil
+	}
+
+	smallest, largest := keyRange(c.inputs)
+	c.lower = v.overlapping(c.level+1, smallest, largest)
+	c.v = v
+	v.ref()
+	return c
+}
+
+// nextTableToCompact returns the first table of level after the
+// level's compaction pointer, wrapping around to the first table.
+func (db *DB) nextTableToCompact(v *version, level int) *table {
+	for _, t := range v.levels[level] {
+		if t.meta.Smallest > db.pointers[level] {
+			return t
+		}
+	}
+	return v.levels[level][0]
+}
+
+// runCompaction merges the inputs of c into new tables in level+1
+// and installs them in a new version.
+func (db *DB) runCompaction(c *compaction) error {
+	defer c.v.unref()
+
+	var iters []iterator
+	for _, t := range c.inputs {
+		iters = append(iters, t.iterator())
+	}
+	for _, t := range c.lower {
+		iters = append(iters, t.iterator())
+	}
+	it := newMergingIterator(iters)
+
+	// tombstones only have to be kept while older data may exist below
+	outputLevel := c.level + 1
+	dropTombstones := true
+	for level := outputLevel + 1; level < numLevels; level++ {
+		if len(c.v.levels[level]) > 0 {
+			dropTombstones = false
+			break
+		}
+	}
+
+	var outputs []*table
+	var tw *tableWriter
+	abort := func() {
+		if tw != nil {
+			tw.abort()
+		}
+		for _, t := range outputs {
+			t.close()
+			os.Remove(t.path)
+		}
+	}
+	finish := func() error {
+		meta, err := tw.finish()
+		if err != nil {
+			os.Remove(tw.file.Name())
+			tw = nil
+			return err
+		}
+		t, err := openTable(tw.file.Name(), meta)
+		tw = nil
+		if err != nil {
+			return err
+		}
+		outputs = append(outputs, t)
+		return nil
+	}
+
+	for it.next() {
+		e := it.entry()
+		if e.deleted && dropTombstones {
+			continue
+		}
+
+		if tw == nil {
+			db.mu.Lock()
+			num := db.newFileNum()
+			db.mu.Unlock()
+
+			var err error
+			if tw, err = newTableWriter(tablePath(db.dir, num), num); err != nil {
+				abort()
+				return err
+			}
+		}
+		if err := tw.add(e); err != nil {
+			abort()
+			return err
+		}
+		if int64(tw.estimatedSize()) >= db.opts.TargetFileSize {
+			if err := finish(); err != nil {
+				abort()
+				return err
+			}
+		}
+	}
+	if err := it.error(); err != nil {
+		abort()
+		return err
+	}
+	if tw != nil {
+		if err := finish(); err != nil {
+			abort()
+			return err
+		}
+	}
+
+	removed := make(map[uint64]bool)
+	for _, t := range append(c.inputs, c.lower...) {
+		removed[t.meta.Num] = true
+	}
+
+	db.mu.Lock()
+	old := db.current
+	db.current = newVersion(old.edit(removed, outputLevel, outputs))
+	if err := writeManifest(db.dir, db.current, db.nextFile, db.applied); err != nil {
+		for _, t := range outputs {
+			t.obsolete.Store(true)
+		}
+		db.discardVersion(old)
+		db.mu.Unlock()
+		return err
+	}
+	if c.level > 0 {
+		_, db.pointers[c.level] = keyRange(c.inputs)
+	}
+	for _, t := range append(c.inputs, c.lower...) {
+		t.obsolete.Store(true)
+	}
+	db.mu.Unlock()
+	old.unref()
+
+	log.Printf("LSM compacted %d+%d tables from L%d into %d tables in L%d",
+		len(c.inputs), len(c.lower), c.level, len(outputs), outputLevel)
+	return nil
+}
+
+// discardVersion drops a version that could not be recorded in the
+// manifest and goes back to old. Called with mu held.
+func (db *DB) discardVersion(old *version) {
+	db.current.unref()
+	db.current = old
+}
+
+// keyRange returns the smallest and largest key covered by tables.
+func keyRange(tables []*table) (string, string) {
+	smallest, largest := tables[0].meta.Smallest, tables[0].meta.Largest
+	for _, t := range tables[1:] {
+		if t.meta.Smallest < smallest {
+			smallest = t.meta.Smallest
+		}
+		if t.meta.Largest > largest {
+			largest = t.meta.Largest
+		}
+	}
+	return smallest, largest
+}
@@ -0,0 +1,533 @@
+package lsm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/store"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/wal"
+)
+
+// Options tunes the LSM tree.
+type Options struct {
+	// MemtableSize is the approximate number of bytes buffered in memory
+	// before the memtable is flushed to an L0 table.
+	MemtableSize int
+
+	// L0CompactionTrigger is the number of L0 tables that starts a compaction
+	// into L1, and L0StopTrigger the number at which writes wait for it.
+	L0CompactionTrigger int
+	L0StopTrigger       int
+
+	// L1MaxBytes is the target size of L1; every further level is
+	// LevelMultiplier times larger than the previous one.
+	L1MaxBytes      int64
+	LevelMultiplier int64
+
+	// TargetFileSize is the size at which compaction output is split
+	// into a new table.
+	TargetFileSize int64
+}
+
+// DefaultOptions returns the options used by the node.
+func DefaultOptions() Options {
+	return Options{
+		MemtableSize:        4 << 20,
+		L0CompactionTrigger: 4,
+		L0StopTrigger:       12,
+		L1MaxBytes:          10 << 20,
+		LevelMultiplier:     10,
+		TargetFileSize:      2 << 20,
+	}
+}
+
+var errClosed = errors.New("lsm: database is closed")
+
+// DB is a log-structured merge-tree implementing store.Engine.
+// Writes go to a write-ahead log and an in-memory memtable; full memtables
+// are flushed to immutable, sorted SSTable files in L0, and a background
+// goroutine merges tables down the levels (leveled compaction), so the data
+// set can be much larger than the available memory.
+type DB struct {
+	dir  string
+	opts Options
+
+	// mu guards every field below. cond is signalled whenever background
+	// work finishes, to wake up writers waiting for room in the memtable.
+	mu        sync.RWMutex
+	cond      *sync.Cond
+	mem       *memtable
+	imm       *memtable // memtable being flushed, or nil
+	log       *wal.Log
+	logNum    uint64
+	immLogNum uint64
+	current   *version
+	nextFile  uint64
+	applied   uint64            // applied index of the tables, as in the manifest
+	pointers  [numLevels]string // where the next compaction of each level starts
+	bgErr     error
+	closed    bool
+
+	work chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Open opens (or creates) the LSM tree stored in dir.
+// Any write-ahead logs left by a previous run are replayed and flushed to L0.
+func Open(dir string, opts Options) (*DB, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	m, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &DB{
+		dir:      dir,
+		opts:     opts,
+		nextFile: m.NextFile,
+		applied:  m.Applied,
+		work:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	db.cond = sync.NewCond(&db.mu)
+
+	var levels [numLevels][]*table
+	live := make(map[string]bool)
+	for level, metas := range m.Levels {
+		for _, meta := range metas {
+			path := tablePath(dir, meta.Num)
+			t, err := openTable(path, meta)
+			if err != nil {
+				return nil, err
+			}
+			levels[level] = append(levels[level], t)
+			live[filepath.Base(path)] = true
+		}
+	}
+	db.current = newVersion(levels)
+
+	if err := db.removeOrphans(live); err != nil {
+		return nil, err
+	}
+	if err := db.recoverLogs(); err != nil {
+		return nil, err
+	}
+	db.mem = newMemtable(db.applied)
+
+	db.logNum = db.newFileNum()
+	if db.log, err = wal.Open(walPath(dir, db.logNum)); err != nil {
+		return nil, err
+	}
+	// persist nextFile so the new log number is never reused
+	if err := writeManifest(dir, db.current, db.nextFile, db.applied); err != nil {
+		return nil, err
+	}
+
+	db.wg.Add(1)
+	go db.backgroundWork()
+	db.schedule()
+
+	return db, nil
+}
+
+// removeOrphans deletes tables that are not in the manifest, which are
+// left behind when the process dies in the middle of a flush or compaction.
+func (db *DB) removeOrphans(live map[string]bool) error {
+	entries, err := os.ReadDir(db.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, ".sst") && !live[name] {
+			log.Printf("Removing orphaned sstable %s", name)
+			if err := os.Remove(filepath.Join(db.dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// recoverLogs replays the write-ahead logs of the previous run into a
+// memtable, flushes it to L0 and removes the logs.
+func (db *DB) recoverLogs() error {
+	paths, err := filepath.Glob(filepath.Join(db.dir, "wal-*.log"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths) // zero-padded numbers, so lexical order is log order
+
+	mem := newMemtable(db.applied)
+	for _, path := range paths {
+		walLog, err := wal.Open(path)
+		if err != nil {
+			return err
+		}
+		err = walLog.Replay(func(data []byte) error {
+			applied, ok, err := decodeRecord(data, mem.put)
+			if ok {
+				mem.applied = applied
+			}
+			return err
+		})
+		walLog.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(mem.entries) > 0 {
+		t, err := db.writeTable(newSliceIterator(mem.sorted()))
+		if err != nil {
+			return err
+		}
+		old := db.current
+		db.current = newVersion(old.edit(nil, 0, []*table{t}))
+		old.unref()
+		log.Printf("Recovered %d entries from the write-ahead log into table %06d", len(mem.entries), t.meta.Num)
+	}
+	if len(mem.entries) > 0 || mem.applied != db.applied {
+		db.applied = mem.applied
+		if err := writeManifest(db.dir, db.current, db.nextFile, db.applied); err != nil {
+			return err
+		}
+	}
+
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get returns the key-value pair stored under key.
+func (db *DB) Get(key string) (store.Store, bool) {
+	e, ok, err := db.get(key)
+	if err != nil {
+		log.Printf("LSM lookup of key %q failed: %v", key, err)
+		return store.Store{}, false
+	}
+	if !ok || e.deleted {
+		return store.Store{}, false
+	}
+
+	item, err := decodeItem(e)
+	if err != nil {
+		log.Printf("LSM lookup of key %q failed: %v", key, err)
+		return store.Store{}, false
+	}
+	return item, true
+}
+
+// get finds the newest entry for key, searching the memtables first
+// and then the levels from top to bottom.
+func (db *DB) get(key string) (entry, bool, error) {
+	db.mu.RLock()
+	if e, ok := db.mem.get(key); ok {
+		db.mu.RUnlock()
+		return e, true, nil
+	}
+	if db.imm != nil {
+		if e, ok := db.imm.get(key); ok {
+			db.mu.RUnlock()
+			return e, true, nil
+		}
+	}
+	v := db.current
+	v.ref()
+	db.mu.RUnlock()
+	defer v.unref()
+
+	// L0 tables overlap, so check all of them, newest first
+	for i := len(v.levels[0]) - 1; i >= 0; i-- {
+		if e, ok, err := v.levels[0][i].get(key); err != nil || ok {
+			return e, ok, err
+		}
+	}
+
+	// deeper levels hold at most one table that can contain the key
+	for level := 1; level < numLevels; level++ {
+		tables := v.levels[level]
+		i := sort.Search(len(tables), func(i int) bool {
+			return tables[i].meta.Largest >= key
+		})
+		if i == len(tables) {
+			continue
+		}
+		if e, ok, err := tables[i].get(key); err != nil || ok {
+			return e, ok, err
+		}
+	}
+	return entry{}, false, nil
+}
+
+// Put stores the key-value pair.
+func (db *DB) Put(item store.Store) error {
+	value, err := json.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("failed to encode value: %w", err)
+	}
+	return db.write(entry{key: item.Key, value: value})
+}
+
+// Delete writes a tombstone for key. The key and its tombstone are
+// removed from disk when compaction reaches the bottom of the tree.
+func (db *DB) Delete(key string) error {
+	return db.write(entry{key: key, deleted: true})
+}
+
+func (db *DB) write(e entry) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.makeRoomForWrite(); err != nil {
+		return err
+	}
+	if err := db.log.Append(appendEntry(nil, e)); err != nil {
+		return err
+	}
+	db.mem.put(e)
+	return nil
+}
+
+// makeRoomForWrite makes sure the memtable can take another write.
+// A full memtable is handed to the background goroutine for flushing;
+// if a flush is still running, or L0 has too many tables, the writer
+// waits until the background work catches up. Called with mu held.
+func (db *DB) makeRoomForWrite() error {
+	for {
+		switch {
+		case db.closed:
+			return errClosed
+		case db.bgErr != nil:
+			return db.bgErr
+		case len(db.current.levels[0]) >= db.opts.L0StopTrigger:
+			db.schedule()
+			db.cond.Wait()
+		case db.mem.size < db.opts.MemtableSize:
+			return nil
+		case db.imm != nil:
+			db.cond.Wait()
+		default:
+			num := db.newFileNum()
+			newLog, err := wal.Open(walPath(db.dir, num))
+			if err != nil {
+				return err
+			}
+			db.log.Close()
+
+			db.imm, db.immLogNum = db.mem, db.logNum
+			db.mem, db.log, db.logNum = newMemtable(db.imm.applied), newLog, num
+			db.schedule()
+			return nil
+		}
+	}
+}
+
+// Scan calls fn for every key-value pair in key order until fn returns false.
+func (db *DB) Scan(fn func(store.Store) bool) {
+	db.Range("", fn)
+}
+
+// Range calls fn, in key order, for every key-value pair whose key is at
+// least start, until fn returns false. Tables and blocks that end before
+// start are skipped without being read.
+func (db *DB) Range(start string, fn func(store.Store) bool) {
+	it, release := db.newIterator(start)
+	defer release()
+
+	for it.next() {
+		e := it.entry()
+		if e.deleted {
+			continue
+		}
+		item, err := decodeItem(e)
+		if err != nil {
+			log.Printf("LSM scan skipped key %q: %v", e.key, err)
+			continue
+		}
+		if !fn(item) {
+			return
+		}
+	}
+	if err := it.error(); err != nil {
+		log.Printf("LSM scan failed: %v", err)
+	}
+}
+
+// newIterator returns an iterator over the keys of the tree that are at
+// least start, tombstones included.
+// release must be called once the iterator is no longer used.
+func (db *DB) newIterator(start string) (iterator, func()) {
+	db.mu.RLock()
+	iters := []iterator{newSliceIterator(seekEntries(db.mem.sorted(), start))}
+	if db.imm != nil {
+		iters = append(iters, newSliceIterator(seekEntries(db.imm.sorted(), start)))
+	}
+	v := db.current
+	v.ref()
+	db.mu.RUnlock()
+
+	for i := len(v.levels[0]) - 1; i >= 0; i-- {
+		if t := v.levels[0][i]; t.meta.Largest >= start {
+			iters = append(iters, t.iteratorFrom(start))
+		}
+	}
+	for level := 1; level < numLevels; level++ {
+		for _, t := range v.levels[level] {
+			if t.meta.Largest >= start {
+				iters = append(iters, t.iteratorFrom(start))
+			}
+		}
+	}
+	return newMergingIterator(iters), v.unref
+}
+
+// Snapshot returns every key-value pair, sorted by key. It holds the whole
+// data set in memory, so callers that only walk the keys should use Range.
+func (db *DB) Snapshot() []store.Store {
+	var items []store.Store
+	db.Scan(func(item store.Store) bool {
+		items = append(items, item)
+		return true
+	})
+	return items
+}
+
+// Len returns an estimate of the number of live keys, taken from the
+// memtables and the table metadata without reading any table: every entry
+// counts as a key and every tombstone as one key less. A key written again
+// since its tables were last compacted together is counted more than once,
+// and a tombstone of a key that was never stored counts one key too few.
+func (db *DB) Len() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	count := len(db.mem.entries) - 2*db.mem.tombstones
+	if db.imm != nil {
+		count += len(db.imm.entries) - 2*db.imm.tombstones
+	}
+	for _, tables := range db.current.levels {
+		for _, t := range tables {
+			count += t.meta.Entries - 2*t.meta.Tombstones
+		}
+	}
+	return max(count, 0)
+}
+
+// Stats describes the shape of the tree.
+type Stats struct {
+	MemtableBytes int     `json:"memtable_bytes"`
+	Flushing      bool    `json:"flushing"`
+	LevelTables   []int   `json:"level_tables"`
+	LevelBytes    []int64 `json:"level_bytes"`
+	Error         string  `json:"error,omitempty"`
+}
+
+// Stats returns the current table counts and sizes of every level.
+func (db *DB) Stats() Stats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	stats := Stats{
+		MemtableBytes: db.mem.size,
+		Flushing:      db.imm != nil,
+		LevelTables:   make([]int, numLevels),
+		LevelBytes:    make([]int64, numLevels),
+	}
+	for level := range db.current.levels {
+		stats.LevelTables[level] = len(db.current.levels[level])
+		stats.LevelBytes[level] = db.current.levelSize(level)
+	}
+	if db.bgErr != nil {
+		stats.Error = db.bgErr.Error()
+	}
+	return stats
+}
+
+// Close stops background work and closes every file.
+// Data in the memtable stays in the write-ahead log and is
+// recovered by the next Open.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return nil
+	}
+	db.closed = true
+	db.cond.Broadcast()
+	db.mu.Unlock()
+
+	close(db.done)
+	db.wg.Wait()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	err := db.log.Close()
+	for _, tables := range db.current.levels {
+		for _, t := range tables {
+			t.close()
+		}
+	}
+	return err
+}
+
+// newFileNum allocates a number for a new table or log file. Called with mu
+// held, or before the background goroutine is started.
+func (db *DB) newFileNum() uint64 {
+	num := db.nextFile
+	db.nextFile++
+	return num
+}
+
+// writeTable writes the entries of it to a single new table.
+func (db *DB) writeTable(it iterator) (*table, error) {
+	db.mu.Lock()
+	num := db.newFileNum()
+	db.mu.Unlock()
+
+	path := tablePath(db.dir, num)
+	tw, err := newTableWriter(path, num)
+	if err != nil {
+		return nil, err
+	}
+	for it.next() {
+		if err := tw.add(it.entry()); err != nil {
+			tw.abort()
+			return nil, err
+		}
+	}
+	if err := it.error(); err != nil {
+		tw.abort()
+		return nil, err
+	}
+
+	meta, err := tw.finish()
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return openTable(path, meta)
+}
+
+func decodeItem(e entry) (store.Store, error) {
+	var item store.Store
+	if err := json.Unmarshal(e.value, &item); err != nil {
+		return store.Store{}, fmt.Errorf("failed to decode value: %w", err)
+	}
+	return item, nil
+}
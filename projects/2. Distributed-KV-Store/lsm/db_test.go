@@ -0,0 +1,196 @@
+package lsm
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/store"
+)
+
+// testOptions makes the tree flush and compact after a few kilobytes, so
+// small tests go through every level of it.
+func testOptions() Options {
+	return Options{
+		MemtableSize:        1 << 10,
+		L0CompactionTrigger: 2,
+		L0StopTrigger:       8,
+		L1MaxBytes:          4 << 10,
+		LevelMultiplier:     2,
+		TargetFileSize:      2 << 10,
+	}
+}
+
+// openDB opens the tree in dir with the test options and closes it when
+// the test ends.
+func openDB(t *testing.T, dir string) *DB {
+	t.Helper()
+
+	db, err := Open(dir, testOptions())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// put stores key with value in db.
+func put(t *testing.T, db *DB, key, value string) {
+	t.Helper()
+
+	if err := db.Put(store.Store{Key: key, Value: value}); err != nil {
+		t.Fatalf("Put %s failed: %v", key, err)
+	}
+}
+
+// waitIdle waits until db has flushed its memtables and finished compacting.
+func waitIdle(t *testing.T, db *DB) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		stats := db.Stats()
+		if stats.Error != "" {
+			t.Fatalf("background work failed: %s", stats.Error)
+		}
+		if !stats.Flushing && stats.LevelTables[0] < db.opts.L0CompactionTrigger {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("background work did not finish")
+}
+
+// checkContents fails the test unless db holds exactly want, both for
+// lookups and for a scan in key order.
+func checkContents(t *testing.T, db *DB, want map[string]string) {
+	t.Helper()
+
+	for key, value := range want {
+		item, ok := db.Get(key)
+		if !ok {
+			t.Fatalf("key %s is missing", key)
+		}
+		if item.Value != value {
+			t.Fatalf("key %s has value %v, want %s", key, item.Value, value)
+		}
+	}
+
+	count, last := 0, ""
+	db.Scan(func(item store.Store) bool {
+		if count > 0 && item.Key <= last {
+			t.Fatalf("scan returned %s after %s", item.Key, last)
+		}
+		if value, ok := want[item.Key]; !ok || item.Value != value {
+			t.Fatalf("scan returned %s = %v, want %q (present: %t)", item.Key, item.Value, value, ok)
+		}
+		count, last = count+1, item.Key
+		return true
+	})
+	if count != len(want) {
+		t.Fatalf("scan returned %d keys, want %d", count, len(want))
+	}
+}
+
+// fill writes n keys with the given prefix and returns their values.
+func fill(t *testing.T, db *DB, prefix string, n int) map[string]string {
+	t.Helper()
+
+	written := make(map[string]string)
+	for i := range n {
+		key := fmt.Sprintf("%s%04d", prefix, i)
+		value := key + strings.Repeat("x", 40)
+		put(t, db, key, value)
+		written[key] = value
+	}
+	return written
+}
+
+func TestPutGetDeleteAcrossFlushAndCompaction(t *testing.T) {
+	db := openDB(t, t.TempDir())
+
+	want := fill(t, db, "key", 500)
+	for i := 0; i < 500; i += 3 {
+		key := fmt.Sprintf("key%04d", i)
+		put(t, db, key, "new")
+		want[key] = "new"
+	}
+	for i := 0; i < 500; i += 5 {
+		key := fmt.Sprintf("key%04d", i)
+		if err := db.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+		delete(want, key)
+	}
+	waitIdle(t, db)
+
+	deeper := 0
+	for _, tables := range db.Stats().LevelTables[1:] {
+		deeper += tables
+	}
+	if deeper == 0 {
+		t.Fatal("no table was compacted below L0")
+	}
+	checkContents(t, db, want)
+
+	if _, ok := db.Get("missing"); ok {
+		t.Fatal("Get found a key that was never written")
+	}
+}
+
+func TestTombstoneShadowsOlderTables(t *testing.T) {
+	dir := t.TempDir()
+	db := openDB(t, dir)
+
+	put(t, db, "victim", "alive")
+	want := fill(t, db, "a", 100)
+	waitIdle(t, db)
+
+	// the value is in a table now, and the tombstone in the memtable
+	if err := db.Delete("victim"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.Get("victim"); ok {
+		t.Fatal("deleted key is still found")
+	}
+	checkContents(t, db, want)
+
+	// and once the tombstone is flushed and compacted too
+	for key, value := range fill(t, db, "b", 100) {
+		want[key] = value
+	}
+	waitIdle(t, db)
+	if _, ok := db.Get("victim"); ok {
+		t.Fatal("deleted key is found again after compaction")
+	}
+	checkContents(t, db, want)
+
+	db.Close()
+	db = openDB(t, dir)
+	if _, ok := db.Get("victim"); ok {
+		t.Fatal("deleted key is found again after reopening")
+	}
+	checkContents(t, db, want)
+}
+
+func TestReopenKeepsTablesAndLog(t *testing.T) {
+	dir := t.TempDir()
+	db := openDB(t, dir)
+
+	want := fill(t, db, "table", 200)
+	waitIdle(t, db)
+	// a few writes that stay in the memtable and its write-ahead log
+	put(t, db, "table0001", "changed")
+	want["table0001"] = "changed"
+	put(t, db, "zlast", "only in the log")
+	want["zlast"] = "only in the log"
+	if err := db.Delete("table0002"); err != nil {
+		t.Fatal(err)
+	}
+	delete(want, "table0002")
+
+	db.Close()
+	db = openDB(t, dir)
+	checkContents(t, db, want)
+}
@@ -0,0 +1,68 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// flagDeleted marks an entry as a tombstone.
+const flagDeleted = 1
+
+var errCorruptEntry = errors.New("corrupt entry")
+
+// entry is a single key as stored in the memtable, the log and SSTables.
+// The value holds the JSON-encoded store.Store; tombstones have no value.
+type entry struct {
+	key     string
+	deleted bool
+	value   []byte
+}
+
+// size is the approximate memory footprint of the entry.
+func (e entry) size() int {
+	return len(e.key) + len(e.value) + 16
+}
+
+// appendEntry encodes e as [flags][key length][key][value length][value].
+func appendEntry(dst []byte, e entry) []byte {
+	var flags byte
+	if e.deleted {
+		flags |= flagDeleted
+	}
+	dst = append(dst, flags)
+	dst = binary.AppendUvarint(dst, uint64(len(e.key)))
+	dst = append(dst, e.key...)
+	dst = binary.AppendUvarint(dst, uint64(len(e.value)))
+	dst = append(dst, e.value...)
+	return dst
+}
+
+// decodeEntry decodes one entry from the front of data
+// and returns it together with the number of bytes consumed.
+func decodeEntry(data []byte) (entry, int, error) {
+	if len(data) < 1 {
+		return entry{}, 0, errCorruptEntry
+	}
+	e := entry{deleted: data[0]&flagDeleted != 0}
+	pos := 1
+
+	keyLen, n := binary.Uvarint(data[pos:])
+	if n <= 0 || uint64(len(data)-pos-n) < keyLen {
+		return entry{}, 0, errCorruptEntry
+	}
+	pos += n
+	e.key = string(data[pos : pos+int(keyLen)])
+	pos += int(keyLen)
+
+	valueLen, n := binary.Uvarint(data[pos:])
+	if n <= 0 || uint64(len(data)-pos-n) < valueLen {
+		return entry{}, 0, errCorruptEntry
+	}
+	pos += n
+	if valueLen > 0 {
+		e.value = append([]byte(nil), data[pos:pos+int(valueLen)]...)
+	}
+	pos += int(valueLen)
+
+	return e, pos, nil
+}
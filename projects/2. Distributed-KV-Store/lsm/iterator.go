@@ -0,0 +1,128 @@
+package lsm
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// iterator yields entries in increasing key order.
+type iterator interface {
+	next() bool
+	entry() entry
+	error() error
+}
+
+// sliceIterator iterates over entries that are already sorted in memory.
+type sliceIterator struct {
+	entries []entry
+	pos     int
+}
+
+func newSliceIterator(entries []entry) *sliceIterator {
+	return &sliceIterator{entries: entries, pos: -1}
+}
+
+// seekEntries returns the entries, sorted by key, whose key is at least start.
+func seekEntries(entries []entry, start string) []entry {
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].key >= start
+	})
+	return entries[i:]
+}
+
+func (it *sliceIterator) next() bool {
+	it.pos++
+	return it.pos < len(it.entries)
+}
+
+func (it *sliceIterator) entry() entry {
+	return it.entries[it.pos]
+}
+
+func (it *sliceIterator) error() error {
+	return nil
+}
+
+// mergingIterator merges several sorted iterators into one.
+// Iterators are passed newest first; when the same key appears in more
+// than one of them, only the entry from the newest iterator is returned.
+type mergingIterator struct {
+	h   mergeHeap
+	cur entry
+	err error
+}
+
+func newMergingIterator(iters []iterator) *mergingIterator {
+	m := &mergingIterator{}
+	for priority, it := range iters {
+		if it.next() {
+			m.h = append(m.h, mergeItem{it: it, priority: priority})
+		} else if err := it.error(); err != nil {
+			m.err = err
+		}
+	}
+	heap.Init(&m.h)
+	return m
+}
+
+func (m *mergingIterator) next() bool {
+	if m.err != nil || len(m.h) == 0 {
+		return false
+	}
+
+	// the top of the heap is the smallest key from the newest iterator
+	m.cur = m.h[0].it.entry()
+	for len(m.h) > 0 && m.h[0].it.entry().key == m.cur.key {
+		m.advance()
+	}
+	return m.err == nil
+}
+
+// advance moves the iterator at the top of the heap forward.
+func (m *mergingIterator) advance() {
+	top := m.h[0].it
+	if top.next() {
+		heap.Fix(&m.h, 0)
+		return
+	}
+	if err := top.error(); err != nil {
+		m.err = err
+	}
+	heap.Pop(&m.h)
+}
+
+func (m *mergingIterator) entry() entry {
+	return m.cur
+}
+
+func (m *mergingIterator) error() error {
+	return m.err
+}
+
+type mergeItem struct {
+	it       iterator
+	priority int // lower is newer
+}
+
+type mergeHeap []mergeItem
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	ki, kj := h[i].it.entry().key, h[j].it.entry().key
+	if ki != kj {
+		return ki < kj
+	}
+	return h[i].priority < h[j].priority
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x any) { *h = append(*h, x.(mergeItem)) }
+
+func (h *mergeHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
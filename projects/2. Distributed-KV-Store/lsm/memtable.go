@@ -0,0 +1,52 @@
+package lsm
+
+import "sort"
+
+// memtable holds the most recent writes in memory until it is
+// large enough to be flushed to an SSTable. tombstones is the number of
+// entries that are tombstones, and applied the index recorded by the
+// latest batch that set one, including those of older memtables.
+type memtable struct {
+	entries    map[string]entry
+	size       int
+	tombstones int
+	applied    uint64
+}
+
+func newMemtable(applied uint64) *memtable {
+	return &memtable{
+		entries: make(map[string]entry),
+		applied: applied,
+	}
+}
+
+func (m *memtable) put(e entry) {
+	if old, ok := m.entries[e.key]; ok {
+		m.size -= old.size()
+		if old.deleted {
+			m.tombstones--
+		}
+	}
+	m.entries[e.key] = e
+	m.size += e.size()
+	if e.deleted {
+		m.tombstones++
+	}
+}
+
+func (m *memtable) get(key string) (entry, bool) {
+	e, ok := m.entries[key]
+	return e, ok
+}
+
+// sorted returns the entries ordered by key, tombstones included.
+func (m *memtable) sorted() []entry {
+	entries := make([]entry, 0, len(m.entries))
+	for _, e := range m.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	return entries
+}
@@ -0,0 +1,419 @@
+package lsm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+	"sync/atomic"
+)
+
+// SSTable layout:
+//
+//	[data block]...[data block][index block][bloom block][footer]
+//
+// Every block ends with a CRC-32C of its contents. Data blocks hold entries
+// sorted by key. The index block holds, for every data block, its last key,
+// offset and length, so a lookup reads at most one data block. The footer
+// has a fixed size and points at the index and bloom blocks.
+const (
+	blockSize  = 4 << 10
+	footerSize = 40
+	tableMagic = 0x6b766c736d746231 // "kvlsmtb1"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errCorruptTable = errors.New("corrupt sstable")
+
+// blockHandle locates a data block inside a table file.
+type blockHandle struct {
+	lastKey string
+	offset  uint64
+	length  uint64
+}
+
+// tableMeta describes an SSTable in the manifest.
+// Tombstones is the number of Entries that are tombstones.
+type tableMeta struct {
+	Num        uint64 `json:"num"`
+	Smallest   string `json:"smallest"`
+	Largest    string `json:"largest"`
+	Size       int64  `json:"size"`
+	Entries    int    `json:"entries"`
+	Tombstones int    `json:"tombstones,omitempty"`
+}
+
+// tableWriter writes sorted entries to a new SSTable file.
+type tableWriter struct {
+	file   *os.File
+	w      *bufio.Writer
+	offset uint64
+	meta   tableMeta
+
+	block     []byte
+	lastKey   string
+	index     []blockHandle
+	keyHashes []uint64
+}
+
+func newTableWriter(path string, num uint64) (*tableWriter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sstable: %w", err)
+	}
+	return &tableWriter{
+		file: file,
+		w:    bufio.NewWriter(file),
+		meta: tableMeta{Num: num},
+	}, nil
+}
+
+// add appends an entry. Entries must be added in increasing key order.
+func (tw *tableWriter) add(e entry) error {
+	if tw.meta.Entries == 0 {
+		tw.meta.Smallest = e.key
+	}
+	tw.meta.Largest = e.key
+	tw.meta.Entries++
+	if e.deleted {
+		tw.meta.Tombstones++
+	}
+
+	tw.block = appendEntry(tw.block, e)
+	tw.lastKey = e.key
+	tw.keyHashes = append(tw.keyHashes, bloomHash(e.key))
+
+	if len(tw.block) >= blockSize {
+		return tw.flushBlock()
+	}
+	return nil
+}
+
+// estimatedSize is the number of bytes the table will take so far.
+func (tw *tableWriter) estimatedSize() uint64 {
+	return tw.offset + uint64(len(tw.block))
+}
+
+func (tw *tableWriter) flushBlock() error {
+	if len(tw.block) == 0 {
+		return nil
+	}
+
+	handle, err := tw.writeBlock(tw.block)
+	if err != nil {
+		return err
+	}
+	handle.lastKey = tw.lastKey
+	tw.index = append(tw.index, handle)
+	tw.block = tw.block[:0]
+	return nil
+}
+
+// writeBlock writes data followed by its checksum.
+func (tw *tableWriter) writeBlock(data []byte) (blockHandle, error) {
+	handle := blockHandle{offset: tw.offset, length: uint64(len(data)) + 4}
+
+	if _, err := tw.w.Write(data); err != nil {
+		return blockHandle{}, err
+	}
+	if err := binary.Write(tw.w, binary.BigEndian, crc32.Checksum(data, crcTable)); err != nil {
+		return blockHandle{}, err
+	}
+	tw.offset += handle.length
+	return handle, nil
+}
+
+// finish writes the index, bloom filter and footer and syncs the file.
+func (tw *tableWriter) finish() (tableMeta, error) {
+	defer tw.file.Close()
+
+	if err := tw.flushBlock(); err != nil {
+		return tableMeta{}, err
+	}
+
+	var index []byte
+	index = binary.AppendUvarint(index, uint64(len(tw.index)))
+	for _, h := range tw.index {
+		index = binary.AppendUvarint(index, uint64(len(h.lastKey)))
+		index = append(index, h.lastKey...)
+		index = binary.AppendUvarint(index, h.offset)
+		index = binary.AppendUvarint(index, h.length)
+	}
+	indexHandle, err := tw.writeBlock(index)
+	if err != nil {
+		return tableMeta{}, err
+	}
+
+	bloomHandle, err := tw.writeBlock(newBloom(tw.keyHashes).encode())
+	if err != nil {
+		return tableMeta{}, err
+	}
+
+	footer := make([]byte, footerSize)
+	binary.BigEndian.PutUint64(footer[0:8], indexHandle.offset)
+	binary.BigEndian.PutUint64(footer[8:16], indexHandle.length)
+	binary.BigEndian.PutUint64(footer[16:24], bloomHandle.offset)
+	binary.BigEndian.PutUint64(footer[24:32], bloomHandle.length)
+	binary.BigEndian.PutUint64(footer[32:40], tableMagic)
+	if _, err := tw.w.Write(footer); err != nil {
+		return tableMeta{}, err
+	}
+	tw.offset += footerSize
+
+	if err := tw.w.Flush(); err != nil {
+		return tableMeta{}, err
+	}
+	if err := tw.file.Sync(); err != nil {
+		return tableMeta{}, err
+	}
+
+	tw.meta.Size = int64(tw.offset)
+	return tw.meta, nil
+}
+
+// abort discards a partially written table.
+func (tw *tableWriter) abort() {
+	tw.file.Close()
+	os.Remove(tw.file.Name())
+}
+
+// table is an open, immutable SSTable.
+// Its index and bloom filter are kept in memory; data blocks are read on demand.
+type table struct {
+	meta  tableMeta
+	path  string
+	file  *os.File
+	index []blockHandle
+	bloom *bloom
+
+	// refs counts the versions that contain this table. The file is
+	// deleted once the table is obsolete and no version refers to it.
+	refs     atomic.Int32
+	obsolete atomic.Bool
+}
+
+func openTable(path string, meta tableMeta) (*table, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sstable: %w", err)
+	}
+
+	t := &table{meta: meta, path: path, file: file}
+	if err := t.load(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to load sstable %s: %w", path, err)
+	}
+	return t, nil
+}
+
+// load reads the footer, index and bloom filter.
+func (t *table) load() error {
+	info, err := t.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < footerSize {
+		return errCorruptTable
+	}
+
+	footer := make([]byte, footerSize)
+	if _, err := t.file.ReadAt(footer, info.Size()-footerSize); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint64(footer[32:40]) != tableMagic {
+		return errCorruptTable
+	}
+
+	index, err := t.readBlock(blockHandle{
+		offset: binary.BigEndian.Uint64(footer[0:8]),
+		length: binary.BigEndian.Uint64(footer[8:16]),
+	})
+	if err != nil {
+		return err
+	}
+	if err := t.decodeIndex(index); err != nil {
+		return err
+	}
+
+	filter, err := t.readBlock(blockHandle{
+		offset: binary.BigEndian.Uint64(footer[16:24]),
+		length: binary.BigEndian.Uint64(footer[24:32]),
+	})
+	if err != nil {
+		return err
+	}
+	t.bloom = decodeBloom(filter)
+	return nil
+}
+
+func (t *table) decodeIndex(data []byte) error {
+	count, n := binary.Uvarint(data)
+	if n <= 0 {
+		return errCorruptTable
+	}
+	data = data[n:]
+
+	t.index = make([]blockHandle, 0, count)
+	for i := uint64(0); i < count; i++ {
+		keyLen, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < keyLen {
+			return errCorruptTable
+		}
+		data = data[n:]
+		h := blockHandle{lastKey: string(data[:keyLen])}
+		data = data[keyLen:]
+
+		if h.offset, n = binary.Uvarint(data); n <= 0 {
+			return errCorruptTable
+		}
+		data = data[n:]
+		if h.length, n = binary.Uvarint(data); n <= 0 {
+			return errCorruptTable
+		}
+		data = data[n:]
+
+		t.index = append(t.index, h)
+	}
+	return nil
+}
+
+// readBlock reads a block and verifies its checksum.
+// The returned data does not include the checksum.
+func (t *table) readBlock(h blockHandle) ([]byte, error) {
+	if h.length < 4 {
+		return nil, errCorruptTable
+	}
+
+	buf := make([]byte, h.length)
+	if _, err := t.file.ReadAt(buf, int64(h.offset)); err != nil {
+		return nil, err
+	}
+	data, sum := buf[:len(buf)-4], binary.BigEndian.Uint32(buf[len(buf)-4:])
+	if crc32.Checksum(data, crcTable) != sum {
+		return nil, errCorruptTable
+	}
+	return data, nil
+}
+
+// get looks up key in the table.
+// The boolean is false if the table has no entry (live or deleted) for key.
+func (t *table) get(key string) (entry, bool, error) {
+	if key < t.meta.Smallest || key > t.meta.Largest {
+		return entry{}, false, nil
+	}
+	if !t.bloom.mayContain(bloomHash(key)) {
+		return entry{}, false, nil
+	}
+
+	// the first block whose last key is >= key is the only one that can hold it
+	i := sort.Search(len(t.index), func(i int) bool {
+		return t.index[i].lastKey >= key
+	})
+	if i == len(t.index) {
+		return entry{}, false, nil
+	}
+
+	data, err := t.readBlock(t.index[i])
+	if err != nil {
+		return entry{}, false, err
+	}
+	for len(data) > 0 {
+		e, n, err := decodeEntry(data)
+		if err != nil {
+			return entry{}, false, err
+		}
+		if e.key == key {
+			return e, true, nil
+		}
+		if e.key > key {
+			break
+		}
+		data = data[n:]
+	}
+	return entry{}, false, nil
+}
+
+// overlaps reports whether the table's key range intersects [smallest, largest].
+func (t *table) overlaps(smallest, largest string) bool {
+	return t.meta.Largest >= smallest && t.meta.Smallest <= largest
+}
+
+func (t *table) ref() {
+	t.refs.Add(1)
+}
+
+// unref drops a reference and removes the file once the table is unused.
+func (t *table) unref() {
+	if t.refs.Add(-1) == 0 && t.obsolete.Load() {
+		t.file.Close()
+		os.Remove(t.path)
+	}
+}
+
+// close closes the file without removing it.
+func (t *table) close() error {
+	return t.file.Close()
+}
+
+// tableIterator walks the entries of a table in key order, one block at a time.
+// Entries with a key before start are skipped.
+type tableIterator struct {
+	t     *table
+	block int
+	start string
+	data  []byte
+	cur   entry
+	err   error
+}
+
+func (t *table) iterator() *tableIterator {
+	return &tableIterator{t: t}
+}
+
+// iteratorFrom returns an iterator over the entries whose key is at least
+// start. It begins at the first block that can hold such a key.
+func (t *table) iteratorFrom(start string) *tableIterator {
+	block := sort.Search(len(t.index), func(i int) bool {
+		return t.index[i].lastKey >= start
+	})
+	return &tableIterator{t: t, block: block, start: start}
+}
+
+func (it *tableIterator) next() bool {
+	for {
+		for len(it.data) == 0 {
+			if it.err != nil || it.block >= len(it.t.index) {
+				return false
+			}
+			it.data, it.err = it.t.readBlock(it.t.index[it.block])
+			it.block++
+			if it.err != nil {
+				return false
+			}
+		}
+
+		e, n, err := decodeEntry(it.data)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.data = it.data[n:]
+		if e.key < it.start {
+			continue
+		}
+		it.cur = e
+		return true
+	}
+}
+
+func (it *tableIterator) entry() entry {
+	return it.cur
+}
+
+func (it *tableIterator) error() error {
+	return it.err
+}
@@ -0,0 +1,175 @@
+package lsm
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+)
+
+// numLevels is the number of levels in the tree, L0 included.
+const numLevels = 7
+
+const manifestFileName = "MANIFEST"
+
+// version is an immutable view of the SSTables making up the tree.
+// L0 tables may overlap and are kept in creation order (newest last);
+// the tables of every other level are sorted by key and never overlap.
+// Readers hold a reference to the version they use, so a compaction
+// can install a new version without pulling files out from under them.
+type version struct {
+	levels [numLevels][]*table
+	refs   atomic.Int32
+}
+
+// newVersion creates a version holding a reference to each of its tables.
+func newVersion(levels [numLevels][]*table) *version {
+	v := &version{levels: levels}
+	for _, tables := range levels {
+		for _, t := range tables {
+			t.ref()
+		}
+	}
+	v.refs.Store(1)
+	return v
+}
+
+func (v *version) ref() {
+	v.refs.Add(1)
+}
+
+func (v *version) unref() {
+	if v.refs.Add(-1) != 0 {
+		return
+	}
+	for _, tables := range v.levels {
+		for _, t := range tables {
+			t.unref()
+		}
+	}
+}
+
+// levelSize returns the total size in bytes of the tables in level.
+func (v *version) levelSize(level int) int64 {
+	var size int64
+	for _, t := range v.levels[level] {
+		size += t.meta.Size
+	}
+	return size
+}
+
+// overlapping returns the tables of level whose range intersects [smallest, largest].
+func (v *version) overlapping(level int, smallest, largest string) []*table {
+	var tables []*table
+	for _, t := range v.levels[level] {
+		if t.overlaps(smallest, largest) {
+			tables = append(tables, t)
+		}
+	}
+	return tables
+}
+
+// edit returns the levels of v with the tables in removed dropped
+// and added inserted into level addLevel.
+func (v *version) edit(removed map[uint64]bool, addLevel int, added []*table) [numLevels][]*table {
+	var levels [numLevels][]*table
+	for level, tables := range v.levels {
+		for _, t := range tables {
+			if !removed[t.meta.Num] {
+				levels[level] = append(levels[level], t)
+			}
+		}
+	}
+
+	levels[addLevel] = append(levels[addLevel], added...)
+	if addLevel > 0 {
+		sort.Slice(levels[addLevel], func(i, j int) bool {
+			return levels[addLevel][i].meta.Smallest < levels[addLevel][j].meta.Smallest
+		})
+	}
+	return levels
+}
+
+// manifest is the on-disk description of the tree. Applied is the index
+// recorded by the latest batch the tables hold (see Batch.SetApplied).
+type manifest struct {
+	NextFile uint64        `json:"next_file"`
+	Applied  uint64        `json:"applied,omitempty"`
+	Levels   [][]tableMeta `json:"levels"`
+}
+
+func readManifest(dir string) (*manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, manifestFileName))
+	if os.IsNotExist(err) {
+		return &manifest{NextFile: 1}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// writeManifest atomically replaces the manifest with the tables of v,
+// which hold the writes up to applied.
+func writeManifest(dir string, v *version, nextFile, applied uint64) error {
+	m := manifest{
+		NextFile: nextFile,
+		Applied:  applied,
+		Levels:   make([][]tableMeta, numLevels),
+	}
+	for level, tables := range v.levels {
+		for _, t := range tables {
+			m.Levels[level] = append(m.Levels[level], t.meta)
+		}
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	tmp := filepath.Join(dir, manifestFileName+".tmp")
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create manifest: %w", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync manifest: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close manifest: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, manifestFileName)); err != nil {
+		return fmt.Errorf("failed to install manifest: %w", err)
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func tablePath(dir string, num uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d.sst", num))
+}
+
+func walPath(dir string, num uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("wal-%06d.log", num))
+}
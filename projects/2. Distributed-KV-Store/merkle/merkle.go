@@ -0,0 +1,129 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+)
+
+// Entry is a key and a digest of everything stored under it.
+type Entry struct {
+	Key    string `json:"key"`
+	Digest []byte `json:"digest"`
+}
+
+// Tree is a Merkle tree over the key space. Keys are spread over 2^depth
+// leaves by the hash of the key, so a leaf covers a fixed range of key
+// hashes and two trees built from the same keys line up node by node.
+// A leaf hashes the entries in its range and every inner node hashes its
+// two children, so comparing two trees from the root down finds the
+// ranges that differ without looking at the others.
+//
+// Nodes are numbered breadth first: the root is 0 and the children of
+// node i are 2i+1 and 2i+2.
+type Tree struct {
+	depth  int
+	hashes [][]byte
+	leaves [][]Entry
+}
+
+// Build creates a tree of the given depth over entries.
+func Build(depth int, entries []Entry) *Tree {
+	numLeaves := 1 << depth
+	t := &Tree{
+		depth:  depth,
+		hashes: make([][]byte, 2*numLeaves-1),
+		leaves: make([][]Entry, numLeaves),
+	}
+
+	for _, e := range entries {
+		leaf := t.leafIndex(e.Key)
+		t.leaves[leaf] = append(t.leaves[leaf], e)
+	}
+
+	first := numLeaves - 1
+	for i, leaf := range t.leaves {
+		sort.Slice(leaf, func(a, b int) bool {
+			return leaf[a].Key < leaf[b].Key
+		})
+		h := sha256.New()
+		for _, e := range leaf {
+			binary.Write(h, binary.BigEndian, uint32(len(e.Key)))
+			h.Write([]byte(e.Key))
+			h.Write(e.Digest)
+		}
+		t.hashes[first+i] = h.Sum(nil)
+	}
+	for i := first - 1; i >= 0; i-- {
+		h := sha256.New()
+		h.Write(t.hashes[2*i+1])
+		h.Write(t.hashes[2*i+2])
+		t.hashes[i] = h.Sum(nil)
+	}
+	return t
+}
+
+// leafIndex returns the leaf (counted from the first leaf) that covers key.
+func (t *Tree) leafIndex(key string) int {
+	sum := sha256.Sum256([]byte(key))
+	return int(binary.BigEndian.Uint64(sum[:8]) >> (64 - t.depth))
+}
+
+// Depth returns the number of levels below the root.
+func (t *Tree) Depth() int {
+	return t.depth
+}
+
+// Root returns the hash of the whole tree.
+func (t *Tree) Root() []byte {
+	return t.hashes[0]
+}
+
+// Size returns the number of nodes in the tree.
+func (t *Tree) Size() int {
+	return len(t.hashes)
+}
+
+// Hash returns the hash of node.
+func (t *Tree) Hash(node int) []byte {
+	return t.hashes[node]
+}
+
+// IsLeaf reports whether node is a leaf.
+func (t *Tree) IsLeaf(node int) bool {
+	return node >= len(t.leaves)-1
+}
+
+// Children returns the two children of an inner node.
+func (t *Tree) Children(node int) (int, int) {
+	return 2*node + 1, 2*node + 2
+}
+
+// Entries returns the entries in a leaf, sorted by key.
+func (t *Tree) Entries(node int) []Entry {
+	return t.leaves[node-(len(t.leaves)-1)]
+}
+
+// Diff returns the keys whose entries differ between local and remote,
+// including keys that are only present on one side.
+func Diff(local, remote []Entry) []string {
+	digests := make(map[string][]byte, len(local))
+	for _, e := range local {
+		digests[e.Key] = e.Digest
+	}
+
+	var keys []string
+	for _, e := range remote {
+		digest, ok := digests[e.Key]
+		if !ok || !bytes.Equal(digest, e.Digest) {
+			keys = append(keys, e.Key)
+		}
+		delete(digests, e.Key)
+	}
+	for key := range digests {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
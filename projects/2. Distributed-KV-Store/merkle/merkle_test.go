@@ -0,0 +1,94 @@
+package merkle
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// entries returns n entries whose digests are derived from version.
+func entries(n int, version string) []Entry {
+	entries := make([]Entry, n)
+	for i := range entries {
+		key := fmt.Sprintf("key-%d", i)
+		entries[i] = Entry{Key: key, Digest: []byte(key + "@" + version)}
+	}
+	return entries
+}
+
+func TestDiff(t *testing.T) {
+	local := entries(10, "v1")
+	remote := entries(10, "v1")
+
+	if keys := Diff(local, remote); len(keys) != 0 {
+		t.Fatalf("Diff of equal entries returned %q", keys)
+	}
+
+	remote[3].Digest = []byte("changed")
+	remote = append(remote, Entry{Key: "only-remote", Digest: []byte("x")})
+	local = append(local, Entry{Key: "only-local", Digest: []byte("y")})
+	local[7].Digest = nil
+
+	want := []string{"key-3", "key-7", "only-local", "only-remote"}
+	if keys := Diff(local, remote); !slices.Equal(keys, want) {
+		t.Fatalf("Diff returned %q, want %q", keys, want)
+	}
+	if keys := Diff(remote, local); !slices.Equal(keys, want) {
+		t.Fatalf("Diff with the sides swapped returned %q, want %q", keys, want)
+	}
+	if keys := Diff(nil, remote[:2]); !slices.Equal(keys, []string{"key-0", "key-1"}) {
+		t.Fatalf("Diff against nothing returned %q", keys)
+	}
+}
+
+func TestBuildIgnoresOrderOfEntries(t *testing.T) {
+	ordered := entries(50, "v1")
+	reversed := slices.Clone(ordered)
+	slices.Reverse(reversed)
+
+	if !bytes.Equal(Build(4, ordered).Root(), Build(4, reversed).Root()) {
+		t.Fatal("trees over the same entries have different roots")
+	}
+}
+
+// Walking two trees from the root down reaches exactly the leaves holding
+// the keys that differ, and Diff of those leaves finds the keys.
+func TestTreesDifferOnlyAlongChangedLeaves(t *testing.T) {
+	local := entries(200, "v1")
+	remote := entries(200, "v1")
+	remote[42].Digest = []byte("changed")
+	remote = remote[:len(remote)-1]
+
+	a, b := Build(5, local), Build(5, remote)
+	if bytes.Equal(a.Root(), b.Root()) {
+		t.Fatal("trees over different entries have the same root")
+	}
+
+	var keys []string
+	leaves := 0
+	pending := []int{0}
+	for len(pending) > 0 {
+		node := pending[0]
+		pending = pending[1:]
+		if bytes.Equal(a.Hash(node), b.Hash(node)) {
+			continue
+		}
+		if b.IsLeaf(node) {
+			leaves++
+			keys = append(keys, Diff(a.Entries(node), b.Entries(node))...)
+			continue
+		}
+		left, right := a.Children(node)
+		pending = append(pending, left, right)
+	}
+	slices.Sort(keys)
+
+	want := []string{"key-199", "key-42"}
+	if !slices.Equal(keys, want) {
+		t.Fatalf("walking the trees found %q, want %q", keys, want)
+	}
+	if leaves > len(want) {
+		t.Fatalf("walking the trees visited %d differing leaves for %d keys", leaves, len(want))
+	}
+}
@@ -0,0 +1,298 @@
+package node
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/merkle"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/store"
+)
+
+// merkleDepth is the depth of the Merkle trees compared during
+// anti-entropy, giving 1024 key ranges.
+const merkleDepth = 10
+
+// merkleRequest asks a peer for part of its Merkle tree over the keys
+// both nodes replicate. Peer is the URL of the node asking, and Round
+// identifies its sync round: every request of a round is answered from
+// the same tree, built by the first one. A zero Round builds a new tree.
+type merkleRequest struct {
+	Peer  string `json:"peer"`
+	Round uint64 `json:"round,omitempty"`
+	Nodes []int  `json:"nodes"`
+}
+
+// merkleTrees holds, for every peer, the tree built for its current sync
+// round, and numbers the rounds this node starts.
+type merkleTrees struct {
+	mu    sync.Mutex
+	last  uint64
+	trees map[string]roundTree
+}
+
+type roundTree struct {
+	round uint64
+	tree  *merkle.Tree
+}
+
+// nextRound returns a new round number. Numbers start at the current time,
+// so a restarted node does not reuse the rounds its peers still hold.
+func (m *merkleTrees) nextRound() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.last == 0 {
+		m.last = uint64(time.Now().UnixNano())
+	}
+	m.last++
+	return m.last
+}
+
+// get returns the tree of peer's sync round, calling build if the round
+// has none yet. The tree of the peer's previous round is dropped.
+func (m *merkleTrees) get(peer string, round uint64, build func() (*merkle.Tree, error)) (*merkle.Tree, error) {
+	if round == 0 {
+		return build()
+	}
+
+	m.mu.Lock()
+	cached, ok := m.trees[peer]
+	m.mu.Unlock()
+	if ok && cached.round == round {
+		return cached.tree, nil
+	}
+
+	tree, err := build()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.trees == nil {
+		m.trees = make(map[string]roundTree)
+	}
+	m.trees[peer] = roundTree{round: round, tree: tree}
+	return tree, nil
+}
+
+// merkleTree builds a Merkle tree over the keys this node and peer both
+// replicate. Every key is summarised by a digest of its versions.
+func (n *Node) merkleTree(peer string) (*merkle.Tree, error) {
+	var entries []merkle.Entry
+	var err error
+	n.scanShared(peer, func(item store.Store) bool {
+		var data []byte
+		if data, err = json.Marshal(item); err != nil {
+			return false
+		}
+		digest := sha256.Sum256(data)
+		entries = append(entries, merkle.Entry{Key: item.Key, Digest: digest[:]})
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return merkle.Build(merkleDepth, entries), nil
+}
+
+// AntiEntropyLoop periodically compares the keys this node shares with each
+// peer that is up and repairs the ones that differ.
+func (n *Node) AntiEntropyLoop() {
+	ticker := time.NewTicker(time.Duration(n.AntiEntropyInterval) * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, peer := range n.Peers {
+			if !n.peerUp(peer) {
+				continue
+			}
+			if err := n.antiEntropy(peer); err != nil {
+				log.Printf("Anti-entropy with peer %s failed: %v", peer, err)
+			}
+		}
+	}
+}
+
+// antiEntropy walks this node's and peer's Merkle trees from the root down
+// to the leaves that differ, compares the keys in those leaves and syncs
+// every key that differs in both directions.
+func (n *Node) antiEntropy(peer string) error {
+	local, err := n.merkleTree(peer)
+	if err != nil {
+		return err
+	}
+	round := n.merkleTrees.nextRound()
+
+	var leaves []int
+	nodes := []int{0}
+	for len(nodes) > 0 {
+		var response struct {
+			Hashes [][]byte `json:"hashes"`
+		}
+		if err := n.postJSON(peer+"/merkle/hashes", merkleRequest{Peer: n.Self, Round: round, Nodes: nodes}, &response); err != nil {
+			return err
+		}
+		if len(response.Hashes) != len(nodes) {
+			return fmt.Errorf("peer returned %d hashes for %d nodes", len(response.Hashes), len(nodes))
+		}
+
+		var next []int
+		for i, node := range nodes {
+			if bytes.Equal(local.Hash(node), response.Hashes[i]) {
+				continue
+			}
+			if local.IsLeaf(node) {
+				leaves = append(leaves, node)
+				continue
+			}
+			left, right := local.Children(node)
+			next = append(next, left, right)
+		}
+		nodes = next
+	}
+	if len(leaves) == 0 {
+		return nil
+	}
+
+	var response struct {
+		Entries []merkle.Entry `json:"entries"`
+	}
+	if err := n.postJSON(peer+"/merkle/entries", merkleRequest{Peer: n.Self, Round: round, Nodes: leaves}, &response); err != nil {
+		return err
+	}
+	var entries []merkle.Entry
+	for _, leaf := range leaves {
+		entries = append(entries, local.Entries(leaf)...)
+	}
+
+	keys := merkle.Diff(entries, response.Entries)
+	for _, key := range keys {
+		n.syncKey(peer, key)
+	}
+	log.Printf("Anti-entropy with peer %s: %d differing ranges, %d keys synced", peer, len(leaves), len(keys))
+	return nil
+}
+
+// syncKey sends the local copy of key to peer and merges the peer's copy
+// into the local store, so that both end up with the same versions.
+func (n *Node) syncKey(peer, key string) {
+	if item, ok := n.DB.Get(key); ok {
+		n.sendReplica(peer, item)
+	}
+
+	reply := n.readReplica(peer, key)
+	if reply.err != nil {
+		log.Printf("Failed to read key %s from peer %s: %v", key, peer, reply.err)
+		return
+	}
+	if reply.found {
+		if err := n.mergeItem(reply.item); err != nil {
+			log.Printf("Failed to merge key %s from peer %s: %v", key, peer, err)
+		}
+	}
+}
+
+// postJSON posts body to url and decodes the JSON response into response.
+func (n *Node) postJSON(url string, body, response any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// MerkleHashes returns the hashes of the requested nodes of this node's
+// Merkle tree over the keys it shares with the asking peer.
+// It expects a POST request with a JSON body {"peer": "<url>", "nodes": [0]}.
+func (n *Node) MerkleHashes(w http.ResponseWriter, r *http.Request) {
+	tree, ok := n.decodeMerkleRequest(w, r)
+	if !ok {
+		return
+	}
+
+	hashes := make([][]byte, len(tree.nodes))
+	for i, node := range tree.nodes {
+		hashes[i] = tree.Hash(node)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string][][]byte{"hashes": hashes})
+}
+
+// MerkleEntries returns the keys and digests in the requested leaves of this
+// node's Merkle tree over the keys it shares with the asking peer.
+// It expects a POST request with a JSON body {"peer": "<url>", "nodes": [...]}.
+func (n *Node) MerkleEntries(w http.ResponseWriter, r *http.Request) {
+	tree, ok := n.decodeMerkleRequest(w, r)
+	if !ok {
+		return
+	}
+
+	entries := []merkle.Entry{}
+	for _, node := range tree.nodes {
+		if !tree.IsLeaf(node) {
+			http.Error(w, fmt.Sprintf("Node %d is not a leaf", node), http.StatusBadRequest)
+			return
+		}
+		entries = append(entries, tree.Entries(node)...)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string][]merkle.Entry{"entries": entries})
+}
+
+// requestedTree is a Merkle tree and the nodes a peer asked for.
+type requestedTree struct {
+	*merkle.Tree
+	nodes []int
+}
+
+// decodeMerkleRequest parses a merkleRequest and finds the tree it refers
+// to, building it on the first request of the round. It writes an error
+// response and returns false if the request is invalid.
+func (n *Node) decodeMerkleRequest(w http.ResponseWriter, r *http.Request) (requestedTree, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return requestedTree{}, false
+	}
+
+	var request merkleRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Peer == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return requestedTree{}, false
+	}
+
+	tree, err := n.merkleTrees.get(request.Peer, request.Round, func() (*merkle.Tree, error) {
+		return n.merkleTree(request.Peer)
+	})
+	if err != nil {
+		http.Error(w, "Failed to build merkle tree", http.StatusInternalServerError)
+		return requestedTree{}, false
+	}
+	for _, node := range request.Nodes {
+		if node < 0 || node >= tree.Size() {
+			http.Error(w, fmt.Sprintf("Node %d is out of range", node), http.StatusBadRequest)
+			return requestedTree{}, false
+		}
+	}
+	return requestedTree{Tree: tree, nodes: request.Nodes}, true
+}
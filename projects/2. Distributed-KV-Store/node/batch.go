@@ -0,0 +1,541 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/replication"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/store"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/watch"
+)
+
+// Limits of POST /batch and POST /mget, and the number of keys they read
+// at once: POST /mget to answer, and POST /batch to stamp its writes.
+const (
+	maxBatchOps = 1000
+	maxMGetKeys = 1000
+	mgetReads   = 16
+)
+
+// batchOp is a put or a delete of a batch. The value of a put can be any
+// JSON value, and the key expires after "ttl" seconds or at "expires_at"
+// (RFC 3339) when either is given. Context is the context returned by a
+// read, as for POST /store; atomic batches and raft mode ignore it.
+type batchOp struct {
+	Op        string `json:"op"`
+	Key       string `json:"key"`
+	Value     any    `json:"value,omitempty"`
+	TTL       int64  `json:"ttl,omitempty"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+	Context   string `json:"context,omitempty"`
+}
+
+// batchRequest is the body of POST /batch. With Atomic either every
+// operation is applied or none is.
+type batchRequest struct {
+	Ops    []batchOp `json:"ops"`
+	Atomic bool      `json:"atomic,omitempty"`
+}
+
+// batchOpResult is the outcome of one operation of a batch. Version is the
+// version a put wrote and Acks the number of replicas that acknowledged the
+// operation, in eventual mode without Atomic. Error is set if it failed.
+type batchOpResult struct {
+	Op      string `json:"op"`
+	Key     string `json:"key"`
+	Version uint64 `json:"version,omitempty"`
+	Acks    int    `json:"acks,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// batchResult is the response to POST /batch, with one result per
+// operation in the order of the request.
+type batchResult struct {
+	Succeeded int             `json:"succeeded"`
+	Failed    int             `json:"failed"`
+	Results   []batchOpResult `json:"results"`
+}
+
+// validate checks that b is well formed. A key can only appear once.
+func (b batchRequest) validate() error {
+	if len(b.Ops) > maxBatchOps {
+		return fmt.Errorf("too many operations: at most %d per batch", maxBatchOps)
+	}
+	seen := make(map[string]bool)
+	for _, op := range b.Ops {
+		if op.Key == "" {
+			return errors.New("operation without a key")
+		}
+		if op.Op != opPut && op.Op != opDelete {
+			return fmt.Errorf("invalid operation %q", op.Op)
+		}
+		if seen[op.Key] {
+			return fmt.Errorf("key %s appears more than once", op.Key)
+		}
+		seen[op.Key] = true
+	}
+	return nil
+}
+
+// items returns the writes of b: the new values of the puts and tombstones
+// for the deletes. The expiry is fixed here, as for a single put.
+func (b batchRequest) items() ([]store.Store, error) {
+	items := make([]store.Store, len(b.Ops))
+	for i, op := range b.Ops {
+		if op.Op == opDelete {
+			items[i] = store.Store{Key: op.Key, Deleted: true}
+			continue
+		}
+		expiresAt, err := parseExpiry(op.TTL, op.ExpiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", op.Key, err)
+		}
+		items[i] = store.Store{Key: op.Key, Value: op.Value, ExpiresAt: expiresAt}
+	}
+	return items, nil
+}
+
+// Batch writes many keys in one request.
+// It expects a POST request with a JSON body such as
+// {"ops": [{"op": "put", "key": "a", "value": 1, "ttl": 60}, {"op": "delete", "key": "b"}], "atomic": false}
+// and responds with the outcome of each operation, in order.
+// In eventual mode every operation is replicated like a single write and
+// succeeds once W replicas have acknowledged it, W being taken from the
+// "w" query parameter or the X-Write-Quorum header; the operations for
+// the same replica are sent to it in one request. With "atomic" the batch
+// is instead written with a two-phase commit, like a transaction, and
+// either every operation is applied or the request fails. In raft mode the
+// batch is a single entry in the log and so always atomic.
+func (n *Node) Batch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Keep numbers exactly as they were sent, as POST /store does
+	var batch batchRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&batch); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := batch.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	items, err := batch.items()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var result batchResult
+	switch {
+	case n.raft != nil:
+		applied, ok := n.raftPropose(w, r, "/batch", batch, command{Op: opBatch, Items: items})
+		if !ok {
+			return
+		}
+		result = applied.(batchResult)
+	case batch.Atomic:
+		result, err = n.runAtomicBatch(items)
+		if errors.Is(err, errTxnConflict) {
+			http.Error(w, "Batch conflicts with a transaction", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to write batch: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	default:
+		writeQuorum, err := n.quorumFor(r, "w", writeQuorumHeader, n.WriteQuorum)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		errs := n.stampBatch(items, batch.Ops)
+		for i, err := range errs {
+			if errors.Is(err, errInvalidContext) {
+				http.Error(w, fmt.Sprintf("key %s: %v", items[i].Key, err), http.StatusBadRequest)
+				return
+			}
+		}
+		result = n.runBatch(items, errs, writeQuorum)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
+
+// batchOpFor returns the result of a successful write of item.
+func batchOpFor(item store.Store) batchOpResult {
+	if item.Deleted {
+		return batchOpResult{Op: opDelete, Key: item.Key}
+	}
+	return batchOpResult{Op: opPut, Key: item.Key, Version: item.Version}
+}
+
+// applyBatch applies a committed batch to the local store.
+// It is called by applyCommand, so every node reaches the same result.
+// Its changes are published to watchers together, under index.
+func (n *Node) applyBatch(index uint64, timestamp int64, items []store.Store) any {
+	result := batchResult{Results: make([]batchOpResult, 0, len(items))}
+	var events []watch.Event
+	for _, item := range items {
+		existing, found := n.DB.Get(item.Key)
+		if item.Deleted {
+			deleted, err := n.applyDelete(item.Key, timestamp, existing, found)
+			if err != nil {
+				return err
+			}
+			if deleted {
+				events = append(events, watch.Event{Type: watch.Delete, Key: item.Key})
+			}
+		} else {
+			item.Version = 1
+			if found {
+				item.Version = existing.NextVersion()
+			}
+			if err := n.DB.Put(item); err != nil {
+				return err
+			}
+			events = append(events, putEvent(item))
+		}
+		result.Results = append(result.Results, batchOpFor(item))
+	}
+	result.Succeeded = len(items)
+	if len(events) > 0 {
+		n.watch.PublishAt(index, events...)
+	}
+	return result
+}
+
+// runAtomicBatch writes items in eventual mode with a two-phase commit, so
+// either every replica gets all of them or nothing is written.
+func (n *Node) runAtomicBatch(items []store.Store) (batchResult, error) {
+	keys := make([]string, len(items))
+	for i, item := range items {
+		keys[i] = item.Key
+	}
+	sort.Strings(keys)
+
+	result := batchResult{Results: make([]batchOpResult, len(items))}
+	err := n.twoPhaseCommit(keys, func(current map[string]store.Store) map[string]store.Store {
+		written := make(map[string]store.Store, len(items))
+		for i, item := range items {
+			existing, ok := current[item.Key]
+			n.stampOver(&item, existing, ok)
+			written[item.Key] = item
+			result.Results[i] = batchOpFor(item)
+		}
+		return written
+	})
+	if err != nil {
+		return batchResult{}, err
+	}
+	result.Succeeded = len(items)
+	return result, nil
+}
+
+// stampBatch stamps the writes of a batch with stampWrite, several at once
+// since stamping a key this node does not hold reads its replicas. It
+// returns the error of each write that could not be stamped.
+func (n *Node) stampBatch(items []store.Store, ops []batchOp) []error {
+	errs := make([]error, len(items))
+	stamps := make(chan struct{}, mgetReads)
+	var wg sync.WaitGroup
+	for i := range items {
+		wg.Add(1)
+		stamps <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = n.stampWrite(&items[i], ops[i].Context)
+			<-stamps
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+// runBatch replicates the stamped items in eventual mode, leaving out the
+// ones stampErrs says could not be stamped, and returns the outcome of each.
+func (n *Node) runBatch(items []store.Store, stampErrs []error, writeQuorum int) batchResult {
+	var stamped []store.Store
+	var indexes []int
+	for i, item := range items {
+		if stampErrs[i] == nil {
+			stamped = append(stamped, item)
+			indexes = append(indexes, i)
+		}
+	}
+	acks := make([]int, len(items))
+	errs := append([]error(nil), stampErrs...)
+	replicatedAcks, replicatedErrs := n.replicateBatch(stamped, writeQuorum)
+	for j, i := range indexes {
+		acks[i], errs[i] = replicatedAcks[j], replicatedErrs[j]
+	}
+
+	result := batchResult{Results: make([]batchOpResult, len(items))}
+	for i, item := range items {
+		opResult := batchOpFor(item)
+		opResult.Acks = acks[i]
+		if errs[i] != nil {
+			opResult.Version = 0
+			opResult.Error = errs[i].Error()
+			result.Failed++
+		} else {
+			result.Succeeded++
+		}
+		result.Results[i] = opResult
+	}
+	return result
+}
+
+// replicateBatch is replicateWrite for many items at once. The items each
+// remote replica holds are queued for it together, so they reach it in one
+// request, and the local ones are stored here. It waits until every item
+// has been acknowledged by writeQuorum replicas or can no longer be, and
+// returns for each item the number of acknowledgements and an error if the
+// quorum was not met. As with replicateWrite, replicas that do not
+// acknowledge get hints and, with the fail policy, every item fails without
+// being stored anywhere when a queue has no room for its items.
+func (n *Node) replicateBatch(items []store.Store, writeQuorum int) ([]int, []error) {
+	acks := make([]int, len(items))
+	failures := make([]int, len(items))
+	errs := make([]error, len(items))
+
+	// the replicas of every item, and the items of every remote replica
+	replicas := make([][]string, len(items))
+	local := make([]bool, len(items))
+	groups := make(map[string][]int)
+	for i, item := range items {
+		replicas[i] = n.replicasFor(item.Key)
+		for _, replica := range replicas[i] {
+			if replica == n.Self {
+				local[i] = true
+			} else {
+				groups[replica] = append(groups[replica], i)
+			}
+		}
+	}
+
+	type groupResult struct {
+		indexes []int
+		ok      bool
+	}
+	results := make(chan groupResult, len(groups))
+
+	writes := make(map[string][]store.Store, len(groups))
+	for replica, indexes := range groups {
+		group := make([]store.Store, len(indexes))
+		for j, i := range indexes {
+			group[j] = items[i]
+		}
+		writes[replica] = group
+	}
+
+	// with the fail policy the items are queued for every remote replica
+	// or, when a queue is full, for none of them
+	var queued map[string]<-chan error
+	if n.queues.Policy() == replication.Fail {
+		var err error
+		if queued, err = n.queues.EnqueueAll(writes); err != nil {
+			for i := range errs {
+				errs[i] = err
+			}
+			return acks, errs
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(n.Timeout)*time.Second)
+	defer cancel()
+	for replica, indexes := range groups {
+		group := writes[replica]
+		done, ok := queued[replica]
+		var err error
+		if !ok {
+			done, err = n.queues.Enqueue(ctx, replica, group...)
+		}
+		if err != nil {
+			n.queueRejected(replica, err, group...)
+			results <- groupResult{indexes: indexes}
+			continue
+		}
+		go func(peer string, indexes []int, group []store.Store) {
+			err := <-done
+			if err != nil {
+				log.Printf("Failed to replicate batch to peer %s: %v", peer, err)
+				for _, item := range group {
+					n.storeHint(peer, item)
+				}
+			}
+			results <- groupResult{indexes: indexes, ok: err == nil}
+		}(replica, indexes, group)
+	}
+
+	for i, item := range items {
+		if !local[i] || errs[i] != nil {
+			continue
+		}
+		if err := n.mergeItem(item); err != nil {
+			log.Printf("Failed to store key-value pair locally: %v", err)
+			failures[i]++
+		} else {
+			acks[i]++
+		}
+	}
+
+	decided := func(i int) bool {
+		return errs[i] != nil || acks[i] >= writeQuorum || acks[i]+failures[i] >= len(replicas[i])
+	}
+	pending := 0
+	for i := range items {
+		if !decided(i) {
+			pending++
+		}
+	}
+	for received := 0; pending > 0 && received < len(groups); received++ {
+		result := <-results
+		for _, i := range result.indexes {
+			if decided(i) {
+				continue
+			}
+			if result.ok {
+				acks[i]++
+			} else {
+				failures[i]++
+			}
+			if decided(i) {
+				pending--
+			}
+		}
+	}
+
+	for i := range items {
+		if errs[i] == nil && acks[i] < writeQuorum {
+			errs[i] = fmt.Errorf("write quorum not met: %d of %d required replicas acknowledged the write", acks[i], writeQuorum)
+		}
+	}
+	return acks, errs
+}
+
+// mgetRequest is the body of POST /mget.
+type mgetRequest struct {
+	Keys []string `json:"keys"`
+}
+
+// mgetResult is one key of the response to POST /mget. Found is false for
+// a key that does not exist, was deleted or has expired, and Error is set
+// for a key that could not be read. The other fields are those of a
+// single read.
+type mgetResult struct {
+	Key         string `json:"key"`
+	Found       bool   `json:"found"`
+	Value       any    `json:"value,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Siblings    []any  `json:"siblings,omitempty"`
+	Version     uint64 `json:"version,omitempty"`
+	Context     string `json:"context,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// mgetResponse is the response to POST /mget, with one result per key in
+// the order of the request.
+type mgetResponse struct {
+	Results []mgetResult `json:"results"`
+}
+
+// MGet reads many keys in one request.
+// It expects a POST request with a JSON body {"keys": ["a", "b"]} and
+// responds with the value of each key, in order. Every key is read as by
+// a single read, with R, "repair" and "stale" taken from the request the
+// same way, and several keys are read at once. In raft mode the read index
+// is confirmed once for the whole request.
+func (n *Node) MGet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var mget mgetRequest
+	if err := json.NewDecoder(r.Body).Decode(&mget); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(mget.Keys) > maxMGetKeys {
+		http.Error(w, fmt.Sprintf("too many keys: at most %d per request", maxMGetKeys), http.StatusBadRequest)
+		return
+	}
+
+	readQuorum := n.ReadQuorum
+	stale := r.URL.Query().Get("stale") == "true"
+	if n.raft == nil {
+		var err error
+		if readQuorum, err = n.quorumFor(r, "r", readQuorumHeader, n.ReadQuorum); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if !stale {
+		// every key read after this sees the writes committed before the request
+		if err := n.linearizableRead(r.Context()); err != nil {
+			http.Error(w, "Failed to confirm read index: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		stale = true
+	}
+	repair := n.readRepairFor(r)
+
+	response := mgetResponse{Results: make([]mgetResult, len(mget.Keys))}
+	reads := make(chan struct{}, mgetReads)
+	var wg sync.WaitGroup
+	for i, key := range mget.Keys {
+		wg.Add(1)
+		reads <- struct{}{}
+		go func(i int, key string) {
+			defer wg.Done()
+			response.Results[i] = n.mgetKey(r.Context(), key, readQuorum, repair, stale)
+			<-reads
+		}(i, key)
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// mgetKey reads one key of a POST /mget request.
+func (n *Node) mgetKey(ctx context.Context, key string, readQuorum int, repair, stale bool) mgetResult {
+	result := mgetResult{Key: key}
+	storeItem, live, err := n.read(ctx, key, readQuorum, repair, stale)
+	if errors.Is(err, errKeyNotFound) {
+		return result
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	result.Found = true
+	result.Value = live[0].Value
+	result.ContentType = live[0].ContentType
+	result.Version = storeItem.CurrentVersion()
+	if n.raft == nil {
+		result.Context = storeItem.Context().Encode()
+		if len(live) > 1 {
+			for _, v := range live {
+				result.Siblings = append(result.Siblings, v.Value)
+			}
+		}
+	}
+	return result
+}
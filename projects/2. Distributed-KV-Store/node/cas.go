@@ -0,0 +1,135 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/store"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/vclock"
+)
+
+// condition is the precondition of a conditional write. With IfAbsent the
+// write only succeeds if the key has no live value, and with IfVersion only
+// if the current version of the key is *IfVersion (0 meaning absent).
+type condition struct {
+	IfAbsent  bool    `json:"if_absent,omitempty"`
+	IfVersion *uint64 `json:"if_version,omitempty"`
+}
+
+// isSet reports whether c makes the write conditional.
+func (c condition) isSet() bool {
+	return c.IfAbsent || c.IfVersion != nil
+}
+
+// check returns a ConflictError if c does not hold for current, the copy of
+// key the write would replace.
+func (c condition) check(key string, current store.Store, found bool) error {
+	version := uint64(0)
+	absent := true
+	if found {
+		version = current.CurrentVersion()
+		absent = len(current.Live()) == 0
+	}
+
+	if c.IfAbsent && !absent {
+		return &ConflictError{Key: key, Version: version}
+	}
+	if c.IfVersion != nil && *c.IfVersion != version {
+		return &ConflictError{Key: key, Version: version}
+	}
+	return nil
+}
+
+// ConflictError is returned when the condition of a conditional write does
+// not hold. Version is the current version of the key.
+type ConflictError struct {
+	Key     string
+	Version uint64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("version conflict on key %s: current version is %d", e.Key, e.Version)
+}
+
+// writeConflict responds with 409 Conflict and the current version of the key.
+func writeConflict(w http.ResponseWriter, conflict *ConflictError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error":   "version conflict",
+		"key":     conflict.Key,
+		"version": conflict.Version,
+	})
+}
+
+// keyLocks serialises operations on the same key. Keys are spread over a
+// fixed number of mutexes by their hash, so operations on different keys
+// rarely wait for each other. A node has one set for the conditional writes
+// it coordinates, which hold their lock across replication, and another for
+// the read-merge-write of a key in its local store.
+type keyLocks [256]sync.Mutex
+
+// lock locks the mutex that guards key and returns it.
+func (l *keyLocks) lock(key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	mu := &l[h.Sum32()%uint32(len(l))]
+	mu.Lock()
+	return mu
+}
+
+// forwardConditional sends a conditional write to the primary replica of
+// key, the first of its replicas on the ring, which coordinates every
+// conditional write to the key. It returns false, without responding,
+// if this node is the primary.
+func (n *Node) forwardConditional(w http.ResponseWriter, r *http.Request, key, path string, body any) bool {
+	primary := n.replicasFor(key)[0]
+	if primary == n.Self {
+		return false
+	}
+	if r.Header.Get(forwardedHeader) != "" {
+		http.Error(w, "Not the primary replica of the key", http.StatusServiceUnavailable)
+		return true
+	}
+
+	n.forward(w, r, primary, path, body)
+	return true
+}
+
+// conditionalWrite writes item to the replicas of its key if cond holds.
+// The primary replica coordinates every conditional write to a key and runs
+// them one at a time: it reads the key from a majority of its replicas,
+// checks cond against what they hold and writes the new version to a
+// majority as well. Every read quorum then overlaps every earlier write
+// quorum, so the condition is checked against the latest conditional write
+// accepted on any replica, not only against the coordinator's copy.
+// The new version descends from every version that was read, and item is
+// updated with its clock and version number. It returns the number of
+// replicas that acknowledged the write, or a ConflictError.
+func (n *Node) conditionalWrite(item *store.Store, cond condition, writeQuorum int) (int, error) {
+	mu := n.keyLocks.lock(item.Key)
+	defer mu.Unlock()
+
+	majority := n.Replicas/2 + 1
+	current, found, err := n.quorumRead(item.Key, max(n.ReadQuorum, majority), false)
+	if err != nil {
+		return 0, err
+	}
+	if err := cond.check(item.Key, current, found); err != nil {
+		return 0, err
+	}
+
+	clock := vclock.Clock{}
+	item.Version = 1
+	if found {
+		clock = current.Context()
+		item.Version = current.NextVersion()
+	}
+	item.Clock = n.tick(clock)
+	item.Timestamp = time.Now().UnixNano()
+	return n.replicateWrite(*item, max(writeQuorum, majority))
+}
@@ -0,0 +1,123 @@
+package node
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/store"
+)
+
+// deadline is a time, in Unix nanoseconds, at which a key has to be looked at.
+type deadline struct {
+	key string
+	at  int64
+}
+
+// deadlineHeap orders deadlines earliest first, for container/heap.
+type deadlineHeap []deadline
+
+func (h deadlineHeap) Len() int           { return len(h) }
+func (h deadlineHeap) Less(i, j int) bool { return h[i].at < h[j].at }
+func (h deadlineHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *deadlineHeap) Push(x any)        { *h = append(*h, x.(deadline)) }
+func (h *deadlineHeap) Pop() any {
+	old := *h
+	d := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return d
+}
+
+// deadlines holds the next time each key needs the reaper or the tombstone
+// purger, so neither has to scan the store to find the keys that are due.
+// A deadline only says when to look at a key: the key is read and checked
+// again then, so a deadline that a later write made stale is harmless.
+// Only the earliest deadline of a key is kept.
+type deadlines struct {
+	mu    sync.Mutex
+	heap  deadlineHeap
+	queue map[string]int64
+}
+
+// add makes key due at at, unless it is already due earlier.
+func (d *deadlines) add(key string, at int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if current, ok := d.queue[key]; ok && current <= at {
+		return
+	}
+	if d.queue == nil {
+		d.queue = make(map[string]int64)
+	}
+	d.queue[key] = at
+	heap.Push(&d.heap, deadline{key: key, at: at})
+}
+
+// due removes and returns the keys whose deadline is at or before now.
+func (d *deadlines) due(now int64) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var keys []string
+	for len(d.heap) > 0 && d.heap[0].at <= now {
+		next := heap.Pop(&d.heap).(deadline)
+		if d.queue[next.key] != next.at {
+			continue // replaced by an earlier deadline, already returned
+		}
+		delete(d.queue, next.key)
+		keys = append(keys, next.key)
+	}
+	return keys
+}
+
+// trackedDB is the node's store. Every version written to it is noted in
+// the node's deadlines, whichever path wrote it, so expired keys and old
+// tombstones are found without scanning the store.
+type trackedDB struct {
+	store.Engine
+	n *Node
+}
+
+// Put stores item and notes when it next needs the reaper or the purger.
+func (db trackedDB) Put(item store.Store) error {
+	if err := db.Engine.Put(item); err != nil {
+		return err
+	}
+	db.n.track(item)
+	return nil
+}
+
+// track notes when item, the current copy of its key, expires and when its
+// tombstone may be purged.
+func (n *Node) track(item store.Store) {
+	if n.ReapInterval > 0 {
+		expiresAt := int64(0)
+		for _, v := range item.Versions() {
+			if !v.Deleted && v.ExpiresAt > 0 && (expiresAt == 0 || v.ExpiresAt < expiresAt) {
+				expiresAt = v.ExpiresAt
+			}
+		}
+		if expiresAt > 0 {
+			n.expiries.add(item.Key, expiresAt)
+		}
+	}
+	if n.TombstoneGrace > 0 && item.IsTombstone() {
+		grace := time.Duration(n.TombstoneGrace) * time.Second
+		n.purges.add(item.Key, item.Timestamp+grace.Nanoseconds())
+	}
+}
+
+// trackStore wraps DB so that writes are tracked, and tracks the keys it
+// already holds. That takes one scan of the store, on startup, and only
+// when expired keys are reaped or tombstones purged.
+func (n *Node) trackStore() {
+	n.DB = trackedDB{Engine: n.DB, n: n}
+	if n.ReapInterval <= 0 && n.TombstoneGrace <= 0 {
+		return
+	}
+	n.DB.Scan(func(item store.Store) bool {
+		n.track(item)
+		return true
+	})
+}
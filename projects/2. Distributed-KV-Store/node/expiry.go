@@ -0,0 +1,122 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/store"
+)
+
+// parseExpiry turns the ttl (seconds from now) or expiresAt (RFC 3339) of
+// a write into an absolute expiry time in Unix nanoseconds, or 0 if the key
+// does not expire.
+func parseExpiry(ttl int64, expiresAt string) (int64, error) {
+	switch {
+	case ttl != 0 && expiresAt != "":
+		return 0, errors.New("only one of ttl and expires_at can be given")
+	case ttl < 0:
+		return 0, errors.New("ttl must be a positive number of seconds")
+	case ttl > 0:
+		return time.Now().Add(time.Duration(ttl) * time.Second).UnixNano(), nil
+	case expiresAt != "":
+		at, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return 0, fmt.Errorf("invalid expires_at: %v", err)
+		}
+		if !at.After(time.Now()) {
+			return 0, errors.New("expires_at must be in the future")
+		}
+		return at.UnixNano(), nil
+	}
+	return 0, nil
+}
+
+// ReaperLoop periodically removes expired keys from the store.
+// Reads already ignore expired versions, so the reaper only frees space.
+func (n *Node) ReaperLoop() {
+	ticker := time.NewTicker(time.Duration(n.ReapInterval) * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n.reapExpired()
+	}
+}
+
+// reapExpired removes the expired versions of the keys that are due in the
+// expiry index; it does not scan the store.
+// In eventual mode an expired version becomes a tombstone, which every
+// replica derives in the same way from the replicated expiry time, and which
+// is purged like the tombstone of a delete. In raft mode the leader deletes
+// expired keys through the log.
+func (n *Node) reapExpired() {
+	now := time.Now()
+	retry := now.Add(time.Duration(n.ReapInterval) * time.Second).UnixNano()
+
+	var expired []store.Store
+	for _, key := range n.expiries.due(now.UnixNano()) {
+		item, ok := n.DB.Get(key)
+		if !ok {
+			continue // deleted meanwhile
+		}
+		reaped, ok := item.Expire(now.UnixNano())
+		if !ok {
+			n.track(item) // written again with a later expiry
+			continue
+		}
+		expired = append(expired, reaped)
+	}
+	if len(expired) == 0 {
+		return
+	}
+
+	if n.raft != nil {
+		n.reapThroughRaft(expired, retry)
+		return
+	}
+
+	reaped := 0
+	for _, item := range expired {
+		if err := n.mergeItem(item); err != nil {
+			log.Printf("Failed to reap expired key %s: %v", item.Key, err)
+			n.expiries.add(item.Key, retry)
+			continue
+		}
+		reaped++
+	}
+	log.Printf("Reaped %d expired keys", reaped)
+}
+
+// reapThroughRaft deletes the keys whose every version has expired by
+// committing an expire for each of them, which every node applies unless
+// the key was written again meanwhile. Only the leader does this; the other
+// nodes look at the keys again at retry, in case they become the leader.
+func (n *Node) reapThroughRaft(expired []store.Store, retry int64) {
+	if !n.raft.IsLeader() {
+		for _, item := range expired {
+			n.expiries.add(item.Key, retry)
+		}
+		return
+	}
+
+	reaped := 0
+	for i, item := range expired {
+		if !item.IsTombstone() {
+			continue
+		}
+		_, err := n.propose(context.Background(), command{Op: opExpire, Item: store.Store{Key: item.Key}})
+		if err != nil {
+			log.Printf("Failed to reap expired key %s: %v", item.Key, err)
+			for _, item := range expired[i:] {
+				n.expiries.add(item.Key, retry)
+			}
+			return
+		}
+		reaped++
+	}
+	if reaped > 0 {
+		log.Printf("Reaped %d expired keys", reaped)
+	}
+}
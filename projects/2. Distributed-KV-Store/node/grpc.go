@@ -0,0 +1,515 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/kvpb"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/raft"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/store"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/watch"
+)
+
+// forwardedKey is the gRPC metadata key that marks a call forwarded by
+// another node, like forwardedHeader for HTTP requests.
+const forwardedKey = "x-forwarded-by"
+
+// withGRPC serves the gRPC services of the node next to the HTTP handler
+// next, on the same port: HTTP/2 requests with a gRPC content type go to
+// the gRPC server, everything else to next. Plain-text HTTP/2 (h2c) is
+// accepted so gRPC works without TLS, as the HTTP API does.
+func (n *Node) withGRPC(next http.Handler) http.Handler {
+	server := grpc.NewServer()
+	kvpb.RegisterKVServer(server, &kvServer{n: n})
+	kvpb.RegisterReplicationServer(server, &replicationServer{n: n})
+
+	return h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			server.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}), &http2.Server{})
+}
+
+// grpcConns keeps one gRPC connection per peer.
+type grpcConns struct {
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+// get returns the connection to peer, creating it on first use. Nodes serve
+// gRPC on the port of their HTTP API, so the peer's URL is all it takes.
+func (c *grpcConns) get(peer string) (*grpc.ClientConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if conn, ok := c.conns[peer]; ok {
+		return conn, nil
+	}
+	u, err := url.Parse(peer)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid peer address %s", peer)
+	}
+	conn, err := grpc.NewClient(u.Host, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	if c.conns == nil {
+		c.conns = make(map[string]*grpc.ClientConn)
+	}
+	c.conns[peer] = conn
+	return conn, nil
+}
+
+// sendReplicasGRPC sends key-value pairs to peer with one Replicate call
+// and returns an error unless the peer stored all of them.
+func (n *Node) sendReplicasGRPC(peer string, items []store.Store) error {
+	conn, err := n.conns.get(peer)
+	if err != nil {
+		return err
+	}
+	req := &kvpb.ReplicateRequest{Items: make([]*kvpb.Item, 0, len(items))}
+	for _, item := range items {
+		pb, err := itemToProto(item)
+		if err != nil {
+			return fmt.Errorf("failed to encode key-value pair: %w", err)
+		}
+		req.Items = append(req.Items, pb)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(n.Timeout)*time.Second)
+	defer cancel()
+	if _, err := kvpb.NewReplicationClient(conn).Replicate(ctx, req); err != nil {
+		return err
+	}
+	log.Printf("Successfully stored %d key-value pairs on peer %s", len(items), peer)
+	return nil
+}
+
+// replicationServer serves the Replication service, which peers use
+// instead of POST /replicate with --transport=grpc.
+type replicationServer struct {
+	kvpb.UnimplementedReplicationServer
+	n *Node
+}
+
+// Replicate merges the items into the local store, like ReplicateKeyValue.
+func (s *replicationServer) Replicate(ctx context.Context, req *kvpb.ReplicateRequest) (*kvpb.ReplicateResponse, error) {
+	if s.n.raft != nil {
+		return nil, status.Error(codes.FailedPrecondition, "replication is handled by raft")
+	}
+
+	for _, pb := range req.Items {
+		item, err := itemFromProto(pb)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if err := s.n.mergeItem(item); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to store key-value pair: %v", err)
+		}
+	}
+	return &kvpb.ReplicateResponse{}, nil
+}
+
+// kvServer serves the KV service. Every call goes through the same read,
+// write and transaction paths as the HTTP API.
+type kvServer struct {
+	kvpb.UnimplementedKVServer
+	n *Node
+}
+
+// Get reads a key, like GET /store/key.
+func (s *kvServer) Get(ctx context.Context, req *kvpb.GetRequest) (*kvpb.GetResponse, error) {
+	n := s.n
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "a key is required")
+	}
+	readQuorum, err := n.grpcQuorum(req.ReadQuorum, n.ReadQuorum)
+	if err != nil {
+		return nil, err
+	}
+	repair := n.ReadRepair
+	if req.ReadRepair != nil {
+		repair = *req.ReadRepair
+	}
+
+	item, live, err := n.read(ctx, req.Key, readQuorum, repair, req.Stale)
+	if err != nil {
+		return nil, grpcStatus(err, codes.Unavailable)
+	}
+
+	value, err := valueToProto(live[0])
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to encode value: %v", err)
+	}
+	resp := &kvpb.GetResponse{
+		Value:     value,
+		Version:   item.CurrentVersion(),
+		ExpiresAt: live[0].ExpiresAt,
+	}
+	if n.raft == nil {
+		resp.Context = item.Context().Encode()
+		if len(live) > 1 {
+			for _, v := range live {
+				sibling, err := valueToProto(v)
+				if err != nil {
+					return nil, status.Errorf(codes.Internal, "failed to encode value: %v", err)
+				}
+				resp.Siblings = append(resp.Siblings, sibling)
+			}
+		}
+	}
+	return resp, nil
+}
+
+// Put writes a key, like PUT /v1/kv/{key}.
+func (s *kvServer) Put(ctx context.Context, req *kvpb.PutRequest) (*kvpb.PutResponse, error) {
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "a key is required")
+	}
+	value, contentType, err := decodeValue(req.Value.GetContentType(), req.Value.GetData())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	expiresAt, err := parseExpiry(req.Ttl, req.ExpiresAt)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	item := store.Store{
+		Key:         req.Key,
+		Value:       value,
+		ContentType: contentType,
+		ExpiresAt:   expiresAt,
+	}
+	writeQuorum, err := s.n.grpcQuorum(req.WriteQuorum, s.n.WriteQuorum)
+	if err != nil {
+		return nil, err
+	}
+	cond := condition{IfAbsent: req.IfAbsent, IfVersion: req.IfVersion}
+	version, acks, target, err := s.n.write(ctx, opPut, item, cond, req.Context, writeQuorum)
+	if err != nil {
+		return nil, grpcStatus(err, codes.Unavailable)
+	}
+	if target != "" {
+		client, ctx, err := s.forwardTo(ctx, target)
+		if err != nil {
+			return nil, err
+		}
+		return client.Put(ctx, req)
+	}
+	return &kvpb.PutResponse{Version: version, Acks: uint32(acks)}, nil
+}
+
+// Delete deletes a key, like DELETE /v1/kv/{key}.
+func (s *kvServer) Delete(ctx context.Context, req *kvpb.DeleteRequest) (*kvpb.DeleteResponse, error) {
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "a key is required")
+	}
+
+	item := store.Store{Key: req.Key, Deleted: true}
+	writeQuorum, err := s.n.grpcQuorum(req.WriteQuorum, s.n.WriteQuorum)
+	if err != nil {
+		return nil, err
+	}
+	cond := condition{IfVersion: req.IfVersion}
+	_, acks, target, err := s.n.write(ctx, opDelete, item, cond, req.Context, writeQuorum)
+	if err != nil {
+		return nil, grpcStatus(err, codes.Unavailable)
+	}
+	if target != "" {
+		client, ctx, err := s.forwardTo(ctx, target)
+		if err != nil {
+			return nil, err
+		}
+		return client.Delete(ctx, req)
+	}
+	return &kvpb.DeleteResponse{Acks: uint32(acks)}, nil
+}
+
+// forwardTo returns a client for target and the context to call it with.
+// A call that was forwarded already is not forwarded again, so a stale
+// view of the leader or of the ring cannot make nodes forward in a loop.
+func (s *kvServer) forwardTo(ctx context.Context, target string) (kvpb.KVClient, context.Context, error) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get(forwardedKey)) > 0 {
+		return nil, nil, status.Errorf(codes.Unavailable, "%s cannot forward a call forwarded by %s", s.n.Self, md.Get(forwardedKey)[0])
+	}
+	conn, err := s.n.conns.get(target)
+	if err != nil {
+		return nil, nil, status.Errorf(codes.Unavailable, "failed to reach %s: %v", target, err)
+	}
+	return kvpb.NewKVClient(conn), metadata.AppendToOutgoingContext(ctx, forwardedKey, s.n.Self), nil
+}
+
+// Scan streams the live keys of a range, like GET /keys, fetching them a
+// page at a time.
+func (s *kvServer) Scan(req *kvpb.ScanRequest, stream kvpb.KV_ScanServer) error {
+	n := s.n
+	if n.raft != nil && !req.Stale {
+		if err := n.linearizableRead(stream.Context()); err != nil {
+			return status.Errorf(codes.Unavailable, "failed to confirm read index: %v", err)
+		}
+	}
+
+	from, sent := max(req.Start, req.Prefix), 0
+	for {
+		limit := maxListLimit
+		if req.Limit > 0 {
+			limit = min(limit, int(req.Limit)-sent)
+		}
+		page, err := n.listKeys(req.Prefix, from, limit, req.Values)
+		if err != nil {
+			return status.Errorf(codes.Unavailable, "failed to list keys: %v", err)
+		}
+
+		for _, entry := range page.Keys {
+			kv := &kvpb.KeyValue{Key: entry.Key, Version: entry.Version}
+			if req.Values {
+				if kv.Value, err = valueToProto(store.Version{Value: entry.Value, ContentType: entry.ContentType}); err != nil {
+					return status.Errorf(codes.Internal, "failed to encode value: %v", err)
+				}
+			}
+			if err := stream.Send(kv); err != nil {
+				return err
+			}
+		}
+		sent += len(page.Keys)
+		if page.Next == "" || (req.Limit > 0 && sent >= int(req.Limit)) {
+			return nil
+		}
+		from = page.Keys[len(page.Keys)-1].Key + "\x00"
+	}
+}
+
+// Watch streams the changes to a key or a prefix, like GET /watch. A
+// revision that is no longer in the history fails with OUT_OF_RANGE, and a
+// watcher that falls behind with ABORTED; the client resumes from the
+// revision after the last one it received.
+func (s *kvServer) Watch(req *kvpb.WatchRequest, stream kvpb.KV_WatchServer) error {
+	if req.Key == "" && !req.Prefix {
+		return status.Error(codes.InvalidArgument, "a key or a prefix is required")
+	}
+
+	watcher, err := s.n.watch.Watch(req.Key, req.Prefix, req.Revision)
+	var compacted *watch.CompactedError
+	if errors.As(err, &compacted) {
+		return status.Error(codes.OutOfRange, compacted.Error())
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to watch: %v", err)
+	}
+	defer watcher.Close()
+
+	send := func(event watch.Event) error {
+		pb := &kvpb.WatchEvent{Type: event.Type, Key: event.Key, Version: event.Version, Revision: event.Revision}
+		if event.Type == watch.Put {
+			value, err := valueToProto(store.Version{Value: event.Value, ContentType: event.ContentType})
+			if err != nil {
+				return status.Errorf(codes.Internal, "failed to encode value: %v", err)
+			}
+			pb.Value = value
+		}
+		return stream.Send(pb)
+	}
+
+	for _, event := range watcher.Backlog() {
+		if err := send(event); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case event := <-watcher.Events():
+			if err := send(event); err != nil {
+				return err
+			}
+		case <-watcher.Done():
+			// deliver what was queued before the watcher was cancelled
+			for queued := true; queued; {
+				select {
+				case event := <-watcher.Events():
+					if err := send(event); err != nil {
+						return err
+					}
+				default:
+					queued = false
+				}
+			}
+			if err := watcher.Err(); err != nil {
+				return status.Error(codes.Aborted, err.Error())
+			}
+			return nil
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// Txn runs a transaction, like POST /txn.
+func (s *kvServer) Txn(ctx context.Context, req *kvpb.TxnRequest) (*kvpb.TxnResponse, error) {
+	n := s.n
+	txn := txnFromProto(req)
+	if err := txn.validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var result txnResult
+	if n.raft != nil {
+		applied, err := n.propose(ctx, command{Op: opTxn, Txn: &txn})
+		if errors.Is(err, raft.ErrNotLeader) {
+			leader := n.raft.Leader()
+			if leader == "" || leader == n.Self {
+				return nil, status.Error(codes.Unavailable, "no raft leader available")
+			}
+			client, ctx, err := s.forwardTo(ctx, leader)
+			if err != nil {
+				return nil, err
+			}
+			return client.Txn(ctx, req)
+		}
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "failed to commit transaction: %v", err)
+		}
+		if err, ok := applied.(error); ok {
+			return nil, status.Errorf(codes.Internal, "failed to apply transaction: %v", err)
+		}
+		result = applied.(txnResult)
+	} else {
+		var err error
+		if result, err = n.runTxn(txn); err != nil {
+			return nil, grpcStatus(err, codes.Unavailable)
+		}
+	}
+
+	resp := &kvpb.TxnResponse{Succeeded: result.Succeeded}
+	for _, r := range result.Responses {
+		resp.Responses = append(resp.Responses, &kvpb.OpResult{Op: r.Op, Key: r.Key, Version: r.Version})
+	}
+	return resp, nil
+}
+
+// grpcQuorum checks a quorum sent in a gRPC request; 0 selects def.
+// Quorums are ignored in raft mode.
+func (n *Node) grpcQuorum(quorum uint32, def int) (int, error) {
+	if quorum == 0 || n.raft != nil {
+		return def, nil
+	}
+	if int(quorum) > n.Replicas {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid quorum %d: must be between 1 and %d", quorum, n.Replicas)
+	}
+	return int(quorum), nil
+}
+
+// grpcStatus turns err into a gRPC status: the errors the HTTP API answers
+// with 404 or 409 get their own codes, and any other error gets code.
+func grpcStatus(err error, code codes.Code) error {
+	var conflict *ConflictError
+	switch {
+	case errors.Is(err, errKeyNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.As(err, &conflict):
+		return status.Errorf(codes.FailedPrecondition, "version conflict: key %s is at version %d", conflict.Key, conflict.Version)
+	case errors.Is(err, errTxnConflict):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, errInvalidContext):
+		return status.Error(codes.InvalidArgument, err.Error())
+	default:
+		return status.Error(code, err.Error())
+	}
+}
+
+// valueToProto encodes the value of v in its content type.
+func valueToProto(v store.Version) (*kvpb.Value, error) {
+	data, contentType, err := encodeValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return &kvpb.Value{Data: data, ContentType: contentType}, nil
+}
+
+// txnFromProto converts a gRPC transaction to the one POST /txn takes.
+func txnFromProto(req *kvpb.TxnRequest) txnRequest {
+	ops := func(pbs []*kvpb.Op) []txnOp {
+		ops := make([]txnOp, 0, len(pbs))
+		for _, op := range pbs {
+			ops = append(ops, txnOp{Op: op.Op, Key: op.Key, Value: op.Value})
+		}
+		return ops
+	}
+
+	txn := txnRequest{Success: ops(req.Success), Failure: ops(req.Failure)}
+	for _, c := range req.Compare {
+		txn.Compare = append(txn.Compare, txnCompare{Key: c.Key, Target: c.Target, Op: c.Op, Version: c.Version, Value: c.Value})
+	}
+	return txn
+}
+
+// itemToProto converts a key-value pair, every version included, to the
+// message replicas exchange. Values are JSON encoded.
+func itemToProto(item store.Store) (*kvpb.Item, error) {
+	pb := &kvpb.Item{Key: item.Key}
+	for _, v := range item.Versions() {
+		value, err := json.Marshal(v.Value)
+		if err != nil {
+			return nil, err
+		}
+		pb.Versions = append(pb.Versions, &kvpb.Version{
+			Value:       value,
+			ContentType: v.ContentType,
+			Timestamp:   v.Timestamp,
+			Clock:       v.Clock,
+			Deleted:     v.Deleted,
+			ExpiresAt:   v.ExpiresAt,
+			Version:     v.Version,
+		})
+	}
+	return pb, nil
+}
+
+// itemFromProto is the reverse of itemToProto.
+func itemFromProto(pb *kvpb.Item) (store.Store, error) {
+	if pb.Key == "" {
+		return store.Store{}, errors.New("item without a key")
+	}
+	if len(pb.Versions) == 0 {
+		return store.Store{}, fmt.Errorf("key %s has no versions", pb.Key)
+	}
+
+	versions := make([]store.Version, 0, len(pb.Versions))
+	for _, v := range pb.Versions {
+		var value any
+		decoder := json.NewDecoder(bytes.NewReader(v.Value))
+		decoder.UseNumber()
+		if err := decoder.Decode(&value); err != nil {
+			return store.Store{}, fmt.Errorf("invalid value for key %s: %w", pb.Key, err)
+		}
+		versions = append(versions, store.Version{
+			Value:       value,
+			ContentType: v.ContentType,
+			Timestamp:   v.Timestamp,
+			Clock:       v.Clock,
+			Deleted:     v.Deleted,
+			ExpiresAt:   v.ExpiresAt,
+			Version:     v.Version,
+		})
+	}
+	return store.FromVersions(pb.Key, versions), nil
+}
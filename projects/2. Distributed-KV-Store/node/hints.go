@@ -0,0 +1,59 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/config"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/hints"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/store"
+)
+
+// openHints opens the hints for writes peers missed. They are kept under
+// the data directory, or in memory when there is none.
+func (n *Node) openHints(cfg config.Config) {
+	opts := hints.Options{
+		TTL:        time.Duration(cfg.HintTTL) * time.Second,
+		MaxPerPeer: cfg.MaxHints,
+	}
+	if cfg.DataDir != "" {
+		opts.Dir = filepath.Join(cfg.DataDir, "hints")
+	}
+
+	h, err := hints.Open(opts)
+	if err != nil {
+		log.Fatalf("Failed to open hints: %v", err)
+	}
+	n.hints = h
+}
+
+// storeHint keeps a write peer did not acknowledge, so that it can be
+// handed off once the peer is back.
+func (n *Node) storeHint(peer string, item store.Store) {
+	err := n.hints.Add(peer, item)
+	switch {
+	case errors.Is(err, hints.ErrFull):
+		log.Printf("Dropping hint for key %s: peer %s has too many pending hints", item.Key, peer)
+	case err != nil:
+		log.Printf("Failed to store hint for peer %s: %v", peer, err)
+	}
+}
+
+// replayHints hands the writes peer missed over to it, oldest first.
+func (n *Node) replayHints(peer string) {
+	delivered, err := n.hints.Replay(peer, func(item store.Store) error {
+		if !n.sendReplica(peer, item) {
+			return fmt.Errorf("peer did not accept hinted write for key %s", item.Key)
+		}
+		return nil
+	})
+	if delivered > 0 {
+		log.Printf("Handed off %d hinted writes to peer %s", delivered, peer)
+	}
+	if err != nil {
+		log.Printf("Hinted handoff to peer %s stopped: %v", peer, err)
+	}
+}
@@ -0,0 +1,282 @@
+package node
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/store"
+)
+
+// Page sizes of GET /keys.
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// KeyEntry is one key in a listing. Value and ContentType are only set
+// when the values were asked for.
+type KeyEntry struct {
+	Key         string `json:"key"`
+	Value       any    `json:"value,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Version     uint64 `json:"version,omitempty"`
+}
+
+// ListResponse is the body returned by GET /keys. Next is set when more
+// keys may follow; passing it back as "continue" returns the next page.
+type ListResponse struct {
+	Keys []KeyEntry `json:"keys"`
+	Next string     `json:"next,omitempty"`
+}
+
+// rangeReply is a node's answer to GET /keys/local: the raw copies,
+// tombstones included, of the first keys of a range, and whether the
+// node holds more keys in the range after them.
+type rangeReply struct {
+	Items []store.Store `json:"items"`
+	More  bool          `json:"more"`
+}
+
+// ListKeys lists the keys in lexical order.
+// The query parameters are "prefix", to list only the keys that start with
+// it, "start", the first key to list, "limit", the page size (100 by
+// default, at most 1000), "values=true" to return the values too, and
+// "continue", the token returned with the previous page.
+// When the keys are partitioned every node is asked for its keys and the
+// answers are merged, so a listing covers the whole cluster. Deleted and
+// expired keys are left out. In raft mode the listing is linearizable
+// unless "stale=true" is given.
+func (n *Node) ListKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	limit, err := parseListLimit(query.Get("limit"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	from := max(query.Get("start"), prefix)
+	if token := query.Get("continue"); token != "" {
+		last, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			http.Error(w, "Invalid continue token", http.StatusBadRequest)
+			return
+		}
+		// the smallest key after the last one listed
+		from = max(from, string(last)+"\x00")
+	}
+
+	if n.raft != nil && query.Get("stale") != "true" {
+		if err := n.linearizableRead(r.Context()); err != nil {
+			http.Error(w, "Failed to confirm read index: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	response, err := n.listKeys(prefix, from, limit, query.Get("values") == "true")
+	if err != nil {
+		http.Error(w, "Failed to list keys: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// parseListLimit parses the "limit" query parameter.
+func parseListLimit(value string) (int, error) {
+	if value == "" {
+		return defaultListLimit, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 || limit > maxListLimit {
+		return 0, fmt.Errorf("invalid limit %s: must be between 1 and %d", value, maxListLimit)
+	}
+	return limit, nil
+}
+
+// listKeys returns up to limit live keys with prefix, starting at from.
+// Pages of the range are fetched until enough live keys are found, since
+// some of the keys fetched may turn out to be deleted or expired.
+func (n *Node) listKeys(prefix, from string, limit int, values bool) (ListResponse, error) {
+	response := ListResponse{Keys: []KeyEntry{}}
+	for {
+		items, more, err := n.gatherRange(prefix, from, limit)
+		if err != nil {
+			return ListResponse{}, err
+		}
+
+		for i, item := range items {
+			live := item.Live()
+			if len(live) == 0 {
+				continue
+			}
+			entry := KeyEntry{Key: item.Key, Version: item.CurrentVersion()}
+			if values {
+				entry.Value, entry.ContentType = live[0].Value, live[0].ContentType
+			}
+			response.Keys = append(response.Keys, entry)
+
+			if len(response.Keys) == limit {
+				if more || i < len(items)-1 {
+					response.Next = base64.RawURLEncoding.EncodeToString([]byte(item.Key))
+				}
+				return response, nil
+			}
+		}
+		if !more || len(items) == 0 {
+			return response, nil
+		}
+		from = items[len(items)-1].Key + "\x00"
+	}
+}
+
+// gatherRange returns the merged copies of the first keys with prefix,
+// starting at from, and whether more keys may follow them.
+// In raft mode, and when every node holds every key, the local store is
+// enough. Otherwise every node is asked for its first limit keys; the
+// answers are only complete up to the smallest last key of a node that
+// has more, so the keys after it are left for the next call.
+func (n *Node) gatherRange(prefix, from string, limit int) ([]store.Store, bool, error) {
+	if n.raft != nil || n.Replicas >= len(n.ring.Nodes()) {
+		reply := n.localRange(prefix, from, limit)
+		return reply.Items, reply.More, nil
+	}
+
+	nodes := n.ring.Nodes()
+	replies := make(chan rangeReply, len(nodes))
+	errs := make(chan error, len(nodes))
+	for _, node := range nodes {
+		if node == n.Self {
+			replies <- n.localRange(prefix, from, limit)
+			continue
+		}
+		go func(peer string) {
+			reply, err := n.fetchRange(peer, prefix, from, limit)
+			if err != nil {
+				errs <- err
+				return
+			}
+			replies <- reply
+		}(node)
+	}
+
+	merged := make(map[string]store.Store)
+	bound, bounded := "", false
+	failures := 0
+	for range nodes {
+		select {
+		case reply := <-replies:
+			for _, item := range reply.Items {
+				if existing, ok := merged[item.Key]; ok {
+					item, _ = store.Merge(existing, item)
+				}
+				merged[item.Key] = item
+			}
+			if reply.More && len(reply.Items) > 0 {
+				last := reply.Items[len(reply.Items)-1].Key
+				if !bounded || last < bound {
+					bound, bounded = last, true
+				}
+			}
+		case err := <-errs:
+			log.Printf("Failed to list keys on peer: %v", err)
+			failures++
+		}
+	}
+	// every key has N replicas, so it is only missed if all of them failed
+	if failures >= n.Replicas {
+		return nil, false, errors.New("too many nodes unreachable to list every key")
+	}
+
+	items := make([]store.Store, 0, len(merged))
+	for key, item := range merged {
+		if !bounded || key <= bound {
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Key < items[j].Key
+	})
+	return items, bounded, nil
+}
+
+// localRange returns the local copies of the first limit keys with prefix,
+// starting at from.
+func (n *Node) localRange(prefix, from string, limit int) rangeReply {
+	reply := rangeReply{Items: []store.Store{}}
+	n.DB.Range(from, func(item store.Store) bool {
+		if !strings.HasPrefix(item.Key, prefix) {
+			// keys are ordered, so no later key has the prefix either
+			return false
+		}
+		if len(reply.Items) == limit {
+			reply.More = true
+			return false
+		}
+		reply.Items = append(reply.Items, item)
+		return true
+	})
+	return reply
+}
+
+// fetchRange asks peer for its copies of the first limit keys with prefix,
+// starting at from.
+func (n *Node) fetchRange(peer, prefix, from string, limit int) (rangeReply, error) {
+	query := url.Values{}
+	query.Set("prefix", prefix)
+	query.Set("start", from)
+	query.Set("limit", strconv.Itoa(limit))
+
+	resp, err := n.client.Get(peer + "/keys/local?" + query.Encode())
+	if err != nil {
+		return rangeReply{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return rangeReply{}, fmt.Errorf("peer %s returned status %d", peer, resp.StatusCode)
+	}
+	var reply rangeReply
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return rangeReply{}, fmt.Errorf("failed to decode reply from %s: %w", peer, err)
+	}
+	return reply, nil
+}
+
+// ListLocalKeys returns this node's own copies of the first keys of a range,
+// tombstones and clocks included, for a node listing the whole cluster.
+// It takes the "prefix", "start" and "limit" query parameters.
+func (n *Node) ListLocalKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	limit, err := parseListLimit(query.Get("limit"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	prefix := query.Get("prefix")
+	reply := n.localRange(prefix, max(query.Get("start"), prefix), limit)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(reply)
+}
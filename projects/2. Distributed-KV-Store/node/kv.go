@@ -0,0 +1,285 @@
+package node
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/store"
+)
+
+// kvPath is the path the keys of the /v1/kv API live under.
+const kvPath = "/v1/kv/"
+
+// Headers of the /v1/kv API. The context of a key is returned by a read in
+// contextHeader and sent back with a write to replace the versions read.
+const (
+	contextHeader   = "X-Context"
+	expiresAtHeader = "X-Expires-At"
+)
+
+// APIError is the body of every error response of the /v1 API.
+type APIError struct {
+	Error  string `json:"error"`
+	Status int    `json:"status"`
+}
+
+// jsonErrorWriter turns the plain-text errors written with http.Error by
+// the handlers a /v1 request is served with into APIError bodies, so the
+// /v1 API answers every error in the same way.
+type jsonErrorWriter struct {
+	http.ResponseWriter
+	status  int
+	written bool
+}
+
+func (w *jsonErrorWriter) WriteHeader(status int) {
+	if status >= http.StatusBadRequest && strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		w.status = status
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *jsonErrorWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		return w.ResponseWriter.Write(p)
+	}
+	// http.Error writes the message at once; anything after it is dropped
+	if !w.written {
+		w.written = true
+		message := strings.TrimSpace(string(p))
+		if err := json.NewEncoder(w.ResponseWriter).Encode(APIError{Error: message, Status: w.status}); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// kvSibling is one of the concurrent versions of a key returned by
+// GET /v1/kv/{key}. Binary values are base64 encoded.
+type kvSibling struct {
+	Value       any    `json:"value"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// KV serves /v1/kv/{key}: GET reads a key, PUT writes it and DELETE
+// deletes it. The key is the rest of the path, URL-encoded, so keys may
+// contain any character, slashes included as %2F.
+// A PUT stores the request body with its Content-Type, and a GET returns
+// it with the same Content-Type: JSON values keep their types, text is
+// stored as a string and anything else, application/octet-stream for
+// example, as raw bytes. Values written with POST /store are returned as
+// JSON.
+// A GET returns the version of the key in the ETag header and, in eventual
+// mode, its context in the X-Context header. When the key has concurrent
+// versions the node responds with 300 Multiple Choices and a JSON list of
+// them. A write sent with that context replaces every version read.
+// Writes take "ttl" and "expires_at" query parameters, and are made
+// conditional with If-Match, holding a version, or If-None-Match: *, for a
+// key that must not exist. Quorums are chosen as for /store.
+// Errors are returned as JSON bodies with the message and status code.
+func (n *Node) KV(w http.ResponseWriter, r *http.Request) {
+	w = &jsonErrorWriter{ResponseWriter: w}
+
+	key, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), kvPath))
+	if err != nil || key == "" {
+		http.Error(w, "Invalid key", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		n.getKV(w, r, key)
+	case http.MethodPut:
+		n.putKV(w, r, key)
+	case http.MethodDelete:
+		n.deleteKV(w, r, key)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// getKV responds with the value of key in its own content type.
+func (n *Node) getKV(w http.ResponseWriter, r *http.Request, key string) {
+	item, live, ok := n.readKey(w, r, key)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("ETag", strconv.Quote(strconv.FormatUint(item.CurrentVersion(), 10)))
+	if n.raft == nil {
+		w.Header().Set(contextHeader, item.Context().Encode())
+	}
+	if live[0].ExpiresAt != 0 {
+		w.Header().Set(expiresAtHeader, time.Unix(0, live[0].ExpiresAt).UTC().Format(time.RFC3339Nano))
+	}
+
+	if len(live) > 1 {
+		siblings := make([]kvSibling, 0, len(live))
+		for _, v := range live {
+			siblings = append(siblings, kvSibling{Value: v.Value, ContentType: v.ContentType})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMultipleChoices)
+		json.NewEncoder(w).Encode(map[string]any{"siblings": siblings})
+		return
+	}
+
+	data, contentType, err := encodeValue(live[0])
+	if err != nil {
+		http.Error(w, "Failed to encode value: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// putKV stores the request body as the value of key.
+func (n *Node) putKV(w http.ResponseWriter, r *http.Request, key string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	keyValue := putRequest{
+		Key:       key,
+		Context:   r.Header.Get(contextHeader),
+		ExpiresAt: r.URL.Query().Get("expires_at"),
+	}
+	keyValue.Value, keyValue.ContentType, err = decodeValue(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if ttl := r.URL.Query().Get("ttl"); ttl != "" {
+		if keyValue.TTL, err = strconv.ParseInt(ttl, 10, 64); err != nil {
+			http.Error(w, "Invalid ttl: "+ttl, http.StatusBadRequest)
+			return
+		}
+	}
+	if keyValue.condition, err = kvCondition(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	n.putKey(w, r, r.URL.EscapedPath(), body, keyValue)
+}
+
+// deleteKV deletes key.
+func (n *Node) deleteKV(w http.ResponseWriter, r *http.Request, key string) {
+	keyValue := deleteRequest{
+		Key:     key,
+		Context: r.Header.Get(contextHeader),
+	}
+	var err error
+	if keyValue.condition, err = kvCondition(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	n.deleteKey(w, r, r.URL.EscapedPath(), []byte{}, keyValue)
+}
+
+// kvCondition reads the condition of a /v1/kv write from its If-Match and
+// If-None-Match headers.
+func kvCondition(r *http.Request) (condition, error) {
+	var cond condition
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if match != "*" {
+			return condition{}, errors.New("only If-None-Match: * is supported")
+		}
+		cond.IfAbsent = true
+	}
+	if match := r.Header.Get("If-Match"); match != "" {
+		version, err := strconv.ParseUint(strings.Trim(match, `"`), 10, 64)
+		if err != nil {
+			return condition{}, fmt.Errorf("invalid If-Match %s: must be a version", match)
+		}
+		cond.IfVersion = &version
+	}
+	return cond, nil
+}
+
+// isJSON reports whether mediaType is JSON.
+func isJSON(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// decodeValue turns the body of a write sent with contentType into the
+// value to store and the content type to store it with. JSON is decoded,
+// keeping its numbers exact, text is kept as a string and anything else is
+// stored base64 encoded. A missing content type means raw bytes.
+func decodeValue(contentType string, body []byte) (any, string, error) {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid content type %s", contentType)
+	}
+
+	switch {
+	case isJSON(mediaType):
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		var value any
+		if err := decoder.Decode(&value); err != nil {
+			return nil, "", fmt.Errorf("invalid JSON value: %v", err)
+		}
+		if _, err := decoder.Token(); err != io.EOF {
+			return nil, "", errors.New("invalid JSON value: unexpected data after the value")
+		}
+		return value, contentType, nil
+	case strings.HasPrefix(mediaType, "text/"):
+		if !utf8.Valid(body) {
+			return nil, "", errors.New("text values must be UTF-8")
+		}
+		return string(body), contentType, nil
+	default:
+		return base64.StdEncoding.EncodeToString(body), contentType, nil
+	}
+}
+
+// encodeValue returns the body and content type a GET returns for v, the
+// reverse of decodeValue. Values without a content type were written as
+// JSON through POST /store or a transaction.
+func encodeValue(v store.Version) ([]byte, string, error) {
+	mediaType, _, _ := mime.ParseMediaType(v.ContentType)
+	switch {
+	case v.ContentType == "" || isJSON(mediaType):
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(v.Value); err != nil {
+			return nil, "", err
+		}
+		contentType := v.ContentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), contentType, nil
+	case strings.HasPrefix(mediaType, "text/"):
+		return []byte(fmt.Sprint(v.Value)), v.ContentType, nil
+	default:
+		encoded, ok := v.Value.(string)
+		if !ok {
+			return nil, "", fmt.Errorf("binary value is a %T", v.Value)
+		}
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		return data, v.ContentType, err
+	}
+}
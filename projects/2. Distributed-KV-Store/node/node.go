@@ -2,33 +2,138 @@ package node
 
 import (
 	"bytes"
-	"crypto/sha256"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/config"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/hints"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/lsm"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/raft"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/replication"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/ring"
 	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/store"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/watch"
 )
 
 // Node represents a node in the distributed key-value store.
 // It contains the port on which the node listens, a list of peer nodes,
 // and a store that holds key-value pairs.
 // It also includes a PingFrequency for pinging peers and a Timeout for operations.
-// PeerStates is a map that tracks the state of each peer (up/down).
+// PeerStates is a map that tracks the state of each peer (up/down); it is
+// written by PingPeers and read through peerUp and peerStates.
+// SnapshotInterval and SnapshotThreshold control how often the store is
+// snapshotted when it is backed by a data directory.
+// Self is the URL peers use to reach this node, and Consistency is the
+// replication mode ("eventual" or "raft").
+// Replicas is the replication factor N, and WriteQuorum and ReadQuorum are
+// the default W and R used when a request does not ask for its own quorum.
+// AntiEntropyInterval is the number of seconds between Merkle tree
+// comparisons with each peer, and ReadRepair tells whether reads repair
+// stale replicas unless the request says otherwise. Tombstones left by
+// deletes are purged TombstoneGrace seconds after the delete, and expired
+// keys are reaped every ReapInterval seconds. Transport is how writes are
+// sent to replicas: "http" or "grpc". RespPort is the port Redis clients
+// connect to, empty when RESP is not served.
 type Node struct {
-	Port          string
-	Peers         []string
-	PeerStates    map[string]bool
-	DB            store.LocalDB
-	PingFrequency int
-	Timeout       int
+	Port                string
+	Peers               []string
+	PeerStates          map[string]bool
+	DB                  store.Engine
+	PingFrequency       int
+	Timeout             int
+	SnapshotInterval    int
+	SnapshotThreshold   int
+	Engine              string
+	Self                string
+	Consistency         string
+	Replicas            int
+	WriteQuorum         int
+	ReadQuorum          int
+	AntiEntropyInterval int
+	ReadRepair          bool
+	TombstoneGrace      int
+	ReapInterval        int
+	Transport           string
+	RespPort            string
+
+	// client sends replication requests to peers
+	client *http.Client
+
+	// ring places every key on its N replicas
+	ring *ring.Ring
+
+	// hints holds writes that peers missed while they were unreachable
+	hints *hints.Hints
+
+	// queues holds the writes waiting to be sent to each peer
+	queues *replication.Queues
+
+	// readRepairs counts the repairs done on the read path
+	readRepairs readRepairCounters
+
+	// peerMu guards PeerStates and pinged
+	peerMu sync.RWMutex
+
+	// pinged holds the peers that have been pinged at least once
+	pinged map[string]bool
+
+	// keyLocks serialises the conditional writes this node coordinates
+	keyLocks keyLocks
+
+	// storeLocks serialises the read-merge-write of each key in DB
+	storeLocks keyLocks
+
+	// txnLocks holds the keys locked by transactions prepared on this node
+	txnLocks txnLocks
+
+	// txnDecisions holds the outcome of the transactions this node coordinates
+	txnDecisions txnDecisions
+
+	// watch streams the changes to the local store to watchers
+	watch *watch.Hub
+
+	// durable is set when DB is backed by a write-ahead log and snapshots
+	durable *store.Durable
+
+	// lsm is set when DB is backed by the LSM tree, and raftLSM when it
+	// is in raft mode as well
+	lsm     *lsm.DB
+	raftLSM *raftLSM
+
+	// expiries and purges hold when keys are due for the reaper and the
+	// tombstone purger
+	expiries deadlines
+	purges   deadlines
+
+	// raft is set in raft mode; every write then goes through the Raft log
+	raft *raft.Raft
+
+	// conns holds the gRPC connections to peers
+	conns grpcConns
+
+	// respCursors holds the position of the SCANs of Redis clients
+	respCursors respCursors
+
+	// merkleTrees holds the Merkle trees built for the sync rounds of peers
+	merkleTrees merkleTrees
 }
 
 // NewNode creates a new Node instance with the specified port and peers.
 // It initializes the store and sets up the HTTP handler.
+// If a data directory is configured, the latest snapshot in it is loaded and
+// the write-ahead log is replayed on top, so the node starts with every key
+// it acknowledged before it was stopped. With the lsm engine the data lives
+// in SSTables under the data directory instead.
+// In raft mode the node also starts its Raft member.
 func NewNode(cfg config.Config) *Node {
 
 	peerState := make(map[string]bool)
@@ -37,30 +142,171 @@ func NewNode(cfg config.Config) *Node {
 	}
 
 	node := &Node{
-		Port:          cfg.Port,
-		Peers:         cfg.Peers,
-		PeerStates:    peerState,
-		DB:            store.LocalDB{}, // Initialize with an empty store
-		PingFrequency: cfg.PingFrequency,
-		Timeout:       cfg.Timeout,
+		Port:                cfg.Port,
+		Peers:               cfg.Peers,
+		PeerStates:          peerState,
+		pinged:              make(map[string]bool),
+		DB:                  store.NewLocalDB(), // Initialize with an empty in-memory store
+		PingFrequency:       cfg.PingFrequency,
+		Timeout:             cfg.Timeout,
+		SnapshotInterval:    cfg.SnapshotInterval,
+		SnapshotThreshold:   cfg.SnapshotThreshold,
+		Engine:              cfg.Engine,
+		Self:                cfg.Self,
+		Consistency:         cfg.Consistency,
+		Replicas:            cfg.Replicas,
+		WriteQuorum:         cfg.WriteQuorum,
+		ReadQuorum:          cfg.ReadQuorum,
+		AntiEntropyInterval: cfg.AntiEntropyInterval,
+		ReadRepair:          cfg.ReadRepair,
+		TombstoneGrace:      cfg.TombstoneGrace,
+		ReapInterval:        cfg.ReapInterval,
+		Transport:           cfg.Transport,
+		RespPort:            cfg.RespPort,
+		client:              &http.Client{Timeout: time.Duration(cfg.Timeout) * time.Second},
+		ring:                ring.New(cfg.VNodes),
+	}
+
+	// In raft mode revisions are log indexes, and the log is applied from
+	// the start on every run, or from where the LSM tree left it (see
+	// startRaft). Otherwise the changes before this run are gone.
+	compact := uint64(0)
+	if cfg.Consistency != "raft" {
+		compact = uint64(time.Now().UnixNano())
+	}
+	node.watch = watch.New(cfg.WatchHistory, compact)
+	node.ring.Add(cfg.Self)
+	for _, peer := range cfg.Peers {
+		node.ring.Add(peer)
+	}
+
+	// a replication factor of 0, or one larger than the cluster, means every node
+	if clusterSize := len(cfg.Peers) + 1; node.Replicas == 0 || node.Replicas > clusterSize {
+		node.Replicas = clusterSize
+	}
+	if node.WriteQuorum > node.Replicas || node.ReadQuorum > node.Replicas {
+		log.Fatalf("Quorums W=%d R=%d cannot exceed the replication factor N=%d",
+			node.WriteQuorum, node.ReadQuorum, node.Replicas)
+	}
+
+	node.openStorage(cfg)
+	node.trackStore()
+	node.openHints(cfg)
+	node.openQueues(cfg)
+	node.openTxnLog(cfg)
+
+	if cfg.Consistency == "raft" {
+		if err := node.startRaft(cfg); err != nil {
+			log.Fatalf("Failed to start raft: %v", err)
+		}
 	}
 
 	return node
 }
 
+// openStorage replaces the in-memory store with the configured persistent engine.
+// In raft mode the memory engine starts empty and is rebuilt by applying the
+// raft log. The LSM tree records the last command it holds with its writes,
+// and raft only applies the log after it; a tree that holds no complete
+// prefix of the log is discarded first, so nothing is applied twice.
+func (n *Node) openStorage(cfg config.Config) {
+	if cfg.Engine == "lsm" {
+		dir := filepath.Join(cfg.DataDir, "lsm")
+		db, err := lsm.Open(dir, lsm.DefaultOptions())
+		if err == nil && cfg.Consistency == "raft" && db.Applied() == 0 {
+			db.Close()
+			if err := os.RemoveAll(dir); err != nil {
+				log.Fatalf("Failed to clear LSM engine in %s: %v", cfg.DataDir, err)
+			}
+			db, err = lsm.Open(dir, lsm.DefaultOptions())
+		}
+		if err != nil {
+			log.Fatalf("Failed to open LSM engine in %s: %v", cfg.DataDir, err)
+		}
+		n.DB = db
+		n.lsm = db
+		if cfg.Consistency == "raft" {
+			n.raftLSM = &raftLSM{DB: db}
+			n.DB = n.raftLSM
+		}
+		log.Printf("Opened LSM engine in %s", cfg.DataDir)
+		return
+	}
+
+	if cfg.DataDir == "" {
+		log.Println("No data directory configured, keys will not survive a restart")
+		return
+	}
+	if cfg.Consistency == "raft" {
+		log.Println("Keys are rebuilt from the raft log on startup")
+		return
+	}
+
+	db, err := store.OpenDurable(cfg.DataDir, n.DB)
+	if err != nil {
+		log.Fatalf("Failed to open data directory %s: %v", cfg.DataDir, err)
+	}
+	n.DB = db
+	n.durable = db
+	log.Printf("Recovered %d keys from %s", db.Len(), cfg.DataDir)
+}
+
 func (n *Node) Start() {
 	// Set up HTTP server and routes
 	http.HandleFunc("/ping", n.Pong)
 	http.HandleFunc("/store", n.StoreKeyValue)
 	http.HandleFunc("/replicate", n.ReplicateKeyValue)
 	http.HandleFunc("/store/hash", n.StoreHash)
-	http.HandleFunc("/store/key", n.GetValue)
+	http.HandleFunc("/store/key", n.StoreKey)
+	http.HandleFunc("/store/local", n.GetLocalValue)
 	http.HandleFunc("/replicateAll", n.AcceptReplicateAll)
+	http.HandleFunc("/status", n.Status)
+	http.HandleFunc("/ring", n.Ring)
+	http.HandleFunc("/merkle/hashes", n.MerkleHashes)
+	http.HandleFunc("/merkle/entries", n.MerkleEntries)
+	http.HandleFunc("/txn", n.Txn)
+	http.HandleFunc("/batch", n.Batch)
+	http.HandleFunc("/mget", n.MGet)
+	http.HandleFunc("/keys", n.ListKeys)
+	http.HandleFunc("/keys/local", n.ListLocalKeys)
+	http.HandleFunc("/watch", n.Watch)
+	http.HandleFunc("/v1/kv/", n.KV)
+	http.HandleFunc("/snapshot", n.Snapshot)
+	if n.raft == nil {
+		http.HandleFunc("/txn/prepare", n.TxnPrepare)
+		http.HandleFunc("/txn/commit", n.TxnCommit)
+		http.HandleFunc("/txn/outcome", n.TxnOutcome)
+	}
+	if n.raft != nil {
+		http.HandleFunc("/raft/vote", n.raft.ServeRequestVote)
+		http.HandleFunc("/raft/append", n.raft.ServeAppendEntries)
+		http.HandleFunc("/raft/snapshot", n.raft.ServeInstallSnapshot)
+		http.HandleFunc("/raft/readindex", n.RaftReadIndex)
+		http.HandleFunc("/raft/members", n.RaftMembers)
+	}
 
 	go n.PingPeers()
+	if n.raft == nil {
+		go n.deliverTxns()
+	}
+	if n.durable != nil {
+		go n.SnapshotLoop()
+	}
+	if n.raft == nil && n.AntiEntropyInterval > 0 {
+		go n.AntiEntropyLoop()
+	}
+	if n.TombstoneGrace > 0 {
+		go n.TombstoneLoop()
+	}
+	if n.ReapInterval > 0 {
+		go n.ReaperLoop()
+	}
+	if n.RespPort != "" {
+		go n.ServeRESP()
+	}
 
 	log.Printf("Starting node on port %s with peers: %v", n.Port, n.Peers)
-	if err := http.ListenAndServe(":"+n.Port, nil); err != nil {
+	if err := http.ListenAndServe(":"+n.Port, n.withGRPC(http.DefaultServeMux)); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
@@ -107,7 +353,7 @@ func (n *Node) PingPeers() {
 			resp, err := client.Get(peer + "/ping")
 			if err != nil {
 				log.Printf("Peer %s is down: %v", peer, err)
-				n.PeerStates[peer] = false
+				n.setPeerUp(peer, false)
 				peerLoggedUp[peer] = false // Reset log flag when peer goes down
 				allUp = false              // Mark as false if any peer is down
 				continue
@@ -124,36 +370,23 @@ func (n *Node) PingPeers() {
 
 			// If response is successful, mark the peer as up
 			if resp.StatusCode == http.StatusOK {
-				n.PeerStates[peer] = true
+				n.setPeerUp(peer, true)
 				// Check if the peer was previously down and log it once
 				if !peerLoggedUp[peer] {
 					log.Printf("Peer %s is up", peer)
 					peerLoggedUp[peer] = true // Mark as logged
 
-					// compute the hash of the local store
-					localstoreHash, err := n.computeHash()
-					if err != nil {
-						log.Printf("Failed to compute local store hash: %v", err)
+					// in raft mode the leader brings the peer's log up to date
+					if n.raft != nil {
 						continue
 					}
 
-					// get the peer's store hash
-					// this is used to check if the local store matches the peer's store
-					peerStoreHash, err := n.getPeerStoreHash(peer)
-					if err != nil {
-						log.Printf("Failed to get peer store hash for %s: %v", peer, err)
-						continue
-					}
+					// hand off the writes the peer missed while it was down
+					n.replayHints(peer)
 
-					// compare the local store hash with the peer's store hash
-					// if they do not match, replicate the local store to the peer
-					if localstoreHash != peerStoreHash {
-						log.Printf("Local store hash %s does not match peer %s hash %s, replicating store", localstoreHash, peer, peerStoreHash)
-						if err := n.replicateStoreToPeer(peer); err != nil {
-							log.Printf("Failed to replicate store to peer %s: %v", peer, err)
-						}
-					} else {
-						log.Printf("Local store hash matches peer %s, no replication needed", peer)
+					// compare the keys both nodes replicate and repair the ones that differ
+					if err := n.antiEntropy(peer); err != nil {
+						log.Printf("Anti-entropy with peer %s failed: %v", peer, err)
 					}
 				}
 			} else {
@@ -175,65 +408,161 @@ func (n *Node) PingPeers() {
 	}
 }
 
-// StoreKeyValue stores a key-value pair in the node's local store.
-// It also replicates the key-value pair to all peers.
-// It expects a POST request with a JSON body containing the key and value.
+// setPeerUp records whether peer answered the last ping.
+func (n *Node) setPeerUp(peer string, up bool) {
+	n.peerMu.Lock()
+	defer n.peerMu.Unlock()
+	n.PeerStates[peer] = up
+	n.pinged[peer] = true
+}
+
+// peerUp reports whether peer answered the last ping.
+func (n *Node) peerUp(peer string) bool {
+	n.peerMu.RLock()
+	defer n.peerMu.RUnlock()
+	return n.PeerStates[peer]
+}
+
+// peerDown reports whether peer failed the last ping. A peer that has not
+// been pinged yet is not known to be down.
+func (n *Node) peerDown(peer string) bool {
+	n.peerMu.RLock()
+	defer n.peerMu.RUnlock()
+	return n.pinged[peer] && !n.PeerStates[peer]
+}
+
+// peerStates returns a copy of PeerStates.
+func (n *Node) peerStates() map[string]bool {
+	n.peerMu.RLock()
+	defer n.peerMu.RUnlock()
+
+	states := make(map[string]bool, len(n.PeerStates))
+	for peer, up := range n.PeerStates {
+		states[peer] = up
+	}
+	return states
+}
+
+// putRequest is the body of POST /store. ContentType is only set by
+// PUT /v1/kv, which stores values of any media type.
+type putRequest struct {
+	Key         string `json:"key"`
+	Value       any    `json:"value"`
+	ContentType string `json:"-"`
+	Context     string `json:"context,omitempty"`
+	TTL         int64  `json:"ttl,omitempty"`
+	ExpiresAt   string `json:"expires_at,omitempty"`
+	condition
+}
+
+// StoreKeyValue stores a key-value pair in the cluster.
+// Any node accepts the request: the pair is sent to the N replicas that own
+// the key on the ring, and the node responds once W of them have
+// acknowledged the write.
+// W is taken from the "w" query parameter or the X-Write-Quorum header,
+// and defaults to the node's write quorum.
+// It expects a POST request with a JSON body containing the key and value,
+// and optionally the context returned by a read: the write then replaces
+// every version that read returned. The value can be any JSON value and is
+// stored with its type. The key expires after "ttl" seconds or at
+// "expires_at" (RFC 3339) when either is given.
+// With "if_absent" the write only succeeds if the key does not exist, and
+// with "if_version" only if the key is at that version; otherwise the node
+// responds with 409 Conflict and the current version.
 func (n *Node) StoreKeyValue(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Parse the key and value from the request body
-	var keyValue struct {
-		Key   string `json:"key"`
-		Value string `json:"value"`
+	// Decode the JSON request body, keeping numbers exactly as they were sent
+	var keyValue putRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&keyValue); err != nil || keyValue.Key == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
 	}
 
-	// Decode the JSON request body into the keyValue struct
-	if err := json.NewDecoder(r.Body).Decode(&keyValue); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	n.putKey(w, r, "/store", keyValue, keyValue)
+}
+
+// putKey writes the value of a put request and responds with the number of
+// acknowledgements and the new version. When the write has to be made by
+// another node, the leader in raft mode or the primary replica of the key
+// for a conditional write, the request is forwarded to path on that node
+// with body.
+func (n *Node) putKey(w http.ResponseWriter, r *http.Request, path string, body any, keyValue putRequest) {
+	// The expiry is fixed here, so every replica expires the key at the same time
+	expiresAt, err := parseExpiry(keyValue.TTL, keyValue.ExpiresAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	// Store the key-value pair in the local store
 	newStore := store.Store{
-		Key:   keyValue.Key,
-		Value: keyValue.Value,
+		Key:         keyValue.Key,
+		Value:       keyValue.Value,
+		ContentType: keyValue.ContentType,
+		ExpiresAt:   expiresAt,
 	}
 
-	n.DB.Store = append(n.DB.Store, newStore)
-	fmt.Println("STORE: ", n.DB)
-
-	// Replicate the key-value pair to peers
-	for _, peer := range n.Peers {
-		// Re-encode the request body for replication to peers
-		body, err := json.Marshal(keyValue)
-		if err != nil {
-			log.Printf("Failed to marshal key-value pair: %v", err)
-			continue
-		}
-
-		// Create a new request to send to the peer for replication
-		resp, err := http.Post(peer+"/replicate", "application/json", bytes.NewBuffer(body))
-		if err != nil {
-			log.Printf("Failed to replicate to peer %s: %v", peer, err)
-			continue
+	// In raft mode the write is committed through the Raft log instead
+	if n.raft != nil {
+		cmd := command{Op: opPut, Item: newStore}
+		if keyValue.condition.isSet() {
+			cmd.Cond = &keyValue.condition
 		}
+		n.raftWrite(w, r, path, body, cmd)
+		return
+	}
 
-		// Ensure that the response body is closed
-		defer resp.Body.Close()
+	writeQuorum, err := n.quorumFor(r, "w", writeQuorumHeader, n.WriteQuorum)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-		if resp.StatusCode != http.StatusOK {
-			log.Printf("Failed to store key-value pair on peer %s: %d", peer, resp.StatusCode)
-		} else {
-			log.Printf("Successfully stored key-value pair on peer %s", peer)
+	// Store the key-value pair on the replicas of the key,
+	// waiting for enough of them to acknowledge it
+	var acks int
+	if keyValue.condition.isSet() {
+		if n.forwardConditional(w, r, keyValue.Key, path, body) {
+			return
+		}
+		acks, err = n.conditionalWrite(&newStore, keyValue.condition, writeQuorum)
+	} else {
+		if err = n.stampWrite(&newStore, keyValue.Context); err == nil {
+			acks, err = n.replicateWrite(newStore, writeQuorum)
 		}
 	}
+	if errors.Is(err, errInvalidContext) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var conflict *ConflictError
+	if errors.As(err, &conflict) {
+		writeConflict(w, conflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to store key-value pair: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"message": "Key-value pair stored",
+		"acks":    acks,
+		"version": newStore.Version,
+	})
 }
 
 // ReplicateKeyValue is a method to accept replication of kv pair from a peer.
-// It expects a POST request with a JSON body containing the key and value.
+// It expects a POST request with a JSON body containing the key and value,
+// or a JSON array of them when the peer sends a batch of writes.
 // it is used so all nodes can have the same key-value pairs.
 func (n *Node) ReplicateKeyValue(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -241,24 +570,45 @@ func (n *Node) ReplicateKeyValue(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Parse the key and value from the request body
-	var keyValue store.Store
-	if err := json.NewDecoder(r.Body).Decode(&keyValue); err != nil {
+	if n.raft != nil {
+		http.Error(w, "Replication is handled by raft", http.StatusConflict)
+		return
+	}
+
+	// Parse the key and value, or the batch of them, from the request body
+	var batch []store.Store
+	body, err := io.ReadAll(r.Body)
+	if err == nil {
+		if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+			err = json.Unmarshal(body, &batch)
+		} else {
+			batch = make([]store.Store, 1)
+			err = json.Unmarshal(body, &batch[0])
+		}
+	}
+	if err != nil || hasEmptyKey(batch) {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	// Store the key-value pair in the local store
-	n.DB.Store = append(n.DB.Store, keyValue)
-	fmt.Println("Received and stored key-value pair:", keyValue)
+	// Merge the key-value pairs into the local copies of their keys, in order
+	for _, keyValue := range batch {
+		if err := n.mergeItem(keyValue); err != nil {
+			http.Error(w, "Failed to store key-value pair", http.StatusInternalServerError)
+			return
+		}
+	}
 
 	// Respond with success
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"message": "Key-value pair replicated successfully"}`))
 }
 
+// StoreHash returns the root hash of the Merkle tree over the local store.
+// With a "peer" query parameter only the keys this node and the peer both
+// replicate are hashed, so two nodes can compare the part of the ring they share.
 func (n *Node) StoreHash(w http.ResponseWriter, r *http.Request) {
-	hash, err := n.computeHash()
+	tree, err := n.merkleTree(r.URL.Query().Get("peer"))
 	if err != nil {
 		http.Error(w, "Failed to compute hash", http.StatusInternalServerError)
 		return
@@ -267,89 +617,82 @@ func (n *Node) StoreHash(w http.ResponseWriter, r *http.Request) {
 	// repond with the hash
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf(`{"hash": "%s"}`, hash)))
-}
-
-func (n *Node) computeHash() (string, error) {
-	storeData, err := json.Marshal(n.DB.Store)
-	if err != nil {
-		return "", err
-	}
-
-	// Create a SHA-256 hash of the store data
-	hash := sha256.New()
-	hash.Write(storeData)
-
-	// Return the hash as a hexadecimal string
-	// fmt.Sprintf is used to format the hash as a hexadecimal string
-	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+	w.Write([]byte(fmt.Sprintf(`{"hash": "%x"}`, tree.Root())))
 }
 
-func (n *Node) getPeerStoreHash(peer string) (string, error) {
-	resp, err := http.Get(peer + "/store/hash")
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	var response struct {
-		Hash string `json:"hash"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return "", fmt.Errorf("failed to decode peer store hash: %w", err)
-	}
-
-	return response.Hash, nil
-}
-
-func (n *Node) replicateStoreToPeer(peer string) error {
-	// marshal the local store to JSON
-	storeData, err := json.Marshal(n.DB.Store)
-	if err != nil {
-		return fmt.Errorf("failed to marshal local store: %w", err)
-	}
-
-	// send the entire store to the peer
-	resp, err := http.Post(peer+"/replicateAll", "application/json", bytes.NewBuffer(storeData))
-	if err != nil {
-		return fmt.Errorf("failed to replicate store to peer %s: %w", peer, err)
-	}
-	defer resp.Body.Close()
-
-	// check if the response status is OK
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to replicate store to peer %s: received status code %d", peer, resp.StatusCode)
-	}
-
-	// log success
-	log.Printf("Successfully replicated store to peer %s", peer)
-	return nil
+// scanShared calls fn, in key order, for every key-value pair that both
+// this node and peer replicate, until fn returns false. An empty peer
+// selects the whole store. The store is streamed, not copied.
+func (n *Node) scanShared(peer string, fn func(store.Store) bool) {
+	n.DB.Scan(func(item store.Store) bool {
+		if peer != "" && !(n.ring.IsOwner(item.Key, n.Replicas, peer) && n.ring.IsOwner(item.Key, n.Replicas, n.Self)) {
+			return true
+		}
+		return fn(item)
+	})
 }
 
-// AcceptReplicateAll accepts a replication of the entire store from a peer.
+// AcceptReplicateAll accepts a replication of the store from a peer.
 // It expects a POST request with a JSON body containing an array of key-value pairs.
+// Every pair is merged into the local store by comparing vector clocks.
 func (n *Node) AcceptReplicateAll(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	if n.raft != nil {
+		http.Error(w, "Replication is handled by raft", http.StatusConflict)
+		return
+	}
+
 	// Parse the entire store from the request body
 	// This expects a JSON array of key-value pairs
 	var storeData []store.Store
-	if err := json.NewDecoder(r.Body).Decode(&storeData); err != nil {
+	if err := json.NewDecoder(r.Body).Decode(&storeData); err != nil || hasEmptyKey(storeData) {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	n.DB.Store = storeData
-	fmt.Println("Received and stored all key-value pairs:", n.DB.Store)
-	fmt.Println(n.DB)
+	for _, item := range storeData {
+		if err := n.mergeItem(item); err != nil {
+			http.Error(w, "Failed to store key-value pairs", http.StatusInternalServerError)
+			return
+		}
+	}
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"message": "All key-value pairs replicated successfully"}`))
 }
 
+// hasEmptyKey tells whether any of items has an empty key.
+func hasEmptyKey(items []store.Store) bool {
+	for _, item := range items {
+		if item.Key == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// StoreKey serves /store/key: GET reads a key and DELETE deletes it.
+func (n *Node) StoreKey(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		n.GetValue(w, r)
+	case http.MethodDelete:
+		n.DeleteValue(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// GetValue returns the value stored under a key.
+// It expects a GET request with a JSON body containing the key.
+// In eventual mode R replicas are asked for the key, where R is taken from the
+// "r" query parameter or the X-Read-Quorum header and defaults to the node's
+// read quorum. Read repair is turned on or off with the "repair" query
+// parameter or the X-Read-Repair header.
 func (n *Node) GetValue(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -366,22 +709,245 @@ func (n *Node) GetValue(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Search for the key in the local store
-	for _, storeItem := range n.DB.Store {
-		if storeItem.Key == keyValue.Key {
-			// If found, respond with the value
-			response := struct {
-				Value any `json:"value"`
-			}{
-				Value: storeItem.Value,
+	storeItem, live, ok := n.readKey(w, r, keyValue.Key)
+	if !ok {
+		return
+	}
+
+	// Respond with the value. Concurrent versions are returned as
+	// siblings, with a context the client sends back on its next write
+	// to replace them. Tombstones and expired versions are left out.
+	response := struct {
+		Value       any    `json:"value"`
+		ContentType string `json:"content_type,omitempty"`
+		Siblings    []any  `json:"siblings,omitempty"`
+		Version     uint64 `json:"version,omitempty"`
+		Context     string `json:"context,omitempty"`
+		ExpiresAt   string `json:"expires_at,omitempty"`
+	}{
+		Value:       live[0].Value,
+		ContentType: live[0].ContentType,
+		Version:     storeItem.CurrentVersion(),
+	}
+	if live[0].ExpiresAt != 0 {
+		response.ExpiresAt = time.Unix(0, live[0].ExpiresAt).UTC().Format(time.RFC3339Nano)
+	}
+	if n.raft == nil {
+		response.Context = storeItem.Context().Encode()
+		if len(live) > 1 {
+			for _, v := range live {
+				response.Siblings = append(response.Siblings, v.Value)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// errKeyNotFound is returned by read for a key that does not exist, was
+// deleted or has expired.
+var errKeyNotFound = errors.New("key not found")
+
+// readKey reads key for a client request and returns it with its live
+// versions, newest first. R is taken from the request as for GetValue, and
+// in raft mode the read is linearizable unless "stale=true" is given.
+// If the read fails or the key has no live version the error has been
+// written to w and the boolean is false.
+func (n *Node) readKey(w http.ResponseWriter, r *http.Request, key string) (store.Store, []store.Version, bool) {
+	readQuorum := n.ReadQuorum
+	if n.raft == nil {
+		var err error
+		if readQuorum, err = n.quorumFor(r, "r", readQuorumHeader, n.ReadQuorum); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return store.Store{}, nil, false
+		}
+	}
+
+	storeItem, live, err := n.read(r.Context(), key, readQuorum, n.readRepairFor(r), r.URL.Query().Get("stale") == "true")
+	if errors.Is(err, errKeyNotFound) {
+		// If not found, deleted or expired, respond with an error
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return store.Store{}, nil, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to read key: "+err.Error(), http.StatusServiceUnavailable)
+		return store.Store{}, nil, false
+	}
+	return storeItem, live, true
+}
+
+// read returns key with its live versions, newest first, or errKeyNotFound.
+// In raft mode the local store is read once it has caught up with every
+// write committed before the read, unless stale reads are acceptable.
+// In eventual mode readQuorum replicas of the key are asked for it and the
+// newest versions are kept; with repair stale replicas are repaired.
+func (n *Node) read(ctx context.Context, key string, readQuorum int, repair, stale bool) (store.Store, []store.Version, error) {
+	var storeItem store.Store
+	var ok bool
+	if n.raft != nil {
+		if !stale {
+			if err := n.linearizableRead(ctx); err != nil {
+				return store.Store{}, nil, fmt.Errorf("failed to confirm read index: %w", err)
 			}
+		}
+		storeItem, ok = n.DB.Get(key)
+	} else {
+		var err error
+		storeItem, ok, err = n.quorumRead(key, readQuorum, repair)
+		if err != nil {
+			return store.Store{}, nil, err
+		}
+	}
 
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(response)
+	live := storeItem.Live()
+	if !ok || len(live) == 0 {
+		return store.Store{}, nil, errKeyNotFound
+	}
+	return storeItem, live, nil
+}
+
+// errNoLeader is returned by write in raft mode while no leader is known.
+var errNoLeader = errors.New("no raft leader available")
+
+// write makes a put or a delete (op) of item, a tombstone for a delete, for
+// the APIs that do not forward HTTP requests. In raft mode it commits the
+// write through the log, otherwise it replicates it like putKey does. When
+// another node has to make the write, the leader or the primary replica of
+// the key for a conditional write, nothing is written and that node is
+// returned, for the caller to forward the write to. It returns the new
+// version and the number of replicas that acknowledged the write.
+func (n *Node) write(ctx context.Context, op string, item store.Store, cond condition, writeContext string, writeQuorum int) (uint64, int, string, error) {
+	if n.raft != nil {
+		cmd := command{Op: op, Item: item}
+		if cond.isSet() {
+			cmd.Cond = &cond
+		}
+		result, err := n.propose(ctx, cmd)
+		if errors.Is(err, raft.ErrNotLeader) {
+			leader := n.raft.Leader()
+			if leader == "" || leader == n.Self {
+				return 0, 0, "", errNoLeader
+			}
+			return 0, 0, leader, nil
+		}
+		if err != nil {
+			return 0, 0, "", fmt.Errorf("failed to commit write: %w", err)
+		}
+		if err, ok := result.(error); ok {
+			return 0, 0, "", err
+		}
+		version, _ := result.(uint64)
+		return version, 0, "", nil
+	}
+
+	var acks int
+	var err error
+	if cond.isSet() {
+		if primary := n.replicasFor(item.Key)[0]; primary != n.Self {
+			return 0, 0, primary, nil
+		}
+		acks, err = n.conditionalWrite(&item, cond, writeQuorum)
+	} else {
+		if err := n.stampWrite(&item, writeContext); err != nil {
+			return 0, 0, "", err
+		}
+		acks, err = n.replicateWrite(item, writeQuorum)
+	}
+	if err != nil {
+		return 0, acks, "", err
+	}
+	return item.Version, acks, "", nil
+}
+
+// deleteRequest is the body of DELETE /store/key.
+type deleteRequest struct {
+	Key     string `json:"key"`
+	Context string `json:"context,omitempty"`
+	condition
+}
+
+// DeleteValue deletes a key. In eventual mode the delete is written as a
+// tombstone to the replicas of the key, like any other write, so that
+// replicas that missed it do not bring the old value back; tombstones are
+// purged once every replica has them and the grace period has passed.
+// W is taken from the "w" query parameter or the X-Write-Quorum header.
+// It expects a DELETE request with a JSON body containing the key and,
+// optionally, the context returned by a read. With "if_version" the key is
+// only deleted if it is at that version.
+func (n *Node) DeleteValue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var keyValue deleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&keyValue); err != nil || keyValue.Key == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	n.deleteKey(w, r, "/store/key", keyValue, keyValue)
+}
+
+// deleteKey deletes the key of a delete request and responds with the
+// number of acknowledgements. Like putKey it forwards the request to path
+// on another node, with body, when that node has to make the delete.
+func (n *Node) deleteKey(w http.ResponseWriter, r *http.Request, path string, body any, keyValue deleteRequest) {
+	if keyValue.IfAbsent {
+		http.Error(w, "if_absent is not supported for deletes", http.StatusBadRequest)
+		return
+	}
+
+	if n.raft != nil {
+		cmd := command{Op: opDelete, Item: store.Store{Key: keyValue.Key}}
+		if keyValue.condition.isSet() {
+			cmd.Cond = &keyValue.condition
+		}
+		n.raftWrite(w, r, path, body, cmd)
+		return
+	}
+
+	writeQuorum, err := n.quorumFor(r, "w", writeQuorumHeader, n.WriteQuorum)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tombstone := store.Store{
+		Key:     keyValue.Key,
+		Deleted: true,
+	}
+	var acks int
+	if keyValue.condition.isSet() {
+		if n.forwardConditional(w, r, keyValue.Key, path, body) {
 			return
 		}
+		acks, err = n.conditionalWrite(&tombstone, keyValue.condition, writeQuorum)
+	} else {
+		if err = n.stampWrite(&tombstone, keyValue.Context); err == nil {
+			acks, err = n.replicateWrite(tombstone, writeQuorum)
+		}
+	}
+	if errors.Is(err, errInvalidContext) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var conflict *ConflictError
+	if errors.As(err, &conflict) {
+		writeConflict(w, conflict)
+		return
 	}
-	// If not found, respond with an error
-	http.Error(w, "Key not found", http.StatusNotFound)
+	if err != nil {
+		http.Error(w, "Failed to delete key: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"message": "Key deleted",
+		"acks":    acks,
+	})
 }
@@ -0,0 +1,294 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/replication"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/store"
+)
+
+// Headers a client can use instead of the "w" and "r" query parameters.
+const (
+	writeQuorumHeader = "X-Write-Quorum"
+	readQuorumHeader  = "X-Read-Quorum"
+)
+
+// quorumFor returns the quorum requested by r through the query parameter
+// param or the header, falling back to def. Besides a number of replicas,
+// "one", "quorum" (a majority of N) and "all" are accepted.
+func (n *Node) quorumFor(r *http.Request, param, header string, def int) (int, error) {
+	value := r.URL.Query().Get(param)
+	if value == "" {
+		value = r.Header.Get(header)
+	}
+
+	switch value {
+	case "":
+		return def, nil
+	case "one":
+		return 1, nil
+	case "quorum":
+		return n.Replicas/2 + 1, nil
+	case "all":
+		return n.Replicas, nil
+	}
+
+	quorum, err := strconv.Atoi(value)
+	if err != nil || quorum < 1 || quorum > n.Replicas {
+		return 0, fmt.Errorf("invalid quorum %s=%s: must be between 1 and %d", param, value, n.Replicas)
+	}
+	return quorum, nil
+}
+
+// replicasFor returns the N nodes that hold key on the ring.
+func (n *Node) replicasFor(key string) []string {
+	return n.ring.Owners(key, n.Replicas)
+}
+
+// mergeItem merges item into the local copy of its key. Versions the local
+// copy already supersedes are ignored and concurrent versions are kept as
+// siblings, so replicas converge no matter in which order writes arrive.
+// If a transaction has locked the key, mergeItem waits until it finishes.
+func (n *Node) mergeItem(item store.Store) error {
+	n.txnLocks.wait(item.Key)
+	return n.merge(item)
+}
+
+// merge is mergeItem without waiting for transactions. Merges of the same
+// key run one at a time, so none of them overwrites a version that another
+// one stored in between, and their changes reach watchers in order.
+func (n *Node) merge(item store.Store) error {
+	mu := n.storeLocks.lock(item.Key)
+	defer mu.Unlock()
+
+	existing, ok := n.DB.Get(item.Key)
+	if !ok {
+		if err := n.DB.Put(item); err != nil {
+			return err
+		}
+		n.publishChange(store.Store{}, false, item)
+		return nil
+	}
+
+	merged, changed := store.Merge(existing, item)
+	if !changed {
+		return nil
+	}
+	if err := n.DB.Put(merged); err != nil {
+		return err
+	}
+	n.publishChange(existing, true, merged)
+	return nil
+}
+
+// replicateWrite sends item to every replica of its key, storing it locally
+// if this node is one of them. It returns as soon as writeQuorum replicas
+// have acknowledged the write, and fails once that can no longer happen.
+// The write is queued for every other replica, and sent in order with the
+// writes queued before it. Replication to the remaining replicas carries on
+// in the background, and a replica that does not acknowledge the write, or
+// whose queue has no room for it, gets it as a hint later. With the drop
+// policy a write a full queue has no room for is dropped instead, and with
+// the fail policy it fails the write, before it is stored locally.
+func (n *Node) replicateWrite(item store.Store, writeQuorum int) (int, error) {
+	replicas := n.replicasFor(item.Key)
+	results := make(chan bool, len(replicas))
+
+	// with the fail policy the write is queued for every remote replica or,
+	// when a queue is full, for none of them and not stored here either
+	var queued map[string]<-chan error
+	if n.queues.Policy() == replication.Fail {
+		writes := make(map[string][]store.Store)
+		for _, replica := range replicas {
+			if replica != n.Self {
+				writes[replica] = []store.Store{item}
+			}
+		}
+		var err error
+		if queued, err = n.queues.EnqueueAll(writes); err != nil {
+			return 0, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(n.Timeout)*time.Second)
+	defer cancel()
+	for _, replica := range replicas {
+		if replica == n.Self {
+			continue
+		}
+		done, ok := queued[replica]
+		var err error
+		if !ok {
+			done, err = n.queues.Enqueue(ctx, replica, item)
+		}
+		if err != nil {
+			n.queueRejected(replica, err, item)
+			results <- false
+			continue
+		}
+		go func(peer string) {
+			err := <-done
+			if err != nil {
+				log.Printf("Failed to replicate to peer %s: %v", peer, err)
+				n.storeHint(peer, item)
+			}
+			results <- err == nil
+		}(replica)
+	}
+
+	acks, failures := 0, 0
+	for _, replica := range replicas {
+		if replica != n.Self {
+			continue
+		}
+		if err := n.mergeItem(item); err != nil {
+			log.Printf("Failed to store key-value pair locally: %v", err)
+			failures++
+		} else {
+			acks++
+		}
+	}
+
+	for acks < writeQuorum && acks+failures < len(replicas) {
+		if <-results {
+			acks++
+		} else {
+			failures++
+		}
+	}
+
+	if acks < writeQuorum {
+		return acks, fmt.Errorf("write quorum not met: %d of %d required replicas acknowledged the write", acks, writeQuorum)
+	}
+	return acks, nil
+}
+
+// readReply is one replica's answer to a read.
+type readReply struct {
+	replica string
+	item    store.Store
+	found   bool
+	err     error
+}
+
+// quorumRead asks the replicas of key for it and merges the versions found
+// in the first readQuorum answers. A replica that does not have the key
+// still counts towards the quorum. This node answers first when it is
+// a replica itself.
+// With repair set every replica is asked, and once all of them have
+// answered the ones that returned a stale or no version are repaired in
+// the background.
+func (n *Node) quorumRead(key string, readQuorum int, repair bool) (store.Store, bool, error) {
+	replicas := n.replicasFor(key)
+	replies := make(chan readReply, len(replicas))
+
+	var received []readReply
+	var merged store.Store
+	found := false
+	answers, failures := 0, 0
+	for _, replica := range replicas {
+		if replica == n.Self {
+			merged, found = n.localGet(key)
+			received = append(received, readReply{replica: n.Self, item: merged, found: found})
+			answers++
+		}
+	}
+	if answers >= readQuorum && (!repair || len(replicas) == 1) {
+		return merged, found, nil
+	}
+
+	for _, replica := range replicas {
+		if replica == n.Self {
+			continue
+		}
+		go func(peer string) {
+			replies <- n.readReplica(peer, key)
+		}(replica)
+	}
+
+	for answers < readQuorum && answers+failures < len(replicas) {
+		reply := <-replies
+		received = append(received, reply)
+		if reply.err != nil {
+			log.Printf("Failed to read key %s from replica: %v", key, reply.err)
+			failures++
+			continue
+		}
+		answers++
+		switch {
+		case !reply.found:
+		case !found:
+			merged, found = reply.item, true
+		default:
+			merged, _ = store.Merge(merged, reply.item)
+		}
+	}
+
+	if repair {
+		go n.readRepair(key, received, replies, len(replicas)-len(received))
+	}
+
+	if answers < readQuorum {
+		return store.Store{}, false, fmt.Errorf("read quorum not met: %d of %d required replicas answered", answers, readQuorum)
+	}
+	return merged, found, nil
+}
+
+// localGet returns the local copy of key. If a transaction has locked the
+// key it waits until the transaction finishes, so a read never sees some
+// of a transaction's writes without the others.
+func (n *Node) localGet(key string) (store.Store, bool) {
+	n.txnLocks.wait(key)
+	return n.DB.Get(key)
+}
+
+// readReplica fetches the local copy of key from peer.
+func (n *Node) readReplica(peer, key string) readReply {
+	resp, err := n.client.Get(peer + "/store/local?key=" + url.QueryEscape(key))
+	if err != nil {
+		return readReply{replica: peer, err: err}
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return readReply{replica: peer}
+	default:
+		return readReply{replica: peer, err: fmt.Errorf("peer %s returned status %d", peer, resp.StatusCode)}
+	}
+
+	var item store.Store
+	if err := json.NewDecoder(resp.Body).Decode(&item); err != nil {
+		return readReply{replica: peer, err: fmt.Errorf("failed to decode reply from %s: %w", peer, err)}
+	}
+	return readReply{replica: peer, item: item, found: true}
+}
+
+// GetLocalValue returns this node's own copy of a key, including its
+// clock and siblings, without asking any other replica. The coordinator of a quorum
+// read calls it on the replicas. It expects a GET request with the key in
+// the "key" query parameter.
+func (n *Node) GetLocalValue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	item, ok := n.localGet(r.URL.Query().Get("key"))
+	if !ok {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(item)
+}
@@ -0,0 +1,546 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/config"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/raft"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/store"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/watch"
+)
+
+// forwardedHeader marks a request a follower forwarded to the leader,
+// so that it is never forwarded a second time.
+const forwardedHeader = "X-Forwarded-By"
+
+// Operations carried by a command.
+const (
+	opPut    = "put"
+	opDelete = "delete"
+	opTxn    = "txn"
+	opBatch  = "batch"
+	opPurge  = "purge"
+	opExpire = "expire"
+)
+
+// command is a write replicated through the Raft log and applied to the
+// local store on every node once it is committed. A command with a Cond
+// is only applied if the condition holds when it is applied. A batch
+// carries its puts and deletes (tombstones) in Items. A purge removes the
+// tombstone of Item.Key if it is still at Item.Version, and an expire
+// deletes Item.Key if it has expired at Time. Time is when the
+// leader proposed the command, in Unix nanoseconds; the tombstones the
+// command writes are stamped with it, so every node writes the same ones.
+type command struct {
+	Op    string        `json:"op"`
+	Item  store.Store   `json:"item"`
+	Cond  *condition    `json:"cond,omitempty"`
+	Txn   *txnRequest   `json:"txn,omitempty"`
+	Items []store.Store `json:"items,omitempty"`
+	Time  int64         `json:"time,omitempty"`
+}
+
+// startRaft starts the node's Raft member. The initial cluster is this
+// node plus its peers, unless the node joins an existing cluster.
+func (n *Node) startRaft(cfg config.Config) error {
+	members := append([]string{cfg.Self}, cfg.Peers...)
+	if cfg.RaftJoin {
+		members = nil
+	}
+
+	dir := ""
+	if cfg.DataDir != "" {
+		dir = filepath.Join(cfg.DataDir, "raft")
+	}
+
+	electionTimeout := time.Duration(cfg.ElectionTimeout) * time.Millisecond
+	raftCfg := raft.Config{
+		ID:                cfg.Self,
+		Members:           members,
+		Dir:               dir,
+		ElectionTimeout:   electionTimeout,
+		HeartbeatInterval: electionTimeout / 10,
+		Transport: &raft.HTTPTransport{
+			Client:         &http.Client{Timeout: electionTimeout},
+			SnapshotClient: &http.Client{},
+		},
+		Apply:   n.applyCommand,
+		Restore: n.restoreRaftSnapshot,
+	}
+	// the LSM tree keeps the keys across restarts and knows how far it
+	// holds the log; the memory engine starts empty and applies all of it
+	if n.raftLSM != nil {
+		raftCfg.Applied = n.raftLSM.Applied()
+		n.watch.Compact(raftCfg.Applied)
+		if raftCfg.Applied > 0 {
+			log.Printf("The LSM engine holds the raft log up to index %d", raftCfg.Applied)
+		}
+	}
+	// the log is compacted after as many applied entries as the write-ahead
+	// log of the memory engine, and never when those snapshots are disabled
+	if cfg.SnapshotThreshold > 0 {
+		raftCfg.Snapshot = n.writeRaftSnapshot
+		raftCfg.SnapshotThreshold = uint64(cfg.SnapshotThreshold)
+	}
+	r, err := raft.New(raftCfg)
+	if err != nil {
+		return err
+	}
+
+	n.raft = r
+	return nil
+}
+
+// applyCommand applies a committed command to the local store.
+// It is called by Raft, in log order, on every node. Conditions are checked
+// and version numbers assigned here, so every node reaches the same result.
+// A put returns the version number it wrote. The changes are published to
+// watchers under the index of the command, so revisions are the same on
+// every node.
+// With the lsm engine the writes of the command are written in one batch
+// together with index, so a restart resumes the log after it.
+func (n *Node) applyCommand(index uint64, data []byte) any {
+	if n.raftLSM == nil {
+		return n.applyEntry(index, data)
+	}
+
+	n.raftLSM.begin()
+	result := n.applyEntry(index, data)
+	if err := n.raftLSM.commit(index); err != nil {
+		// the store no longer matches the log, and cannot skip an entry
+		log.Fatalf("Failed to write raft entry %d to the LSM engine: %v", index, err)
+	}
+	return result
+}
+
+// applyEntry applies the command of the log entry at index.
+func (n *Node) applyEntry(index uint64, data []byte) any {
+	// numbers in values are kept exactly, as the write that proposed them did
+	var cmd command
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&cmd); err != nil {
+		return fmt.Errorf("failed to decode command: %w", err)
+	}
+
+	switch cmd.Op {
+	case opTxn:
+		return n.applyTxn(index, cmd.Time, *cmd.Txn)
+	case opBatch:
+		return n.applyBatch(index, cmd.Time, cmd.Items)
+	}
+
+	existing, found := n.DB.Get(cmd.Item.Key)
+	if cmd.Cond != nil {
+		if err := cmd.Cond.check(cmd.Item.Key, existing, found); err != nil {
+			return err
+		}
+	}
+
+	switch cmd.Op {
+	case opPut:
+		item := cmd.Item
+		item.Version = 1
+		if found {
+			item.Version = existing.NextVersion()
+		}
+		if err := n.DB.Put(item); err != nil {
+			return err
+		}
+		n.watch.PublishAt(index, putEvent(item))
+		return item.Version
+	case opDelete:
+		deleted, err := n.applyDelete(cmd.Item.Key, cmd.Time, existing, found)
+		if err != nil {
+			return err
+		}
+		if deleted {
+			n.watch.PublishAt(index, watch.Event{Type: watch.Delete, Key: cmd.Item.Key})
+		}
+		return nil
+	case opExpire:
+		// a key written again since the leader found it expired is kept
+		if reaped, ok := existing.Expire(cmd.Time); !found || !ok || !reaped.IsTombstone() {
+			return nil
+		}
+		deleted, err := n.applyDelete(cmd.Item.Key, cmd.Time, existing, found)
+		if err != nil {
+			return err
+		}
+		if deleted {
+			n.watch.PublishAt(index, watch.Event{Type: watch.Delete, Key: cmd.Item.Key})
+		}
+		return nil
+	case opPurge:
+		// a key written again since the leader saw the tombstone is kept
+		if found && existing.IsTombstone() && existing.Version == cmd.Item.Version {
+			if err := n.DB.Delete(cmd.Item.Key); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q", cmd.Op)
+	}
+}
+
+// applyDelete replaces key, whose current copy is existing, with a tombstone
+// that takes the next version number, so a key written again after a delete
+// keeps counting up rather than starting at version 1 again. A missing or
+// already deleted key is left alone. It reports whether a live version was
+// deleted. The tombstone is stamped with timestamp, the time the command
+// was proposed, which decides when it is purged.
+func (n *Node) applyDelete(key string, timestamp int64, existing store.Store, found bool) (bool, error) {
+	if !found || existing.IsTombstone() {
+		return false, nil
+	}
+	tombstone := store.Store{
+		Key:       key,
+		Deleted:   true,
+		Version:   existing.NextVersion(),
+		Timestamp: timestamp,
+	}
+	if err := n.DB.Put(tombstone); err != nil {
+		return false, err
+	}
+	return len(existing.Live()) > 0, nil
+}
+
+// writeRaftSnapshot writes every item of the store, tombstones included,
+// as a line of JSON. Raft calls it between two applied commands, so the
+// snapshot matches the log up to the last applied one.
+func (n *Node) writeRaftSnapshot(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	var err error
+	n.DB.Range("", func(item store.Store) bool {
+		err = encoder.Encode(item)
+		return err == nil
+	})
+	return err
+}
+
+// restoreRaftSnapshot replaces the store with the items of a snapshot
+// written by writeRaftSnapshot that covers the log up to index. The changes
+// it skips are never published, so the watch history is compacted up to
+// index and current watchers are cancelled.
+// With the lsm engine the tree is marked as not matching the log until the
+// snapshot is fully restored.
+func (n *Node) restoreRaftSnapshot(index uint64, r io.Reader) error {
+	if n.raftLSM != nil {
+		if err := n.raftLSM.setApplied(0); err != nil {
+			return err
+		}
+	}
+
+	var keys []string
+	n.DB.Range("", func(item store.Store) bool {
+		keys = append(keys, item.Key)
+		return true
+	})
+	for _, key := range keys {
+		if err := n.DB.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	decoder := json.NewDecoder(r)
+	count := 0
+	for {
+		var item store.Store
+		if err := decoder.Decode(&item); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to decode snapshot item: %w", err)
+		}
+		if err := n.DB.Put(item); err != nil {
+			return err
+		}
+		count++
+	}
+
+	if n.raftLSM != nil {
+		if err := n.raftLSM.setApplied(index); err != nil {
+			return err
+		}
+	}
+
+	n.watch.Compact(index)
+	log.Printf("Restored %d keys from the raft snapshot at index %d", count, index)
+	return nil
+}
+
+// raftWrite commits cmd through the Raft log and responds once it has been
+// applied. Followers forward the request (body) to the leader's path instead.
+func (n *Node) raftWrite(w http.ResponseWriter, r *http.Request, path string, body any, cmd command) {
+	result, ok := n.raftPropose(w, r, path, body, cmd)
+	if !ok {
+		return
+	}
+
+	response := map[string]any{"message": "Write committed successfully"}
+	if version, ok := result.(uint64); ok {
+		response["version"] = version
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// raftPropose commits cmd through the Raft log and returns the result of
+// applying it. Followers forward the request (body) to the leader's path
+// instead. It returns false if the request has already been answered:
+// forwarded, or failed with an error response.
+func (n *Node) raftPropose(w http.ResponseWriter, r *http.Request, path string, body any, cmd command) (any, bool) {
+	result, err := n.propose(r.Context(), cmd)
+	if errors.Is(err, raft.ErrNotLeader) {
+		n.forwardToLeader(w, r, path, body)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to commit write: "+err.Error(), http.StatusServiceUnavailable)
+		return nil, false
+	}
+	var conflict *ConflictError
+	if err, ok := result.(error); ok && errors.As(err, &conflict) {
+		writeConflict(w, conflict)
+		return nil, false
+	}
+	if err, ok := result.(error); ok {
+		http.Error(w, "Failed to apply write: "+err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return result, true
+}
+
+// propose commits cmd through the Raft log and returns the result of
+// applying it, which is an error if the command failed. It fails with
+// raft.ErrNotLeader on a follower, or if leadership was lost before the
+// command was committed.
+func (n *Node) propose(ctx context.Context, cmd command) (any, error) {
+	if !n.raft.IsLeader() {
+		return nil, raft.ErrNotLeader
+	}
+
+	cmd.Time = time.Now().UnixNano()
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode command: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(n.Timeout)*time.Second)
+	defer cancel()
+	return n.raft.Propose(ctx, data)
+}
+
+// forwardToLeader sends body to the same path on the current leader
+// and relays the leader's response to the client.
+func (n *Node) forwardToLeader(w http.ResponseWriter, r *http.Request, path string, body any) {
+	leader := n.raft.Leader()
+	if leader == "" || leader == n.Self || r.Header.Get(forwardedHeader) != "" {
+		http.Error(w, "No raft leader available", http.StatusServiceUnavailable)
+		return
+	}
+
+	n.forward(w, r, leader, path, body)
+}
+
+// forward sends body to path on target, keeping the method, query and
+// quorum headers of r, and relays target's response to the client.
+// A []byte body is sent as it is, with the content type and the
+// conditional headers of r; any other body is sent as JSON.
+func (n *Node) forward(w http.ResponseWriter, r *http.Request, target, path string, body any) {
+	headers := []string{writeQuorumHeader, readQuorumHeader}
+	contentType := "application/json"
+	data, raw := body.([]byte)
+	if raw {
+		headers = append(headers, contextHeader, "If-Match", "If-None-Match")
+		contentType = r.Header.Get("Content-Type")
+	} else {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			http.Error(w, "Failed to encode request", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	url := target + path
+	if r.URL.RawQuery != "" {
+		url += "?" + r.URL.RawQuery
+	}
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, url, bytes.NewReader(data))
+	if err != nil {
+		http.Error(w, "Failed to forward request", http.StatusInternalServerError)
+		return
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set(forwardedHeader, n.Self)
+	for _, header := range headers {
+		if value := r.Header.Get(header); value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+
+	client := &http.Client{Timeout: time.Duration(n.Timeout) * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		http.Error(w, "Failed to reach "+target+": "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// linearizableRead waits until the local store reflects every write that
+// was committed before the read started. The leader confirms its commit
+// index with a majority; followers ask the leader for it.
+func (n *Node) linearizableRead(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(n.Timeout)*time.Second)
+	defer cancel()
+
+	var index uint64
+	var err error
+	if n.raft.IsLeader() {
+		index, err = n.raft.ReadIndex(ctx)
+	} else {
+		index, err = n.leaderReadIndex(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	return n.raft.WaitApplied(ctx, index)
+}
+
+// leaderReadIndex asks the leader for a read index.
+func (n *Node) leaderReadIndex(ctx context.Context) (uint64, error) {
+	leader := n.raft.Leader()
+	if leader == "" {
+		return 0, errors.New("no raft leader available")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, leader+"/raft/readindex", nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("leader %s returned status %d", leader, resp.StatusCode)
+	}
+
+	var response struct {
+		Index uint64 `json:"index"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return 0, fmt.Errorf("failed to decode read index: %w", err)
+	}
+	return response.Index, nil
+}
+
+// RaftReadIndex returns the leader's confirmed commit index.
+// Followers call it before serving a linearizable read.
+func (n *Node) RaftReadIndex(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(n.Timeout)*time.Second)
+	defer cancel()
+
+	index, err := n.raft.ReadIndex(ctx)
+	if err != nil {
+		http.Error(w, "Failed to confirm read index: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]uint64{"index": index})
+}
+
+// RaftMembers lists the cluster members (GET) or changes them (POST).
+// A POST expects a JSON body {"action": "add" | "remove", "id": "<node url>"}
+// and is forwarded to the leader when received by a follower.
+func (n *Node) RaftMembers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		response := struct {
+			Leader  string   `json:"leader"`
+			Members []string `json:"members"`
+		}{
+			Leader:  n.raft.Leader(),
+			Members: n.raft.Members(),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(response)
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var change struct {
+		Action string `json:"action"`
+		ID     string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil || change.ID == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !n.raft.IsLeader() {
+		n.forwardToLeader(w, r, "/raft/members", change)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(n.Timeout)*time.Second)
+	defer cancel()
+
+	var err error
+	switch change.Action {
+	case "add":
+		err = n.raft.AddMember(ctx, change.ID)
+	case "remove":
+		err = n.raft.RemoveMember(ctx, change.ID)
+	default:
+		http.Error(w, "Action must be add or remove", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case errors.Is(err, raft.ErrConfigInProgress):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "Failed to change membership: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	log.Printf("Raft membership change committed: %s %s", change.Action, change.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"message": "Membership change committed"}`))
+}
@@ -0,0 +1,96 @@
+package node
+
+import (
+	"sync"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/lsm"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/store"
+)
+
+// raftLSM is the LSM engine of a node in raft mode. The writes of a command
+// are buffered while it is applied and written in one batch together with
+// the index of the command, so the tree never holds half a command, and a
+// restart resumes the log after the last command the tree holds instead of
+// applying the whole log again.
+type raftLSM struct {
+	*lsm.DB
+
+	// mu guards the writes of the command being applied. pending holds
+	// them by key, nil for a delete, so the command reads its own writes.
+	mu      sync.Mutex
+	batch   *lsm.Batch
+	pending map[string]*store.Store
+}
+
+// Get returns the key-value pair stored under key, including the writes of
+// the command being applied.
+func (db *raftLSM) Get(key string) (store.Store, bool) {
+	db.mu.Lock()
+	item, ok := db.pending[key]
+	db.mu.Unlock()
+	if !ok {
+		return db.DB.Get(key)
+	}
+	if item == nil {
+		return store.Store{}, false
+	}
+	return *item, true
+}
+
+// Put stores the key-value pair, as part of the command being applied if
+// there is one.
+func (db *raftLSM) Put(item store.Store) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.batch == nil {
+		return db.DB.Put(item)
+	}
+	if err := db.batch.Put(item); err != nil {
+		return err
+	}
+	db.pending[item.Key] = &item
+	return nil
+}
+
+// Delete removes the key, as part of the command being applied if there
+// is one.
+func (db *raftLSM) Delete(key string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.batch == nil {
+		return db.DB.Delete(key)
+	}
+	db.batch.Delete(key)
+	db.pending[key] = nil
+	return nil
+}
+
+// begin starts buffering the writes of a command.
+func (db *raftLSM) begin() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.batch = &lsm.Batch{}
+	db.pending = make(map[string]*store.Store)
+}
+
+// commit writes the buffered writes of the command at index in the log.
+func (db *raftLSM) commit(index uint64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.batch.SetApplied(index)
+	err := db.DB.Write(db.batch)
+	db.batch, db.pending = nil, nil
+	return err
+}
+
+// setApplied records that the tree holds the log up to index, or that it
+// does not match the log when index is 0.
+func (db *raftLSM) setApplied(index uint64) error {
+	var batch lsm.Batch
+	batch.SetApplied(index)
+	return db.DB.Write(&batch)
+}
@@ -0,0 +1,112 @@
+package node
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/store"
+)
+
+// readRepairHeader lets a client turn read repair on or off for one read,
+// like the "repair" query parameter.
+const readRepairHeader = "X-Read-Repair"
+
+// ReadRepairStats counts the work done by read repair.
+// Reads is the number of reads that were checked, StaleReplicas the number
+// of replicas that answered with a stale or missing version, Repairs the
+// number of those that were brought up to date and Failures the number of
+// repairs that did not go through.
+type ReadRepairStats struct {
+	Reads         uint64 `json:"reads"`
+	StaleReplicas uint64 `json:"stale_replicas"`
+	Repairs       uint64 `json:"repairs"`
+	Failures      uint64 `json:"failures"`
+}
+
+// readRepairCounters are the live counters behind ReadRepairStats.
+type readRepairCounters struct {
+	reads         atomic.Uint64
+	staleReplicas atomic.Uint64
+	repairs       atomic.Uint64
+	failures      atomic.Uint64
+}
+
+// stats returns a copy of the counters.
+func (c *readRepairCounters) stats() ReadRepairStats {
+	return ReadRepairStats{
+		Reads:         c.reads.Load(),
+		StaleReplicas: c.staleReplicas.Load(),
+		Repairs:       c.repairs.Load(),
+		Failures:      c.failures.Load(),
+	}
+}
+
+// readRepairFor reports whether read repair is wanted for r: the "repair"
+// query parameter or the X-Read-Repair header, or the node's default.
+func (n *Node) readRepairFor(r *http.Request) bool {
+	value := r.URL.Query().Get("repair")
+	if value == "" {
+		value = r.Header.Get(readRepairHeader)
+	}
+	if repair, err := strconv.ParseBool(value); err == nil {
+		return repair
+	}
+	return n.ReadRepair
+}
+
+// readRepair waits for the outstanding replies of a read, merges every
+// version the replicas returned and sends the result to each replica that
+// answered with a stale or missing version.
+func (n *Node) readRepair(key string, received []readReply, replies <-chan readReply, outstanding int) {
+	for i := 0; i < outstanding; i++ {
+		received = append(received, <-replies)
+	}
+
+	var merged store.Store
+	found := false
+	for _, reply := range received {
+		switch {
+		case reply.err != nil || !reply.found:
+		case !found:
+			merged, found = reply.item, true
+		default:
+			merged, _ = store.Merge(merged, reply.item)
+		}
+	}
+	n.readRepairs.reads.Add(1)
+	if !found {
+		return
+	}
+
+	for _, reply := range received {
+		if reply.err != nil {
+			continue
+		}
+		if reply.found {
+			if _, stale := store.Merge(reply.item, merged); !stale {
+				continue
+			}
+		}
+
+		n.readRepairs.staleReplicas.Add(1)
+		ok := false
+		if reply.replica == n.Self {
+			if err := n.mergeItem(merged); err != nil {
+				log.Printf("Failed to repair key %s locally: %v", key, err)
+			} else {
+				ok = true
+			}
+		} else {
+			ok = n.sendReplica(reply.replica, merged)
+		}
+
+		if ok {
+			n.readRepairs.repairs.Add(1)
+			log.Printf("Read repair updated key %s on %s", key, reply.replica)
+		} else {
+			n.readRepairs.failures.Add(1)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/config"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/replication"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/store"
+)
+
+// maxReplicationBackoff caps the wait between two attempts to send a batch
+// of writes to a peer.
+const maxReplicationBackoff = 2 * time.Second
+
+// openQueues sets up the outbound queue of each peer. Sends to a peer that
+// has not failed a ping are retried for up to the node's timeout; a write
+// that is given up, or that a peer that is down did not accept, is kept as
+// a hint.
+func (n *Node) openQueues(cfg config.Config) {
+	n.queues = replication.New(n.sendReplicas, replication.Options{
+		Capacity:   cfg.ReplicationQueue,
+		MaxBatch:   cfg.ReplicationBatch,
+		Policy:     replication.Policy(cfg.ReplicationPolicy),
+		GiveUp:     time.Duration(cfg.Timeout) * time.Second,
+		MaxBackoff: maxReplicationBackoff,
+		Down:       n.peerDown,
+	})
+}
+
+// sendReplica sends a key-value pair to peer, over the node's transport,
+// and reports whether the peer stored it.
+func (n *Node) sendReplica(peer string, item store.Store) bool {
+	if err := n.sendReplicas(peer, []store.Store{item}); err != nil {
+		log.Printf("Failed to replicate to peer %s: %v", peer, err)
+		return false
+	}
+	return true
+}
+
+// sendReplicas sends key-value pairs to peer in one request, over the
+// node's transport, and returns an error unless the peer stored all of them.
+func (n *Node) sendReplicas(peer string, items []store.Store) error {
+	if n.Transport == "grpc" {
+		return n.sendReplicasGRPC(peer, items)
+	}
+
+	// a single pair is sent on its own, as nodes without batches expect it
+	var body []byte
+	var err error
+	if len(items) == 1 {
+		body, err = json.Marshal(items[0])
+	} else {
+		body, err = json.Marshal(items)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode key-value pairs: %w", err)
+	}
+	resp, err := n.client.Post(peer+"/replicate", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer responded with status %d", resp.StatusCode)
+	}
+	log.Printf("Successfully stored %d key-value pairs on peer %s", len(items), peer)
+	return nil
+}
+
+// queueRejected handles writes the queue of peer had no room for. With the
+// drop policy they are dropped, and the replica catches up through
+// anti-entropy; otherwise they are kept as hints.
+func (n *Node) queueRejected(peer string, err error, items ...store.Store) {
+	if n.queues.Policy() == replication.Drop {
+		log.Printf("Dropping %d writes for peer %s: %v", len(items), peer, err)
+		return
+	}
+	log.Printf("Handing off %d writes: %v for peer %s", len(items), err, peer)
+	for _, item := range items {
+		n.storeHint(peer, item)
+	}
+}
@@ -0,0 +1,659 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/resp"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/store"
+)
+
+const (
+	// maxRespBackoff bounds the random wait before a command that reads a
+	// key and writes it back tries again because the key changed.
+	maxRespBackoff = 50 * time.Millisecond
+
+	// maxRespCursors is the number of SCAN cursors a node remembers; the
+	// oldest one is forgotten to make room for a new one.
+	maxRespCursors = 10000
+)
+
+// Errors returned to Redis clients, with Redis's messages where Redis has one.
+var (
+	errRespNotInteger = errors.New("value is not an integer or out of range")
+	errRespOverflow   = errors.New("increment or decrement would overflow")
+	errRespSyntax     = errors.New("syntax error")
+	errRespEmptyKey   = errors.New("keys must not be empty")
+)
+
+// respCommand is a command Redis clients can send. arity is the number of
+// arguments, the name included; a negative arity is a minimum.
+type respCommand struct {
+	arity int
+	run   func(n *Node, ctx context.Context, args []string, w *resp.Writer)
+}
+
+// respCommands holds the supported commands by lowercase name.
+var respCommands = map[string]respCommand{
+	"ping":    {-1, (*Node).respPing},
+	"command": {-1, (*Node).respCommand},
+	"get":     {2, (*Node).respGet},
+	"set":     {-3, (*Node).respSet},
+	"del":     {-2, (*Node).respDel},
+	"exists":  {-2, (*Node).respExists},
+	"keys":    {2, (*Node).respKeys},
+	"scan":    {-2, (*Node).respScan},
+	"incr":    {2, (*Node).respIncr},
+	"expire":  {3, (*Node).respExpire},
+	"ttl":     {2, (*Node).respTTL},
+}
+
+// ServeRESP serves the Redis protocol on RespPort, so Redis clients can
+// read and write keys with GET, SET (with EX, PX, NX and XX), DEL, EXISTS,
+// KEYS, SCAN, INCR, EXPIRE and TTL. The commands are mapped onto the same
+// read and write paths as the HTTP API: a SET is replicated like
+// POST /store, with the node's default quorums, and stores the value as a
+// string; in raft mode writes go through the leader. GET returns strings
+// as they are and any other value in the encoding GET /v1/kv returns it in.
+// Commands that read a key and write it back, like INCR, only write if the
+// key did not change in between, and try again if it did. SCAN cursors are
+// only known to the node that returned them.
+func (n *Node) ServeRESP() {
+	listener, err := net.Listen("tcp", ":"+n.RespPort)
+	if err != nil {
+		log.Fatalf("Failed to listen for RESP clients: %v", err)
+	}
+	log.Printf("Serving RESP on port %s", n.RespPort)
+	if err := resp.Serve(listener, n.handleRESP); err != nil {
+		log.Fatalf("Failed to serve RESP clients: %v", err)
+	}
+}
+
+// handleRESP runs a command sent by a Redis client.
+func (n *Node) handleRESP(args []string, w *resp.Writer) {
+	name := strings.ToLower(args[0])
+	cmd, ok := respCommands[name]
+	if !ok {
+		w.Error(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || len(args) < -cmd.arity {
+		w.Error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(n.Timeout)*time.Second)
+	defer cancel()
+	cmd.run(n, ctx, args, w)
+}
+
+// respError writes err as an error reply.
+func respError(w *resp.Writer, err error) {
+	w.Error("ERR " + err.Error())
+}
+
+// respPing answers PING [message].
+func (n *Node) respPing(ctx context.Context, args []string, w *resp.Writer) {
+	switch len(args) {
+	case 1:
+		w.SimpleString("PONG")
+	case 2:
+		w.BulkString(args[1])
+	default:
+		w.Error("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+// respCommand answers COMMAND, which clients send to discover the server's
+// commands, with an empty list.
+func (n *Node) respCommand(ctx context.Context, args []string, w *resp.Writer) {
+	w.Array(0)
+}
+
+// respGet answers GET key.
+func (n *Node) respGet(ctx context.Context, args []string, w *resp.Writer) {
+	_, live, err := n.read(ctx, args[1], n.ReadQuorum, n.ReadRepair, false)
+	if errors.Is(err, errKeyNotFound) {
+		w.Null()
+		return
+	}
+	if err != nil {
+		respError(w, err)
+		return
+	}
+
+	// a string written without a content type is returned as it is
+	if s, ok := live[0].Value.(string); ok && live[0].ContentType == "" {
+		w.BulkString(s)
+		return
+	}
+	data, _, err := encodeValue(live[0])
+	if err != nil {
+		respError(w, err)
+		return
+	}
+	w.Bulk(data)
+}
+
+// respSet answers SET key value [EX seconds | PX milliseconds] [NX | XX].
+func (n *Node) respSet(ctx context.Context, args []string, w *resp.Writer) {
+	key, value := args[1], args[2]
+	if key == "" {
+		respError(w, errRespEmptyKey)
+		return
+	}
+	if !utf8.ValidString(value) {
+		w.Error("ERR values must be valid UTF-8")
+		return
+	}
+
+	item := store.Store{Key: key, Value: value}
+	var nx, xx, expiry bool
+	for i := 3; i < len(args); i++ {
+		switch option := strings.ToUpper(args[i]); {
+		case option == "NX" && !xx:
+			nx = true
+		case option == "XX" && !nx:
+			xx = true
+		case (option == "EX" || option == "PX") && !expiry && i+1 < len(args):
+			i++
+			amount, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				respError(w, errRespNotInteger)
+				return
+			}
+			unit := time.Second
+			if option == "PX" {
+				unit = time.Millisecond
+			}
+			var ok bool
+			if item.ExpiresAt, ok = respExpiry(amount, unit); !ok {
+				w.Error("ERR invalid expire time in 'set' command")
+				return
+			}
+			expiry = true
+		default:
+			respError(w, errRespSyntax)
+			return
+		}
+	}
+
+	var err error
+	wrote := true
+	switch {
+	case nx:
+		_, err = n.respWrite(ctx, opPut, item, condition{IfAbsent: true}, "")
+	case xx:
+		wrote, err = n.respUpdate(ctx, key, func(live []store.Version) (string, store.Store, error) {
+			if live == nil {
+				return "", store.Store{}, nil
+			}
+			return opPut, item, nil
+		})
+	default:
+		_, err = n.respWrite(ctx, opPut, item, condition{}, "")
+	}
+
+	var conflict *ConflictError
+	switch {
+	case errors.As(err, &conflict) || !wrote:
+		w.Null()
+	case err != nil:
+		respError(w, err)
+	default:
+		w.SimpleString("OK")
+	}
+}
+
+// respDel answers DEL key [key ...] with the number of keys deleted.
+func (n *Node) respDel(ctx context.Context, args []string, w *resp.Writer) {
+	var deleted int64
+	for _, key := range args[1:] {
+		current, _, err := n.read(ctx, key, n.ReadQuorum, n.ReadRepair, false)
+		if errors.Is(err, errKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			respError(w, err)
+			return
+		}
+
+		// the delete replaces every version that was read
+		tombstone := store.Store{Key: key, Deleted: true}
+		if _, err := n.respWrite(ctx, opDelete, tombstone, condition{}, current.Context().Encode()); err != nil {
+			respError(w, err)
+			return
+		}
+		deleted++
+	}
+	w.Integer(deleted)
+}
+
+// respExists answers EXISTS key [key ...] with the number of keys that
+// exist; a key given twice is counted twice.
+func (n *Node) respExists(ctx context.Context, args []string, w *resp.Writer) {
+	var found int64
+	for _, key := range args[1:] {
+		_, _, err := n.read(ctx, key, n.ReadQuorum, n.ReadRepair, false)
+		if errors.Is(err, errKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			respError(w, err)
+			return
+		}
+		found++
+	}
+	w.Integer(found)
+}
+
+// respKeys answers KEYS pattern with every key matching pattern.
+// Only the keys that start with the literal prefix of the pattern are
+// listed, so a pattern like "user:*" does not walk the whole keyspace.
+func (n *Node) respKeys(ctx context.Context, args []string, w *resp.Writer) {
+	pattern := args[1]
+	var keys []string
+	from := ""
+	for {
+		page, err := n.listKeys(resp.Prefix(pattern), from, maxListLimit, false)
+		if err != nil {
+			respError(w, err)
+			return
+		}
+		for _, entry := range page.Keys {
+			if resp.Match(pattern, entry.Key) {
+				keys = append(keys, entry.Key)
+			}
+		}
+		if page.Next == "" {
+			break
+		}
+		from = page.Keys[len(page.Keys)-1].Key + "\x00"
+	}
+
+	w.Array(len(keys))
+	for _, key := range keys {
+		w.BulkString(key)
+	}
+}
+
+// respScan answers SCAN cursor [MATCH pattern] [COUNT count]. Each call
+// looks at the next COUNT keys, 10 by default, in lexical order and returns
+// those matching the pattern, with the cursor of the next call or 0 once
+// every key has been seen.
+func (n *Node) respScan(ctx context.Context, args []string, w *resp.Writer) {
+	from := ""
+	if cursor := args[1]; cursor != "0" {
+		var ok bool
+		if from, ok = n.respCursors.get(cursor); !ok {
+			w.Error("ERR invalid cursor")
+			return
+		}
+	}
+
+	pattern, count := "*", 10
+	for i := 2; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			respError(w, errRespSyntax)
+			return
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			var err error
+			if count, err = strconv.Atoi(args[i+1]); err != nil {
+				respError(w, errRespNotInteger)
+				return
+			}
+			if count < 1 {
+				respError(w, errRespSyntax)
+				return
+			}
+		default:
+			respError(w, errRespSyntax)
+			return
+		}
+	}
+
+	page, err := n.listKeys(resp.Prefix(pattern), from, min(count, maxListLimit), false)
+	if err != nil {
+		respError(w, err)
+		return
+	}
+	var keys []string
+	for _, entry := range page.Keys {
+		if resp.Match(pattern, entry.Key) {
+			keys = append(keys, entry.Key)
+		}
+	}
+	next := "0"
+	if page.Next != "" {
+		next = n.respCursors.add(page.Keys[len(page.Keys)-1].Key + "\x00")
+	}
+
+	w.Array(2)
+	w.BulkString(next)
+	w.Array(len(keys))
+	for _, key := range keys {
+		w.BulkString(key)
+	}
+}
+
+// respIncr answers INCR key with the incremented value. A missing key
+// counts as 0. A JSON number stays a number, and the key keeps its
+// content type and expiry.
+func (n *Node) respIncr(ctx context.Context, args []string, w *resp.Writer) {
+	key := args[1]
+	if key == "" {
+		respError(w, errRespEmptyKey)
+		return
+	}
+	var result int64
+	_, err := n.respUpdate(ctx, key, func(live []store.Version) (string, store.Store, error) {
+		if live == nil {
+			result = 1
+			return opPut, store.Store{Key: key, Value: "1"}, nil
+		}
+
+		number, ok := respInteger(live[0])
+		if !ok {
+			return "", store.Store{}, errRespNotInteger
+		}
+		if number == math.MaxInt64 {
+			return "", store.Store{}, errRespOverflow
+		}
+		result = number + 1
+
+		item := store.Store{
+			Key:         key,
+			Value:       strconv.FormatInt(result, 10),
+			ContentType: live[0].ContentType,
+			ExpiresAt:   live[0].ExpiresAt,
+		}
+		if _, isNumber := live[0].Value.(json.Number); isNumber {
+			item.Value = json.Number(strconv.FormatInt(result, 10))
+		}
+		return opPut, item, nil
+	})
+	if err != nil {
+		respError(w, err)
+		return
+	}
+	w.Integer(result)
+}
+
+// respExpire answers EXPIRE key seconds with 1, or 0 if the key does not
+// exist. The value is written again with its new expiry; a time that is
+// not in the future deletes the key.
+func (n *Node) respExpire(ctx context.Context, args []string, w *resp.Writer) {
+	key := args[1]
+	seconds, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		respError(w, errRespNotInteger)
+		return
+	}
+	var expiresAt int64
+	if seconds > 0 {
+		var ok bool
+		if expiresAt, ok = respExpiry(seconds, time.Second); !ok {
+			w.Error("ERR invalid expire time in 'expire' command")
+			return
+		}
+	}
+
+	wrote, err := n.respUpdate(ctx, key, func(live []store.Version) (string, store.Store, error) {
+		switch {
+		case live == nil:
+			return "", store.Store{}, nil
+		case expiresAt == 0:
+			return opDelete, store.Store{Key: key, Deleted: true}, nil
+		}
+		return opPut, store.Store{
+			Key:         key,
+			Value:       live[0].Value,
+			ContentType: live[0].ContentType,
+			ExpiresAt:   expiresAt,
+		}, nil
+	})
+	if err != nil {
+		respError(w, err)
+		return
+	}
+	if wrote {
+		w.Integer(1)
+	} else {
+		w.Integer(0)
+	}
+}
+
+// respTTL answers TTL key with the seconds left before the key expires,
+// -1 if it does not expire and -2 if it does not exist.
+func (n *Node) respTTL(ctx context.Context, args []string, w *resp.Writer) {
+	_, live, err := n.read(ctx, args[1], n.ReadQuorum, n.ReadRepair, false)
+	switch {
+	case errors.Is(err, errKeyNotFound):
+		w.Integer(-2)
+	case err != nil:
+		respError(w, err)
+	case live[0].ExpiresAt == 0:
+		w.Integer(-1)
+	default:
+		left := time.Until(time.Unix(0, live[0].ExpiresAt))
+		w.Integer(int64((left + time.Second/2) / time.Second))
+	}
+}
+
+// respExpiry returns the expiry time, in Unix nanoseconds, amount units
+// from now. It returns false if amount is not positive or too large.
+func respExpiry(amount int64, unit time.Duration) (int64, bool) {
+	if amount <= 0 || amount > (math.MaxInt64-time.Now().UnixNano())/int64(unit) {
+		return 0, false
+	}
+	return time.Now().Add(time.Duration(amount) * unit).UnixNano(), true
+}
+
+// respInteger returns the value of v as an integer, for INCR. JSON numbers
+// and strings holding an integer qualify; binary values do not.
+func respInteger(v store.Version) (int64, bool) {
+	switch value := v.Value.(type) {
+	case json.Number:
+		number, err := value.Int64()
+		return number, err == nil
+	case string:
+		if mediaType, _, _ := mime.ParseMediaType(v.ContentType); v.ContentType != "" &&
+			!isJSON(mediaType) && !strings.HasPrefix(mediaType, "text/") {
+			return 0, false
+		}
+		number, err := strconv.ParseInt(value, 10, 64)
+		return number, err == nil
+	}
+	return 0, false
+}
+
+// respUpdate reads key and writes back what update makes of its live
+// versions, nil if the key does not exist, on the condition that the key
+// is still at the version that was read. When the key changed in between
+// it is read again after a random wait, until the command times out.
+// update returns the operation and the item to write, or an empty
+// operation to write nothing. respUpdate reports whether a write was made.
+// The key is read from a majority of its replicas, like the primary does
+// to check the condition, so that a stale replica cannot fail every try.
+func (n *Node) respUpdate(ctx context.Context, key string, update func(live []store.Version) (string, store.Store, error)) (bool, error) {
+	readQuorum := max(n.ReadQuorum, n.Replicas/2+1)
+	for attempt := 1; ; attempt++ {
+		current, live, err := n.read(ctx, key, readQuorum, n.ReadRepair, false)
+		cond := condition{IfAbsent: true}
+		switch {
+		case errors.Is(err, errKeyNotFound):
+		case err != nil:
+			return false, err
+		default:
+			version := current.CurrentVersion()
+			cond = condition{IfVersion: &version}
+		}
+
+		op, item, err := update(live)
+		if err != nil || op == "" {
+			return false, err
+		}
+		_, err = n.respWrite(ctx, op, item, cond, "")
+		var conflict *ConflictError
+		if !errors.As(err, &conflict) {
+			return err == nil, err
+		}
+
+		backoff := time.Duration(rand.Int63n(int64(min(time.Duration(attempt)*time.Millisecond, maxRespBackoff)) + 1))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return false, fmt.Errorf("key %s kept changing while it was being updated", key)
+		}
+	}
+}
+
+// respWrite makes a write for a Redis client and returns the new version.
+// A write another node has to make is sent to that node over HTTP, so it
+// is made exactly as if the client had sent it there.
+func (n *Node) respWrite(ctx context.Context, op string, item store.Store, cond condition, writeContext string) (uint64, error) {
+	version, _, target, err := n.write(ctx, op, item, cond, writeContext, n.WriteQuorum)
+	if err != nil || target == "" {
+		return version, err
+	}
+
+	req, err := n.respRequest(ctx, target, op, item, cond, writeContext)
+	if err != nil {
+		return 0, err
+	}
+	response, err := n.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to reach %s: %w", target, err)
+	}
+	defer response.Body.Close()
+
+	var reply struct {
+		Version uint64 `json:"version"`
+	}
+	switch response.StatusCode {
+	case http.StatusOK:
+		json.NewDecoder(response.Body).Decode(&reply)
+		return reply.Version, nil
+	case http.StatusConflict:
+		json.NewDecoder(response.Body).Decode(&reply)
+		return 0, &ConflictError{Key: item.Key, Version: reply.Version}
+	default:
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return 0, fmt.Errorf("%s responded with status %d: %s", target, response.StatusCode, strings.TrimSpace(string(message)))
+	}
+}
+
+// respRequest returns the HTTP request that makes a write on target:
+// DELETE /store/key for a delete, POST /store for a value without a
+// content type and PUT /v1/kv/{key} for one with a content type.
+func (n *Node) respRequest(ctx context.Context, target, op string, item store.Store, cond condition, writeContext string) (*http.Request, error) {
+	var expiresAt string
+	if item.ExpiresAt != 0 {
+		expiresAt = time.Unix(0, item.ExpiresAt).UTC().Format(time.RFC3339Nano)
+	}
+
+	var method, path, contentType string
+	var body []byte
+	var kv bool
+	var err error
+	switch {
+	case op == opDelete:
+		method, path, contentType = http.MethodDelete, "/store/key", "application/json"
+		body, err = json.Marshal(deleteRequest{Key: item.Key, Context: writeContext, condition: cond})
+	case item.ContentType == "":
+		method, path, contentType = http.MethodPost, "/store", "application/json"
+		body, err = json.Marshal(putRequest{
+			Key:       item.Key,
+			Value:     item.Value,
+			Context:   writeContext,
+			ExpiresAt: expiresAt,
+			condition: cond,
+		})
+	default:
+		method, path, contentType = http.MethodPut, kvPath+url.PathEscape(item.Key), item.ContentType
+		kv = true
+		if expiresAt != "" {
+			path += "?expires_at=" + url.QueryEscape(expiresAt)
+		}
+		body, _, err = encodeValue(store.Version{Value: item.Value, ContentType: item.ContentType})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(forwardedHeader, n.Self)
+	// the /v1/kv API takes the context and the condition in headers
+	if kv {
+		if writeContext != "" {
+			req.Header.Set(contextHeader, writeContext)
+		}
+		if cond.IfAbsent {
+			req.Header.Set("If-None-Match", "*")
+		}
+		if cond.IfVersion != nil {
+			req.Header.Set("If-Match", strconv.Quote(strconv.FormatUint(*cond.IfVersion, 10)))
+		}
+	}
+	return req, nil
+}
+
+// respCursors maps the cursors SCAN returns to the key the next call
+// starts at.
+type respCursors struct {
+	mu     sync.Mutex
+	last   uint64
+	from   map[string]string
+	oldest []string
+}
+
+// add returns a new cursor for a scan that goes on at from.
+func (c *respCursors) add(from string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.from == nil {
+		c.from = make(map[string]string)
+	}
+	c.last++
+	cursor := strconv.FormatUint(c.last, 10)
+	c.from[cursor] = from
+	c.oldest = append(c.oldest, cursor)
+	if len(c.oldest) > maxRespCursors {
+		delete(c.from, c.oldest[0])
+		c.oldest = c.oldest[1:]
+	}
+	return cursor
+}
+
+// get returns the key the scan with cursor goes on at.
+func (c *respCursors) get(cursor string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	from, ok := c.from[cursor]
+	return from, ok
+}
@@ -0,0 +1,49 @@
+package node
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/ring"
+)
+
+// RingResponse is the body returned by GET /ring.
+// Ownership is the share of the key space each node is the primary for,
+// and Owners lists the replicas of Key when a key was asked for.
+type RingResponse struct {
+	Replicas  int                `json:"replicas"`
+	VNodes    int                `json:"vnodes"`
+	Nodes     []string           `json:"nodes"`
+	Ownership map[string]float64 `json:"ownership"`
+	Key       string             `json:"key,omitempty"`
+	Owners    []string           `json:"owners,omitempty"`
+	Tokens    []ring.Token       `json:"tokens,omitempty"`
+}
+
+// Ring reports how keys are partitioned across the cluster.
+// With a "key" query parameter it also returns the replicas of that key,
+// and with tokens=true it lists every virtual node on the ring.
+func (n *Node) Ring(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	response := RingResponse{
+		Replicas:  n.Replicas,
+		VNodes:    n.ring.VNodes(),
+		Nodes:     n.ring.Nodes(),
+		Ownership: n.ring.Ownership(),
+	}
+	if key := r.URL.Query().Get("key"); key != "" {
+		response.Key = key
+		response.Owners = n.replicasFor(key)
+	}
+	if r.URL.Query().Get("tokens") == "true" {
+		response.Tokens = n.ring.Tokens()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,91 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/raft"
+)
+
+// SnapshotLoop periodically snapshots the store and compacts the write-ahead log.
+// A snapshot is taken every node.SnapshotInterval seconds, or earlier once
+// node.SnapshotThreshold writes have been logged since the last snapshot.
+func (n *Node) SnapshotLoop() {
+	if n.SnapshotInterval <= 0 && n.SnapshotThreshold <= 0 {
+		log.Println("Periodic snapshots are disabled")
+		return
+	}
+
+	// check once per second, so the threshold is noticed quickly
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	lastSnapshot := time.Now()
+	interval := time.Duration(n.SnapshotInterval) * time.Second
+
+	for range ticker.C {
+		dueByTime := n.SnapshotInterval > 0 && time.Since(lastSnapshot) >= interval
+		dueBySize := n.SnapshotThreshold > 0 && n.durable.PendingRecords() >= uint64(n.SnapshotThreshold)
+		if !dueByTime && !dueBySize {
+			continue
+		}
+
+		lastSnapshot = time.Now()
+		if err := n.durable.Checkpoint(); err != nil {
+			log.Printf("Failed to take snapshot: %v", err)
+			continue
+		}
+	}
+}
+
+// Snapshot takes a snapshot of the store right away and compacts the
+// write-ahead log, as SnapshotLoop does periodically, and responds with the
+// persistence state. It expects a POST request and fails with 409 Conflict
+// when the node has no data directory or runs the lsm engine, which keeps
+// its data in SSTables instead. In raft mode it compacts the Raft log
+// instead and responds with the Raft state.
+func (n *Node) Snapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if n.raft != nil {
+		n.snapshotRaft(w)
+		return
+	}
+	if n.durable == nil {
+		http.Error(w, "Snapshots need a data directory and the memory engine", http.StatusConflict)
+		return
+	}
+
+	if err := n.durable.Checkpoint(); err != nil {
+		http.Error(w, "Failed to take snapshot: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Took snapshot on request")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(n.durable.Status())
+}
+
+// snapshotRaft snapshots the state machine and compacts the Raft log.
+func (n *Node) snapshotRaft(w http.ResponseWriter) {
+	err := n.raft.TakeSnapshot()
+	if errors.Is(err, raft.ErrNoSnapshots) {
+		http.Error(w, "Raft snapshots are disabled by --snapshot-threshold=0", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to take snapshot: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Compacted the raft log on request")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(n.raft.Status())
+}
@@ -0,0 +1,73 @@
+package node
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/hints"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/lsm"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/raft"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/replication"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/store"
+)
+
+// StatusResponse is the body returned by GET /status.
+// Snapshot is nil when the node keeps its data in memory only,
+// LSM is only set when the node runs the lsm engine, and Raft only in raft mode.
+// Hints lists, per peer, the writes waiting to be handed off, Replication
+// the state of the queue of writes waiting to be sent to each peer, and
+// ReadRepair counts the replicas repaired by reads in eventual mode.
+type StatusResponse struct {
+	Port        string                       `json:"port"`
+	Peers       []string                     `json:"peers"`
+	PeerStates  map[string]bool              `json:"peer_states"`
+	Engine      string                       `json:"engine"`
+	Consistency string                       `json:"consistency"`
+	Keys        int                          `json:"keys"`
+	Snapshot    *store.SnapshotStatus        `json:"snapshot"`
+	LSM         *lsm.Stats                   `json:"lsm,omitempty"`
+	Raft        *raft.Status                 `json:"raft,omitempty"`
+	Hints       map[string]hints.Stats       `json:"hints,omitempty"`
+	Replication map[string]replication.Stats `json:"replication,omitempty"`
+	ReadRepair  *ReadRepairStats             `json:"read_repair,omitempty"`
+}
+
+// Status reports the node's view of the cluster and the state of its storage,
+// including when the last snapshot was taken.
+func (n *Node) Status(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	response := StatusResponse{
+		Port:        n.Port,
+		Peers:       n.Peers,
+		PeerStates:  n.peerStates(),
+		Engine:      n.Engine,
+		Consistency: n.Consistency,
+		Keys:        n.DB.Len(),
+	}
+	if n.durable != nil {
+		status := n.durable.Status()
+		response.Snapshot = &status
+	}
+	if n.lsm != nil {
+		stats := n.lsm.Stats()
+		response.LSM = &stats
+	}
+	if n.raft != nil {
+		status := n.raft.Status()
+		response.Raft = &status
+	}
+	response.Hints = n.hints.Stats()
+	response.Replication = n.queues.Stats()
+	if n.raft == nil {
+		stats := n.readRepairs.stats()
+		response.ReadRepair = &stats
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
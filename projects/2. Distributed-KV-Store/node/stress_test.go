@@ -0,0 +1,241 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/config"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/store"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/vclock"
+)
+
+// These tests hammer the handlers and background paths that share a node's
+// state from many goroutines at once. They are meant to be run with
+// go test -race, which reports any unguarded access; without it they still
+// check that no write is lost.
+
+// startCluster starts size nodes in eventual mode, each serving the routes
+// the tests use on its own test server, with every node replicating every key.
+func startCluster(t *testing.T, size int) ([]*Node, []string) {
+	t.Helper()
+
+	servers := make([]*httptest.Server, size)
+	urls := make([]string, size)
+	for i := range servers {
+		servers[i] = httptest.NewUnstartedServer(nil)
+		urls[i] = "http://" + servers[i].Listener.Addr().String()
+	}
+
+	nodes := make([]*Node, size)
+	for i := range nodes {
+		var peers []string
+		for j, url := range urls {
+			if j != i {
+				peers = append(peers, url)
+			}
+		}
+
+		n := NewNode(config.Config{
+			Peers:             peers,
+			Timeout:           5,
+			DataDir:           t.TempDir(),
+			Engine:            "memory",
+			Self:              urls[i],
+			Consistency:       "eventual",
+			WriteQuorum:       size,
+			ReadQuorum:        1,
+			VNodes:            16,
+			WatchHistory:      100,
+			Transport:         "http",
+			ReplicationQueue:  100,
+			ReplicationBatch:  10,
+			ReplicationPolicy: "block",
+		})
+		for _, peer := range peers {
+			n.setPeerUp(peer, true)
+		}
+		nodes[i] = n
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/ping", n.Pong)
+		mux.HandleFunc("/store", n.StoreKeyValue)
+		mux.HandleFunc("/store/key", n.StoreKey)
+		mux.HandleFunc("/store/local", n.GetLocalValue)
+		mux.HandleFunc("/replicate", n.ReplicateKeyValue)
+		mux.HandleFunc("/replicateAll", n.AcceptReplicateAll)
+		mux.HandleFunc("/snapshot", n.Snapshot)
+		mux.HandleFunc("/status", n.Status)
+		servers[i].Config.Handler = mux
+		servers[i].Start()
+		t.Cleanup(servers[i].Close)
+	}
+	return nodes, urls
+}
+
+// post sends body as JSON to url and returns the response status.
+func post(t *testing.T, url string, body any) int {
+	t.Helper()
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Error(err)
+		return 0
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// TestConcurrentHandlers runs writes, replication, merges, snapshots and
+// peer state changes against a cluster at the same time, then checks that
+// every acknowledged write reached every node.
+func TestConcurrentHandlers(t *testing.T) {
+	nodes, urls := startCluster(t, 3)
+
+	const workers = 8
+	const rounds = 25
+
+	var mu sync.Mutex
+	acknowledged := make(map[string]bool)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(5)
+
+		// client writes through every node
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				key := fmt.Sprintf("store-%d", i%5)
+				value := fmt.Sprintf("%d-%d", w, i)
+				if post(t, urls[(w+i)%len(urls)]+"/store", map[string]any{"key": key, "value": value}) == http.StatusOK {
+					mu.Lock()
+					acknowledged[key] = true
+					mu.Unlock()
+				}
+			}
+		}(w)
+
+		// replicas pushed by a peer, one at a time and in batches
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				item := store.Store{
+					Key:     fmt.Sprintf("merge-%d", i%5),
+					Value:   w,
+					Clock:   vclock.Clock{fmt.Sprintf("writer-%d", w): uint64(i + 1)},
+					Version: uint64(i + 1),
+				}
+				url := urls[i%len(urls)]
+				if i%2 == 0 {
+					post(t, url+"/replicate", item)
+				} else {
+					post(t, url+"/replicateAll", []store.Store{item})
+				}
+			}
+		}(w)
+
+		// local merges, as anti-entropy and read repair make them
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				item := store.Store{
+					Key:   fmt.Sprintf("merge-%d", i%5),
+					Value: w,
+					Clock: vclock.Clock{fmt.Sprintf("merger-%d", w): uint64(i + 1)},
+				}
+				if err := nodes[i%len(nodes)].mergeItem(item); err != nil {
+					t.Error(err)
+				}
+			}
+		}(w)
+
+		// snapshots and status, which read the whole store
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds/5; i++ {
+				url := urls[(w+i)%len(urls)]
+				if status := post(t, url+"/snapshot", nil); status != http.StatusOK {
+					t.Errorf("POST /snapshot: status %d", status)
+				}
+				resp, err := http.Get(url + "/status")
+				if err != nil {
+					t.Error(err)
+					continue
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		}(w)
+
+		// peer states, written by pings and read by writes and /status
+		go func(w int) {
+			defer wg.Done()
+			n := nodes[w%len(nodes)]
+			for i := 0; i < rounds*4; i++ {
+				for _, peer := range n.Peers {
+					n.setPeerUp(peer, true)
+					n.peerUp(peer)
+				}
+				n.peerStates()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for key := range acknowledged {
+		for i, n := range nodes {
+			if _, ok := n.DB.Get(key); !ok {
+				t.Errorf("node %d is missing acknowledged key %s", i, key)
+			}
+		}
+	}
+}
+
+// TestConcurrentMergesKeepEverySibling merges concurrent versions of one key
+// from many goroutines. Since merges of a key are serialised, none of them
+// may overwrite a version another one stored in between.
+func TestConcurrentMergesKeepEverySibling(t *testing.T) {
+	nodes, urls := startCluster(t, 1)
+	n := nodes[0]
+
+	const writers = 32
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			item := store.Store{
+				Key:   "siblings",
+				Value: w,
+				Clock: vclock.Clock{fmt.Sprintf("writer-%d", w): 1},
+			}
+			if w%2 == 0 {
+				if err := n.mergeItem(item); err != nil {
+					t.Error(err)
+				}
+			} else if status := post(t, urls[0]+"/replicate", item); status != http.StatusOK {
+				t.Errorf("POST /replicate: status %d", status)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	item, ok := n.DB.Get("siblings")
+	if !ok {
+		t.Fatal("key siblings is missing")
+	}
+	if got := len(item.Versions()); got != writers {
+		t.Errorf("got %d versions of key siblings, want %d", got, writers)
+	}
+}
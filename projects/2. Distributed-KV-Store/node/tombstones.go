@@ -0,0 +1,142 @@
+package node
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/store"
+)
+
+// TombstoneLoop periodically purges tombstones that are older than the
+// grace period and that every replica of their key already has.
+func (n *Node) TombstoneLoop() {
+	grace := time.Duration(n.TombstoneGrace) * time.Second
+
+	ticker := time.NewTicker(purgeInterval(grace))
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n.purgeTombstones(grace)
+	}
+}
+
+// purgeInterval is how often tombstones are purged: a few times per grace
+// period, but not more than once a second or less than once a minute.
+func purgeInterval(grace time.Duration) time.Duration {
+	return min(max(grace/4, time.Second), time.Minute)
+}
+
+// purgeTombstones removes the tombstones written more than grace ago from
+// the local store, once no replica holds a version they do not supersede.
+// Until then the tombstone is kept, so that anti-entropy or read repair
+// cannot bring a deleted value back from a replica that missed the delete.
+// Only the keys that are due in the purge index are looked at; the store
+// is not scanned. In raft mode the leader purges them through the log.
+func (n *Node) purgeTombstones(grace time.Duration) {
+	now := time.Now()
+	cutoff := now.Add(-grace).UnixNano()
+	retry := now.Add(purgeInterval(grace)).UnixNano()
+
+	var candidates []store.Store
+	for _, key := range n.purges.due(now.UnixNano()) {
+		item, ok := n.DB.Get(key)
+		if !ok || !item.IsTombstone() {
+			continue // purged or written again meanwhile
+		}
+		// the primary version is the newest one
+		if item.Timestamp >= cutoff {
+			n.track(item)
+			continue
+		}
+		candidates = append(candidates, item)
+	}
+	if n.raft != nil {
+		n.purgeThroughRaft(candidates, grace, retry)
+		return
+	}
+
+	purged := 0
+	for _, item := range candidates {
+		if !n.tombstoneAcknowledged(item) || !n.purgeTombstone(item) {
+			n.purges.add(item.Key, retry)
+			continue
+		}
+		purged++
+	}
+	if purged > 0 {
+		log.Printf("Purged %d tombstones older than %s", purged, grace)
+	}
+}
+
+// purgeThroughRaft purges tombstones by committing a purge for each of them,
+// which every node applies unless the key was written again meanwhile.
+// Only the leader does this; the other nodes look at the keys again at
+// retry, in case they become the leader.
+func (n *Node) purgeThroughRaft(candidates []store.Store, grace time.Duration, retry int64) {
+	if len(candidates) == 0 {
+		return
+	}
+	if !n.raft.IsLeader() {
+		for _, item := range candidates {
+			n.purges.add(item.Key, retry)
+		}
+		return
+	}
+
+	purged := 0
+	for i, item := range candidates {
+		_, err := n.propose(context.Background(), command{Op: opPurge, Item: store.Store{Key: item.Key, Version: item.Version}})
+		if err != nil {
+			log.Printf("Failed to purge tombstone for key %s: %v", item.Key, err)
+			for _, item := range candidates[i:] {
+				n.purges.add(item.Key, retry)
+			}
+			return
+		}
+		purged++
+	}
+	log.Printf("Purged %d tombstones older than %s", purged, grace)
+}
+
+// purgeTombstone removes tombstone from the local store and reports whether
+// it did. The key is skipped if it was written while the replicas were asked.
+func (n *Node) purgeTombstone(tombstone store.Store) bool {
+	mu := n.storeLocks.lock(tombstone.Key)
+	defer mu.Unlock()
+
+	current, ok := n.DB.Get(tombstone.Key)
+	if !ok {
+		return false
+	}
+	if _, changed := store.Merge(tombstone, current); changed {
+		return false
+	}
+	if err := n.DB.Delete(tombstone.Key); err != nil {
+		log.Printf("Failed to purge tombstone for key %s: %v", tombstone.Key, err)
+		return false
+	}
+	return true
+}
+
+// tombstoneAcknowledged reports whether every other replica of the key
+// answered and holds nothing that tombstone does not supersede.
+// A replica that no longer has the key at all has purged it already.
+func (n *Node) tombstoneAcknowledged(tombstone store.Store) bool {
+	for _, replica := range n.replicasFor(tombstone.Key) {
+		if replica == n.Self {
+			continue
+		}
+		reply := n.readReplica(replica, tombstone.Key)
+		if reply.err != nil {
+			return false
+		}
+		if !reply.found {
+			continue
+		}
+		if _, changed := store.Merge(tombstone, reply.item); changed {
+			return false
+		}
+	}
+	return true
+}
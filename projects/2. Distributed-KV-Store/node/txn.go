@@ -0,0 +1,700 @@
+package node
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/store"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/watch"
+)
+
+// maxTxnOps is the largest number of operations in either branch of a
+// transaction.
+const maxTxnOps = 128
+
+// txnCompare is one condition of a transaction. It compares the version
+// (the default) or the value of Key with Version or Value using Op,
+// one of "=" (the default), "!=", "<" and ">". A key that does not exist
+// has version 0 and no value, so every value comparison on it fails.
+// Values are compared with their type: numbers by value, strings in
+// lexical order, and any other values only for equality.
+type txnCompare struct {
+	Key     string `json:"key"`
+	Target  string `json:"target,omitempty"`
+	Op      string `json:"op,omitempty"`
+	Version uint64 `json:"version,omitempty"`
+	Value   any    `json:"value,omitempty"`
+}
+
+// txnOp is a put or a delete run by a transaction. A put stores Value,
+// which can be any JSON value, with ContentType, as PUT /v1/kv does.
+type txnOp struct {
+	Op          string `json:"op"`
+	Key         string `json:"key"`
+	Value       any    `json:"value,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// txnRequest is the body of POST /txn. If every Compare holds the Success
+// operations are run, otherwise the Failure operations, in order and as a
+// single atomic write.
+type txnRequest struct {
+	Compare []txnCompare `json:"compare"`
+	Success []txnOp      `json:"success"`
+	Failure []txnOp      `json:"failure"`
+}
+
+// txnOpResult is the outcome of one operation of a transaction.
+// Version is the version a put wrote.
+type txnOpResult struct {
+	Op      string `json:"op"`
+	Key     string `json:"key"`
+	Version uint64 `json:"version,omitempty"`
+}
+
+// txnResult is the response to POST /txn. Succeeded tells whether every
+// comparison held and so which branch was run.
+type txnResult struct {
+	Succeeded bool          `json:"succeeded"`
+	Responses []txnOpResult `json:"responses"`
+}
+
+// validate checks that t is well formed.
+func (t txnRequest) validate() error {
+	if len(t.Success) > maxTxnOps || len(t.Failure) > maxTxnOps {
+		return fmt.Errorf("too many operations: at most %d per branch", maxTxnOps)
+	}
+	for _, c := range t.Compare {
+		if c.Key == "" {
+			return errors.New("compare without a key")
+		}
+		switch c.Target {
+		case "", "version", "value":
+		default:
+			return fmt.Errorf("invalid compare target %q", c.Target)
+		}
+		switch c.Op {
+		case "", "=", "!=", "<", ">":
+		default:
+			return fmt.Errorf("invalid compare op %q", c.Op)
+		}
+	}
+	for _, op := range append(append([]txnOp(nil), t.Success...), t.Failure...) {
+		if op.Key == "" {
+			return errors.New("operation without a key")
+		}
+		if op.Op != opPut && op.Op != opDelete {
+			return fmt.Errorf("invalid operation %q", op.Op)
+		}
+		if op.ContentType != "" {
+			mediaType, _, err := mime.ParseMediaType(op.ContentType)
+			if err != nil {
+				return fmt.Errorf("invalid content type %s", op.ContentType)
+			}
+			if _, ok := op.Value.(string); !ok && !isJSON(mediaType) {
+				return fmt.Errorf("key %s: a %s value must be a string", op.Key, mediaType)
+			}
+		}
+	}
+	return nil
+}
+
+// item returns the version op writes.
+func (op txnOp) item() store.Store {
+	if op.Op == opDelete {
+		return store.Store{Key: op.Key, Deleted: true}
+	}
+	return store.Store{Key: op.Key, Value: op.Value, ContentType: op.ContentType}
+}
+
+// keys returns every key t compares or writes, sorted.
+func (t txnRequest) keys() []string {
+	seen := make(map[string]bool)
+	var keys []string
+	add := func(key string) {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	for _, c := range t.Compare {
+		add(c.Key)
+	}
+	for _, op := range t.Success {
+		add(op.Key)
+	}
+	for _, op := range t.Failure {
+		add(op.Key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// evaluate reports whether every comparison of t holds for the copies of
+// the keys get returns.
+func (t txnRequest) evaluate(get func(string) (store.Store, bool)) bool {
+	for _, c := range t.Compare {
+		item, found := get(c.Key)
+		if !c.holds(item, found) {
+			return false
+		}
+	}
+	return true
+}
+
+// ops returns the operations of the branch chosen by succeeded.
+func (t txnRequest) ops(succeeded bool) []txnOp {
+	if succeeded {
+		return t.Success
+	}
+	return t.Failure
+}
+
+// holds reports whether c holds for item, the copy of c.Key.
+func (c txnCompare) holds(item store.Store, found bool) bool {
+	var live []store.Version
+	if found {
+		live = item.Live()
+	}
+
+	cmp := 0
+	if c.Target == "value" {
+		if len(live) == 0 {
+			return false
+		}
+		var ordered bool
+		cmp, ordered = compareValues(live[0].Value, c.Value)
+		if !ordered && (c.Op == "<" || c.Op == ">") {
+			return false
+		}
+	} else {
+		version := uint64(0)
+		if found {
+			version = item.CurrentVersion()
+		}
+		switch {
+		case version < c.Version:
+			cmp = -1
+		case version > c.Version:
+			cmp = 1
+		}
+	}
+
+	switch c.Op {
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp == 0
+	}
+}
+
+// compareValues compares two values of the same JSON type. Numbers and
+// strings are ordered, and the boolean is true for them; other values,
+// and values of different types, are only equal (0) or not (1).
+func compareValues(a, b any) (int, bool) {
+	if x, ok := numberValue(a); ok {
+		if y, ok := numberValue(b); ok {
+			return x.Cmp(y), true
+		}
+		return 1, false
+	}
+	if x, ok := a.(string); ok {
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+		return 1, false
+	}
+
+	x, errA := json.Marshal(a)
+	y, errB := json.Marshal(b)
+	if errA != nil || errB != nil || !bytes.Equal(x, y) {
+		return 1, false
+	}
+	return 0, false
+}
+
+// numberValue returns v as an exact rational if it is a JSON number.
+func numberValue(v any) (*big.Rat, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		return new(big.Rat).SetString(v.String())
+	case float64:
+		r := new(big.Rat)
+		if r.SetFloat64(v) == nil {
+			return nil, false
+		}
+		return r, true
+	}
+	return nil, false
+}
+
+// Txn runs a transaction: a list of comparisons and the operations to run
+// when they all hold (success) or not (failure), applied atomically.
+// It expects a POST request with a JSON body such as
+// {"compare": [{"key": "a", "version": 3}], "success": [{"op": "put", "key": "a", "value": 1}], "failure": []}.
+// Values can be any JSON value and keep their type, as in POST /store.
+// In raft mode the transaction is a single entry in the log. In eventual
+// mode it is run with a two-phase commit over every replica of its keys;
+// a transaction that needs a key another one is writing fails with 409.
+func (n *Node) Txn(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Keep numbers exactly as they were sent, as POST /store does
+	var txn txnRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&txn); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := txn.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var result txnResult
+	if n.raft != nil {
+		applied, ok := n.raftPropose(w, r, "/txn", txn, command{Op: opTxn, Txn: &txn})
+		if !ok {
+			return
+		}
+		result = applied.(txnResult)
+	} else {
+		var err error
+		result, err = n.runTxn(txn)
+		if errors.Is(err, errTxnConflict) {
+			http.Error(w, "Transaction conflicts with another transaction", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to run transaction: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
+
+// applyTxn applies a committed transaction to the local store.
+// It is called by applyCommand, so every node reaches the same result.
+// Its changes are published to watchers together, under index.
+func (n *Node) applyTxn(index uint64, timestamp int64, txn txnRequest) any {
+	succeeded := txn.evaluate(n.DB.Get)
+	result := txnResult{Succeeded: succeeded, Responses: []txnOpResult{}}
+	var events []watch.Event
+	for _, op := range txn.ops(succeeded) {
+		existing, found := n.DB.Get(op.Key)
+		switch op.Op {
+		case opPut:
+			item := op.item()
+			item.Version = 1
+			if found {
+				item.Version = existing.NextVersion()
+			}
+			if err := n.DB.Put(item); err != nil {
+				return err
+			}
+			events = append(events, putEvent(item))
+			result.Responses = append(result.Responses, txnOpResult{Op: op.Op, Key: op.Key, Version: item.Version})
+		case opDelete:
+			deleted, err := n.applyDelete(op.Key, timestamp, existing, found)
+			if err != nil {
+				return err
+			}
+			if deleted {
+				events = append(events, watch.Event{Type: watch.Delete, Key: op.Key})
+			}
+			result.Responses = append(result.Responses, txnOpResult{Op: op.Op, Key: op.Key})
+		}
+	}
+	if len(events) > 0 {
+		n.watch.PublishAt(index, events...)
+	}
+	return result
+}
+
+// txnPrepare is the body of POST /txn/prepare. Coordinator is the node
+// that runs the transaction.
+type txnPrepare struct {
+	ID          string   `json:"id"`
+	Coordinator string   `json:"coordinator"`
+	Keys        []string `json:"keys"`
+}
+
+// txnCommit is the body of POST /txn/commit, and the response to POST
+// /txn/outcome. A commit without items aborts the transaction.
+type txnCommit struct {
+	ID    string        `json:"id"`
+	Items []store.Store `json:"items"`
+}
+
+// txnOutcomeRequest is the body of POST /txn/outcome.
+type txnOutcomeRequest struct {
+	ID          string `json:"id"`
+	Participant string `json:"participant"`
+}
+
+// runTxn runs a transaction in eventual mode with a two-phase commit.
+// The comparisons are checked against the merged copies the replicas
+// return, and the new versions, each descending from every version that
+// was read, are committed.
+func (n *Node) runTxn(txn txnRequest) (txnResult, error) {
+	var result txnResult
+	err := n.twoPhaseCommit(txn.keys(), func(current map[string]store.Store) map[string]store.Store {
+		get := func(key string) (store.Store, bool) {
+			item, ok := current[key]
+			return item, ok
+		}
+		succeeded := txn.evaluate(get)
+		result = txnResult{Succeeded: succeeded, Responses: []txnOpResult{}}
+		written := make(map[string]store.Store)
+		for _, op := range txn.ops(succeeded) {
+			item := op.item()
+			existing, ok := get(op.Key)
+			n.stampOver(&item, existing, ok)
+
+			current[op.Key] = item
+			written[op.Key] = item
+			opResult := txnOpResult{Op: op.Op, Key: op.Key}
+			if op.Op == opPut {
+				opResult.Version = item.Version
+			}
+			result.Responses = append(result.Responses, opResult)
+		}
+		return written
+	})
+	return result, err
+}
+
+// twoPhaseCommit writes to keys atomically in eventual mode.
+// Every replica of every key is asked to lock the keys it holds and return
+// its copies of them. Once all of them have, write is called with the
+// merged copies and the items it returns are sent to the replicas, which
+// store them and unlock the keys. If any replica cannot lock its keys
+// nothing is written and the error, errTxnConflict if another transaction
+// holds one of them, is returned.
+// The decision to commit is written to the transaction log before any
+// replica is told, and a replica that does not acknowledge the commit gets
+// the new versions as hints, so once the decision is made the write reaches
+// every replica, even if this node fails in the middle of the commit.
+func (n *Node) twoPhaseCommit(keys []string, write func(current map[string]store.Store) map[string]store.Store) error {
+	id, err := newTxnID()
+	if err != nil {
+		return err
+	}
+
+	participants := make(map[string][]string)
+	for _, key := range keys {
+		for _, replica := range n.replicasFor(key) {
+			participants[replica] = append(participants[replica], key)
+		}
+	}
+
+	// a participant that gives up waiting for the commit aborts the
+	// transaction from here on
+	n.txnDecisions.begin(id)
+
+	type prepared struct {
+		items []store.Store
+		err   error
+	}
+	results := make(chan prepared, len(participants))
+	for replica, keys := range participants {
+		go func(replica string, keys []string) {
+			items, err := n.prepareOn(replica, id, keys)
+			results <- prepared{items: items, err: err}
+		}(replica, keys)
+	}
+
+	current := make(map[string]store.Store)
+	var prepareErr error
+	for range participants {
+		result := <-results
+		if result.err != nil {
+			if prepareErr == nil || errors.Is(result.err, errTxnConflict) {
+				prepareErr = result.err
+			}
+			continue
+		}
+		for _, item := range result.items {
+			if existing, ok := current[item.Key]; ok {
+				item, _ = store.Merge(existing, item)
+			}
+			current[item.Key] = item
+		}
+	}
+	if prepareErr != nil {
+		n.txnDecisions.abort(id)
+		n.commitOn(id, txnItems(participants, nil))
+		return prepareErr
+	}
+
+	items := txnItems(participants, write(current))
+	if err := n.txnDecisions.commit(id, items); err != nil {
+		n.txnDecisions.abort(id)
+		n.commitOn(id, txnItems(participants, nil))
+		return err
+	}
+	n.commitOn(id, items)
+	n.txnDecisions.delivered(id)
+	return nil
+}
+
+// txnItems returns, for every participant, the items of written it
+// replicates. A nil written aborts the transaction on every participant.
+func txnItems(participants map[string][]string, written map[string]store.Store) map[string][]store.Store {
+	items := make(map[string][]store.Store, len(participants))
+	for replica, keys := range participants {
+		items[replica] = []store.Store{}
+		for _, key := range keys {
+			if item, ok := written[key]; ok {
+				items[replica] = append(items[replica], item)
+			}
+		}
+	}
+	return items
+}
+
+// newTxnID returns a random transaction id.
+func newTxnID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// prepareOn asks replica to lock keys for transaction id and returns its
+// copies of them.
+func (n *Node) prepareOn(replica, id string, keys []string) ([]store.Store, error) {
+	if replica == n.Self {
+		return n.prepareTxn(id, n.Self, keys)
+	}
+
+	body, err := json.Marshal(txnPrepare{ID: id, Coordinator: n.Self, Keys: keys})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := n.client.Post(replica+"/txn/prepare", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusConflict:
+		return nil, errTxnConflict
+	default:
+		return nil, fmt.Errorf("peer %s returned status %d", replica, resp.StatusCode)
+	}
+
+	var items []store.Store
+	if err := json.NewDecoder(resp.Body).Decode(&items); err != nil {
+		return nil, fmt.Errorf("failed to decode reply from %s: %w", replica, err)
+	}
+	return items, nil
+}
+
+// commitOn sends every participant its items of transaction id and
+// releases the participant's locks. A participant without items aborts the
+// transaction.
+func (n *Node) commitOn(id string, participants map[string][]store.Store) {
+	var wg sync.WaitGroup
+	for replica, items := range participants {
+		if replica == n.Self {
+			if err := n.commitTxn(id, items); err != nil {
+				log.Printf("Failed to commit transaction %s locally: %v", id, err)
+			}
+			continue
+		}
+
+		wg.Add(1)
+		go func(peer string, items []store.Store) {
+			defer wg.Done()
+			if err := n.postJSON(peer+"/txn/commit", txnCommit{ID: id, Items: items}, &struct{}{}); err != nil {
+				log.Printf("Failed to commit transaction %s on peer %s: %v", id, peer, err)
+				for _, item := range items {
+					n.storeHint(peer, item)
+				}
+			}
+		}(replica, items)
+	}
+	wg.Wait()
+}
+
+// prepareTxn locks keys for transaction id and returns the local copies
+// of the ones that exist. If coordinator has neither committed nor aborted
+// the transaction after twice the timeout, it is asked for the outcome.
+func (n *Node) prepareTxn(id, coordinator string, keys []string) ([]store.Store, error) {
+	if err := n.txnLocks.acquire(id, keys); err != nil {
+		return nil, err
+	}
+	time.AfterFunc(time.Duration(2*n.Timeout)*time.Second, func() {
+		n.resolveTxn(id, coordinator)
+	})
+
+	items := []store.Store{}
+	for _, key := range keys {
+		if item, ok := n.DB.Get(key); ok {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+// commitTxn stores the items of transaction id and releases its locks.
+func (n *Node) commitTxn(id string, items []store.Store) error {
+	defer n.txnLocks.release(id)
+
+	for _, item := range items {
+		if err := n.merge(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveTxn settles transaction id if it still holds its locks: its
+// coordinator is asked for the outcome, and the transaction is committed
+// with the items it returns or aborted. Asking aborts a transaction the
+// coordinator has not decided yet, so it cannot commit once the locks are
+// gone. If the coordinator does not answer, the locks are released anyway,
+// so a failed coordinator cannot block the keys; a commit it had decided
+// is delivered from its transaction log once it is back.
+func (n *Node) resolveTxn(id, coordinator string) {
+	if !n.txnLocks.prepared(id) {
+		return
+	}
+
+	items, err := n.txnOutcome(coordinator, id)
+	if err != nil {
+		log.Printf("Releasing transaction %s: coordinator %s did not answer: %v", id, coordinator, err)
+		n.txnLocks.release(id)
+		return
+	}
+	if len(items) == 0 {
+		log.Printf("Transaction %s expired before it finished and was aborted", id)
+	}
+	if err := n.commitTxn(id, items); err != nil {
+		log.Printf("Failed to commit transaction %s locally: %v", id, err)
+	}
+}
+
+// txnOutcome asks coordinator for the items this node stores for
+// transaction id; none if it is aborted.
+func (n *Node) txnOutcome(coordinator, id string) ([]store.Store, error) {
+	if coordinator == n.Self {
+		return n.txnDecisions.outcome(id, n.Self), nil
+	}
+
+	var commit txnCommit
+	if err := n.postJSON(coordinator+"/txn/outcome", txnOutcomeRequest{ID: id, Participant: n.Self}, &commit); err != nil {
+		return nil, err
+	}
+	return commit.Items, nil
+}
+
+// TxnPrepare locks keys for a transaction coordinated by a peer and returns
+// the local copies of them. It responds with 409 if another transaction
+// holds one of the keys.
+// It expects a POST request with a JSON body
+// {"id": "...", "coordinator": "http://...", "keys": [...]}.
+func (n *Node) TxnPrepare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var prepare txnPrepare
+	if err := json.NewDecoder(r.Body).Decode(&prepare); err != nil || prepare.ID == "" || prepare.Coordinator == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	items, err := n.prepareTxn(prepare.ID, prepare.Coordinator, prepare.Keys)
+	if errors.Is(err, errTxnConflict) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to prepare transaction: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(items)
+}
+
+// TxnCommit stores the writes of a transaction prepared on this node and
+// releases its locks. A commit without items aborts the transaction.
+// It expects a POST request with a JSON body {"id": "...", "items": [...]}.
+func (n *Node) TxnCommit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var commit txnCommit
+	if err := json.NewDecoder(r.Body).Decode(&commit); err != nil || commit.ID == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := n.commitTxn(commit.ID, commit.Items); err != nil {
+		http.Error(w, "Failed to commit transaction: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"message": "Transaction committed"}`))
+}
+
+// TxnOutcome tells a participant whose locks have been held for too long
+// the outcome of a transaction this node coordinates, as the commit it
+// should have received. A transaction that is not decided yet is aborted.
+// It expects a POST request with a JSON body {"id": "...", "participant": "http://..."}.
+func (n *Node) TxnOutcome(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request txnOutcomeRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.ID == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	items := n.txnDecisions.outcome(request.ID, request.Participant)
+	if items == nil {
+		items = []store.Store{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(txnCommit{ID: request.ID, Items: items})
+}
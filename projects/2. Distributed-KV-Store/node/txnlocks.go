@@ -0,0 +1,105 @@
+package node
+
+import (
+	"errors"
+	"sync"
+)
+
+// errTxnConflict is returned when a transaction needs a key another
+// transaction has locked.
+var errTxnConflict = errors.New("key is locked by another transaction")
+
+// txnLock is held by a prepared transaction on the keys it will write.
+// done is closed when the transaction commits or aborts.
+type txnLock struct {
+	id   string
+	keys []string
+	done chan struct{}
+}
+
+// txnLocks tracks the keys locked by the transactions prepared on this node.
+// While a key is locked, writes and local reads of that key wait until the
+// transaction finishes, so they never see it half applied. A transaction
+// that is neither committed nor aborted in time is resolved with its
+// coordinator (see resolveTxn), so a coordinator that fails cannot block
+// a key forever.
+type txnLocks struct {
+	mu   sync.Mutex
+	held map[string]*txnLock
+	txns map[string]*txnLock
+}
+
+// acquire locks keys for transaction id until it is released.
+// It fails without waiting if another transaction holds one of them.
+func (l *txnLocks) acquire(id string, keys []string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.held == nil {
+		l.held = make(map[string]*txnLock)
+		l.txns = make(map[string]*txnLock)
+	}
+	if _, ok := l.txns[id]; ok {
+		return nil
+	}
+	for _, key := range keys {
+		if _, ok := l.held[key]; ok {
+			return errTxnConflict
+		}
+	}
+
+	lock := &txnLock{
+		id:   id,
+		keys: keys,
+		done: make(chan struct{}),
+	}
+	for _, key := range keys {
+		l.held[key] = lock
+	}
+	l.txns[id] = lock
+	return nil
+}
+
+// prepared reports whether transaction id holds its locks.
+func (l *txnLocks) prepared(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.txns[id]
+	return ok
+}
+
+// release unlocks the keys of transaction id. Releasing a transaction that
+// holds no locks is a no-op.
+func (l *txnLocks) release(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.releaseLocked(id)
+}
+
+// releaseLocked is release with mu held.
+func (l *txnLocks) releaseLocked(id string) {
+	lock, ok := l.txns[id]
+	if !ok {
+		return
+	}
+	for _, key := range lock.keys {
+		if l.held[key] == lock {
+			delete(l.held, key)
+		}
+	}
+	delete(l.txns, id)
+	close(lock.done)
+}
+
+// wait blocks until no transaction holds key.
+func (l *txnLocks) wait(key string) {
+	for {
+		l.mu.Lock()
+		lock, ok := l.held[key]
+		l.mu.Unlock()
+		if !ok {
+			return
+		}
+		<-lock.done
+	}
+}
@@ -0,0 +1,191 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/config"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/store"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/wal"
+)
+
+// errTxnAborted is returned when a participant asked for the outcome of a
+// transaction before the coordinator decided it, which aborts it.
+var errTxnAborted = errors.New("transaction took too long and was aborted by a participant")
+
+// txnDecision is the decision to commit a transaction this node coordinates:
+// the items each participant stores. A record with Done set means the
+// decision reached every participant, as a commit or as hints.
+type txnDecision struct {
+	ID    string                   `json:"id"`
+	Items map[string][]store.Store `json:"items,omitempty"`
+	Done  bool                     `json:"done,omitempty"`
+}
+
+// txnDecisions holds the outcome of the transactions this node coordinates.
+// A commit decision is written to a write-ahead log under the data
+// directory before any participant is told, so a coordinator that fails in
+// the middle of a commit delivers it to the others once it is back.
+// A transaction that is neither pending nor committed is aborted: a
+// participant that asks for the outcome of a pending transaction aborts it,
+// so it cannot commit after the participant released its locks.
+type txnDecisions struct {
+	mu        sync.Mutex
+	log       *wal.Log
+	pending   map[string]bool
+	committed map[string]txnDecision
+}
+
+// begin registers transaction id, which is neither committed nor aborted yet.
+func (d *txnDecisions) begin(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.pending == nil {
+		d.pending = make(map[string]bool)
+	}
+	d.pending[id] = true
+}
+
+// abort aborts transaction id.
+func (d *txnDecisions) abort(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.pending, id)
+}
+
+// commit records the decision to commit transaction id with items, per
+// participant. It fails with errTxnAborted if a participant aborted the
+// transaction already.
+func (d *txnDecisions) commit(id string, items map[string][]store.Store) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.pending[id] {
+		return errTxnAborted
+	}
+	delete(d.pending, id)
+
+	decision := txnDecision{ID: id, Items: items}
+	if err := d.append(decision); err != nil {
+		return err
+	}
+	if d.committed == nil {
+		d.committed = make(map[string]txnDecision)
+	}
+	d.committed[id] = decision
+	return nil
+}
+
+// delivered forgets the decision of transaction id once every participant
+// has it. The log is emptied when no decision is left to deliver.
+func (d *txnDecisions) delivered(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.committed, id)
+	if d.log == nil {
+		return
+	}
+	var err error
+	if len(d.committed) == 0 {
+		err = d.log.Reset()
+	} else {
+		err = d.append(txnDecision{ID: id, Done: true})
+	}
+	if err != nil {
+		log.Printf("Failed to record the delivery of transaction %s: %v", id, err)
+	}
+}
+
+// outcome returns the items participant stores for transaction id, or
+// none if the transaction is aborted. A pending transaction is aborted.
+func (d *txnDecisions) outcome(id, participant string) []store.Store {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if decision, ok := d.committed[id]; ok {
+		return decision.Items[participant]
+	}
+	delete(d.pending, id)
+	return nil
+}
+
+// undelivered returns the commit decisions not known to have reached
+// every participant.
+func (d *txnDecisions) undelivered() []txnDecision {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	decisions := make([]txnDecision, 0, len(d.committed))
+	for _, decision := range d.committed {
+		decisions = append(decisions, decision)
+	}
+	return decisions
+}
+
+// append writes decision to the log, if there is one. Decisions without
+// items have nothing to deliver and are not written.
+func (d *txnDecisions) append(decision txnDecision) error {
+	if d.log == nil || (!decision.Done && len(decision.Items) == 0) {
+		return nil
+	}
+	data, err := json.Marshal(decision)
+	if err != nil {
+		return err
+	}
+	return d.log.Append(data)
+}
+
+// openTxnLog opens the log of transaction decisions under the data
+// directory and reads back the decisions an earlier run had not delivered.
+// Without a data directory decisions are only kept in memory.
+func (n *Node) openTxnLog(cfg config.Config) {
+	if cfg.DataDir == "" || cfg.Consistency == "raft" {
+		return
+	}
+	if err := os.MkdirAll(cfg.DataDir, 0o755); err != nil {
+		log.Fatalf("Failed to create data directory %s: %v", cfg.DataDir, err)
+	}
+	l, err := wal.Open(filepath.Join(cfg.DataDir, "txn.log"))
+	if err != nil {
+		log.Fatalf("Failed to open transaction log: %v", err)
+	}
+
+	committed := make(map[string]txnDecision)
+	err = l.Replay(func(data []byte) error {
+		var decision txnDecision
+		if err := json.Unmarshal(data, &decision); err != nil {
+			return fmt.Errorf("failed to decode transaction decision: %w", err)
+		}
+		if decision.Done {
+			delete(committed, decision.ID)
+		} else {
+			committed[decision.ID] = decision
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Failed to replay transaction log: %v", err)
+	}
+
+	n.txnDecisions.log = l
+	n.txnDecisions.committed = committed
+	if len(committed) > 0 {
+		log.Printf("Recovered %d undelivered transaction commits", len(committed))
+	}
+}
+
+// deliverTxns sends the commit decisions an earlier run had not delivered
+// to their participants.
+func (n *Node) deliverTxns() {
+	for _, decision := range n.txnDecisions.undelivered() {
+		n.commitOn(decision.ID, decision.Items)
+		n.txnDecisions.delivered(decision.ID)
+	}
+}
@@ -0,0 +1,84 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/store"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/vclock"
+)
+
+// errInvalidContext is returned for a context token that cannot be decoded.
+var errInvalidContext = errors.New("invalid context")
+
+// stampWrite sets the vector clock, version number and timestamp of a new
+// write. The write descends from the versions named by the client's context
+// token. Without a token it descends from the versions this node holds, so a
+// plain write replaces whatever the node has seen, while writes accepted
+// elsewhere in the meantime are kept as siblings. The version number is the
+// next one after the node's copy. A node that is not a replica of the key
+// holds no copy, so it reads the key from R of its replicas instead and
+// stamps the write over the merged copy; a plain write through such a node
+// therefore replaces every version the read returned.
+// It fails with errInvalidContext for a token that cannot be decoded, and
+// with another error if the replicas cannot be read.
+func (n *Node) stampWrite(item *store.Store, context string) error {
+	clock := vclock.Clock{}
+	if context != "" {
+		decoded, err := vclock.Decode(context)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidContext, err)
+		}
+		clock = decoded
+	}
+
+	var known store.Store
+	found := false
+	if n.ring.IsOwner(item.Key, n.Replicas, n.Self) {
+		known, found = n.DB.Get(item.Key)
+	} else {
+		var err error
+		known, found, err = n.quorumRead(item.Key, n.ReadQuorum, false)
+		if err != nil {
+			return fmt.Errorf("failed to read key %s from its replicas: %w", item.Key, err)
+		}
+	}
+	if context == "" && found {
+		clock = known.Context()
+	}
+
+	item.Clock = n.tick(clock)
+	item.Version = 1
+	if found {
+		item.Version = known.NextVersion()
+	}
+	item.Timestamp = time.Now().UnixNano()
+	return nil
+}
+
+// stampOver is stampWrite for a write whose coordinator has already read
+// existing, the merged copy of the key when found, from the replicas: the
+// write descends from every version of it.
+func (n *Node) stampOver(item *store.Store, existing store.Store, found bool) {
+	clock := vclock.Clock{}
+	item.Version = 1
+	if found {
+		clock = existing.Context()
+		item.Version = existing.NextVersion()
+	}
+	item.Clock = n.tick(clock)
+	item.Timestamp = time.Now().UnixNano()
+}
+
+// tick advances this node's counter in clock and returns it.
+// The counter follows the wall clock, so two writes coordinated by this
+// node never get equal clocks, not even across restarts.
+func (n *Node) tick(clock vclock.Clock) vclock.Clock {
+	counter := clock[n.Self] + 1
+	if now := uint64(time.Now().UnixNano()); now > counter {
+		counter = now
+	}
+	clock[n.Self] = counter
+	return clock
+}
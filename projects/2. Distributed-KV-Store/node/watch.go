@@ -0,0 +1,189 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/store"
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/watch"
+)
+
+// watchProgressInterval is how often an idle watch stream gets a progress
+// message, which tells the client the current revision and keeps
+// proxies from closing the connection.
+const watchProgressInterval = 10 * time.Second
+
+// putEvent returns the watch event for a write of item.
+func putEvent(item store.Store) watch.Event {
+	event := watch.Event{Type: watch.Put, Key: item.Key, Version: item.CurrentVersion()}
+	if live := item.Live(); len(live) > 0 {
+		event.Value, event.ContentType = live[0].Value, live[0].ContentType
+	}
+	return event
+}
+
+// publishChange tells watchers how the local copy of a key changed from
+// before (found tells whether there was one) to after: a put when the
+// newest live version changed, a delete when no live version is left.
+func (n *Node) publishChange(before store.Store, found bool, after store.Store) {
+	var was []store.Version
+	if found {
+		was = before.Live()
+	}
+	is := after.Live()
+
+	switch {
+	case len(is) > 0:
+		if len(was) > 0 && was[0].Timestamp == is[0].Timestamp && was[0].Version == is[0].Version {
+			return
+		}
+		n.watch.Publish(putEvent(after))
+	case len(was) > 0:
+		n.watch.Publish(watch.Event{Type: watch.Delete, Key: after.Key})
+	}
+}
+
+// watchMessage is a message in a watch stream that is not an event.
+type watchMessage struct {
+	Type            string `json:"type"`
+	Revision        uint64 `json:"revision"`
+	CompactRevision uint64 `json:"compact_revision,omitempty"`
+	Error           string `json:"error,omitempty"`
+}
+
+// Watch streams the changes to a key ("key" query parameter) or to every
+// key with a prefix ("prefix") as they happen. With "revision" the stream
+// starts with the changes since that revision; a client that was
+// disconnected resumes with the revision after the last one it received.
+// If that revision is no longer in the history the node responds with
+// 410 Gone and the compaction revision.
+// Events are sent as Server-Sent Events when the client accepts
+// text/event-stream or asks for format=sse, and as newline-delimited JSON
+// otherwise. With SSE the Last-Event-ID header resumes the stream.
+// In eventual mode revisions are local to the node and only changes to the
+// keys the node replicates are seen; in raft mode they are Raft log indexes,
+// the same on every node.
+func (n *Node) Watch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	key, prefix := query.Get("key"), false
+	if query.Has("prefix") {
+		key, prefix = query.Get("prefix"), true
+	}
+	if key == "" && !prefix {
+		http.Error(w, "A key or a prefix is required", http.StatusBadRequest)
+		return
+	}
+
+	sse := query.Get("format") == "sse" || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	var start uint64
+	if value := query.Get("revision"); value != "" {
+		revision, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid revision: "+value, http.StatusBadRequest)
+			return
+		}
+		start = revision
+	} else if id := r.Header.Get("Last-Event-ID"); sse && id != "" {
+		last, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid Last-Event-ID: "+id, http.StatusBadRequest)
+			return
+		}
+		start = last + 1
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	watcher, err := n.watch.Watch(key, prefix, start)
+	var compacted *watch.CompactedError
+	if err != nil && !errors.As(err, &compacted) {
+		http.Error(w, "Failed to watch: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if compacted != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusGone)
+		json.NewEncoder(w).Encode(watchMessage{
+			Type:            "error",
+			Revision:        compacted.Revision,
+			CompactRevision: compacted.CompactRevision,
+			Error:           "revision compacted",
+		})
+		return
+	}
+	defer watcher.Close()
+
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	// send writes one message in the stream's format
+	send := func(kind string, revision uint64, message any) {
+		data, _ := json.Marshal(message)
+		if sse {
+			if kind == watch.Put || kind == watch.Delete {
+				fmt.Fprintf(w, "id: %d\n", revision)
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", kind, data)
+		} else {
+			w.Write(append(data, '\n'))
+		}
+	}
+
+	last := start
+	for _, event := range watcher.Backlog() {
+		send(event.Type, event.Revision, event)
+		last = event.Revision
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(watchProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case event := <-watcher.Events():
+			send(event.Type, event.Revision, event)
+			last = event.Revision
+			flusher.Flush()
+		case <-ticker.C:
+			send("progress", 0, watchMessage{Type: "progress", Revision: n.watch.Revision()})
+			flusher.Flush()
+		case <-watcher.Done():
+			// deliver what was queued before the watcher was cancelled
+			for queued := true; queued; {
+				select {
+				case event := <-watcher.Events():
+					send(event.Type, event.Revision, event)
+					last = event.Revision
+				default:
+					queued = false
+				}
+			}
+			if err := watcher.Err(); err != nil {
+				send("error", 0, watchMessage{Type: "error", Revision: last, Error: err.Error()})
+			}
+			flusher.Flush()
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
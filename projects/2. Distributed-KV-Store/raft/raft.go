@@ -0,0 +1,1161 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+)
+
+// maxEntriesPerAppend bounds the size of a single AppendEntries RPC.
+const maxEntriesPerAppend = 256
+
+// tickInterval is how often timers are checked.
+const tickInterval = 10 * time.Millisecond
+
+// defaultSnapshotThreshold is used when Config.SnapshotThreshold is zero.
+const defaultSnapshotThreshold = 10000
+
+// snapshotTimeout bounds sending a snapshot to a follower, which can take
+// much longer than the other RPCs.
+const snapshotTimeout = time.Minute
+
+// ApplyFunc applies a committed command to the state machine and returns
+// a result that is handed back to the caller of Propose on the leader.
+// index is the position of the command in the log.
+type ApplyFunc func(index uint64, data []byte) any
+
+// Config configures a Raft node.
+type Config struct {
+	// ID identifies this node. With HTTPTransport it is the node's base URL.
+	ID string
+
+	// Members is the initial cluster membership, including ID. A node that
+	// joins an existing cluster starts with no members and learns them from
+	// the leader once it has been added with AddMember.
+	Members []string
+
+	// Dir is where the term, vote, latest snapshot and log are persisted.
+	// When empty the state is kept in memory only and is lost on restart.
+	Dir string
+
+	// ElectionTimeout is the minimum time without hearing from a leader
+	// before a follower starts an election; the actual timeout is randomized
+	// between ElectionTimeout and twice that. HeartbeatInterval is how often
+	// the leader sends heartbeats and must be well below ElectionTimeout.
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+
+	Transport Transport
+	Apply     ApplyFunc
+
+	// Applied is the index up to which a state machine that persists itself
+	// already holds the log, or 0. The entries up to it are not applied
+	// again on startup, and the latest snapshot is only restored if it goes
+	// beyond it. It cannot be beyond the persisted log.
+	Applied uint64
+
+	// Snapshot writes the state machine to w, and Restore replaces the
+	// state machine with one written by Snapshot that covers the log up to
+	// and including index. With both set, the log is compacted: once
+	// SnapshotThreshold entries (defaultSnapshotThreshold when zero) have
+	// been applied since the last snapshot, the node takes a snapshot and
+	// drops the entries it covers. A follower that needs entries the leader
+	// has dropped is sent the leader's snapshot instead. A node with only
+	// Restore set never compacts its own log but still accepts snapshots.
+	Snapshot          func(w io.Writer) error
+	Restore           func(index uint64, r io.Reader) error
+	SnapshotThreshold uint64
+}
+
+// proposal is a caller waiting for its entry to be applied.
+type proposal struct {
+	term   uint64
+	result chan proposalResult
+}
+
+type proposalResult struct {
+	value any
+	err   error
+}
+
+// Raft is a single member of a Raft cluster. It elects a leader, replicates
+// the log to followers, tracks the commit index and applies committed
+// commands to the state machine in log order on every node.
+type Raft struct {
+	cfg     Config
+	storage *storage
+
+	mu          sync.Mutex
+	state       State
+	currentTerm uint64
+	votedFor    string
+	leaderID    string
+	log         []Entry // log[0] is a sentinel with the index and term of the snapshot, or 0 and 0
+	commitIndex uint64
+	lastApplied uint64
+	members     []string
+
+	snapshot     snapshotMeta // the latest snapshot
+	snapshotData []byte       // the latest snapshot when there is no storage
+
+	// applyMu is held while the state machine is changed or snapshotted,
+	// so applying entries, taking snapshots and installing snapshots from
+	// the leader never overlap.
+	applyMu sync.Mutex
+
+	electionDeadline  time.Time
+	lastHeartbeat     time.Time
+	lastLeaderContact time.Time
+
+	// leader state
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	inflight   map[string]bool
+	pending    map[string]bool
+	lastAck    map[string]time.Time // send time of the latest acknowledged RPC
+
+	proposals map[uint64]proposal
+	applyCond *sync.Cond
+	applied   chan struct{} // closed and replaced whenever lastApplied advances
+
+	stop    chan struct{}
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+// New creates a Raft node, restores its persisted state and starts it.
+func New(cfg Config) (*Raft, error) {
+	r := &Raft{
+		cfg:       cfg,
+		log:       []Entry{{}},
+		proposals: make(map[uint64]proposal),
+		applied:   make(chan struct{}),
+		stop:      make(chan struct{}),
+	}
+	r.applyCond = sync.NewCond(&r.mu)
+
+	if cfg.Dir != "" {
+		s, state, meta, entries, err := openStorage(cfg.Dir)
+		if err != nil {
+			return nil, err
+		}
+		r.storage = s
+		r.currentTerm = state.Term
+		r.votedFor = state.VotedFor
+		r.snapshot = meta
+		r.log = append([]Entry{{Index: meta.Index, Term: meta.Term}}, entries...)
+	}
+	if cfg.Applied > r.lastIndexLocked() {
+		if r.storage != nil {
+			r.storage.close()
+		}
+		return nil, fmt.Errorf("state machine has applied index %d, beyond the log ending at %d", cfg.Applied, r.lastIndexLocked())
+	}
+	switch {
+	case cfg.Applied >= r.snapshot.Index && cfg.Applied > 0:
+		r.commitIndex = cfg.Applied
+		r.lastApplied = cfg.Applied
+	case r.snapshot.Index > 0:
+		if err := r.restoreSnapshot(); err != nil {
+			r.storage.close()
+			return nil, err
+		}
+		r.commitIndex = r.snapshot.Index
+		r.lastApplied = r.snapshot.Index
+	}
+	r.updateMembersLocked()
+	r.resetElectionTimerLocked()
+
+	r.wg.Add(2)
+	go r.run()
+	go r.applyLoop()
+
+	log.Printf("Raft node %s started at term %d with its log up to index %d (snapshot at %d), members %v",
+		cfg.ID, r.currentTerm, r.lastIndexLocked(), r.snapshot.Index, r.members)
+	return r, nil
+}
+
+// Stop stops the node's background goroutines.
+func (r *Raft) Stop() {
+	r.mu.Lock()
+	if r.stopped {
+		r.mu.Unlock()
+		return
+	}
+	r.stopped = true
+	close(r.stop)
+	r.applyCond.Broadcast()
+	r.mu.Unlock()
+
+	r.wg.Wait()
+	if r.storage != nil {
+		r.storage.close()
+	}
+}
+
+// Propose appends a command to the log and waits until it is committed and
+// applied, returning the state machine's result. Only the leader accepts
+// proposals; other nodes return ErrNotLeader.
+func (r *Raft) Propose(ctx context.Context, data []byte) (any, error) {
+	return r.propose(ctx, Entry{Type: EntryCommand, Data: data})
+}
+
+// AddMember adds a node to the cluster. Membership changes one node at a
+// time, so a change is rejected while a previous one is not yet committed.
+func (r *Raft) AddMember(ctx context.Context, id string) error {
+	return r.changeMembers(ctx, id, true)
+}
+
+// RemoveMember removes a node from the cluster. If the leader removes
+// itself it steps down once the change is committed.
+func (r *Raft) RemoveMember(ctx context.Context, id string) error {
+	return r.changeMembers(ctx, id, false)
+}
+
+func (r *Raft) changeMembers(ctx context.Context, id string, add bool) error {
+	r.mu.Lock()
+	if r.state != Leader {
+		r.mu.Unlock()
+		return ErrNotLeader
+	}
+	if r.configPendingLocked() {
+		r.mu.Unlock()
+		return ErrConfigInProgress
+	}
+
+	members := slices.Clone(r.members)
+	i := slices.Index(members, id)
+	switch {
+	case add && i >= 0, !add && i < 0:
+		r.mu.Unlock()
+		return nil // nothing to change
+	case add:
+		members = append(members, id)
+	default:
+		members = slices.Delete(members, i, i+1)
+	}
+	r.mu.Unlock()
+
+	_, err := r.propose(ctx, Entry{Type: EntryConfig, Members: members})
+	return err
+}
+
+func (r *Raft) propose(ctx context.Context, e Entry) (any, error) {
+	r.mu.Lock()
+	if r.stopped {
+		r.mu.Unlock()
+		return nil, ErrStopped
+	}
+	if r.state != Leader {
+		r.mu.Unlock()
+		return nil, ErrNotLeader
+	}
+
+	e.Term = r.currentTerm
+	e.Index = r.lastIndexLocked() + 1
+	r.appendLocked([]Entry{e})
+
+	p := proposal{term: e.Term, result: make(chan proposalResult, 1)}
+	r.proposals[e.Index] = p
+	r.advanceCommitLocked()
+	r.broadcastLocked()
+	r.mu.Unlock()
+
+	select {
+	case res := <-p.result:
+		return res.value, res.err
+	case <-ctx.Done():
+		r.mu.Lock()
+		delete(r.proposals, e.Index)
+		r.mu.Unlock()
+		return nil, ctx.Err()
+	case <-r.stop:
+		return nil, ErrStopped
+	}
+}
+
+// ReadIndex returns a commit index that is safe to serve linearizable reads
+// from: once the local state machine has applied it (see WaitApplied), the
+// read observes every write that completed before ReadIndex was called.
+// The leader confirms it still holds leadership by hearing back from a
+// majority before returning. Only the leader can serve ReadIndex.
+func (r *Raft) ReadIndex(ctx context.Context) (uint64, error) {
+	r.mu.Lock()
+	if r.state != Leader {
+		r.mu.Unlock()
+		return 0, ErrNotLeader
+	}
+	// a new leader only knows the commit index once it committed an entry
+	// of its own term, which is what the no-op appended on election is for
+	if r.entryLocked(r.commitIndex).Term != r.currentTerm {
+		r.mu.Unlock()
+		if err := r.waitCommitInTerm(ctx); err != nil {
+			return 0, err
+		}
+		r.mu.Lock()
+	}
+	readIndex := r.commitIndex
+	term := r.currentTerm
+	start := time.Now()
+	r.broadcastLocked()
+	r.mu.Unlock()
+
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		r.mu.Lock()
+		if r.state != Leader || r.currentTerm != term {
+			r.mu.Unlock()
+			return 0, ErrNotLeader
+		}
+		if r.hasQuorumSinceLocked(start) {
+			r.mu.Unlock()
+			return readIndex, nil
+		}
+		r.mu.Unlock()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-r.stop:
+			return 0, ErrStopped
+		}
+	}
+}
+
+// waitCommitInTerm waits until the leader has committed an entry of its term.
+func (r *Raft) waitCommitInTerm(ctx context.Context) error {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		r.mu.Lock()
+		if r.state != Leader {
+			r.mu.Unlock()
+			return ErrNotLeader
+		}
+		if r.entryLocked(r.commitIndex).Term == r.currentTerm {
+			r.mu.Unlock()
+			return nil
+		}
+		r.mu.Unlock()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-r.stop:
+			return ErrStopped
+		}
+	}
+}
+
+// WaitApplied waits until the state machine has applied index.
+func (r *Raft) WaitApplied(ctx context.Context, index uint64) error {
+	for {
+		r.mu.Lock()
+		if r.lastApplied >= index {
+			r.mu.Unlock()
+			return nil
+		}
+		applied := r.applied
+		r.mu.Unlock()
+
+		select {
+		case <-applied:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-r.stop:
+			return ErrStopped
+		}
+	}
+}
+
+// Leader returns the ID of the current leader, or "" if it is not known.
+func (r *Raft) Leader() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.leaderID
+}
+
+// IsLeader reports whether this node is the leader.
+func (r *Raft) IsLeader() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state == Leader
+}
+
+// Members returns the current cluster membership.
+func (r *Raft) Members() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.members)
+}
+
+// Status returns a snapshot of the node's Raft state.
+func (r *Raft) Status() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return Status{
+		ID:            r.cfg.ID,
+		State:         r.state.String(),
+		Term:          r.currentTerm,
+		Leader:        r.leaderID,
+		CommitIndex:   r.commitIndex,
+		LastApplied:   r.lastApplied,
+		LastIndex:     r.lastIndexLocked(),
+		SnapshotIndex: r.log[0].Index,
+		Members:       slices.Clone(r.members),
+	}
+}
+
+// HandleRequestVote answers a candidate's request for a vote.
+func (r *Raft) HandleRequestVote(args RequestVoteArgs) RequestVoteReply {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// A follower ignores candidates while it hears from a leader, and a
+	// leader ignores candidates that are not members. This keeps a node that
+	// was removed from the cluster (and so no longer hears from the leader)
+	// from disrupting it with ever higher terms. A member with a higher term
+	// still makes the leader step down.
+	if r.state == Follower && r.leaderID != "" && time.Since(r.lastLeaderContact) < r.cfg.ElectionTimeout {
+		return RequestVoteReply{Term: r.currentTerm}
+	}
+	if r.state == Leader && !slices.Contains(r.members, args.CandidateID) {
+		return RequestVoteReply{Term: r.currentTerm}
+	}
+
+	if args.Term > r.currentTerm {
+		r.becomeFollowerLocked(args.Term, "")
+	}
+
+	reply := RequestVoteReply{Term: r.currentTerm}
+	if args.Term < r.currentTerm {
+		return reply
+	}
+
+	// only vote for candidates whose log is at least as up to date as ours
+	lastIndex := r.lastIndexLocked()
+	lastTerm := r.entryLocked(lastIndex).Term
+	upToDate := args.LastLogTerm > lastTerm ||
+		(args.LastLogTerm == lastTerm && args.LastLogIndex >= lastIndex)
+
+	if (r.votedFor == "" || r.votedFor == args.CandidateID) && upToDate {
+		r.votedFor = args.CandidateID
+		r.persistStateLocked()
+		r.resetElectionTimerLocked()
+		reply.VoteGranted = true
+	}
+	return reply
+}
+
+// HandleAppendEntries accepts entries (or a heartbeat) from the leader.
+func (r *Raft) HandleAppendEntries(args AppendEntriesArgs) AppendEntriesReply {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if args.Term < r.currentTerm {
+		return AppendEntriesReply{Term: r.currentTerm}
+	}
+	if args.Term > r.currentTerm || r.state != Follower {
+		r.becomeFollowerLocked(args.Term, args.LeaderID)
+	}
+	r.leaderID = args.LeaderID
+	r.lastLeaderContact = time.Now()
+	r.resetElectionTimerLocked()
+
+	reply := AppendEntriesReply{Term: r.currentTerm}
+
+	// entries covered by the snapshot are committed, so they match
+	if snapshotIndex := r.log[0].Index; args.PrevLogIndex < snapshotIndex {
+		skip := min(snapshotIndex-args.PrevLogIndex, uint64(len(args.Entries)))
+		args.Entries = args.Entries[skip:]
+		args.PrevLogIndex = snapshotIndex
+		args.PrevLogTerm = r.log[0].Term
+	}
+
+	// the entry before the new ones must match, or the leader has to back up
+	lastIndex := r.lastIndexLocked()
+	if args.PrevLogIndex > lastIndex {
+		reply.ConflictIndex = lastIndex + 1
+		return reply
+	}
+	if prevTerm := r.entryLocked(args.PrevLogIndex).Term; prevTerm != args.PrevLogTerm {
+		// skip back over the whole conflicting term at once
+		i := args.PrevLogIndex
+		for i > r.commitIndex+1 && r.entryLocked(i-1).Term == prevTerm {
+			i--
+		}
+		reply.ConflictIndex = i
+		return reply
+	}
+
+	// append the entries we do not have yet, dropping any conflicting suffix
+	for i, e := range args.Entries {
+		if e.Index <= r.lastIndexLocked() {
+			if r.entryLocked(e.Index).Term == e.Term {
+				continue
+			}
+			r.truncateLocked(e.Index)
+		}
+		r.appendLocked(args.Entries[i:])
+		break
+	}
+
+	if args.LeaderCommit > r.commitIndex {
+		lastNew := args.PrevLogIndex + uint64(len(args.Entries))
+		r.commitIndex = min(args.LeaderCommit, lastNew)
+		r.applyCond.Broadcast()
+	}
+
+	reply.Success = true
+	return reply
+}
+
+// run drives elections and heartbeats.
+func (r *Raft) run() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		}
+
+		r.mu.Lock()
+		switch {
+		case r.state == Leader:
+			if time.Since(r.lastHeartbeat) >= r.cfg.HeartbeatInterval {
+				r.broadcastLocked()
+			}
+		case time.Now().After(r.electionDeadline):
+			// nodes that are not (or not yet) members never campaign
+			if slices.Contains(r.members, r.cfg.ID) {
+				r.startElectionLocked()
+			} else {
+				r.resetElectionTimerLocked()
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+// startElectionLocked becomes a candidate and asks every member for a vote.
+func (r *Raft) startElectionLocked() {
+	r.state = Candidate
+	r.currentTerm++
+	r.votedFor = r.cfg.ID
+	r.leaderID = ""
+	r.persistStateLocked()
+	r.resetElectionTimerLocked()
+
+	term := r.currentTerm
+	lastIndex := r.lastIndexLocked()
+	args := RequestVoteArgs{
+		Term:         term,
+		CandidateID:  r.cfg.ID,
+		LastLogIndex: lastIndex,
+		LastLogTerm:  r.entryLocked(lastIndex).Term,
+	}
+	log.Printf("Raft node %s starting election for term %d", r.cfg.ID, term)
+
+	votes := 1
+	if r.hasMajorityLocked(votes) {
+		r.becomeLeaderLocked()
+		return
+	}
+
+	for _, peer := range r.peersLocked() {
+		go func(peer string) {
+			ctx, cancel := context.WithTimeout(context.Background(), r.cfg.ElectionTimeout)
+			defer cancel()
+
+			reply, err := r.cfg.Transport.RequestVote(ctx, peer, args)
+			if err != nil {
+				return
+			}
+
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if reply.Term > r.currentTerm {
+				r.becomeFollowerLocked(reply.Term, "")
+				return
+			}
+			if r.state != Candidate || r.currentTerm != term || !reply.VoteGranted {
+				return
+			}
+			votes++
+			if r.hasMajorityLocked(votes) {
+				r.becomeLeaderLocked()
+			}
+		}(peer)
+	}
+}
+
+func (r *Raft) becomeLeaderLocked() {
+	log.Printf("Raft node %s became leader for term %d", r.cfg.ID, r.currentTerm)
+	r.state = Leader
+	r.leaderID = r.cfg.ID
+	r.nextIndex = make(map[string]uint64)
+	r.matchIndex = make(map[string]uint64)
+	r.inflight = make(map[string]bool)
+	r.pending = make(map[string]bool)
+	r.lastAck = make(map[string]time.Time)
+
+	// commit a no-op so entries from earlier terms get committed too
+	r.appendLocked([]Entry{{
+		Index: r.lastIndexLocked() + 1,
+		Term:  r.currentTerm,
+		Type:  EntryNoop,
+	}})
+	r.advanceCommitLocked()
+	r.broadcastLocked()
+}
+
+func (r *Raft) becomeFollowerLocked(term uint64, leader string) {
+	if r.state == Leader {
+		log.Printf("Raft node %s stepping down at term %d", r.cfg.ID, term)
+	}
+	r.state = Follower
+	r.leaderID = leader
+	if term > r.currentTerm {
+		r.currentTerm = term
+		r.votedFor = ""
+		r.persistStateLocked()
+	}
+	r.resetElectionTimerLocked()
+}
+
+// broadcastLocked sends AppendEntries to every peer that has no RPC in
+// flight; peers that do are marked so they get another round afterwards.
+func (r *Raft) broadcastLocked() {
+	r.lastHeartbeat = time.Now()
+	for _, peer := range r.peersLocked() {
+		if r.inflight[peer] {
+			r.pending[peer] = true
+			continue
+		}
+		r.inflight[peer] = true
+		go r.replicateTo(peer, r.currentTerm)
+	}
+}
+
+// replicateTo sends one AppendEntries RPC to peer and processes the reply.
+func (r *Raft) replicateTo(peer string, term uint64) {
+	r.mu.Lock()
+	if r.state != Leader || r.currentTerm != term {
+		r.inflight[peer] = false
+		r.mu.Unlock()
+		return
+	}
+	if _, ok := r.nextIndex[peer]; !ok {
+		r.nextIndex[peer] = r.lastIndexLocked() + 1
+	}
+	next := r.nextIndex[peer]
+	if next <= r.log[0].Index {
+		// the peer needs entries that have been compacted
+		r.mu.Unlock()
+		r.sendSnapshot(peer, term)
+		return
+	}
+	end := min(r.lastIndexLocked()+1, next+maxEntriesPerAppend)
+	args := AppendEntriesArgs{
+		Term:         term,
+		LeaderID:     r.cfg.ID,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  r.entryLocked(next - 1).Term,
+		Entries:      r.entriesLocked(next, end),
+		LeaderCommit: r.commitIndex,
+	}
+	r.mu.Unlock()
+
+	sent := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), r.cfg.ElectionTimeout)
+	reply, err := r.cfg.Transport.AppendEntries(ctx, peer, args)
+	cancel()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.inflight[peer] = false
+
+	if err == nil {
+		r.handleAppendReplyLocked(peer, args, reply, sent)
+	}
+	r.replicateAgainLocked(peer, term, err == nil)
+}
+
+// sendSnapshot sends the latest snapshot to peer and processes the reply.
+func (r *Raft) sendSnapshot(peer string, term uint64) {
+	sent := time.Now()
+	meta, data, err := r.openSnapshot()
+	var reply InstallSnapshotReply
+	if err == nil {
+		args := InstallSnapshotArgs{
+			Term:              term,
+			LeaderID:          r.cfg.ID,
+			LastIncludedIndex: meta.Index,
+			LastIncludedTerm:  meta.Term,
+			Members:           meta.Members,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+		reply, err = r.cfg.Transport.InstallSnapshot(ctx, peer, args, data)
+		cancel()
+		data.Close()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.inflight[peer] = false
+
+	if err == nil && reply.Term > r.currentTerm {
+		r.becomeFollowerLocked(reply.Term, "")
+	} else if err == nil && r.state == Leader && r.currentTerm == term {
+		if sent.After(r.lastAck[peer]) {
+			r.lastAck[peer] = sent
+		}
+		if meta.Index > r.matchIndex[peer] {
+			r.matchIndex[peer] = meta.Index
+		}
+		r.nextIndex[peer] = r.matchIndex[peer] + 1
+		r.advanceCommitLocked()
+	}
+	r.replicateAgainLocked(peer, term, err == nil)
+}
+
+// replicateAgainLocked sends peer another RPC right away if it is behind
+// or a round was requested while the last one was in flight. ok tells
+// whether the last RPC succeeded.
+func (r *Raft) replicateAgainLocked(peer string, term uint64, ok bool) {
+	if r.state == Leader && r.currentTerm == term && r.pending[peer] ||
+		(ok && r.state == Leader && r.nextIndex[peer] <= r.lastIndexLocked()) {
+		r.pending[peer] = false
+		r.inflight[peer] = true
+		go r.replicateTo(peer, term)
+	}
+}
+
+func (r *Raft) handleAppendReplyLocked(peer string, args AppendEntriesArgs, reply AppendEntriesReply, sent time.Time) {
+	if reply.Term > r.currentTerm {
+		r.becomeFollowerLocked(reply.Term, "")
+		return
+	}
+	if r.state != Leader || reply.Term != r.currentTerm || args.Term != r.currentTerm {
+		return
+	}
+
+	if sent.After(r.lastAck[peer]) {
+		r.lastAck[peer] = sent
+	}
+
+	if !reply.Success {
+		if reply.ConflictIndex > 0 {
+			r.nextIndex[peer] = reply.ConflictIndex
+		} else if r.nextIndex[peer] > 1 {
+			r.nextIndex[peer]--
+		}
+		return
+	}
+
+	match := args.PrevLogIndex + uint64(len(args.Entries))
+	if match > r.matchIndex[peer] {
+		r.matchIndex[peer] = match
+	}
+	r.nextIndex[peer] = r.matchIndex[peer] + 1
+	r.advanceCommitLocked()
+}
+
+// advanceCommitLocked moves the commit index to the highest entry of the
+// current term that is stored on a majority of members.
+func (r *Raft) advanceCommitLocked() {
+	if r.state != Leader {
+		return
+	}
+
+	for n := r.lastIndexLocked(); n > r.commitIndex; n-- {
+		if r.entryLocked(n).Term != r.currentTerm {
+			break // older terms are only committed indirectly
+		}
+
+		count := 0
+		for _, m := range r.members {
+			if m == r.cfg.ID || r.matchIndex[m] >= n {
+				count++
+			}
+		}
+		if count > len(r.members)/2 {
+			r.commitIndex = n
+			r.applyCond.Broadcast()
+			return
+		}
+	}
+}
+
+// hasQuorumSinceLocked reports whether a majority of members acknowledged
+// an RPC sent after start, confirming that this node is still the leader.
+func (r *Raft) hasQuorumSinceLocked(start time.Time) bool {
+	count := 0
+	for _, m := range r.members {
+		if m == r.cfg.ID || !r.lastAck[m].Before(start) {
+			count++
+		}
+	}
+	return count > len(r.members)/2
+}
+
+func (r *Raft) hasMajorityLocked(votes int) bool {
+	return votes > len(r.members)/2
+}
+
+// applyLoop applies committed entries to the state machine in order.
+func (r *Raft) applyLoop() {
+	defer r.wg.Done()
+
+	for {
+		r.mu.Lock()
+		for r.lastApplied >= r.commitIndex && !r.stopped {
+			r.applyCond.Wait()
+		}
+		if r.stopped {
+			r.mu.Unlock()
+			return
+		}
+		entries := r.entriesLocked(r.lastApplied+1, r.commitIndex+1)
+		r.mu.Unlock()
+
+		r.applyMu.Lock()
+		for _, e := range entries {
+			r.mu.Lock()
+			if e.Index != r.lastApplied+1 {
+				// a snapshot from the leader was installed meanwhile
+				r.mu.Unlock()
+				break
+			}
+			r.mu.Unlock()
+
+			var value any
+			if e.Type == EntryCommand {
+				value = r.cfg.Apply(e.Index, e.Data)
+			}
+
+			r.mu.Lock()
+			r.lastApplied = e.Index
+			if p, ok := r.proposals[e.Index]; ok {
+				delete(r.proposals, e.Index)
+				if p.term == e.Term {
+					p.result <- proposalResult{value: value}
+				} else {
+					p.result <- proposalResult{err: ErrLeadershipLost}
+				}
+			}
+			if e.Type == EntryConfig && r.state == Leader && !slices.Contains(e.Members, r.cfg.ID) {
+				log.Printf("Raft node %s was removed from the cluster", r.cfg.ID)
+				r.becomeFollowerLocked(r.currentTerm, "")
+			}
+			close(r.applied)
+			r.applied = make(chan struct{})
+			r.mu.Unlock()
+		}
+		if r.cfg.Snapshot != nil {
+			threshold := r.cfg.SnapshotThreshold
+			if threshold == 0 {
+				threshold = defaultSnapshotThreshold
+			}
+			if err := r.takeSnapshot(threshold); err != nil {
+				log.Printf("Raft node %s failed to take a snapshot: %v", r.cfg.ID, err)
+			}
+		}
+		r.applyMu.Unlock()
+	}
+}
+
+// TakeSnapshot snapshots the state machine and compacts the log right away,
+// rather than waiting for SnapshotThreshold applied entries.
+func (r *Raft) TakeSnapshot() error {
+	if r.cfg.Snapshot == nil {
+		return ErrNoSnapshots
+	}
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+	return r.takeSnapshot(1)
+}
+
+// takeSnapshot takes a snapshot and compacts the log if at least threshold
+// entries have been applied since the last one. Called with applyMu held,
+// so the state machine does not change while it is written.
+func (r *Raft) takeSnapshot(threshold uint64) error {
+	r.mu.Lock()
+	if r.lastApplied-r.log[0].Index < threshold {
+		r.mu.Unlock()
+		return nil
+	}
+	meta := snapshotMeta{
+		Index:   r.lastApplied,
+		Term:    r.entryLocked(r.lastApplied).Term,
+		Members: r.membersAtLocked(r.lastApplied),
+	}
+	r.mu.Unlock()
+
+	if err := r.saveSnapshot(meta, r.cfg.Snapshot); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.compactLocked(meta)
+	r.mu.Unlock()
+	log.Printf("Raft node %s compacted its log up to index %d", r.cfg.ID, meta.Index)
+	return nil
+}
+
+// HandleInstallSnapshot installs a snapshot sent by the leader, whose data
+// is read from data, in place of the entries it covers. A snapshot that is
+// older than what the node has applied already is ignored.
+func (r *Raft) HandleInstallSnapshot(args InstallSnapshotArgs, data io.Reader) (InstallSnapshotReply, error) {
+	r.mu.Lock()
+	if args.Term < r.currentTerm {
+		reply := InstallSnapshotReply{Term: r.currentTerm}
+		r.mu.Unlock()
+		return reply, nil
+	}
+	if args.Term > r.currentTerm || r.state != Follower {
+		r.becomeFollowerLocked(args.Term, args.LeaderID)
+	}
+	r.leaderID = args.LeaderID
+	r.lastLeaderContact = time.Now()
+	r.resetElectionTimerLocked()
+	reply := InstallSnapshotReply{Term: r.currentTerm}
+	r.mu.Unlock()
+
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+
+	r.mu.Lock()
+	stale := args.LastIncludedIndex <= r.lastApplied
+	r.mu.Unlock()
+	if stale {
+		return reply, nil
+	}
+
+	meta := snapshotMeta{
+		Index:   args.LastIncludedIndex,
+		Term:    args.LastIncludedTerm,
+		Members: args.Members,
+	}
+	err := r.saveSnapshot(meta, func(w io.Writer) error {
+		_, err := io.Copy(w, data)
+		return err
+	})
+	if err != nil {
+		return reply, err
+	}
+	if err := r.restoreSnapshot(); err != nil {
+		log.Fatalf("Raft node %s failed to install a snapshot: %v", r.cfg.ID, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.compactLocked(meta)
+	r.commitIndex = max(r.commitIndex, meta.Index)
+	r.lastApplied = meta.Index
+	for index, p := range r.proposals {
+		if index <= meta.Index {
+			delete(r.proposals, index)
+			p.result <- proposalResult{err: ErrLeadershipLost}
+		}
+	}
+	close(r.applied)
+	r.applied = make(chan struct{})
+	r.lastLeaderContact = time.Now()
+	r.resetElectionTimerLocked()
+	log.Printf("Raft node %s installed a snapshot up to index %d from %s", r.cfg.ID, meta.Index, args.LeaderID)
+	return reply, nil
+}
+
+// saveSnapshot replaces the latest snapshot with one described by meta,
+// whose data is written by write.
+func (r *Raft) saveSnapshot(meta snapshotMeta, write func(io.Writer) error) error {
+	if r.storage != nil {
+		return r.storage.saveSnapshot(meta, write)
+	}
+
+	var buf bytes.Buffer
+	if err := encodeSnapshot(&buf, meta, write); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.snapshotData = buf.Bytes()
+	r.mu.Unlock()
+	return nil
+}
+
+// openSnapshot opens the latest snapshot and returns its metadata and data.
+// The caller closes the data.
+func (r *Raft) openSnapshot() (snapshotMeta, io.ReadCloser, error) {
+	var source io.ReadCloser
+	if r.storage != nil {
+		file, err := r.storage.openSnapshot()
+		if err != nil {
+			return snapshotMeta{}, nil, err
+		}
+		source = file
+	} else {
+		r.mu.Lock()
+		source = io.NopCloser(bytes.NewReader(r.snapshotData))
+		r.mu.Unlock()
+	}
+
+	meta, data, err := decodeSnapshot(source)
+	if err != nil {
+		source.Close()
+		return meta, nil, err
+	}
+	return meta, struct {
+		io.Reader
+		io.Closer
+	}{data, source}, nil
+}
+
+// restoreSnapshot replaces the state machine with the latest snapshot.
+func (r *Raft) restoreSnapshot() error {
+	if r.cfg.Restore == nil {
+		return fmt.Errorf("raft node %s has a snapshot but cannot restore it", r.cfg.ID)
+	}
+	meta, data, err := r.openSnapshot()
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	if err := r.cfg.Restore(meta.Index, data); err != nil {
+		return fmt.Errorf("failed to restore raft snapshot at index %d: %w", meta.Index, err)
+	}
+	return nil
+}
+
+// compactLocked drops the log entries covered by the snapshot described by
+// meta. Entries after the snapshot are kept if the log agrees with it on the
+// last covered entry; otherwise the whole log is replaced by the snapshot.
+func (r *Raft) compactLocked(meta snapshotMeta) {
+	if meta.Index >= r.log[0].Index && meta.Index <= r.lastIndexLocked() &&
+		r.entryLocked(meta.Index).Term == meta.Term {
+		r.log = slices.Clone(r.log[meta.Index-r.log[0].Index:])
+	} else {
+		r.log = make([]Entry, 1)
+	}
+	r.log[0] = Entry{Index: meta.Index, Term: meta.Term}
+	r.snapshot = meta
+	if r.storage != nil {
+		if err := r.storage.rewrite(r.log[1:]); err != nil {
+			log.Fatalf("Raft node %s failed to rewrite its log: %v", r.cfg.ID, err)
+		}
+	}
+	r.updateMembersLocked()
+}
+
+// appendLocked appends entries to the log and persists them.
+func (r *Raft) appendLocked(entries []Entry) {
+	r.log = append(r.log, entries...)
+	if r.storage != nil {
+		if err := r.storage.append(entries); err != nil {
+			log.Fatalf("Raft node %s failed to persist log entries: %v", r.cfg.ID, err)
+		}
+	}
+	for _, e := range entries {
+		if e.Type == EntryConfig {
+			r.updateMembersLocked()
+			break
+		}
+	}
+}
+
+// truncateLocked drops every entry from index on.
+func (r *Raft) truncateLocked(index uint64) {
+	r.log = r.log[:index-r.log[0].Index]
+	if r.storage != nil {
+		if err := r.storage.rewrite(r.log[1:]); err != nil {
+			log.Fatalf("Raft node %s failed to rewrite its log: %v", r.cfg.ID, err)
+		}
+	}
+	r.updateMembersLocked()
+}
+
+// updateMembersLocked uses the latest membership in the log, committed or
+// not, falling back to the membership of the snapshot and then to the
+// configured initial members.
+func (r *Raft) updateMembersLocked() {
+	r.members = r.membersAtLocked(r.lastIndexLocked())
+}
+
+// membersAtLocked returns the membership as of the entry at index.
+func (r *Raft) membersAtLocked(index uint64) []string {
+	for i := index; i > r.log[0].Index; i-- {
+		if e := r.entryLocked(i); e.Type == EntryConfig {
+			return slices.Clone(e.Members)
+		}
+	}
+	if r.snapshot.Index > 0 {
+		return slices.Clone(r.snapshot.Members)
+	}
+	return slices.Clone(r.cfg.Members)
+}
+
+// configPendingLocked reports whether the latest membership change is uncommitted.
+func (r *Raft) configPendingLocked() bool {
+	for i := r.lastIndexLocked(); i > r.commitIndex; i-- {
+		if r.entryLocked(i).Type == EntryConfig {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Raft) persistStateLocked() {
+	if r.storage == nil {
+		return
+	}
+	if err := r.storage.saveState(hardState{Term: r.currentTerm, VotedFor: r.votedFor}); err != nil {
+		log.Fatalf("Raft node %s failed to persist its state: %v", r.cfg.ID, err)
+	}
+}
+
+func (r *Raft) resetElectionTimerLocked() {
+	timeout := r.cfg.ElectionTimeout + time.Duration(rand.Int63n(int64(r.cfg.ElectionTimeout)))
+	r.electionDeadline = time.Now().Add(timeout)
+}
+
+// peersLocked returns the members other than this node.
+func (r *Raft) peersLocked() []string {
+	peers := make([]string, 0, len(r.members))
+	for _, m := range r.members {
+		if m != r.cfg.ID {
+			peers = append(peers, m)
+		}
+	}
+	return peers
+}
+
+func (r *Raft) lastIndexLocked() uint64 {
+	return r.log[0].Index + uint64(len(r.log)-1)
+}
+
+// entryLocked returns the entry at index, which must not be older than the
+// snapshot; the entry at the snapshot index only carries its term.
+func (r *Raft) entryLocked(index uint64) Entry {
+	return r.log[index-r.log[0].Index]
+}
+
+// entriesLocked returns a copy of the entries from start up to, but not
+// including, end. start must be after the snapshot.
+func (r *Raft) entriesLocked(start, end uint64) []Entry {
+	return slices.Clone(r.log[start-r.log[0].Index : end-r.log[0].Index])
+}
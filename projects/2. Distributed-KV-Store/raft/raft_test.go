@@ -0,0 +1,353 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// network connects the nodes of a test cluster in memory. A node that is
+// cut off neither sends nor receives RPCs.
+type network struct {
+	mu    sync.Mutex
+	nodes map[string]*Raft
+	cut   map[string]bool
+}
+
+func (n *network) node(from, to string) (*Raft, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	r, ok := n.nodes[to]
+	if !ok || n.cut[from] || n.cut[to] {
+		return nil, fmt.Errorf("%s cannot reach %s", from, to)
+	}
+	return r, nil
+}
+
+func (n *network) setCut(id string, cut bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.cut[id] = cut
+}
+
+func (n *network) isCut(id string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.cut[id]
+}
+
+// transport is the Transport of one node of a network.
+type transport struct {
+	net  *network
+	from string
+}
+
+func (t transport) RequestVote(ctx context.Context, peer string, args RequestVoteArgs) (RequestVoteReply, error) {
+	r, err := t.net.node(t.from, peer)
+	if err != nil {
+		return RequestVoteReply{}, err
+	}
+	return r.HandleRequestVote(args), nil
+}
+
+func (t transport) AppendEntries(ctx context.Context, peer string, args AppendEntriesArgs) (AppendEntriesReply, error) {
+	r, err := t.net.node(t.from, peer)
+	if err != nil {
+		return AppendEntriesReply{}, err
+	}
+	return r.HandleAppendEntries(args), nil
+}
+
+func (t transport) InstallSnapshot(ctx context.Context, peer string, args InstallSnapshotArgs, data io.Reader) (InstallSnapshotReply, error) {
+	r, err := t.net.node(t.from, peer)
+	if err != nil {
+		return InstallSnapshotReply{}, err
+	}
+	return r.HandleInstallSnapshot(args, data)
+}
+
+// member is a node of a test cluster and the commands it applied.
+type member struct {
+	id  string
+	dir string
+
+	mu      sync.Mutex
+	applied []string
+}
+
+func (m *member) apply(index uint64, data []byte) any {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.applied = append(m.applied, string(data))
+	return index
+}
+
+func (m *member) commands() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.applied)
+}
+
+// cluster is a test cluster of Raft nodes on one network.
+type cluster struct {
+	t       *testing.T
+	net     *network
+	members []*member
+}
+
+// newCluster starts size nodes that persist their state under temporary
+// directories.
+func newCluster(t *testing.T, size int) *cluster {
+	t.Helper()
+
+	c := &cluster{
+		t:   t,
+		net: &network{nodes: make(map[string]*Raft), cut: make(map[string]bool)},
+	}
+	var ids []string
+	for i := range size {
+		m := &member{id: fmt.Sprintf("n%d", i+1), dir: t.TempDir()}
+		c.members = append(c.members, m)
+		ids = append(ids, m.id)
+	}
+	for _, m := range c.members {
+		c.start(m, ids, 0)
+	}
+	t.Cleanup(func() {
+		for _, m := range c.members {
+			if r := c.raft(m); r != nil {
+				r.Stop()
+			}
+		}
+	})
+	return c
+}
+
+// start starts the node of m with the given initial members, resuming a
+// state machine that holds the log up to applied.
+func (c *cluster) start(m *member, ids []string, applied uint64) {
+	c.t.Helper()
+
+	r, err := New(Config{
+		ID:                m.id,
+		Members:           ids,
+		Dir:               m.dir,
+		ElectionTimeout:   50 * time.Millisecond,
+		HeartbeatInterval: 10 * time.Millisecond,
+		Transport:         transport{net: c.net, from: m.id},
+		Apply:             m.apply,
+		Applied:           applied,
+	})
+	if err != nil {
+		c.t.Fatalf("failed to start %s: %v", m.id, err)
+	}
+	c.net.mu.Lock()
+	c.net.nodes[m.id] = r
+	c.net.mu.Unlock()
+}
+
+func (c *cluster) raft(m *member) *Raft {
+	c.net.mu.Lock()
+	defer c.net.mu.Unlock()
+	return c.net.nodes[m.id]
+}
+
+// leader waits until exactly one of the members that are not cut off is
+// the leader, and every one of them follows it, and returns it.
+func (c *cluster) leader() *member {
+	c.t.Helper()
+
+	var leader *member
+	waitFor(c.t, "a leader", func() bool {
+		leader = nil
+		for _, m := range c.members {
+			if c.net.isCut(m.id) {
+				continue
+			}
+			status := c.raft(m).Status()
+			if status.State == Leader.String() {
+				if leader != nil {
+					return false
+				}
+				leader = m
+			}
+		}
+		if leader == nil {
+			return false
+		}
+		for _, m := range c.members {
+			if !c.net.isCut(m.id) && c.raft(m).Leader() != leader.id {
+				return false
+			}
+		}
+		return true
+	})
+	return leader
+}
+
+// propose proposes command on m and fails the test if it is not applied.
+func (c *cluster) propose(m *member, command string) {
+	c.t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := c.raft(m).Propose(ctx, []byte(command)); err != nil {
+		c.t.Fatalf("proposing %q on %s failed: %v", command, m.id, err)
+	}
+}
+
+// waitApplied waits until every member has applied exactly want.
+func (c *cluster) waitApplied(want []string) {
+	c.t.Helper()
+
+	waitFor(c.t, fmt.Sprintf("every node to apply %q", want), func() bool {
+		for _, m := range c.members {
+			if !slices.Equal(m.commands(), want) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// waitFor polls cond until it holds, and fails the test after 5 seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestElectsOneLeader(t *testing.T) {
+	c := newCluster(t, 3)
+	leader := c.leader()
+
+	term := c.raft(leader).Status().Term
+	for _, m := range c.members {
+		if m == leader {
+			continue
+		}
+		status := c.raft(m).Status()
+		if status.State != Follower.String() || status.Term != term {
+			t.Errorf("%s is a %s at term %d, want a follower at term %d", m.id, status.State, status.Term, term)
+		}
+	}
+}
+
+func TestFollowerCannotPropose(t *testing.T) {
+	c := newCluster(t, 3)
+	leader := c.leader()
+
+	for _, m := range c.members {
+		if m == leader {
+			continue
+		}
+		_, err := c.raft(m).Propose(context.Background(), []byte("x"))
+		if !errors.Is(err, ErrNotLeader) {
+			t.Errorf("Propose on follower %s returned %v, want ErrNotLeader", m.id, err)
+		}
+	}
+}
+
+func TestAppliesCommandsInTheSameOrderEverywhere(t *testing.T) {
+	c := newCluster(t, 3)
+	leader := c.leader()
+
+	var want []string
+	for i := range 20 {
+		command := fmt.Sprintf("cmd-%d", i)
+		c.propose(leader, command)
+		want = append(want, command)
+	}
+	c.waitApplied(want)
+}
+
+// A leader that is cut off keeps appending entries no one else sees. Once
+// it is back, the new leader's log replaces the entries that conflict with
+// it, so every node applies the same commands.
+func TestNewLeaderOverwritesEntriesOfCutOffLeader(t *testing.T) {
+	c := newCluster(t, 3)
+	old := c.leader()
+	c.propose(old, "before")
+
+	c.net.setCut(old.id, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	_, err := c.raft(old).Propose(ctx, []byte("lost"))
+	cancel()
+	if err == nil {
+		t.Fatal("a leader without a majority committed an entry")
+	}
+
+	leader := c.leader()
+	if leader == old {
+		t.Fatal("the cut off leader is still the leader of the others")
+	}
+	if c.raft(leader).Status().Term <= c.raft(old).Status().Term {
+		t.Fatal("the new leader did not start a new term")
+	}
+	c.propose(leader, "after")
+
+	c.net.setCut(old.id, false)
+	c.leader()
+	c.waitApplied([]string{"before", "after"})
+
+	status := c.raft(old).Status()
+	if want := c.raft(leader).Status().LastIndex; status.LastIndex != want {
+		t.Fatalf("old leader's log ends at %d, want %d", status.LastIndex, want)
+	}
+}
+
+// A node whose state machine persists itself only applies the entries
+// after the index it already holds when it restarts.
+func TestRestartResumesAfterAppliedIndex(t *testing.T) {
+	c := newCluster(t, 3)
+	leader := c.leader()
+	c.propose(leader, "one")
+	c.propose(leader, "two")
+	c.waitApplied([]string{"one", "two"})
+
+	var follower *member
+	for _, m := range c.members {
+		if m != leader {
+			follower = m
+			break
+		}
+	}
+	applied := c.raft(follower).Status().LastApplied
+	c.raft(follower).Stop()
+	follower.mu.Lock()
+	follower.applied = []string{"one", "two"}
+	follower.mu.Unlock()
+
+	ids := []string{"n1", "n2", "n3"}
+	c.start(follower, ids, applied)
+	leader = c.leader()
+	c.propose(leader, "three")
+	c.waitApplied([]string{"one", "two", "three"})
+
+	// a state machine cannot be ahead of the log
+	c.raft(follower).Stop()
+	last := c.raft(follower).Status().LastIndex
+	_, err := New(Config{
+		ID:        follower.id,
+		Members:   ids,
+		Dir:       follower.dir,
+		Transport: transport{net: c.net, from: follower.id},
+		Apply:     follower.apply,
+		Applied:   last + 1,
+	})
+	if err == nil {
+		t.Fatal("New accepted an applied index beyond the log")
+	}
+}
@@ -0,0 +1,242 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/wal"
+)
+
+const (
+	stateFileName    = "state.json"
+	logFileName      = "log.wal"
+	snapshotFileName = "snapshot"
+)
+
+// hardState is the part of the Raft state that must survive a restart
+// before the node answers any RPC.
+type hardState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for"`
+}
+
+// snapshotMeta describes a snapshot of the state machine. It covers the log
+// up to and including Index, whose entry has Term, and Members is the
+// membership at that point.
+type snapshotMeta struct {
+	Index   uint64   `json:"index"`
+	Term    uint64   `json:"term"`
+	Members []string `json:"members"`
+}
+
+// storage persists the hard state, the latest snapshot and the log in a
+// directory. The log is kept in a write-ahead log with one record per
+// entry, and only holds the entries after the snapshot.
+type storage struct {
+	dir string
+	log *wal.Log
+}
+
+// openStorage opens the Raft directory and reads back the saved state, the
+// metadata of the latest snapshot and the log entries after the snapshot.
+func openStorage(dir string) (*storage, hardState, snapshotMeta, []Entry, error) {
+	var state hardState
+	var meta snapshotMeta
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, state, meta, nil, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, stateFileName))
+	if err == nil {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, state, meta, nil, fmt.Errorf("failed to decode raft state: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, state, meta, nil, err
+	}
+
+	s := &storage{dir: dir}
+	file, err := s.openSnapshot()
+	if err == nil {
+		meta, _, err = decodeSnapshot(file)
+		file.Close()
+		if err != nil {
+			return nil, state, meta, nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, state, meta, nil, err
+	}
+
+	walLog, err := wal.Open(filepath.Join(dir, logFileName))
+	if err != nil {
+		return nil, state, meta, nil, err
+	}
+
+	// entries the snapshot covers are left over from a crash between
+	// saving the snapshot and compacting the log
+	var entries []Entry
+	err = walLog.Replay(func(data []byte) error {
+		var e Entry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return err
+		}
+		if e.Index > meta.Index {
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	if err != nil {
+		walLog.Close()
+		return nil, state, meta, nil, err
+	}
+
+	s.log = walLog
+	return s, state, meta, entries, nil
+}
+
+// saveState atomically replaces the saved hard state.
+func (s *storage) saveState(state hardState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(s.dir, stateFileName+".tmp")
+	if err := writeFileSync(tmp, data); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, stateFileName))
+}
+
+// append adds entries to the end of the saved log.
+func (s *storage) append(entries []Entry) error {
+	for _, e := range entries {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if err := s.log.Append(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewrite replaces the saved log with entries. It is used when a follower
+// has to drop a conflicting suffix of its log. The new log is built next to
+// the old one and renamed into place, so a crash keeps one of the two.
+func (s *storage) rewrite(entries []Entry) error {
+	path := filepath.Join(s.dir, logFileName)
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+
+	tmpLog, err := wal.Open(tmp)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		data, err := json.Marshal(e)
+		if err != nil {
+			tmpLog.Close()
+			return err
+		}
+		if err := tmpLog.Append(data); err != nil {
+			tmpLog.Close()
+			return err
+		}
+	}
+	tmpLog.Close()
+
+	s.log.Close()
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	s.log, err = wal.Open(path)
+	return err
+}
+
+// saveSnapshot atomically replaces the saved snapshot with one described
+// by meta, whose data is written by write.
+func (s *storage) saveSnapshot(meta snapshotMeta, write func(io.Writer) error) error {
+	path := filepath.Join(s.dir, snapshotFileName)
+	tmp := path + ".tmp"
+
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	if err := encodeSnapshot(w, meta, write); err != nil {
+		file.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// openSnapshot opens the saved snapshot, to be read with decodeSnapshot.
+func (s *storage) openSnapshot() (*os.File, error) {
+	return os.Open(filepath.Join(s.dir, snapshotFileName))
+}
+
+func (s *storage) close() error {
+	return s.log.Close()
+}
+
+func writeFileSync(path string, data []byte) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// encodeSnapshot writes a snapshot: its metadata as a line of JSON,
+// followed by the data written by write.
+func encodeSnapshot(w io.Writer, meta snapshotMeta, write func(io.Writer) error) error {
+	header, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(append(header, '\n')); err != nil {
+		return err
+	}
+	return write(w)
+}
+
+// decodeSnapshot reads the metadata of a snapshot written by encodeSnapshot
+// and returns a reader for its data.
+func decodeSnapshot(r io.Reader) (snapshotMeta, io.Reader, error) {
+	var meta snapshotMeta
+	br := bufio.NewReader(r)
+	header, err := br.ReadBytes('\n')
+	if err != nil {
+		return meta, nil, fmt.Errorf("failed to read raft snapshot: %w", err)
+	}
+	if err := json.Unmarshal(header, &meta); err != nil {
+		return meta, nil, fmt.Errorf("failed to decode raft snapshot: %w", err)
+	}
+	return meta, br, nil
+}
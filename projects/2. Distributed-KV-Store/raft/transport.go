@@ -0,0 +1,161 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// snapshotHeader carries the InstallSnapshotArgs of a snapshot sent over
+// HTTP, whose body is the snapshot data.
+const snapshotHeader = "X-Raft-Snapshot"
+
+// Transport carries Raft RPCs between nodes. Peers are identified
+// by the same IDs that are used as cluster members.
+type Transport interface {
+	RequestVote(ctx context.Context, peer string, args RequestVoteArgs) (RequestVoteReply, error)
+	AppendEntries(ctx context.Context, peer string, args AppendEntriesArgs) (AppendEntriesReply, error)
+	InstallSnapshot(ctx context.Context, peer string, args InstallSnapshotArgs, data io.Reader) (InstallSnapshotReply, error)
+}
+
+// HTTPTransport sends RPCs as JSON over HTTP. Member IDs are the base URLs
+// of the nodes, and the receiving side serves ServeRequestVote on
+// /raft/vote, ServeAppendEntries on /raft/append and ServeInstallSnapshot
+// on /raft/snapshot. Snapshots are sent with SnapshotClient, or with Client
+// when it is nil, since they can take much longer than the other RPCs.
+type HTTPTransport struct {
+	Client         *http.Client
+	SnapshotClient *http.Client
+}
+
+// RequestVote sends a RequestVote RPC to peer.
+func (t *HTTPTransport) RequestVote(ctx context.Context, peer string, args RequestVoteArgs) (RequestVoteReply, error) {
+	var reply RequestVoteReply
+	err := t.post(ctx, peer+"/raft/vote", args, &reply)
+	return reply, err
+}
+
+// AppendEntries sends an AppendEntries RPC to peer.
+func (t *HTTPTransport) AppendEntries(ctx context.Context, peer string, args AppendEntriesArgs) (AppendEntriesReply, error) {
+	var reply AppendEntriesReply
+	err := t.post(ctx, peer+"/raft/append", args, &reply)
+	return reply, err
+}
+
+// InstallSnapshot sends an InstallSnapshot RPC to peer, streaming the
+// snapshot data as the request body.
+func (t *HTTPTransport) InstallSnapshot(ctx context.Context, peer string, args InstallSnapshotArgs, data io.Reader) (InstallSnapshotReply, error) {
+	var reply InstallSnapshotReply
+	header, err := json.Marshal(args)
+	if err != nil {
+		return reply, err
+	}
+
+	url := peer + "/raft/snapshot"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, data)
+	if err != nil {
+		return reply, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(snapshotHeader, string(header))
+
+	client := t.SnapshotClient
+	if client == nil {
+		client = t.Client
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return reply, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return reply, fmt.Errorf("raft rpc to %s failed with status %d", url, resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&reply)
+	return reply, err
+}
+
+func (t *HTTPTransport) post(ctx context.Context, url string, args, reply any) error {
+	body, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("raft rpc to %s failed with status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
+
+// ServeRequestVote handles a RequestVote RPC sent by HTTPTransport.
+func (r *Raft) ServeRequestVote(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var args RequestVoteArgs
+	if err := json.NewDecoder(req.Body).Decode(&args); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.HandleRequestVote(args))
+}
+
+// ServeAppendEntries handles an AppendEntries RPC sent by HTTPTransport.
+func (r *Raft) ServeAppendEntries(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var args AppendEntriesArgs
+	if err := json.NewDecoder(req.Body).Decode(&args); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.HandleAppendEntries(args))
+}
+
+// ServeInstallSnapshot handles an InstallSnapshot RPC sent by HTTPTransport.
+func (r *Raft) ServeInstallSnapshot(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var args InstallSnapshotArgs
+	if err := json.Unmarshal([]byte(req.Header.Get(snapshotHeader)), &args); err != nil {
+		http.Error(w, "Invalid snapshot header", http.StatusBadRequest)
+		return
+	}
+
+	reply, err := r.HandleInstallSnapshot(args, req.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to install snapshot: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply)
+}
@@ -0,0 +1,123 @@
+package raft
+
+import "errors"
+
+// State is the role a node currently plays in the cluster.
+type State int
+
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+func (s State) String() string {
+	switch s {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	default:
+		return "unknown"
+	}
+}
+
+// EntryType tells what a log entry carries.
+type EntryType int
+
+const (
+	// EntryCommand carries an opaque command for the state machine.
+	EntryCommand EntryType = iota
+	// EntryNoop is appended by a new leader to commit entries from earlier terms.
+	EntryNoop
+	// EntryConfig carries a new cluster membership.
+	EntryConfig
+)
+
+// Entry is a single entry of the replicated log.
+type Entry struct {
+	Index   uint64    `json:"index"`
+	Term    uint64    `json:"term"`
+	Type    EntryType `json:"type"`
+	Data    []byte    `json:"data,omitempty"`
+	Members []string  `json:"members,omitempty"`
+}
+
+// RequestVoteArgs is sent by candidates to gather votes.
+type RequestVoteArgs struct {
+	Term         uint64 `json:"term"`
+	CandidateID  string `json:"candidate_id"`
+	LastLogIndex uint64 `json:"last_log_index"`
+	LastLogTerm  uint64 `json:"last_log_term"`
+}
+
+// RequestVoteReply is the answer to RequestVoteArgs.
+type RequestVoteReply struct {
+	Term        uint64 `json:"term"`
+	VoteGranted bool   `json:"vote_granted"`
+}
+
+// AppendEntriesArgs is sent by the leader to replicate entries
+// and, with no entries, as a heartbeat.
+type AppendEntriesArgs struct {
+	Term         uint64  `json:"term"`
+	LeaderID     string  `json:"leader_id"`
+	PrevLogIndex uint64  `json:"prev_log_index"`
+	PrevLogTerm  uint64  `json:"prev_log_term"`
+	Entries      []Entry `json:"entries,omitempty"`
+	LeaderCommit uint64  `json:"leader_commit"`
+}
+
+// AppendEntriesReply is the answer to AppendEntriesArgs.
+// On a log mismatch, ConflictIndex tells the leader where to retry from,
+// so it does not have to walk back one entry per round trip.
+type AppendEntriesReply struct {
+	Term          uint64 `json:"term"`
+	Success       bool   `json:"success"`
+	ConflictIndex uint64 `json:"conflict_index,omitempty"`
+}
+
+// InstallSnapshotArgs is sent by the leader, together with the snapshot
+// data, to a follower that needs entries the leader has already compacted.
+// The snapshot covers the log up to and including LastIncludedIndex, and
+// Members is the membership at that point.
+type InstallSnapshotArgs struct {
+	Term              uint64   `json:"term"`
+	LeaderID          string   `json:"leader_id"`
+	LastIncludedIndex uint64   `json:"last_included_index"`
+	LastIncludedTerm  uint64   `json:"last_included_term"`
+	Members           []string `json:"members"`
+}
+
+// InstallSnapshotReply is the answer to InstallSnapshotArgs.
+type InstallSnapshotReply struct {
+	Term uint64 `json:"term"`
+}
+
+// Status is a point-in-time view of a node's Raft state.
+type Status struct {
+	ID            string   `json:"id"`
+	State         string   `json:"state"`
+	Term          uint64   `json:"term"`
+	Leader        string   `json:"leader"`
+	CommitIndex   uint64   `json:"commit_index"`
+	LastApplied   uint64   `json:"last_applied"`
+	LastIndex     uint64   `json:"last_index"`
+	SnapshotIndex uint64   `json:"snapshot_index"`
+	Members       []string `json:"members"`
+}
+
+var (
+	// ErrNotLeader is returned for operations that only the leader can perform.
+	ErrNotLeader = errors.New("raft: not the leader")
+	// ErrLeadershipLost is returned when an entry was overwritten by a new leader.
+	ErrLeadershipLost = errors.New("raft: leadership lost before the entry was committed")
+	// ErrConfigInProgress is returned when a membership change is still uncommitted.
+	ErrConfigInProgress = errors.New("raft: a membership change is already in progress")
+	// ErrNoSnapshots is returned by TakeSnapshot when no Snapshot function is configured.
+	ErrNoSnapshots = errors.New("raft: snapshots are not configured")
+	// ErrStopped is returned once the node has been stopped.
+	ErrStopped = errors.New("raft: node stopped")
+)
@@ -0,0 +1,349 @@
+// Package replication sends writes to peers through one bounded queue per
+// peer. A worker per peer drains its queue in order and sends the writes in
+// batches, so a busy peer gets one request for many writes instead of one
+// request each. Writes queued together are always sent in the same batch.
+// A batch that fails is retried with exponential backoff until it is
+// delivered or its writes have waited too long.
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/store"
+)
+
+// minBackoff is the wait before the first retry of a batch.
+const minBackoff = 50 * time.Millisecond
+
+// Policy tells Enqueue what to do when the queue of a peer is full.
+type Policy string
+
+const (
+	// Block waits for room in the queue until the context is done.
+	Block Policy = "block"
+	// Drop leaves the write out of the queue; the caller drops the write.
+	Drop Policy = "drop"
+	// Fail leaves the write out of the queue; the caller fails the write.
+	Fail Policy = "fail"
+)
+
+var (
+	// ErrFull is returned by Enqueue when the write was not queued because
+	// the queue of the peer is full.
+	ErrFull = errors.New("replication queue is full")
+
+	// ErrExpired is delivered for a queued write that the peer did not
+	// accept within the give-up time.
+	ErrExpired = errors.New("replication gave up")
+)
+
+// SendFunc sends a batch of writes to peer, in the order given, and returns
+// an error unless the peer stored all of them. A batch may be sent again
+// after an error, so storing a write twice must be harmless.
+type SendFunc func(peer string, items []store.Store) error
+
+// Options configures the queues. Capacity is the number of writes a queue
+// holds, including the batch being sent, and MaxBatch the number of writes
+// sent in one request, unless more were queued together. A write is given
+// up once it has been queued for GiveUp, and MaxBackoff caps the wait
+// between two attempts. Down, when set, tells whether a peer is known to
+// be unreachable; when a send to such a peer fails, its queued writes are
+// given up right away instead of retried.
+type Options struct {
+	Capacity   int
+	MaxBatch   int
+	Policy     Policy
+	GiveUp     time.Duration
+	MaxBackoff time.Duration
+	Down       func(peer string) bool
+}
+
+// Stats describes the queue of one peer. Depth is the number of queued
+// writes and LagMs the time the oldest of them has been waiting. Rejected
+// counts the writes left out because the queue was full, and Expired the
+// ones given up.
+type Stats struct {
+	Depth     int    `json:"depth"`
+	Capacity  int    `json:"capacity"`
+	LagMs     int64  `json:"lag_ms"`
+	Enqueued  uint64 `json:"enqueued"`
+	Sent      uint64 `json:"sent"`
+	Batches   uint64 `json:"batches"`
+	Retries   uint64 `json:"retries"`
+	Rejected  uint64 `json:"rejected"`
+	Expired   uint64 `json:"expired"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// entry is the writes of one Enqueue call and the channel their outcome is
+// delivered on.
+type entry struct {
+	items  []store.Store
+	queued time.Time
+	done   chan error
+}
+
+// peerQueue holds the writes waiting for one peer, oldest first, and size
+// is their number. room is closed and replaced whenever writes leave the
+// queue, so a full queue can be waited on, and ready wakes the worker up
+// when writes are added.
+type peerQueue struct {
+	entries []entry
+	size    int
+	room    chan struct{}
+	ready   chan struct{}
+	stats   Stats
+}
+
+// Queues holds the outbound queue of every peer. It is safe for
+// concurrent use.
+type Queues struct {
+	mu    sync.Mutex
+	send  SendFunc
+	opts  Options
+	peers map[string]*peerQueue
+}
+
+// New returns queues that deliver writes with send. The queue and the
+// worker of a peer are created with its first write.
+func New(send SendFunc, opts Options) *Queues {
+	return &Queues{
+		send:  send,
+		opts:  opts,
+		peers: make(map[string]*peerQueue),
+	}
+}
+
+// Policy returns the policy applied when a queue is full.
+func (q *Queues) Policy() Policy {
+	return q.opts.Policy
+}
+
+// peer returns the queue of peer, creating it and starting its worker if
+// needed.
+func (q *Queues) peer(peer string) *peerQueue {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	p, ok := q.peers[peer]
+	if !ok {
+		p = &peerQueue{
+			room:  make(chan struct{}),
+			ready: make(chan struct{}, 1),
+		}
+		p.stats.Capacity = q.opts.Capacity
+		q.peers[peer] = p
+		go q.run(peer, p)
+	}
+	return p
+}
+
+// Enqueue adds writes to the queue of peer and returns the channel their
+// outcome is delivered on: nil once the peer stored them, or an error
+// matching ErrExpired if they were given up. The writes are sent together,
+// in one request. When the queue has no room for them it waits for room
+// until ctx is done with the Block policy, and fails with ErrFull right
+// away otherwise, as it does for more writes than the queue holds; writes
+// that were not queued are never sent.
+func (q *Queues) Enqueue(ctx context.Context, peer string, items ...store.Store) (<-chan error, error) {
+	p := q.peer(peer)
+
+	q.mu.Lock()
+	for p.size+len(items) > q.opts.Capacity {
+		if q.opts.Policy != Block || len(items) > q.opts.Capacity {
+			p.stats.Rejected += uint64(len(items))
+			q.mu.Unlock()
+			return nil, ErrFull
+		}
+		room := p.room
+		q.mu.Unlock()
+		select {
+		case <-room:
+		case <-ctx.Done():
+			q.mu.Lock()
+			p.stats.Rejected += uint64(len(items))
+			q.mu.Unlock()
+			return nil, ErrFull
+		}
+		q.mu.Lock()
+	}
+
+	done := q.addLocked(p, items)
+	q.mu.Unlock()
+
+	p.wake()
+	return done, nil
+}
+
+// EnqueueAll adds writes[peer] to the queue of every peer, or nothing at
+// all: when the queue of any peer has no room for its writes it fails with
+// an error matching ErrFull and queues none of them, so a write is never
+// sent to some peers and failed for the others. It does not wait for room,
+// whatever the policy. It returns the channel the outcome of the writes of
+// each peer is delivered on, as Enqueue does.
+func (q *Queues) EnqueueAll(writes map[string][]store.Store) (map[string]<-chan error, error) {
+	queues := make(map[string]*peerQueue, len(writes))
+	for peer := range writes {
+		queues[peer] = q.peer(peer)
+	}
+
+	q.mu.Lock()
+	for peer, items := range writes {
+		if queues[peer].size+len(items) <= q.opts.Capacity {
+			continue
+		}
+		for peer, items := range writes {
+			queues[peer].stats.Rejected += uint64(len(items))
+		}
+		q.mu.Unlock()
+		return nil, fmt.Errorf("%w for peer %s", ErrFull, peer)
+	}
+
+	done := make(map[string]<-chan error, len(writes))
+	for peer, items := range writes {
+		done[peer] = q.addLocked(queues[peer], items)
+	}
+	q.mu.Unlock()
+
+	for _, p := range queues {
+		p.wake()
+	}
+	return done, nil
+}
+
+// addLocked appends items to the queue p as one entry and returns the
+// channel their outcome is delivered on. Called with mu held.
+func (q *Queues) addLocked(p *peerQueue, items []store.Store) <-chan error {
+	done := make(chan error, 1)
+	p.entries = append(p.entries, entry{items: items, queued: time.Now(), done: done})
+	p.size += len(items)
+	p.stats.Enqueued += uint64(len(items))
+	return done
+}
+
+// wake tells the worker of p that writes were added.
+func (p *peerQueue) wake() {
+	select {
+	case p.ready <- struct{}{}:
+	default:
+	}
+}
+
+// run is the worker of one peer. It sends the oldest writes in a batch and
+// only moves on once the batch is delivered or given up, so the writes to
+// a key reach the peer in the order they were queued.
+func (q *Queues) run(peer string, p *peerQueue) {
+	backoff := minBackoff
+	for range p.ready {
+		for {
+			batch := q.next(p)
+			if len(batch) == 0 {
+				break
+			}
+
+			var items []store.Store
+			for _, e := range batch {
+				items = append(items, e.items...)
+			}
+			err := q.send(peer, items)
+			if err == nil {
+				q.finish(p, len(batch), nil)
+				backoff = minBackoff
+				continue
+			}
+
+			wait := q.retry(peer, p, err, backoff)
+			time.Sleep(wait)
+			backoff = min(2*backoff, q.opts.MaxBackoff)
+		}
+	}
+}
+
+// next returns the oldest entries of p, with at most MaxBatch writes in
+// total unless the oldest entry alone has more. They stay queued until
+// they are finished.
+func (q *Queues) next(p *peerQueue) []entry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n, writes := 0, 0
+	for n < len(p.entries) && (n == 0 || writes+len(p.entries[n].items) <= q.opts.MaxBatch) {
+		writes += len(p.entries[n].items)
+		n++
+	}
+	return append([]entry(nil), p.entries[:n]...)
+}
+
+// finish removes the n oldest entries of p, delivers err to each and wakes
+// up the writers waiting for room. Called without mu held.
+func (q *Queues) finish(p *peerQueue, n int, err error) {
+	q.mu.Lock()
+	finished := p.entries[:n]
+	p.entries = append([]entry(nil), p.entries[n:]...)
+	writes := 0
+	for _, e := range finished {
+		writes += len(e.items)
+	}
+	p.size -= writes
+	if err == nil {
+		p.stats.Sent += uint64(writes)
+		p.stats.Batches++
+	} else {
+		p.stats.Expired += uint64(writes)
+	}
+	close(p.room)
+	p.room = make(chan struct{})
+	q.mu.Unlock()
+
+	for _, e := range finished {
+		e.done <- err
+	}
+}
+
+// retry records a failed attempt, gives up the writes that have waited
+// longer than GiveUp, or every write if peer is down, and returns how long
+// to wait before the next attempt: backoff, or less if the oldest remaining
+// write is given up sooner.
+func (q *Queues) retry(peer string, p *peerQueue, sendErr error, backoff time.Duration) time.Duration {
+	down := q.opts.Down != nil && q.opts.Down(peer)
+	now := time.Now()
+	q.mu.Lock()
+	p.stats.LastError = sendErr.Error()
+	expired := 0
+	for expired < len(p.entries) && (down || now.Sub(p.entries[expired].queued) >= q.opts.GiveUp) {
+		expired++
+	}
+	wait := time.Duration(0)
+	if expired < len(p.entries) {
+		p.stats.Retries++
+		wait = min(backoff, p.entries[expired].queued.Add(q.opts.GiveUp).Sub(now))
+	}
+	q.mu.Unlock()
+
+	if expired > 0 {
+		q.finish(p, expired, fmt.Errorf("%w: %v", ErrExpired, sendErr))
+	}
+	return wait
+}
+
+// Stats returns the state of the queue of every peer that has had writes.
+func (q *Queues) Stats() map[string]Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	stats := make(map[string]Stats, len(q.peers))
+	for peer, p := range q.peers {
+		s := p.stats
+		s.Depth = p.size
+		if len(p.entries) > 0 {
+			s.LagMs = now.Sub(p.entries[0].queued).Milliseconds()
+		}
+		stats[peer] = s
+	}
+	return stats
+}
@@ -0,0 +1,226 @@
+// Package resp implements the server side of RESP, the Redis serialization
+// protocol: it reads the commands sent by Redis clients and writes the
+// replies, so any Redis client can talk to a server built on it.
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Limits on the commands a client may send, the same as Redis's defaults.
+const (
+	maxInline = 64 * 1024
+	maxArgs   = 1024 * 1024
+	maxBulk   = 512 * 1024 * 1024
+)
+
+// ErrProtocol is wrapped by the errors ReadCommand returns for input that
+// is not valid RESP. The connection cannot be used after one.
+var ErrProtocol = errors.New("protocol error")
+
+// Reader reads commands from a client.
+type Reader struct {
+	r *bufio.Reader
+}
+
+// NewReader returns a Reader reading from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReaderSize(r, maxInline)}
+}
+
+// Buffered returns the number of bytes received but not read yet, which
+// is not 0 while a client is pipelining commands.
+func (r *Reader) Buffered() int {
+	return r.r.Buffered()
+}
+
+// ReadCommand reads the next command: an array of bulk strings, as sent by
+// client libraries, or an inline command, a line of words separated by
+// spaces, as typed over telnet. Empty commands are skipped.
+func (r *Reader) ReadCommand() ([]string, error) {
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		if !strings.HasPrefix(line, "*") {
+			if args := strings.Fields(line); len(args) > 0 {
+				return args, nil
+			}
+			continue
+		}
+
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n > maxArgs {
+			return nil, fmt.Errorf("%w: invalid multibulk length", ErrProtocol)
+		}
+		if n <= 0 {
+			continue
+		}
+		args := make([]string, 0, min(n, 1024))
+		for range n {
+			arg, err := r.readBulk()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+		}
+		return args, nil
+	}
+}
+
+// readLine reads a line without its CRLF; a bare LF ends a line as well.
+func (r *Reader) readLine() (string, error) {
+	line, err := r.r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", fmt.Errorf("%w: too big inline request", ErrProtocol)
+	}
+	if err != nil {
+		return "", err
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return string(line), nil
+}
+
+// readBulk reads one bulk string of a command.
+func (r *Reader) readBulk() (string, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(line, "$") {
+		return "", fmt.Errorf("%w: expected '$', got %q", ErrProtocol, line)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > maxBulk {
+		return "", fmt.Errorf("%w: invalid bulk length", ErrProtocol)
+	}
+
+	data := make([]byte, n+2)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return "", err
+	}
+	if data[n] != '\r' || data[n+1] != '\n' {
+		return "", fmt.Errorf("%w: bulk string not terminated by CRLF", ErrProtocol)
+	}
+	return string(data[:n]), nil
+}
+
+// Writer writes replies to a client. Replies are buffered until Flush.
+type Writer struct {
+	w *bufio.Writer
+}
+
+// NewWriter returns a Writer writing to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// SimpleString writes a status reply such as OK. s must not contain CR or LF.
+func (w *Writer) SimpleString(s string) {
+	w.w.WriteString("+" + s + "\r\n")
+}
+
+// Error writes an error reply. By convention message starts with an error
+// code in capitals, as in "ERR syntax error".
+func (w *Writer) Error(message string) {
+	message = strings.NewReplacer("\r", " ", "\n", " ").Replace(message)
+	w.w.WriteString("-" + message + "\r\n")
+}
+
+// Integer writes an integer reply.
+func (w *Writer) Integer(i int64) {
+	w.w.WriteString(":" + strconv.FormatInt(i, 10) + "\r\n")
+}
+
+// Bulk writes a bulk string reply holding data.
+func (w *Writer) Bulk(data []byte) {
+	w.w.WriteString("$" + strconv.Itoa(len(data)) + "\r\n")
+	w.w.Write(data)
+	w.w.WriteString("\r\n")
+}
+
+// BulkString writes a bulk string reply holding s.
+func (w *Writer) BulkString(s string) {
+	w.w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+// Null writes the null bulk string, the reply for a missing value.
+func (w *Writer) Null() {
+	w.w.WriteString("$-1\r\n")
+}
+
+// Array writes the header of an array of n elements, which must be
+// followed by the n replies it holds.
+func (w *Writer) Array(n int) {
+	w.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// Flush sends the buffered replies to the client.
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+// Handler runs a command, args[0] being its name, and writes its reply to w.
+type Handler func(args []string, w *Writer)
+
+// Serve accepts connections on l and runs the commands of each client with
+// h, one at a time and in order, until the client sends QUIT or closes the
+// connection. Replies to pipelined commands are sent together.
+// It returns when l fails, with the error.
+func Serve(l net.Listener, h Handler) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serveConn(conn, h)
+	}
+}
+
+// serveConn runs the commands sent on conn.
+func serveConn(conn net.Conn, h Handler) {
+	defer conn.Close()
+	r, w := NewReader(conn), NewWriter(conn)
+
+	for {
+		args, err := r.ReadCommand()
+		if errors.Is(err, ErrProtocol) {
+			message := strings.TrimPrefix(err.Error(), ErrProtocol.Error()+": ")
+			w.Error("ERR Protocol error: " + message)
+			w.Flush()
+			return
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("RESP connection from %s failed: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		if strings.EqualFold(args[0], "QUIT") {
+			w.SimpleString("OK")
+			w.Flush()
+			return
+		}
+		h(args, w)
+
+		// replies to pipelined commands wait until the pipeline is drained
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
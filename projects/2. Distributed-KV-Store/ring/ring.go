@@ -0,0 +1,171 @@
+package ring
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Token is one virtual node: a point on the ring owned by a node.
+// A key belongs to the first token at or after the key's hash,
+// wrapping around at the end of the ring.
+type Token struct {
+	Hash uint64 `json:"hash"`
+	Node string `json:"node"`
+}
+
+// Ring is a consistent-hash ring. Every node is placed on the ring
+// VNodes times, so keys spread evenly and adding or removing a node only
+// moves the keys next to its tokens.
+// A Ring is safe for concurrent use.
+type Ring struct {
+	mu     sync.RWMutex
+	vnodes int
+	tokens []Token // sorted by hash
+	nodes  map[string]bool
+}
+
+// New creates an empty ring that places every node on vnodes tokens.
+func New(vnodes int) *Ring {
+	if vnodes < 1 {
+		vnodes = 1
+	}
+	return &Ring{
+		vnodes: vnodes,
+		nodes:  make(map[string]bool),
+	}
+}
+
+// VNodes returns the number of tokens per node.
+func (r *Ring) VNodes() int {
+	return r.vnodes
+}
+
+// Hash returns the position of key on the ring.
+func Hash(key string) uint64 {
+	sum := md5.Sum([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Add places node on the ring. Adding a node twice has no effect.
+func (r *Ring) Add(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.nodes[node] {
+		return
+	}
+	r.nodes[node] = true
+	for i := 0; i < r.vnodes; i++ {
+		r.tokens = append(r.tokens, Token{Hash: Hash(node + "#" + strconv.Itoa(i)), Node: node})
+	}
+	sort.Slice(r.tokens, func(i, j int) bool {
+		return r.tokens[i].Hash < r.tokens[j].Hash
+	})
+}
+
+// Remove takes node and its tokens off the ring.
+func (r *Ring) Remove(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.nodes[node] {
+		return
+	}
+	delete(r.nodes, node)
+	tokens := r.tokens[:0]
+	for _, t := range r.tokens {
+		if t.Node != node {
+			tokens = append(tokens, t)
+		}
+	}
+	r.tokens = tokens
+}
+
+// Owners returns the n distinct nodes that hold key: the owner of the
+// first token after the key's hash and the next nodes clockwise.
+// The first node is the key's primary. Fewer than n nodes are returned
+// when the ring does not have that many.
+func (r *Ring) Owners(key string, n int) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.tokens) == 0 {
+		return nil
+	}
+	if n > len(r.nodes) {
+		n = len(r.nodes)
+	}
+
+	hash := Hash(key)
+	start := sort.Search(len(r.tokens), func(i int) bool {
+		return r.tokens[i].Hash >= hash
+	})
+
+	owners := make([]string, 0, n)
+	seen := make(map[string]bool, n)
+	for i := 0; len(owners) < n; i++ {
+		t := r.tokens[(start+i)%len(r.tokens)]
+		if !seen[t.Node] {
+			seen[t.Node] = true
+			owners = append(owners, t.Node)
+		}
+	}
+	return owners
+}
+
+// IsOwner reports whether node is one of the n nodes holding key.
+func (r *Ring) IsOwner(key string, n int, node string) bool {
+	for _, owner := range r.Owners(key, n) {
+		if owner == node {
+			return true
+		}
+	}
+	return false
+}
+
+// Nodes returns the nodes on the ring, sorted.
+func (r *Ring) Nodes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	nodes := make([]string, 0, len(r.nodes))
+	for node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// Tokens returns a copy of the ring's tokens, sorted by hash.
+func (r *Ring) Tokens() []Token {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return append([]Token(nil), r.tokens...)
+}
+
+// Ownership returns the share of the hash space for which each node is
+// the primary owner. The shares add up to 1.
+func (r *Ring) Ownership() map[string]float64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	shares := make(map[string]float64, len(r.nodes))
+	for i, t := range r.tokens {
+		// a token owns the range from the previous token (exclusive) up to itself
+		var prev uint64
+		if i > 0 {
+			prev = r.tokens[i-1].Hash
+		} else {
+			prev = r.tokens[len(r.tokens)-1].Hash
+		}
+		shares[t.Node] += float64(t.Hash-prev) / (1 << 64)
+	}
+	if len(r.tokens) == 1 {
+		shares[r.tokens[0].Node] = 1
+	}
+	return shares
+}
@@ -0,0 +1,123 @@
+package ring
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+)
+
+// newRing returns a ring holding the given nodes.
+func newRing(vnodes int, nodes ...string) *Ring {
+	r := New(vnodes)
+	for _, node := range nodes {
+		r.Add(node)
+	}
+	return r
+}
+
+// keys returns n distinct test keys.
+func keys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	return keys
+}
+
+func TestOwnersAreDistinctAndStartWithPrimary(t *testing.T) {
+	r := newRing(16, "a", "b", "c")
+
+	for _, key := range keys(200) {
+		owners := r.Owners(key, 3)
+		if len(owners) != 3 {
+			t.Fatalf("key %s has %d owners, want 3", key, len(owners))
+		}
+		sorted := slices.Clone(owners)
+		slices.Sort(sorted)
+		if !slices.Equal(slices.Compact(sorted), []string{"a", "b", "c"}) {
+			t.Fatalf("key %s has owners %q, want each node once", key, owners)
+		}
+		if primary := r.Owners(key, 1); !slices.Equal(primary, owners[:1]) {
+			t.Fatalf("key %s has primary %q, but owners %q", key, primary, owners)
+		}
+	}
+
+	if owners := r.Owners("x", 5); len(owners) != 3 {
+		t.Fatalf("Owners returned %d nodes from a ring of 3", len(owners))
+	}
+}
+
+// Adding a node only moves keys to the new node: every key either keeps
+// its owners or has the new node take the place of one of them.
+func TestAddingNodeOnlyMovesKeysToIt(t *testing.T) {
+	const replicas = 2
+	r := newRing(32, "a", "b", "c")
+
+	before := make(map[string][]string)
+	for _, key := range keys(1000) {
+		before[key] = r.Owners(key, replicas)
+	}
+	r.Add("d")
+
+	moved := 0
+	for key, old := range before {
+		owners := r.Owners(key, replicas)
+		if slices.Equal(owners, old) {
+			continue
+		}
+		moved++
+		if !slices.Contains(owners, "d") {
+			t.Fatalf("key %s moved from %q to %q without the new node", key, old, owners)
+		}
+		for _, owner := range owners {
+			if owner != "d" && !slices.Contains(old, owner) {
+				t.Fatalf("key %s moved from %q to %q, a node other than the new one gained it", key, old, owners)
+			}
+		}
+	}
+	if moved == 0 {
+		t.Fatal("the new node took no keys")
+	}
+	// the new node takes about its share, nowhere near all of the keys
+	if moved > len(before)*3/4 {
+		t.Fatalf("%d of %d keys moved when a fourth node joined", moved, len(before))
+	}
+}
+
+func TestRemoveRestoresOwners(t *testing.T) {
+	r := newRing(16, "a", "b", "c")
+	before := make(map[string][]string)
+	for _, key := range keys(200) {
+		before[key] = r.Owners(key, 2)
+	}
+
+	r.Add("d")
+	r.Remove("d")
+	for key, want := range before {
+		if owners := r.Owners(key, 2); !slices.Equal(owners, want) {
+			t.Fatalf("key %s has owners %q after d joined and left, want %q", key, owners, want)
+		}
+	}
+	if nodes := r.Nodes(); !slices.Equal(nodes, []string{"a", "b", "c"}) {
+		t.Fatalf("ring holds %q, want a, b and c", nodes)
+	}
+	if got := len(r.Tokens()); got != 3*16 {
+		t.Fatalf("ring holds %d tokens, want %d", got, 3*16)
+	}
+}
+
+func TestOwnershipAddsUpToOne(t *testing.T) {
+	r := newRing(64, "a", "b", "c", "d")
+
+	total := 0.0
+	for node, share := range r.Ownership() {
+		if share <= 0 {
+			t.Errorf("node %s owns %f of the ring", node, share)
+		}
+		total += share
+	}
+	if math.Abs(total-1) > 1e-9 {
+		t.Fatalf("shares add up to %f, want 1", total)
+	}
+}
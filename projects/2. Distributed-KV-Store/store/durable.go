@@ -0,0 +1,237 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/wal"
+)
+
+// walFileName is the name of the write-ahead log inside the data directory.
+const walFileName = "wal.log"
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Mutation operations recorded in the write-ahead log.
+const (
+	opPut    = "put"
+	opDelete = "delete"
+)
+
+// mutation is the JSON payload of a single write-ahead log record.
+// Seq increases by one with every mutation and is used to skip
+// records that are already part of a snapshot.
+type mutation struct {
+	Seq  uint64 `json:"seq"`
+	Op   string `json:"op"`
+	Item Store  `json:"item"`
+}
+
+// SnapshotStatus describes the persistence state of a Durable engine.
+type SnapshotStatus struct {
+	DataDir          string    `json:"data_dir"`
+	Seq              uint64    `json:"seq"`
+	LastSnapshotSeq  uint64    `json:"last_snapshot_seq"`
+	LastSnapshotTime time.Time `json:"last_snapshot_time"`
+	LastSnapshotPath string    `json:"last_snapshot_path,omitempty"`
+	WALRecords       uint64    `json:"wal_records"`
+	LastError        string    `json:"last_error,omitempty"`
+}
+
+// Durable wraps an Engine and makes its mutations durable.
+// Every Put and Delete is first appended (and fsynced) to a write-ahead log
+// and only then applied to the wrapped engine, so an acknowledged write
+// is never lost when the process exits.
+// Checkpoint writes a snapshot of the engine and truncates the log,
+// which keeps the log from growing forever.
+type Durable struct {
+	Engine
+
+	// mu makes sure records are applied to the engine in log order
+	// and that no mutation slips in while a snapshot is being taken
+	mu     sync.Mutex
+	dir    string
+	log    *wal.Log
+	seq    uint64
+	status SnapshotStatus
+}
+
+// OpenDurable opens the data directory dir on top of engine.
+// It loads the latest valid snapshot into engine, replays the part of the
+// write-ahead log written after that snapshot, and returns a Durable engine
+// that logs every further mutation.
+func OpenDurable(dir string, engine Engine) (*Durable, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	d := &Durable{
+		Engine: engine,
+		dir:    dir,
+	}
+	d.status.DataDir = dir
+
+	path, seq, items, err := loadLatestSnapshot(dir)
+	if err != nil {
+		return nil, err
+	}
+	if path != "" {
+		for _, item := range items {
+			if err := engine.Put(item); err != nil {
+				return nil, err
+			}
+		}
+		d.seq = seq
+		d.status.LastSnapshotSeq = seq
+		d.status.LastSnapshotPath = path
+		if info, err := os.Stat(path); err == nil {
+			d.status.LastSnapshotTime = info.ModTime()
+		}
+		log.Printf("Loaded snapshot at seq %d with %d keys", seq, len(items))
+	}
+
+	walLog, err := wal.Open(filepath.Join(dir, walFileName))
+	if err != nil {
+		return nil, err
+	}
+	if err := walLog.Replay(d.replay); err != nil {
+		walLog.Close()
+		return nil, err
+	}
+	d.log = walLog
+
+	return d, nil
+}
+
+// Put logs the key-value pair and stores it in the wrapped engine.
+func (d *Durable) Put(item Store) error {
+	return d.write(mutation{Op: opPut, Item: item})
+}
+
+// Delete logs the deletion and removes the key from the wrapped engine.
+func (d *Durable) Delete(key string) error {
+	return d.write(mutation{Op: opDelete, Item: Store{Key: key}})
+}
+
+// Checkpoint writes a point-in-time snapshot of the engine to the data
+// directory and then truncates the write-ahead log, since every record in
+// it is now covered by the snapshot. Writes are blocked while it runs.
+func (d *Durable) Checkpoint() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	err := d.checkpoint()
+	if err != nil {
+		d.status.LastError = err.Error()
+	} else {
+		d.status.LastError = ""
+	}
+	return err
+}
+
+func (d *Durable) checkpoint() error {
+	if d.status.WALRecords == 0 {
+		return nil // nothing changed since the last snapshot
+	}
+
+	path, err := writeSnapshot(d.dir, d.seq, d.Engine.Snapshot())
+	if err != nil {
+		return err
+	}
+
+	// The snapshot is durable, so the log can be dropped. If the process dies
+	// before the reset, startup simply skips the records already in the snapshot.
+	if err := d.log.Reset(); err != nil {
+		return err
+	}
+	if err := pruneSnapshots(d.dir); err != nil {
+		log.Printf("Failed to prune old snapshots: %v", err)
+	}
+
+	d.status.LastSnapshotSeq = d.seq
+	d.status.LastSnapshotTime = time.Now()
+	d.status.LastSnapshotPath = path
+	d.status.WALRecords = 0
+	return nil
+}
+
+// PendingRecords returns the number of mutations logged since the last snapshot.
+func (d *Durable) PendingRecords() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.status.WALRecords
+}
+
+// Status returns the current persistence state.
+func (d *Durable) Status() SnapshotStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	status := d.status
+	status.Seq = d.seq
+	return status
+}
+
+// Close closes the write-ahead log.
+func (d *Durable) Close() error {
+	return d.log.Close()
+}
+
+func (d *Durable) write(m mutation) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	m.Seq = d.seq + 1
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to encode mutation: %w", err)
+	}
+
+	if err := d.log.Append(data); err != nil {
+		return err
+	}
+	if err := d.apply(m); err != nil {
+		return err
+	}
+	d.seq = m.Seq
+	d.status.WALRecords++
+	return nil
+}
+
+// replay applies a log record read back at startup,
+// skipping records that the loaded snapshot already contains.
+func (d *Durable) replay(data []byte) error {
+	var m mutation
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("failed to decode mutation: %w", err)
+	}
+	if m.Seq <= d.seq {
+		return nil
+	}
+
+	if err := d.apply(m); err != nil {
+		return err
+	}
+	d.seq = m.Seq
+	d.status.WALRecords++
+	return nil
+}
+
+// apply applies a mutation to the wrapped engine.
+func (d *Durable) apply(m mutation) error {
+	switch m.Op {
+	case opPut:
+		return d.Engine.Put(m.Item)
+	case opDelete:
+		return d.Engine.Delete(m.Item.Key)
+	default:
+		return fmt.Errorf("unknown mutation %q", m.Op)
+	}
+}
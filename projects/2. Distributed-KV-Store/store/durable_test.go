@@ -0,0 +1,135 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openDurable opens a Durable engine over an empty LocalDB in dir and
+// closes it when the test ends.
+func openDurable(t *testing.T, dir string) *Durable {
+	t.Helper()
+
+	d, err := OpenDurable(dir, NewLocalDB())
+	if err != nil {
+		t.Fatalf("OpenDurable failed: %v", err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+// put stores key with value in d.
+func put(t *testing.T, d *Durable, key, value string) {
+	t.Helper()
+
+	if err := d.Put(Store{Key: key, Value: value}); err != nil {
+		t.Fatalf("Put %s failed: %v", key, err)
+	}
+}
+
+// checkKeys fails the test unless engine holds exactly want.
+func checkKeys(t *testing.T, engine Engine, want map[string]string) {
+	t.Helper()
+
+	if got := engine.Len(); got != len(want) {
+		t.Errorf("engine holds %d keys, want %d", got, len(want))
+	}
+	for key, value := range want {
+		item, ok := engine.Get(key)
+		if !ok {
+			t.Errorf("key %s is missing", key)
+			continue
+		}
+		if item.Value != value {
+			t.Errorf("key %s has value %v, want %s", key, item.Value, value)
+		}
+	}
+}
+
+func TestDurableReplaysLog(t *testing.T) {
+	dir := t.TempDir()
+	d := openDurable(t, dir)
+	put(t, d, "a", "1")
+	put(t, d, "b", "2")
+	put(t, d, "a", "3")
+	put(t, d, "c", "4")
+	if err := d.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	d = openDurable(t, dir)
+	checkKeys(t, d, map[string]string{"a": "3", "c": "4"})
+	if got := d.Status().Seq; got != 5 {
+		t.Errorf("recovered seq %d, want 5", got)
+	}
+}
+
+func TestDurableReplaysLogAfterSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	d := openDurable(t, dir)
+	put(t, d, "a", "1")
+	put(t, d, "b", "2")
+	if err := d.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	put(t, d, "c", "3")
+	if err := d.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	d = openDurable(t, dir)
+	checkKeys(t, d, map[string]string{"b": "2", "c": "3"})
+	if got := d.PendingRecords(); got != 2 {
+		t.Errorf("replayed %d records after the snapshot, want 2", got)
+	}
+}
+
+// A crash between writing a snapshot and truncating the log leaves records
+// in the log that the snapshot already holds; they are skipped.
+func TestDurableSkipsRecordsInSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	d := openDurable(t, dir)
+	put(t, d, "a", "1")
+	put(t, d, "b", "2")
+	if _, err := writeSnapshot(dir, d.Status().Seq, d.Engine.Snapshot()); err != nil {
+		t.Fatal(err)
+	}
+	put(t, d, "a", "3")
+	d.Close()
+
+	d = openDurable(t, dir)
+	checkKeys(t, d, map[string]string{"a": "3", "b": "2"})
+	if got := d.PendingRecords(); got != 1 {
+		t.Errorf("replayed %d records after the snapshot, want 1", got)
+	}
+}
+
+func TestDurableRecoversFromTornLog(t *testing.T) {
+	dir := t.TempDir()
+	d := openDurable(t, dir)
+	put(t, d, "a", "1")
+	put(t, d, "b", "2")
+	d.Close()
+
+	// a crash in the middle of an append leaves part of a record behind
+	file, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte{0, 0, 0, 40, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	d = openDurable(t, dir)
+	checkKeys(t, d, map[string]string{"a": "1", "b": "2"})
+
+	// the torn record is gone, so later writes are replayed too
+	put(t, d, "c", "3")
+	d.Close()
+	d = openDurable(t, dir)
+	checkKeys(t, d, map[string]string{"a": "1", "b": "2", "c": "3"})
+}
@@ -0,0 +1,103 @@
+package store
+
+import "math/rand"
+
+// maxIndexLevel bounds the height of the skip list, which is plenty for
+// billions of keys with a branching factor of 4.
+const maxIndexLevel = 16
+
+// indexNode is a key in the skip list with a forward pointer per level.
+type indexNode struct {
+	key  string
+	next []*indexNode
+}
+
+// index is an ordered set of keys, kept as a skip list so that inserts,
+// removals and seeks take O(log n) on average and keys can be walked in
+// lexical order from any point. It is not safe for concurrent use.
+type index struct {
+	head  indexNode
+	level int
+	rand  *rand.Rand
+}
+
+func newIndex() *index {
+	return &index{
+		head:  indexNode{next: make([]*indexNode, maxIndexLevel)},
+		level: 1,
+		rand:  rand.New(rand.NewSource(1)),
+	}
+}
+
+// randomLevel picks the height of a new node: each extra level with
+// probability 1/4.
+func (ix *index) randomLevel() int {
+	level := 1
+	for level < maxIndexLevel && ix.rand.Intn(4) == 0 {
+		level++
+	}
+	return level
+}
+
+// findPrev fills prev with the last node before key on every level and
+// returns the first node whose key is at least key.
+func (ix *index) findPrev(key string, prev []*indexNode) *indexNode {
+	x := &ix.head
+	for level := ix.level - 1; level >= 0; level-- {
+		for x.next[level] != nil && x.next[level].key < key {
+			x = x.next[level]
+		}
+		if prev != nil {
+			prev[level] = x
+		}
+	}
+	return x.next[0]
+}
+
+// insert adds key to the index. Inserting a key twice is a no-op.
+func (ix *index) insert(key string) {
+	prev := make([]*indexNode, maxIndexLevel)
+	if x := ix.findPrev(key, prev); x != nil && x.key == key {
+		return
+	}
+
+	level := ix.randomLevel()
+	for l := ix.level; l < level; l++ {
+		prev[l] = &ix.head
+	}
+	if level > ix.level {
+		ix.level = level
+	}
+
+	node := &indexNode{key: key, next: make([]*indexNode, level)}
+	for l := 0; l < level; l++ {
+		node.next[l] = prev[l].next[l]
+		prev[l].next[l] = node
+	}
+}
+
+// remove deletes key from the index. Removing a missing key is a no-op.
+func (ix *index) remove(key string) {
+	prev := make([]*indexNode, maxIndexLevel)
+	x := ix.findPrev(key, prev)
+	if x == nil || x.key != key {
+		return
+	}
+
+	for l := 0; l < len(x.next); l++ {
+		prev[l].next[l] = x.next[l]
+	}
+	for ix.level > 1 && ix.head.next[ix.level-1] == nil {
+		ix.level--
+	}
+}
+
+// ascend calls fn, in lexical order, for every key that is at least start,
+// until fn returns false.
+func (ix *index) ascend(start string, fn func(key string) bool) {
+	for x := ix.findPrev(start, nil); x != nil; x = x.next[0] {
+		if !fn(x.key) {
+			return
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package store
+
+import "sync"
+
+// LocalDB is the default in-memory Engine.
+// It keeps the key-value pairs in a hash map, so lookups by key are O(1),
+// and their keys in an ordered index, so they can be walked in key order.
+type LocalDB struct {
+	mu    sync.RWMutex
+	items map[string]Store
+	keys  *index
+}
+
+// NewLocalDB creates an empty in-memory store.
+func NewLocalDB() *LocalDB {
+	return &LocalDB{
+		items: make(map[string]Store),
+		keys:  newIndex(),
+	}
+}
+
+// Get returns the key-value pair stored under key.
+func (db *LocalDB) Get(key string) (Store, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	item, ok := db.items[key]
+	return item, ok
+}
+
+// Put stores the key-value pair, replacing any previous value for the key.
+func (db *LocalDB) Put(item Store) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.items[item.Key]; !ok {
+		db.keys.insert(item.Key)
+	}
+	db.items[item.Key] = item
+	return nil
+}
+
+// Delete removes the key from the store.
+func (db *LocalDB) Delete(key string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.items[key]; ok {
+		db.keys.remove(key)
+		delete(db.items, key)
+	}
+	return nil
+}
+
+// Scan calls fn for every key-value pair until fn returns false.
+// Pairs are visited in key order.
+func (db *LocalDB) Scan(fn func(Store) bool) {
+	db.Range("", fn)
+}
+
+// Range calls fn, in key order, for every key-value pair whose key is at
+// least start, until fn returns false.
+func (db *LocalDB) Range(start string, fn func(Store) bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	db.keys.ascend(start, func(key string) bool {
+		return fn(db.items[key])
+	})
+}
+
+// Snapshot returns a copy of every key-value pair, sorted by key.
+// Sorting makes the result independent of map iteration order,
+// which is what allows two nodes to compare stores by hash.
+func (db *LocalDB) Snapshot() []Store {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	items := make([]Store, 0, len(db.items))
+	db.keys.ascend("", func(key string) bool {
+		items = append(items, db.items[key])
+		return true
+	})
+	return items
+}
+
+// Len returns the number of keys in the store.
+func (db *LocalDB) Len() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return len(db.items)
+}
@@ -0,0 +1,177 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	snapshotPrefix = "snapshot-"
+	snapshotSuffix = ".json"
+
+	// snapshotsToKeep is how many snapshot files are kept on disk.
+	// Keeping more than one lets startup fall back to an older snapshot
+	// if the newest one turns out to be unreadable.
+	snapshotsToKeep = 2
+)
+
+// snapshotFile is the on-disk format of a point-in-time snapshot.
+// Seq is the sequence number of the last mutation included in Items,
+// and Checksum is the CRC-32C of the raw Items JSON.
+type snapshotFile struct {
+	Seq      uint64          `json:"seq"`
+	Checksum uint32          `json:"checksum"`
+	Items    json.RawMessage `json:"items"`
+}
+
+// writeSnapshot atomically writes items as the snapshot for seq into dir.
+// The data is written to a temporary file, fsynced and then renamed into
+// place, so a crash never leaves a half-written snapshot behind.
+func writeSnapshot(dir string, seq uint64, items []Store) (string, error) {
+	raw, err := json.Marshal(items)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+
+	data, err := json.Marshal(snapshotFile{
+		Seq:      seq,
+		Checksum: crc32.Checksum(raw, crcTable),
+		Items:    raw,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, snapshotPrefix+"*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("failed to create snapshot file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // no-op once the file has been renamed
+
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("failed to set snapshot permissions: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("failed to sync snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("failed to close snapshot: %w", err)
+	}
+
+	path := filepath.Join(dir, snapshotName(seq))
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", fmt.Errorf("failed to install snapshot: %w", err)
+	}
+	if err := syncDir(dir); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// loadLatestSnapshot returns the newest snapshot in dir that passes
+// validation. Corrupted snapshots are skipped with a log message.
+// If there is no usable snapshot, path is empty.
+func loadLatestSnapshot(dir string) (path string, seq uint64, items []Store, err error) {
+	names, err := listSnapshots(dir)
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	// newest first
+	for i := len(names) - 1; i >= 0; i-- {
+		path := filepath.Join(dir, names[i])
+		seq, items, err := readSnapshot(path)
+		if err != nil {
+			log.Printf("Skipping invalid snapshot %s: %v", path, err)
+			continue
+		}
+		return path, seq, items, nil
+	}
+	return "", 0, nil, nil
+}
+
+func readSnapshot(path string) (uint64, []Store, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var file snapshotFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return 0, nil, fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+	if crc32.Checksum(file.Items, crcTable) != file.Checksum {
+		return 0, nil, fmt.Errorf("checksum mismatch")
+	}
+
+	var items []Store
+	if err := json.Unmarshal(file.Items, &items); err != nil {
+		return 0, nil, fmt.Errorf("failed to decode snapshot items: %w", err)
+	}
+	return file.Seq, items, nil
+}
+
+// pruneSnapshots removes all but the newest snapshotsToKeep snapshots.
+func pruneSnapshots(dir string) error {
+	names, err := listSnapshots(dir)
+	if err != nil {
+		return err
+	}
+
+	for len(names) > snapshotsToKeep {
+		if err := os.Remove(filepath.Join(dir, names[0])); err != nil {
+			return fmt.Errorf("failed to remove old snapshot: %w", err)
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// listSnapshots returns the snapshot file names in dir, oldest first.
+// Names embed a zero-padded sequence number, so lexical order is seq order.
+func listSnapshots(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list data directory: %w", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, snapshotPrefix) && strings.HasSuffix(name, snapshotSuffix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func snapshotName(seq uint64) string {
+	return fmt.Sprintf("%s%020d%s", snapshotPrefix, seq, snapshotSuffix)
+}
+
+// syncDir fsyncs a directory so that a rename inside it is durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open data directory: %w", err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync data directory: %w", err)
+	}
+	return nil
+}
@@ -1,20 +1,76 @@
 package store
 
-// LocalDB represents a local database in the distributed key-value store.
-// It contains a slice of Store, which holds key-value pairs.
-type LocalDB struct {
-	Store []Store
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/vclock"
+)
+
+// Engine is the storage interface used by a node.
+// Every read and write of key-value pairs goes through an Engine, so the
+// node does not need to know how the data is laid out or persisted.
+// Implementations must be safe for concurrent use.
+type Engine interface {
+	// Get returns the key-value pair stored under key.
+	// The boolean is false if the key does not exist.
+	Get(key string) (Store, bool)
+
+	// Put stores the key-value pair, replacing any previous value for the key.
+	Put(item Store) error
+
+	// Delete removes the key. Deleting a missing key is not an error.
+	Delete(key string) error
+
+	// Scan calls fn for every key-value pair in the engine.
+	// Iteration stops as soon as fn returns false.
+	Scan(fn func(Store) bool)
+
+	// Range calls fn, in key order, for every key-value pair whose key is
+	// at least start. Iteration stops as soon as fn returns false.
+	Range(start string, fn func(Store) bool)
+
+	// Snapshot returns a copy of every key-value pair, sorted by key.
+	Snapshot() []Store
+
+	// Len returns the number of keys in the engine.
+	Len() int
 }
 
 // Store represents a key-value pair in the distributed key-value store.
 // It contains a key and its corresponding value.
+// Timestamp is the time, in Unix nanoseconds, at which the coordinating node
+// accepted the write, and Clock is the vector clock of the write.
+// When writes to the key happened concurrently, the versions that no other
+// version supersedes are kept as Siblings next to the newest one.
+// Deleted marks a tombstone: a version written by a delete. ExpiresAt, when
+// set, is the time in Unix nanoseconds after which the version is gone.
+// Version counts the writes to the key, starting at 1.
+// ContentType, when set, is the media type the value was written with.
 type Store struct {
-	Key   any
-	Value any
+	Key         string       `json:"key"`
+	Value       any          `json:"value"`
+	ContentType string       `json:"content_type,omitempty"`
+	Timestamp   int64        `json:"timestamp,omitempty"`
+	Clock       vclock.Clock `json:"clock,omitempty"`
+	Deleted     bool         `json:"deleted,omitempty"`
+	ExpiresAt   int64        `json:"expires_at,omitempty"`
+	Version     uint64       `json:"version,omitempty"`
+	Siblings    []Version    `json:"siblings,omitempty"`
+}
+
+// UnmarshalJSON decodes a Store, keeping numbers in values as json.Number
+// so that integers too large for a float64 survive replication and
+// persistence unchanged.
+func (s *Store) UnmarshalJSON(data []byte) error {
+	type plain Store
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode((*plain)(s))
 }
 
 // GetKey returns the key of the Store.
-func (s *Store) GetKey() any {
+func (s *Store) GetKey() string {
 	return s.Key
 }
 
@@ -24,7 +80,7 @@ func (s *Store) GetValue() any {
 }
 
 // SetKey sets the key of the Store.
-func (s *Store) SetKey(key any) {
+func (s *Store) SetKey(key string) {
 	s.Key = key
 }
 
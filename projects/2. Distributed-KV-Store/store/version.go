@@ -0,0 +1,194 @@
+package store
+
+import (
+	"sort"
+	"time"
+
+	"github.com/YpatiosCh/Distributed-Systems/projects/Distributed-kv-store/vclock"
+)
+
+// Version is one value of a key together with the clock of the write
+// that produced it. A deleted version is a tombstone and has no value.
+// A version with ExpiresAt set is gone once that time has passed.
+// Version is the number of writes to the key this version follows.
+// ContentType, when set, is the media type the value was written with.
+type Version struct {
+	Value       any          `json:"value"`
+	ContentType string       `json:"content_type,omitempty"`
+	Timestamp   int64        `json:"timestamp,omitempty"`
+	Clock       vclock.Clock `json:"clock,omitempty"`
+	Deleted     bool         `json:"deleted,omitempty"`
+	ExpiresAt   int64        `json:"expires_at,omitempty"`
+	Version     uint64       `json:"version,omitempty"`
+}
+
+// Expired reports whether v has expired at now (Unix nanoseconds).
+func (v Version) Expired(now int64) bool {
+	return v.ExpiresAt != 0 && v.ExpiresAt <= now
+}
+
+// Versions returns every version of the key, newest first.
+func (s Store) Versions() []Version {
+	versions := []Version{{
+		Value:       s.Value,
+		ContentType: s.ContentType,
+		Timestamp:   s.Timestamp,
+		Clock:       s.Clock,
+		Deleted:     s.Deleted,
+		ExpiresAt:   s.ExpiresAt,
+		Version:     s.Version,
+	}}
+	return append(versions, s.Siblings...)
+}
+
+// CurrentVersion returns the highest version number among the live versions
+// of the key, or 0 if the key has none: it does not exist, was deleted or
+// has expired.
+func (s Store) CurrentVersion() uint64 {
+	var current uint64
+	for _, v := range s.Live() {
+		current = max(current, v.Version)
+	}
+	return current
+}
+
+// NextVersion returns the version number of the next write to the key.
+// Tombstones count too, so version numbers never go back after a delete.
+func (s Store) NextVersion() uint64 {
+	var latest uint64
+	for _, v := range s.Versions() {
+		latest = max(latest, v.Version)
+	}
+	return latest + 1
+}
+
+// Live returns the versions of the key that are neither tombstones nor
+// expired, newest first.
+func (s Store) Live() []Version {
+	now := time.Now().UnixNano()
+	var live []Version
+	for _, v := range s.Versions() {
+		if !v.Deleted && !v.Expired(now) {
+			live = append(live, v)
+		}
+	}
+	return live
+}
+
+// IsTombstone reports whether every version of the key is a tombstone,
+// meaning the key was deleted.
+func (s Store) IsTombstone() bool {
+	for _, v := range s.Versions() {
+		if !v.Deleted {
+			return false
+		}
+	}
+	return true
+}
+
+// Expire turns the versions of the key that have expired at now into
+// tombstones, stamped with their expiry time. Every replica turns a version
+// into the same tombstone, and the tombstone wins over the expired version
+// it replaces when replicas are merged. The boolean reports whether any
+// version had expired.
+func (s Store) Expire(now int64) (Store, bool) {
+	expired := false
+	versions := s.Versions()
+	for i, v := range versions {
+		if v.Deleted || !v.Expired(now) {
+			continue
+		}
+		versions[i] = Version{Timestamp: v.ExpiresAt, Clock: v.Clock, Deleted: true, Version: v.Version}
+		expired = true
+	}
+	if !expired {
+		return s, false
+	}
+	return FromVersions(s.Key, versions), true
+}
+
+// Context returns a clock that descends from every version of the key.
+// A write carrying it supersedes all of them.
+func (s Store) Context() vclock.Clock {
+	context := vclock.Clock{}
+	for _, v := range s.Versions() {
+		context = context.Merge(v.Clock)
+	}
+	return context
+}
+
+// Merge reconciles two copies of the same key. Versions whose clock is
+// superseded by a version in the other copy are dropped, versions with
+// equal clocks are kept once, and concurrent versions are all kept as
+// siblings. The boolean reports whether the result differs from existing,
+// that is whether incoming brought anything new.
+func Merge(existing, incoming Store) (Store, bool) {
+	type candidate struct {
+		Version
+		incoming bool
+	}
+
+	var candidates []candidate
+	for _, v := range existing.Versions() {
+		candidates = append(candidates, candidate{Version: v})
+	}
+	for _, v := range incoming.Versions() {
+		candidates = append(candidates, candidate{Version: v, incoming: true})
+	}
+
+	var kept []candidate
+	for i, c := range candidates {
+		superseded := false
+		for j, other := range candidates {
+			if i == j {
+				continue
+			}
+			switch c.Clock.Compare(other.Clock) {
+			case vclock.Before:
+				superseded = true
+			case vclock.Equal:
+				// keep a single copy: the newer one, or the earlier one in the list
+				if other.Timestamp > c.Timestamp || (other.Timestamp == c.Timestamp && j < i) {
+					superseded = true
+				}
+			}
+			if superseded {
+				break
+			}
+		}
+		if !superseded {
+			kept = append(kept, c)
+		}
+	}
+
+	changed := false
+	versions := make([]Version, 0, len(kept))
+	for _, c := range kept {
+		changed = changed || c.incoming
+		versions = append(versions, c.Version)
+	}
+	return FromVersions(incoming.Key, versions), changed
+}
+
+// FromVersions builds a Store holding versions, with the newest one as the
+// primary version. versions must not be empty.
+func FromVersions(key string, versions []Version) Store {
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].Timestamp > versions[j].Timestamp
+	})
+
+	s := Store{
+		Key:         key,
+		Value:       versions[0].Value,
+		ContentType: versions[0].ContentType,
+		Timestamp:   versions[0].Timestamp,
+		Clock:       versions[0].Clock,
+		Deleted:     versions[0].Deleted,
+		ExpiresAt:   versions[0].ExpiresAt,
+		Version:     versions[0].Version,
+	}
+	if len(versions) > 1 {
+		s.Siblings = versions[1:]
+	}
+	return s
+}
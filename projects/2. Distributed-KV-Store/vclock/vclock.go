@@ -0,0 +1,118 @@
+package vclock
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// Ordering is the causal relation between two clocks.
+type Ordering int
+
+const (
+	// Equal clocks describe the same history.
+	Equal Ordering = iota
+	// Before means the first clock happened before the second.
+	Before
+	// After means the first clock happened after the second.
+	After
+	// Concurrent clocks do not know about each other.
+	Concurrent
+)
+
+// String returns the name of the ordering.
+func (o Ordering) String() string {
+	switch o {
+	case Equal:
+		return "equal"
+	case Before:
+		return "before"
+	case After:
+		return "after"
+	default:
+		return "concurrent"
+	}
+}
+
+// Clock is a vector clock: a counter per node that coordinated a write.
+// A missing entry counts as zero, so the zero value is an empty clock.
+type Clock map[string]uint64
+
+// Copy returns an independent copy of c.
+func (c Clock) Copy() Clock {
+	copied := make(Clock, len(c))
+	for node, counter := range c {
+		copied[node] = counter
+	}
+	return copied
+}
+
+// Merge returns the pointwise maximum of c and other: a clock that
+// descends from both.
+func (c Clock) Merge(other Clock) Clock {
+	merged := c.Copy()
+	for node, counter := range other {
+		if counter > merged[node] {
+			merged[node] = counter
+		}
+	}
+	return merged
+}
+
+// Compare returns how c is ordered relative to other.
+func (c Clock) Compare(other Clock) Ordering {
+	less, greater := false, false
+	for node, counter := range c {
+		if counter > other[node] {
+			greater = true
+		} else if counter < other[node] {
+			less = true
+		}
+	}
+	for node, counter := range other {
+		if _, ok := c[node]; !ok && counter > 0 {
+			less = true
+		}
+	}
+
+	switch {
+	case less && greater:
+		return Concurrent
+	case less:
+		return Before
+	case greater:
+		return After
+	default:
+		return Equal
+	}
+}
+
+// Descends reports whether c has seen every event other has seen.
+func (c Clock) Descends(other Clock) bool {
+	ordering := c.Compare(other)
+	return ordering == After || ordering == Equal
+}
+
+// Encode returns c as an opaque token that is safe to use in URLs and headers.
+func (c Clock) Encode() string {
+	// maps are marshalled with sorted keys, so equal clocks give equal tokens
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Decode parses a token created by Encode.
+func Decode(token string) (Clock, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid clock token: %w", err)
+	}
+
+	var c Clock
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("invalid clock token: %w", err)
+	}
+	if c == nil {
+		c = Clock{}
+	}
+	return c, nil
+}
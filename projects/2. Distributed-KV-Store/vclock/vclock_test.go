@@ -0,0 +1,92 @@
+package vclock
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b Clock
+		want Ordering
+	}{
+		{name: "empty clocks", a: Clock{}, b: nil, want: Equal},
+		{name: "same counters", a: Clock{"x": 1, "y": 2}, b: Clock{"x": 1, "y": 2}, want: Equal},
+		{name: "zero counts as missing", a: Clock{"x": 1, "y": 0}, b: Clock{"x": 1}, want: Equal},
+		{name: "lower counter", a: Clock{"x": 1, "y": 2}, b: Clock{"x": 2, "y": 2}, want: Before},
+		{name: "missing node", a: Clock{"x": 1}, b: Clock{"x": 1, "y": 1}, want: Before},
+		{name: "higher counter", a: Clock{"x": 3}, b: Clock{"x": 2}, want: After},
+		{name: "extra node", a: Clock{"x": 1, "y": 1}, b: Clock{"x": 1}, want: After},
+		{name: "each ahead on one node", a: Clock{"x": 2, "y": 1}, b: Clock{"x": 1, "y": 2}, want: Concurrent},
+		{name: "disjoint nodes", a: Clock{"x": 1}, b: Clock{"y": 1}, want: Concurrent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.a.Compare(tt.b); got != tt.want {
+				t.Errorf("%v.Compare(%v) = %s, want %s", tt.a, tt.b, got, tt.want)
+			}
+			// the relation seen from the other side
+			reverse := map[Ordering]Ordering{Equal: Equal, Before: After, After: Before, Concurrent: Concurrent}
+			if got := tt.b.Compare(tt.a); got != reverse[tt.want] {
+				t.Errorf("%v.Compare(%v) = %s, want %s", tt.b, tt.a, got, reverse[tt.want])
+			}
+		})
+	}
+}
+
+func TestMergeDescendsFromBoth(t *testing.T) {
+	a := Clock{"x": 2, "y": 1}
+	b := Clock{"x": 1, "y": 3, "z": 1}
+	if a.Compare(b) != Concurrent {
+		t.Fatal("test clocks are not concurrent")
+	}
+
+	merged := a.Merge(b)
+	if want := (Clock{"x": 2, "y": 3, "z": 1}); !maps.Equal(merged, want) {
+		t.Fatalf("Merge returned %v, want %v", merged, want)
+	}
+	if !merged.Descends(a) || !merged.Descends(b) {
+		t.Fatalf("merged clock %v does not descend from %v and %v", merged, a, b)
+	}
+	if a.Compare(merged) != Before || b.Compare(merged) != Before {
+		t.Fatalf("%v and %v are not both before the merged clock %v", a, b, merged)
+	}
+
+	// a write coordinated by x after the merge supersedes both siblings
+	merged["x"]++
+	if merged.Compare(a) != After || merged.Compare(b) != After {
+		t.Fatalf("clock %v after the merge is not after %v and %v", merged, a, b)
+	}
+}
+
+func TestMergeLeavesInputsUnchanged(t *testing.T) {
+	a := Clock{"x": 1}
+	b := Clock{"y": 1}
+	merged := a.Merge(b)
+	merged["x"] = 5
+
+	if !maps.Equal(a, Clock{"x": 1}) || !maps.Equal(b, Clock{"y": 1}) {
+		t.Fatalf("Merge changed its inputs to %v and %v", a, b)
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	c := Clock{"node-1": 3, "node-2": 1}
+
+	decoded, err := Decode(c.Encode())
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if !maps.Equal(decoded, c) {
+		t.Fatalf("Decode returned %v, want %v", decoded, c)
+	}
+	if c.Encode() != c.Copy().Encode() {
+		t.Fatal("equal clocks encode to different tokens")
+	}
+
+	if _, err := Decode("not a token!"); err == nil {
+		t.Fatal("Decode accepted an invalid token")
+	}
+}
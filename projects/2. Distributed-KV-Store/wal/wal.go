@@ -0,0 +1,203 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// headerSize is the size of the frame header written before every record:
+// 4 bytes of payload length followed by 4 bytes of CRC-32C checksum.
+const headerSize = 8
+
+// maxRecordSize guards replay against allocating huge buffers
+// when a corrupted length field is read.
+const maxRecordSize = 64 << 20
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorrupt is returned by Replay when a damaged record is followed by
+// valid ones, which a crash during Append cannot cause.
+var ErrCorrupt = errors.New("write-ahead log is corrupted")
+
+// Log is an append-only, checksummed write-ahead log stored in a single file.
+// Every record is framed as [length][crc32c][payload] and fsynced before
+// Append returns, so an acknowledged record survives a crash.
+type Log struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// Open opens the log at path, creating it if it does not exist.
+// Records already in the file can be read back with Replay.
+func Open(path string) (*Log, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open write-ahead log %s: %w", path, err)
+	}
+
+	return &Log{
+		path: path,
+		file: file,
+	}, nil
+}
+
+// Append writes a record to the end of the log and fsyncs it to disk.
+// Records cannot be empty, so that zeroed space left at the end of the file
+// by a crash is never read back as records.
+func (l *Log) Append(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("cannot append an empty record")
+	}
+	if len(data) > maxRecordSize {
+		return fmt.Errorf("record of %d bytes exceeds the maximum of %d bytes", len(data), maxRecordSize)
+	}
+
+	frame := make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(data, crcTable))
+	copy(frame[headerSize:], data)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := l.file.Write(frame); err != nil {
+		return fmt.Errorf("failed to append to write-ahead log: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync write-ahead log: %w", err)
+	}
+	return nil
+}
+
+// Replay calls fn for every valid record in the log, oldest first.
+// If the log ends with a torn or corrupted record (for example because the
+// process crashed in the middle of Append), the log is truncated back to the
+// last valid record so that new appends start from a clean tail. A damaged
+// record followed by valid ones is not a torn write but corruption, and
+// Replay fails with ErrCorrupt rather than drop the records after it.
+func (l *Log) Replay(fn func(data []byte) error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := l.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek write-ahead log: %w", err)
+	}
+
+	reader := bufio.NewReader(l.file)
+	var offset int64
+	header := make([]byte, headerSize)
+
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil // clean end of log
+			}
+			return l.damaged(offset, "incomplete record header")
+		}
+
+		length := binary.BigEndian.Uint32(header[0:4])
+		checksum := binary.BigEndian.Uint32(header[4:8])
+		if length == 0 || length > maxRecordSize {
+			return l.damaged(offset, "invalid record length")
+		}
+
+		data := make([]byte, length)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return l.damaged(offset, "incomplete record payload")
+		}
+		if crc32.Checksum(data, crcTable) != checksum {
+			return l.damaged(offset, "checksum mismatch")
+		}
+
+		if err := fn(data); err != nil {
+			return fmt.Errorf("failed to apply write-ahead log record at offset %d: %w", offset, err)
+		}
+		offset += headerSize + int64(length)
+	}
+}
+
+// damaged handles a record at offset that cannot be read back. If no valid
+// record follows it, it is a torn tail and is truncated; otherwise the log
+// is corrupted and an error matching ErrCorrupt is returned.
+func (l *Log) damaged(offset int64, reason string) error {
+	info, err := l.file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat write-ahead log: %w", err)
+	}
+	rest := make([]byte, info.Size()-offset)
+	if _, err := l.file.ReadAt(rest, offset); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to read write-ahead log: %w", err)
+	}
+
+	if next := nextValidRecord(rest); next > 0 {
+		return fmt.Errorf("%w: %s at offset %d of %s, with a valid record at offset %d",
+			ErrCorrupt, reason, offset, l.path, offset+int64(next))
+	}
+	return l.truncateTail(offset, reason)
+}
+
+// nextValidRecord returns the position in data, after the damaged record at
+// its start, of the first frame holding a record whose checksum matches,
+// or 0 if there is none.
+func nextValidRecord(data []byte) int {
+	for i := 1; i+headerSize < len(data); i++ {
+		length := int(binary.BigEndian.Uint32(data[i : i+4]))
+		if length == 0 || length > maxRecordSize || length > len(data)-i-headerSize {
+			continue
+		}
+		payload := data[i+headerSize : i+headerSize+length]
+		if crc32.Checksum(payload, crcTable) == binary.BigEndian.Uint32(data[i+4:i+8]) {
+			return i
+		}
+	}
+	return 0
+}
+
+// truncateTail drops everything after offset, which is the end of the
+// last record that was read back successfully.
+func (l *Log) truncateTail(offset int64, reason string) error {
+	info, err := l.file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat write-ahead log: %w", err)
+	}
+
+	log.Printf("Write-ahead log %s has a torn tail (%s), dropping %d bytes after offset %d", l.path, reason, info.Size()-offset, offset)
+	if err := l.file.Truncate(offset); err != nil {
+		return fmt.Errorf("failed to truncate write-ahead log: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync write-ahead log: %w", err)
+	}
+	return nil
+}
+
+// Reset discards every record in the log.
+// It is used after the records have been captured by a snapshot.
+func (l *Log) Reset() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate write-ahead log: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync write-ahead log: %w", err)
+	}
+	return nil
+}
+
+// Close closes the underlying file.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.file.Close()
+}
@@ -0,0 +1,220 @@
+package wal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// writeLog creates a log in a new directory holding records and returns
+// its path.
+func writeLog(t *testing.T, records ...string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "test.log")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for _, record := range records {
+		if err := l.Append([]byte(record)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+// replay opens the log at path and returns its records and the error of
+// Replay. The log is left open for further appends.
+func replay(t *testing.T, path string) (*Log, []string, error) {
+	t.Helper()
+
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	var records []string
+	err = l.Replay(func(data []byte) error {
+		records = append(records, string(data))
+		return nil
+	})
+	return l, records, err
+}
+
+// fileSize returns the size of the file at path.
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+// frameSize is the size a record of n bytes takes in the log.
+func frameSize(n int) int64 {
+	return int64(headerSize + n)
+}
+
+func TestReplayReturnsRecordsInOrder(t *testing.T) {
+	path := writeLog(t, "one", "two", "three")
+
+	_, records, err := replay(t, path)
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if want := []string{"one", "two", "three"}; !slices.Equal(records, want) {
+		t.Fatalf("Replay returned %q, want %q", records, want)
+	}
+}
+
+func TestAppendRejectsEmptyRecord(t *testing.T) {
+	l, err := Open(filepath.Join(t.TempDir(), "test.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if err := l.Append(nil); err == nil {
+		t.Fatal("Append of an empty record succeeded")
+	}
+}
+
+func TestReplayTruncatesTornTail(t *testing.T) {
+	first := frameSize(len("first"))
+
+	// every case starts from a log holding "first" and "second"
+	tests := []struct {
+		name   string
+		damage func(t *testing.T, path string)
+		want   []string
+	}{
+		{
+			name: "truncated header",
+			damage: func(t *testing.T, path string) {
+				if err := os.Truncate(path, first+headerSize/2); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []string{"first"},
+		},
+		{
+			name: "truncated payload",
+			damage: func(t *testing.T, path string) {
+				if err := os.Truncate(path, first+headerSize+2); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []string{"first"},
+		},
+		{
+			name: "bad checksum on the last record",
+			damage: func(t *testing.T, path string) {
+				flipByte(t, path, first+headerSize)
+			},
+			want: []string{"first"},
+		},
+		{
+			name: "zeroed tail",
+			damage: func(t *testing.T, path string) {
+				if err := os.Truncate(path, fileSize(t, path)+64); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []string{"first", "second"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeLog(t, "first", "second")
+			tt.damage(t, path)
+
+			l, records, err := replay(t, path)
+			if err != nil {
+				t.Fatalf("Replay failed: %v", err)
+			}
+			if !slices.Equal(records, tt.want) {
+				t.Fatalf("Replay returned %q, want %q", records, tt.want)
+			}
+
+			// the damaged tail is gone, so new records follow the valid ones
+			if err := l.Append([]byte("third")); err != nil {
+				t.Fatal(err)
+			}
+			_, records, err = replay(t, path)
+			if err != nil {
+				t.Fatalf("Replay after append failed: %v", err)
+			}
+			if want := append(slices.Clone(tt.want), "third"); !slices.Equal(records, want) {
+				t.Fatalf("Replay after append returned %q, want %q", records, want)
+			}
+		})
+	}
+}
+
+func TestReplayReportsCorruptionBeforeValidRecords(t *testing.T) {
+	path := writeLog(t, "first", "second", "third")
+	flipByte(t, path, frameSize(len("first"))+headerSize)
+	size := fileSize(t, path)
+
+	_, records, err := replay(t, path)
+	if !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Replay returned %v, want ErrCorrupt", err)
+	}
+	if want := []string{"first"}; !slices.Equal(records, want) {
+		t.Fatalf("Replay returned %q before failing, want %q", records, want)
+	}
+	if got := fileSize(t, path); got != size {
+		t.Fatalf("corrupted log was truncated from %d to %d bytes", size, got)
+	}
+}
+
+func TestReset(t *testing.T) {
+	path := writeLog(t, "first", "second")
+
+	l, _, err := replay(t, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Reset(); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	if err := l.Append([]byte("third")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, records, err := replay(t, path)
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if want := []string{"third"}; !slices.Equal(records, want) {
+		t.Fatalf("Replay returned %q, want %q", records, want)
+	}
+}
+
+// flipByte inverts the byte at offset in the file at path.
+func flipByte(t *testing.T, path string, offset int64) {
+	t.Helper()
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	b := make([]byte, 1)
+	if _, err := file.ReadAt(b, offset); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err := file.WriteAt(b, offset); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,250 @@
+package watch
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types.
+const (
+	Put    = "put"
+	Delete = "delete"
+)
+
+// watcherBuffer is the number of events a watcher can fall behind before
+// it is cancelled.
+const watcherBuffer = 1024
+
+// ErrLagging is returned by a watcher that fell too far behind the events.
+var ErrLagging = errors.New("watcher fell behind")
+
+// Event is a change to a key. Events published together, by a transaction
+// for example, share a revision. ContentType is the media type the value
+// was written with, if any.
+type Event struct {
+	Type        string `json:"type"`
+	Key         string `json:"key"`
+	Value       any    `json:"value,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Version     uint64 `json:"version,omitempty"`
+	Revision    uint64 `json:"revision"`
+}
+
+// CompactedError is returned when a watch starts at a revision that is no
+// longer in the history. CompactRevision is the newest revision that was
+// dropped, so watching from CompactRevision+1 succeeds.
+type CompactedError struct {
+	Revision        uint64
+	CompactRevision uint64
+}
+
+func (e *CompactedError) Error() string {
+	return fmt.Sprintf("revision %d has been compacted, the oldest available revision is %d", e.Revision, e.CompactRevision+1)
+}
+
+// Hub keeps a bounded history of events and streams new events to
+// watchers. It is safe for concurrent use.
+type Hub struct {
+	mu       sync.Mutex
+	history  []Event
+	first    int
+	size     int
+	revision uint64
+	compact  uint64
+	watchers map[*Watcher]struct{}
+}
+
+// New creates a hub that keeps the last capacity events. Revisions up to
+// and including compact are treated as already dropped from the history.
+func New(capacity int, compact uint64) *Hub {
+	return &Hub{
+		history:  make([]Event, max(capacity, 1)),
+		revision: compact,
+		compact:  compact,
+		watchers: make(map[*Watcher]struct{}),
+	}
+}
+
+// Revision returns the revision of the newest event.
+func (h *Hub) Revision() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.revision
+}
+
+// CompactRevision returns the newest revision dropped from the history.
+func (h *Hub) CompactRevision() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.compact
+}
+
+// Compact drops the history up to and including revision, which becomes the
+// newest revision if it is newer, and cancels every watcher with a
+// CompactedError. It is used when the state jumps ahead without events,
+// such as when a Raft snapshot is installed, so watchers learn that they
+// missed changes.
+func (h *Hub) Compact(revision uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if revision <= h.compact {
+		return
+	}
+	h.first, h.size = 0, 0
+	h.compact = revision
+	h.revision = max(h.revision, revision)
+	for w := range h.watchers {
+		h.cancelLocked(w, &CompactedError{Revision: revision, CompactRevision: revision})
+	}
+}
+
+// Publish records events under a new revision and sends them to the
+// watchers. The revision follows the wall clock, like vector clock
+// counters, so revisions keep increasing across restarts. It returns the
+// revision.
+func (h *Hub) Publish(events ...Event) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	revision := h.revision + 1
+	if now := uint64(time.Now().UnixNano()); now > revision {
+		revision = now
+	}
+	h.publishLocked(revision, events)
+	return revision
+}
+
+// PublishAt records events under revision, which must be newer than every
+// revision published before; older revisions are ignored. It is used when
+// revisions come from elsewhere, such as the index of a Raft log entry.
+func (h *Hub) PublishAt(revision uint64, events ...Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if revision <= h.revision {
+		return
+	}
+	h.publishLocked(revision, events)
+}
+
+// publishLocked appends events to the history and sends them to every
+// watcher they match. Called with mu held.
+func (h *Hub) publishLocked(revision uint64, events []Event) {
+	h.revision = revision
+	for _, e := range events {
+		e.Revision = revision
+
+		if h.size == len(h.history) {
+			h.compact = h.history[h.first].Revision
+			h.first = (h.first + 1) % len(h.history)
+			h.size--
+		}
+		h.history[(h.first+h.size)%len(h.history)] = e
+		h.size++
+
+		for w := range h.watchers {
+			if !w.matches(e.Key) {
+				continue
+			}
+			select {
+			case w.events <- e:
+			default:
+				h.cancelLocked(w, ErrLagging)
+			}
+		}
+	}
+}
+
+// Watch returns a watcher for key, or for every key starting with key when
+// prefix is set. With a non-zero start the watcher first receives the
+// events from revision start onwards that are still in the history; it
+// fails with a CompactedError if some of them have been dropped already.
+// Without start only new events are received.
+func (h *Hub) Watch(key string, prefix bool, start uint64) (*Watcher, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if start != 0 && start <= h.compact {
+		return nil, &CompactedError{Revision: start, CompactRevision: h.compact}
+	}
+
+	w := &Watcher{
+		key:    key,
+		prefix: prefix,
+		events: make(chan Event, watcherBuffer),
+		done:   make(chan struct{}),
+		hub:    h,
+	}
+	if start != 0 {
+		for i := 0; i < h.size; i++ {
+			e := h.history[(h.first+i)%len(h.history)]
+			if e.Revision >= start && w.matches(e.Key) {
+				w.backlog = append(w.backlog, e)
+			}
+		}
+	}
+	h.watchers[w] = struct{}{}
+	return w, nil
+}
+
+// cancelLocked stops w with err. Called with mu held.
+func (h *Hub) cancelLocked(w *Watcher, err error) {
+	if _, ok := h.watchers[w]; !ok {
+		return
+	}
+	delete(h.watchers, w)
+	w.err = err
+	close(w.done)
+}
+
+// Watcher receives the events of a key or prefix.
+type Watcher struct {
+	key     string
+	prefix  bool
+	backlog []Event
+	events  chan Event
+	done    chan struct{}
+	err     error
+	hub     *Hub
+}
+
+// matches reports whether the watcher wants the events of key.
+func (w *Watcher) matches(key string) bool {
+	if w.prefix {
+		return strings.HasPrefix(key, w.key)
+	}
+	return key == w.key
+}
+
+// Backlog returns the past events the watcher was asked to start from.
+func (w *Watcher) Backlog() []Event {
+	return w.backlog
+}
+
+// Events returns the channel new events are delivered on.
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+// Done is closed when the watcher has been cancelled; Err then tells why.
+func (w *Watcher) Done() <-chan struct{} {
+	return w.done
+}
+
+// Err returns why the watcher was cancelled, or nil if it was closed.
+func (w *Watcher) Err() error {
+	w.hub.mu.Lock()
+	defer w.hub.mu.Unlock()
+	return w.err
+}
+
+// Close stops the watcher.
+func (w *Watcher) Close() {
+	w.hub.mu.Lock()
+	defer w.hub.mu.Unlock()
+	w.hub.cancelLocked(w, nil)
+}